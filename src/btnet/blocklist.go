@@ -0,0 +1,264 @@
+package btnet
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"util"
+)
+
+var ErrBlocklistLine = errors.New("blocklist: unrecognized line")
+
+// An inclusive range of addresses, both ends in 16 byte form
+type IPRange struct {
+	First net.IP
+	Last  net.IP
+}
+
+// Addresses peers must not connect from or to, read from a file of
+// PeerGuardian (P2P), eMule (DAT) or CIDR lines, which may be mixed.
+// Safe for concurrent use, a nil Blocklist blocks nothing.
+type Blocklist struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	ranges  []IPRange // sorted and merged
+}
+
+// makes an empty blocklist backed by the file at path, call Reload to read it
+func NewBlocklist(path string) *Blocklist {
+	return &Blocklist{path: path}
+}
+
+// Re-reads the file if it has changed since it was last read. Returns true
+// if the ranges were replaced. On error the old ranges are kept.
+func (b *Blocklist) Reload() (bool, error) {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return false, err
+	}
+	b.mu.RLock()
+	unchanged := info.ModTime().Equal(b.modTime)
+	b.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+	file, err := os.Open(b.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	ranges, err := ParseBlocklist(file)
+	if err != nil {
+		return false, err
+	}
+	b.Set(ranges)
+	b.mu.Lock()
+	b.modTime = info.ModTime()
+	b.mu.Unlock()
+	return true, nil
+}
+
+// replace the blocked ranges
+func (b *Blocklist) Set(ranges []IPRange) {
+	merged := mergeRanges(ranges)
+	b.mu.Lock()
+	b.ranges = merged
+	b.mu.Unlock()
+}
+
+// returns true if ip is blocked
+func (b *Blocklist) Contains(ip net.IP) bool {
+	if b == nil || ip == nil {
+		return false
+	}
+	ip = ip.To16()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	// the first range ending at or after ip is the only one that can hold it
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].Last, ip) >= 0
+	})
+	return i < len(b.ranges) && bytes.Compare(b.ranges[i].First, ip) <= 0
+}
+
+// returns the number of disjoint ranges blocked
+func (b *Blocklist) Len() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.ranges)
+}
+
+// Reads blocked ranges from r, one per line in any of these formats:
+//
+//	P2P:  Some description:1.2.3.0-1.2.3.255
+//	DAT:  001.002.003.000 - 001.002.003.255 , 000 , Some description
+//	CIDR: 1.2.3.0/24
+//
+// DAT ranges with an access level above 127 are allowed, not blocked.
+// Blank lines and lines starting with # or // are skipped, as are lines
+// we can't make sense of, since published lists are rarely spotless.
+func ParseBlocklist(r io.Reader) ([]IPRange, error) {
+	ranges := []IPRange{}
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		ipRange, blocked, err := parseBlocklistLine(scanner.Text())
+		if err != nil {
+			util.WPrintf("blocklist: skipping line %d: %q\n", lineNum, scanner.Text())
+			continue
+		}
+		if blocked {
+			ranges = append(ranges, ipRange)
+		}
+	}
+	return ranges, scanner.Err()
+}
+
+// returns the range on line, and false if the line doesn't block anything
+func parseBlocklistLine(line string) (IPRange, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+		return IPRange{}, false, nil
+	}
+
+	if !strings.Contains(line, "-") && strings.Contains(line, "/") {
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return IPRange{}, false, ErrBlocklistLine
+		}
+		first := ipNet.IP.To16()
+		last := make(net.IP, len(first))
+		mask := ipNet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range first {
+			last[i] = first[i] | ^mask[i]
+		}
+		return IPRange{first, last}, true, nil
+	}
+
+	if fields := strings.Split(line, ","); len(fields) >= 2 {
+		// a P2P description may have commas too, but not a level after one
+		if level, err := strconv.Atoi(strings.TrimSpace(fields[1])); err == nil {
+			ipRange, err := parseRange(fields[0])
+			return ipRange, err == nil && level <= 127, err
+		}
+	}
+
+	// P2P, where the description may itself contain colons
+	sep := strings.LastIndex(line, "-")
+	if sep < 0 {
+		ip := parseBlocklistIP(line)
+		if ip == nil {
+			return IPRange{}, false, ErrBlocklistLine
+		}
+		return IPRange{ip, ip}, true, nil
+	}
+	start := line[:sep]
+	if parseBlocklistIP(start) == nil {
+		start = start[strings.LastIndex(start, ":")+1:]
+	}
+	ipRange, err := parseRange(start + "-" + line[sep+1:])
+	return ipRange, err == nil, err
+}
+
+// parses "first - last"
+func parseRange(s string) (IPRange, error) {
+	ends := strings.Split(s, "-")
+	if len(ends) != 2 {
+		return IPRange{}, ErrBlocklistLine
+	}
+	first := parseBlocklistIP(ends[0])
+	last := parseBlocklistIP(ends[1])
+	if first == nil || last == nil || bytes.Compare(first, last) > 0 {
+		return IPRange{}, ErrBlocklistLine
+	}
+	return IPRange{first, last}, nil
+}
+
+// like net.ParseIP, but allows the zero padded octets DAT files use
+func parseBlocklistIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s).To16()
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	ip := make([]byte, 4)
+	for i, octet := range octets {
+		n, err := strconv.Atoi(octet)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3]).To16()
+}
+
+// sorts ranges and merges any that overlap or touch
+func mergeRanges(ranges []IPRange) []IPRange {
+	sorted := make([]IPRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].First, sorted[j].First) < 0
+	})
+	merged := []IPRange{}
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && bytes.Compare(r.First, nextIP(merged[n-1].Last)) <= 0 {
+			if bytes.Compare(r.Last, merged[n-1].Last) > 0 {
+				merged[n-1].Last = r.Last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// returns the address after ip, or ip itself if it's the last one
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+	return ip
+}
+
+// Wraps ln so connections from addresses that allowed rejects are closed
+// as soon as they're accepted, before any handshaking
+func FilterListener(ln net.Listener, allowed func(net.Addr) bool) net.Listener {
+	return &filterListener{ln, allowed}
+}
+
+type filterListener struct {
+	net.Listener
+	allowed func(net.Addr) bool
+}
+
+func (l *filterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.allowed(conn.RemoteAddr()) {
+			return conn, err
+		}
+		util.TPrintf("refusing connection from %s\n", conn.RemoteAddr())
+		conn.Close()
+	}
+}
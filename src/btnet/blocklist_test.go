@@ -0,0 +1,142 @@
+package btnet
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"util"
+)
+
+const TestBlocklist = `# comment lines and blank lines are skipped
+
+Some Org, Inc:1.2.3.0-1.2.3.255
+Bad: People:5.6.7.8-5.6.7.8
+001.009.096.105 - 001.009.096.110 , 000 , eMule entry
+010.000.000.001 - 010.000.000.255 , 200 , allowed by its access level
+192.168.0.0/16
+2001:db8::/32
+this line is junk
+9.9.9.9-1.1.1.1
+`
+
+func TestParseBlocklist(t *testing.T) {
+	util.StartTest("Testing parsing P2P, DAT and CIDR blocklists...")
+	ranges, err := ParseBlocklist(strings.NewReader(TestBlocklist))
+	if err != nil {
+		t.Fatalf("ParseBlocklist error: %s", err)
+	}
+	if len(ranges) != 5 {
+		t.Fatalf("Expected 5 ranges, got %v", ranges)
+	}
+	list := NewBlocklist("")
+	list.Set(ranges)
+	tests := map[string]bool{
+		"1.2.3.0":        true,
+		"1.2.3.255":      true,
+		"1.2.4.0":        false,
+		"1.2.2.255":      false,
+		"5.6.7.8":        true,
+		"5.6.7.9":        false,
+		"1.9.96.105":     true,
+		"1.9.96.110":     true,
+		"1.9.96.111":     false,
+		"10.0.0.2":       false,
+		"192.168.44.1":   true,
+		"192.169.0.0":    false,
+		"2001:db8::1":    true,
+		"2001:db9::1":    false,
+		"9.9.9.9":        false,
+		"::ffff:1.2.3.4": true,
+	}
+	for ip, blocked := range tests {
+		if list.Contains(net.ParseIP(ip)) != blocked {
+			t.Fatalf("Expected %s blocked to be %t", ip, blocked)
+		}
+	}
+	var none *Blocklist
+	if none.Contains(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("A nil blocklist shouldn't block anything")
+	}
+	util.EndTest()
+}
+
+func TestBlocklistMergesRanges(t *testing.T) {
+	util.StartTest("Testing merging overlapping blocklist ranges...")
+	ranges, _ := ParseBlocklist(strings.NewReader(
+		"a:1.0.0.10-1.0.0.20\nb:1.0.0.15-1.0.0.30\nc:1.0.0.31-1.0.0.40\nd:1.0.0.50-1.0.0.60\n1.0.0.0/24\n2.0.0.0/8"))
+	list := NewBlocklist("")
+	list.Set(ranges[:4])
+	if list.Len() != 2 || !list.Contains(net.ParseIP("1.0.0.31")) || list.Contains(net.ParseIP("1.0.0.45")) {
+		t.Fatalf("Expected 2 ranges, got %v", list.ranges)
+	}
+	list.Set(ranges)
+	if list.Len() != 2 || !list.Contains(net.ParseIP("1.0.0.45")) || !list.Contains(net.ParseIP("2.255.255.255")) {
+		t.Fatalf("Expected 2 ranges, got %v", list.ranges)
+	}
+	util.EndTest()
+}
+
+func TestBlocklistReload(t *testing.T) {
+	util.StartTest("Testing rereading a blocklist when it changes...")
+	file, _ := ioutil.TempFile("", "blocklist")
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+	ioutil.WriteFile(path, []byte("1.2.3.4/32\n"), 0644)
+
+	list := NewBlocklist(path)
+	if changed, err := list.Reload(); !changed || err != nil || !list.Contains(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("Expected blocklist to load, got %t, %v", changed, err)
+	}
+	if changed, _ := list.Reload(); changed {
+		t.Fatalf("Blocklist shouldn't reload when the file hasn't changed")
+	}
+	ioutil.WriteFile(path, []byte("5.6.7.8/32\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if changed, _ := list.Reload(); !changed || list.Contains(net.ParseIP("1.2.3.4")) || !list.Contains(net.ParseIP("5.6.7.8")) {
+		t.Fatalf("Blocklist should reload when the file changes")
+	}
+	os.Remove(path)
+	if _, err := list.Reload(); err == nil || !list.Contains(net.ParseIP("5.6.7.8")) {
+		t.Fatalf("Blocklist should keep its ranges when the file goes away")
+	}
+	util.EndTest()
+}
+
+func TestFilterListener(t *testing.T) {
+	util.StartTest("Testing refusing blocked connections on accept...")
+	network := NewPipeNetwork()
+	ln, _ := network.Listen("10.0.0.1:6881")
+	list := NewBlocklist("")
+	list.Set([]IPRange{{net.ParseIP("10.0.0.3"), net.ParseIP("10.0.0.3")}})
+	filtered := FilterListener(ln, func(addr net.Addr) bool {
+		host, _, _ := net.SplitHostPort(addr.String())
+		return !list.Contains(net.ParseIP(host))
+	})
+	defer filtered.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := filtered.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	blocked, _ := network.DialFrom("10.0.0.3", "10.0.0.1:6881")
+	if _, err := blocked.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Blocked connection should be closed")
+	}
+	allowed, _ := network.DialFrom("10.0.0.2", "10.0.0.1:6881")
+	defer allowed.Close()
+	if conn := <-accepted; !strings.HasPrefix(conn.RemoteAddr().String(), "10.0.0.2:") {
+		t.Fatalf("Expected connection from 10.0.0.2, got %s", conn.RemoteAddr())
+	}
+	util.EndTest()
+}
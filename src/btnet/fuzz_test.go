@@ -0,0 +1,57 @@
+package btnet
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Run with e.g. go test -fuzz=FuzzDecodePeerMessage btnet
+
+func FuzzDecodeHandshake(f *testing.F) {
+	f.Add(EncodeHandshake(HandshakeMsg))
+	f.Add([]byte{0x13})
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		handshake := DecodeHandshake(data)
+		if len(handshake.InfoHash) != 20 {
+			return
+		}
+		encoded := EncodeHandshake(handshake)
+		if !bytes.Equal(encoded, data[:len(encoded)]) {
+			t.Fatalf("handshake %v doesn't round trip: %v", data, encoded)
+		}
+	})
+}
+
+func FuzzDecodePeerMessage(f *testing.F) {
+	for _, data := range [][]byte{KeepAliveBytes, ChokeBytes, UnchokeBytes, InterestedBytes,
+		NotInterestedBytes, HaveBytes, BitfieldBytes, RequestBytes, PieceBytes, CancelBytes} {
+		f.Add(data, 16)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, numPieces int) {
+		if numPieces < 0 || numPieces > 1<<20 {
+			return
+		}
+		msg, err := DecodePeerMessage(data, numPieces)
+		if err != nil {
+			return
+		}
+		if encoded := EncodePeerMessage(msg); !bytes.Equal(encoded, data) {
+			t.Fatalf("message %v doesn't round trip: %v", data, encoded)
+		}
+	})
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add(HaveBytes)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(msg, data[:len(msg)]) {
+			t.Fatalf("read %v from %v", msg, data)
+		}
+	})
+}
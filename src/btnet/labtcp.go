@@ -5,11 +5,15 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 	"util"
 )
 
-func StartTCPServer(addr string, handler func(*net.TCPConn)) bool {
+// Start listening on addr, handing every accepted connection to handler.
+// If enc is non-nil, incoming connections are checked for message stream
+// encryption and decrypted before being handed off.
+func StartTCPServer(addr string, handler func(net.Conn), enc *EncryptionConfig) bool {
 	util.TPrintf("Starting the TCP Server on addr %s...\n", addr)
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
@@ -22,16 +26,67 @@ func StartTCPServer(addr string, handler func(*net.TCPConn)) bool {
 			return false
 		}
 	}
-	go func(ln *net.TCPListener) {
-		for {
-			conn, err := ln.AcceptTCP()
-			if err != nil {
-				util.WPrintf("labtcp StartTCPServer: %s\n", err)
+	go Serve(ln, handler, enc)
+	return true
+}
+
+// Start accepting uTP connections on addr, handing them to handler the same
+// way StartTCPServer does. Returns nil if the socket can't be opened.
+func StartUTPServer(addr string, handler func(net.Conn), enc *EncryptionConfig) *UTPSocket {
+	util.TPrintf("Starting the uTP Server on addr %s...\n", addr)
+	sock, err := ListenUTP(addr)
+	if err != nil {
+		util.WPrintf("labtcp StartUTPServer: %s\n", err)
+		return nil
+	}
+	go Serve(sock, handler, enc)
+	return sock
+}
+
+// Accept connections from ln until it's closed, negotiating encryption
+// for each one before handing it to handler. Once ln is closed, closes
+// any connection handler hasn't finished with and returns when it has.
+func Serve(ln net.Listener, handler func(net.Conn), enc *EncryptionConfig) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	pending := make(map[net.Conn]bool)
+	defer func() {
+		mu.Lock()
+		for conn := range pending {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			util.WPrintf("labtcp Serve: %s\n", err)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
 			}
-			go handler(conn)
+			return
 		}
-	}(ln)
-	return true
+		mu.Lock()
+		pending[conn] = true
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer func() {
+				mu.Lock()
+				delete(pending, conn)
+				mu.Unlock()
+				wg.Done()
+			}()
+			peerConn, err := EncryptIncoming(conn, enc)
+			if err != nil {
+				util.WPrintf("labtcp Serve: %s: %s\n", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			handler(peerConn)
+		}()
+	}
 }
 
 func DoDial(addr *net.TCPAddr, data []byte) (*net.TCPConn, error) {
@@ -48,20 +103,91 @@ func DoDial(addr *net.TCPAddr, data []byte) (*net.TCPConn, error) {
 	return conn, err
 }
 
-func ReadHandshake(conn *net.TCPConn) ([]byte, error) {
+// Settings for opening connections to peers
+type Dialer struct {
+	Encryption EncryptionPolicy
+	Networks   []Network     // tried in order until one connects, TCP if empty
+	Timeout    time.Duration // to connect on each network, none if 0
+}
+
+// Dial a peer and send data (normally our handshake) over the preferred
+// network and encryption
+func (d *Dialer) DialPeer(addr *net.TCPAddr, data []byte, infoHash []byte) (net.Conn, error) {
+	if d == nil {
+		return DoEncryptedDial(addr, data, infoHash, EncryptionDisabled)
+	}
+	if len(d.Networks) == 0 {
+		return DoEncryptedDial(addr, data, infoHash, d.Encryption)
+	}
+	var err error
+	for _, network := range d.Networks {
+		n := network
+		dial := func() (net.Conn, error) { return DialTimeout(n, addr.String(), d.Timeout) }
+		var conn net.Conn
+		conn, err = encryptedDial(dial, data, infoHash, d.Encryption)
+		if err == nil {
+			return conn, nil
+		}
+		util.TPrintf("labtcp DialPeer: %T to %s failed: %s\n", n, addr, err)
+	}
+	return nil, err
+}
+
+// Dial addr and send data, negotiating message stream encryption for
+// infoHash first according to policy. With EncryptionPrefer we retry in
+// plaintext if the peer doesn't speak MSE.
+func DoEncryptedDial(addr *net.TCPAddr, data []byte, infoHash []byte, policy EncryptionPolicy) (net.Conn, error) {
+	util.TPrintf("Dialing (encryption %s): %v\n", policy, addr.String())
+	dial := func() (net.Conn, error) { return net.DialTCP("tcp", nil, addr) }
+	return encryptedDial(dial, data, infoHash, policy)
+}
+
+func encryptedDial(dial func() (net.Conn, error), data []byte, infoHash []byte, policy EncryptionPolicy) (net.Conn, error) {
+	if policy == EncryptionDisabled {
+		return plaintextDial(dial, data)
+	}
+	conn, err := dial()
+	if err != nil {
+		util.WPrintf("labtcp encryptedDial: %s\n", err)
+		return nil, err
+	}
+	encConn, err := EncryptOutgoing(conn, infoHash, data, policy)
+	if err != nil {
+		util.WPrintf("labtcp encryptedDial: %s\n", err)
+		conn.Close()
+		if policy == EncryptionPrefer {
+			return plaintextDial(dial, data)
+		}
+		return nil, err
+	}
+	return encConn, nil
+}
+
+func plaintextDial(dial func() (net.Conn, error), data []byte) (net.Conn, error) {
+	conn, err := dial()
+	if err != nil {
+		util.WPrintf("labtcp plaintextDial: %s\n", err)
+		return nil, err
+	}
+	if _, err := conn.Write(data); err != nil {
+		util.WPrintf("labtcp plaintextDial: %s\n", err)
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func ReadHandshake(conn io.Reader) ([]byte, error) {
 	// General strategy for reading handshakes
 	// 1) The first byte for the length of the pstr
 	// 2) Read that many bytes after to form a packet + 49
 	// 3) Hope that nothing goes out of sync
 	// 4) Check that the packets are reasonable
 	// 5) repeat 3
-	util.TPrintf("Reading Handshake from: %s\n", conn.RemoteAddr().String())
+	util.TPrintf("Reading Handshake from: %s\n", remoteAddrOf(conn))
 	msgLength := make([]byte, 1)
 	_, err := io.ReadFull(conn, msgLength)
 	if err != nil {
-		if err == io.EOF {
-			return []byte{}, nil
-		}
 		return []byte{}, err
 	}
 	length := int(msgLength[0]) + 48
@@ -70,36 +196,44 @@ func ReadHandshake(conn *net.TCPConn) ([]byte, error) {
 	if err != nil {
 		return []byte{}, err
 	}
-	util.TPrintf("Finished Handshake from: %s\n", conn.RemoteAddr().String())
+	util.TPrintf("Finished Handshake from: %s\n", remoteAddrOf(conn))
 	return append(msgLength, msg...), nil
 }
 
-func ReadMessage(conn *net.TCPConn) ([]byte, error) {
+func ReadMessage(conn io.Reader) ([]byte, error) {
 	// General strategy for reading packets back
 	// 1) The first four bytes for the length of the packets
 	// 2) Read that many bytes after to form a packet
 	// 3) Hope that nothing goes out of sync
 	// 4) Check that the packets are reasonable
 	// 5) repeat 3
-	util.TPrintf("Reading Message from:%s\n", conn.RemoteAddr().String())
+	util.TPrintf("Reading Message from:%s\n", remoteAddrOf(conn))
 	msgLength := make([]byte, 4)
 	_, err := io.ReadFull(conn, msgLength)
 	if err != nil {
-		if err == io.EOF {
-			return []byte{}, nil
-		}
 		return []byte{}, err
 	}
 	length := binary.BigEndian.Uint32(msgLength)
+	if length > MaxMessageLength {
+		return []byte{}, ErrMessageTooLarge
+	}
 	msg := make([]byte, length)
 	_, err = io.ReadFull(conn, msg)
 	if err != nil {
 		return []byte{}, err
 	}
-	util.TPrintf("Finished Reading Message from:%s\n", conn.RemoteAddr().String())
+	util.TPrintf("Finished Reading Message from:%s\n", remoteAddrOf(conn))
 	return append(msgLength, msg...), nil
 }
 
+// describe where a stream comes from, for logging
+func remoteAddrOf(r io.Reader) string {
+	if conn, ok := r.(net.Conn); ok && conn.RemoteAddr() != nil {
+		return conn.RemoteAddr().String()
+	}
+	return "stream"
+}
+
 // TODO: This doesnt work... wtf
 func IsConnectionClosed(conn *net.TCPConn) bool {
 	one := []byte{}
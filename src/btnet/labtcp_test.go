@@ -11,7 +11,7 @@ func init() {
 }
 
 // Test
-func testTCPHandler(tcpConn *net.TCPConn) {
+func testTCPHandler(tcpConn net.Conn) {
 	// Assume this is a TCP connection
 	b := make([]byte, 128)
 	_, err := tcpConn.Read(b)
@@ -27,7 +27,7 @@ func testTCPHandler(tcpConn *net.TCPConn) {
 
 func TestTCP(t *testing.T) {
 	util.StartTest("Test TCP...")
-	StartTCPServer("localhost:6666", testTCPHandler)
+	StartTCPServer("localhost:6666", testTCPHandler, nil)
 	servAddr := "localhost:6666"
 	tcpAddr, _ := net.ResolveTCPAddr("tcp", servAddr)
 	// Send an interested msg
@@ -52,7 +52,7 @@ func TestTCP(t *testing.T) {
 
 func TestSendPeerMessage(t *testing.T) {
 	util.StartTest("Test SendPeerMessage...")
-	sendPeerMessageHandler := func(tcpConn *net.TCPConn) {
+	sendPeerMessageHandler := func(tcpConn net.Conn) {
 		b, err := ReadMessage(tcpConn)
 		util.TPrintf("Message: %v\n", b)
 		if err != nil {
@@ -61,7 +61,7 @@ func TestSendPeerMessage(t *testing.T) {
 	}
 
 	servAddr := "localhost:6667"
-	StartTCPServer(servAddr, sendPeerMessageHandler)
+	StartTCPServer(servAddr, sendPeerMessageHandler, nil)
 	// msg := PeerMessage{KeepAlive: true}
 	// addr, _ := net.ResolveTCPAddr("tcp", servAddr)
 	// addr := tcpAddr.(*net.Addr)
@@ -0,0 +1,435 @@
+package btnet
+
+// Message stream encryption (MSE/PE)
+// Diffie-Hellman key exchange followed by an RC4 obfuscated stream, see
+// http://wiki.vuze.com/w/Message_Stream_Encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	mathrand "math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"util"
+)
+
+type EncryptionPolicy int
+
+const (
+	EncryptionDisabled EncryptionPolicy = iota // plaintext connections only
+	EncryptionPrefer                           // encrypt when possible, fall back to plaintext
+	EncryptionRequire                          // refuse plaintext connections
+)
+
+// crypto_provide / crypto_select bits
+const (
+	cryptoPlaintext uint32 = 0x01
+	cryptoRC4       uint32 = 0x02
+)
+
+const (
+	mseKeyLength     = 96  // bytes in Ya/Yb and S
+	mseSecretLength  = 20  // bytes in Xa/Xb
+	mseMaxPadLength  = 512 // max length of PadA, PadB, PadC and PadD
+	mseDiscardLength = 1024
+	mseTimeout       = time.Second * 10
+)
+
+var ErrMSEPolicy = errors.New("mse: peer does not support our encryption policy")
+var ErrMSESync = errors.New("mse: could not synchronize on handshake stream")
+var ErrMSEUnknownInfoHash = errors.New("mse: unknown info hash")
+var ErrMSEBadVC = errors.New("mse: bad verification constant")
+
+var msePrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+	"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+var mseGenerator = big.NewInt(2)
+var mseVC = make([]byte, 8)
+
+// Settings used to negotiate incoming connections
+type EncryptionConfig struct {
+	Policy EncryptionPolicy
+	// info hashes we accept as the shared secret (SKEY) of incoming streams
+	InfoHashes func() [][]byte
+}
+
+func (p EncryptionPolicy) String() string {
+	switch p {
+	case EncryptionDisabled:
+		return "disabled"
+	case EncryptionPrefer:
+		return "prefer"
+	case EncryptionRequire:
+		return "require"
+	}
+	return "unknown"
+}
+
+func ParseEncryptionPolicy(str string) (EncryptionPolicy, error) {
+	switch strings.ToLower(str) {
+	case "disabled":
+		return EncryptionDisabled, nil
+	case "prefer":
+		return EncryptionPrefer, nil
+	case "require":
+		return EncryptionRequire, nil
+	}
+	return EncryptionDisabled, errors.New("invalid encryption policy " + str)
+}
+
+// net.Conn whose reads go through a buffered reader, so that bytes peeked
+// or read ahead during negotiation aren't lost
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// net.Conn that encrypts everything written and decrypts everything read
+type encryptedConn struct {
+	net.Conn
+	r   io.Reader
+	wmu sync.Mutex
+	enc *rc4.Cipher
+}
+
+func (c *encryptedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *encryptedConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// returns true if conn carries an RC4 encrypted stream
+func IsEncrypted(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case *limitedConn:
+			conn = c.Conn
+		case *bufferedConn:
+			conn = c.Conn
+		case *encryptedConn:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// Decide whether an incoming connection is plaintext or encrypted by
+// peeking at the first bytes, and negotiate MSE if needed. The returned
+// connection yields the plaintext peer stream, starting with the handshake.
+func EncryptIncoming(conn net.Conn, cfg *EncryptionConfig) (net.Conn, error) {
+	if cfg == nil {
+		return conn, nil
+	}
+	br := bufio.NewReaderSize(conn, mseKeyLength+mseMaxPadLength)
+	conn.SetReadDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	prefix, err := br.Peek(len(BT_PROTOCOL) + 1)
+	if err != nil {
+		return nil, err
+	}
+	if prefix[0] == byte(len(BT_PROTOCOL)) && string(prefix[1:]) == BT_PROTOCOL {
+		if cfg.Policy == EncryptionRequire {
+			return nil, ErrMSEPolicy
+		}
+		return &bufferedConn{conn, br}, nil
+	}
+	if cfg.Policy == EncryptionDisabled {
+		return nil, ErrMSEPolicy
+	}
+	var infoHashes [][]byte
+	if cfg.InfoHashes != nil {
+		infoHashes = cfg.InfoHashes()
+	}
+	return receiveMSE(conn, br, infoHashes, cfg.Policy)
+}
+
+// Negotiate MSE as the initiating side of conn, sending payload (normally
+// our handshake) as the initial payload of the encrypted stream
+func EncryptOutgoing(conn net.Conn, infoHash []byte, payload []byte, policy EncryptionPolicy) (net.Conn, error) {
+	if policy == EncryptionDisabled {
+		return nil, ErrMSEPolicy
+	}
+	conn.SetDeadline(time.Now().Add(mseTimeout))
+	defer conn.SetDeadline(time.Time{})
+	br := bufio.NewReaderSize(conn, mseKeyLength+mseMaxPadLength)
+
+	// 1 A->B: Ya, PadA
+	xa, ya, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(ya, msePad()...)); err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Yb, PadB
+	yb := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(br, yb); err != nil {
+		return nil, err
+	}
+	secret := mseSecret(yb, xa)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	//         ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	enc := mseCipher("keyA", secret, infoHash)
+	dec := mseCipher("keyB", secret, infoHash)
+	provide := cryptoRC4
+	if policy == EncryptionPrefer {
+		provide |= cryptoPlaintext
+	}
+	plain := new(bytes.Buffer)
+	plain.Write(mseVC)
+	binary.Write(plain, binary.BigEndian, provide)
+	binary.Write(plain, binary.BigEndian, uint16(0))
+	binary.Write(plain, binary.BigEndian, uint16(len(payload)))
+	plain.Write(payload)
+	encrypted := make([]byte, plain.Len())
+	enc.XORKeyStream(encrypted, plain.Bytes())
+
+	msg := new(bytes.Buffer)
+	msg.Write(mseHash([]byte("req1"), secret))
+	msg.Write(xorBytes(mseHash([]byte("req2"), infoHash), mseHash([]byte("req3"), secret)))
+	msg.Write(encrypted)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, err
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	encryptedVC := make([]byte, len(mseVC))
+	dec.XORKeyStream(encryptedVC, mseVC)
+	if err := mseSynchronize(br, encryptedVC, mseMaxPadLength+len(encryptedVC)); err != nil {
+		return nil, err
+	}
+	decrypted := &cipherReader{dec, br}
+	var selected uint32
+	var padLen uint16
+	if err := binary.Read(decrypted, binary.BigEndian, &selected); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(decrypted, binary.BigEndian, &padLen); err != nil {
+		return nil, err
+	}
+	if padLen > mseMaxPadLength {
+		return nil, ErrMSESync
+	}
+	if _, err := io.CopyN(ioutil.Discard, decrypted, int64(padLen)); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case selected == cryptoRC4:
+		util.TPrintf("mse: negotiated RC4 stream with %s\n", conn.RemoteAddr())
+		return &encryptedConn{Conn: conn, r: decrypted, enc: enc}, nil
+	case selected == cryptoPlaintext && policy == EncryptionPrefer:
+		util.TPrintf("mse: negotiated plaintext stream with %s\n", conn.RemoteAddr())
+		return &bufferedConn{conn, br}, nil
+	}
+	return nil, ErrMSEPolicy
+}
+
+// Run the receiving side of the handshake once we know the stream isn't
+// plaintext
+func receiveMSE(conn net.Conn, br *bufio.Reader, infoHashes [][]byte, policy EncryptionPolicy) (net.Conn, error) {
+	// 1 A->B: Ya, PadA
+	ya := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(br, ya); err != nil {
+		return nil, err
+	}
+
+	// 2 B->A: Yb, PadB
+	xb, yb, err := mseKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(yb, msePad()...)); err != nil {
+		return nil, err
+	}
+	secret := mseSecret(ya, xb)
+
+	// 3 A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S),
+	//         ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	req1 := mseHash([]byte("req1"), secret)
+	if err := mseSynchronize(br, req1, mseMaxPadLength+len(req1)); err != nil {
+		return nil, err
+	}
+	obfuscated := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(br, obfuscated); err != nil {
+		return nil, err
+	}
+	req2 := xorBytes(obfuscated, mseHash([]byte("req3"), secret))
+	var infoHash []byte
+	for _, candidate := range infoHashes {
+		if bytes.Equal(req2, mseHash([]byte("req2"), candidate)) {
+			infoHash = candidate
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, ErrMSEUnknownInfoHash
+	}
+
+	dec := mseCipher("keyA", secret, infoHash)
+	enc := mseCipher("keyB", secret, infoHash)
+	decrypted := &cipherReader{dec, br}
+	vc := make([]byte, len(mseVC))
+	if _, err := io.ReadFull(decrypted, vc); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(vc, mseVC) {
+		return nil, ErrMSEBadVC
+	}
+	var provide uint32
+	var padLen uint16
+	if err := binary.Read(decrypted, binary.BigEndian, &provide); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(decrypted, binary.BigEndian, &padLen); err != nil {
+		return nil, err
+	}
+	if padLen > mseMaxPadLength {
+		return nil, ErrMSESync
+	}
+	if _, err := io.CopyN(ioutil.Discard, decrypted, int64(padLen)); err != nil {
+		return nil, err
+	}
+	var iaLen uint16
+	if err := binary.Read(decrypted, binary.BigEndian, &iaLen); err != nil {
+		return nil, err
+	}
+	ia := make([]byte, iaLen)
+	if _, err := io.ReadFull(decrypted, ia); err != nil {
+		return nil, err
+	}
+
+	var selected uint32
+	if provide&cryptoRC4 != 0 {
+		selected = cryptoRC4
+	} else if provide&cryptoPlaintext != 0 && policy != EncryptionRequire {
+		selected = cryptoPlaintext
+	} else {
+		return nil, ErrMSEPolicy
+	}
+
+	// 4 B->A: ENCRYPT(VC, crypto_select, len(padD), padD)
+	plain := new(bytes.Buffer)
+	plain.Write(mseVC)
+	binary.Write(plain, binary.BigEndian, selected)
+	binary.Write(plain, binary.BigEndian, uint16(0))
+	msg := make([]byte, plain.Len())
+	enc.XORKeyStream(msg, plain.Bytes())
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	if selected == cryptoRC4 {
+		util.TPrintf("mse: accepted RC4 stream from %s\n", conn.RemoteAddr())
+		return &encryptedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(ia), decrypted), enc: enc}, nil
+	}
+	util.TPrintf("mse: accepted plaintext stream from %s\n", conn.RemoteAddr())
+	return &bufferedConn{conn, io.MultiReader(bytes.NewReader(ia), br)}, nil
+}
+
+// reader that decrypts everything read from r
+type cipherReader struct {
+	c *rc4.Cipher
+	r io.Reader
+}
+
+func (cr *cipherReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.c.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+// consume bytes from r until the last bytes read equal marker, giving up
+// after limit bytes
+func mseSynchronize(r *bufio.Reader, marker []byte, limit int) error {
+	window := make([]byte, 0, limit)
+	for len(window) < limit {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, marker) {
+			return nil
+		}
+	}
+	return ErrMSESync
+}
+
+// generate a private key X and the matching public key Y = G^X mod P
+func mseKeyPair() (*big.Int, []byte, error) {
+	secret := make([]byte, mseSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	x := new(big.Int).SetBytes(secret)
+	y := new(big.Int).Exp(mseGenerator, x, msePrime)
+	return x, mseLeftPad(y.Bytes()), nil
+}
+
+// compute the shared secret S = Y^X mod P
+func mseSecret(y []byte, x *big.Int) []byte {
+	s := new(big.Int).Exp(new(big.Int).SetBytes(y), x, msePrime)
+	return mseLeftPad(s.Bytes())
+}
+
+func mseLeftPad(b []byte) []byte {
+	out := make([]byte, mseKeyLength)
+	copy(out[mseKeyLength-len(b):], b)
+	return out
+}
+
+// random length run of random bytes
+func msePad() []byte {
+	pad := make([]byte, mathrand.Intn(mseMaxPadLength+1))
+	rand.Read(pad)
+	return pad
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// RC4 keyed with HASH(name, S, SKEY), with the first 1024 bytes discarded
+func mseCipher(name string, secret []byte, infoHash []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), secret, infoHash))
+	discard := make([]byte, mseDiscardLength)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+func xorBytes(a []byte, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
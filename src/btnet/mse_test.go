@@ -0,0 +1,175 @@
+package btnet
+
+import (
+	"net"
+	"testing"
+	"time"
+	"util"
+)
+
+var mseInfoHash []byte = HandshakeMsg.InfoHash
+
+// Helpers
+func makeEncryptionConfig(policy EncryptionPolicy) *EncryptionConfig {
+	return &EncryptionConfig{
+		Policy:     policy,
+		InfoHashes: func() [][]byte { return [][]byte{mseInfoHash} }}
+}
+
+// starts a server that reads a handshake and replies with a Have message,
+// reporting whether each accepted connection was encrypted on the channel
+func startMSEServer(t *testing.T, addr string, policy EncryptionPolicy) chan bool {
+	encrypted := make(chan bool, 1)
+	handler := func(conn net.Conn) {
+		defer conn.Close()
+		data, err := ReadHandshake(conn)
+		if err != nil {
+			return
+		}
+		if !util.ByteArrayEquals(data, EncodeHandshake(HandshakeMsg)) {
+			t.Errorf("Server got handshake %v", data)
+			return
+		}
+		encrypted <- IsEncrypted(conn)
+		conn.Write(HaveBytes)
+	}
+	if !StartTCPServer(addr, handler, makeEncryptionConfig(policy)) {
+		t.Fatalf("Could not start server on %s", addr)
+	}
+	return encrypted
+}
+
+func dialMSEServer(t *testing.T, addr string, policy EncryptionPolicy) (net.Conn, error) {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	return DoEncryptedDial(tcpAddr, EncodeHandshake(HandshakeMsg), mseInfoHash, policy)
+}
+
+func expectHave(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	actual, err := ReadMessage(conn)
+	if err != nil {
+		t.Fatalf("Err: %s\n", err.Error())
+	}
+	if !util.ByteArrayEquals(HaveBytes, actual) {
+		t.Fatalf("Expected %v, got %v\n", HaveBytes, actual)
+	}
+}
+
+func expectClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	actual, err := ReadMessage(conn)
+	if err == nil && len(actual) > 0 {
+		t.Fatalf("Expected connection to be dropped, got %v\n", actual)
+	}
+}
+
+// Tests
+func TestMSEEncryptedBothWays(t *testing.T) {
+	util.StartTest("Testing MSE encrypted connection...")
+	addr := "localhost:6680"
+	encrypted := startMSEServer(t, addr, EncryptionPrefer)
+	conn, err := dialMSEServer(t, addr, EncryptionRequire)
+	if err != nil {
+		t.Fatalf("DoEncryptedDial error: %s", err.Error())
+	}
+	defer conn.Close()
+	if !IsEncrypted(conn) {
+		t.Fatalf("Outgoing connection should be encrypted")
+	}
+	if !<-encrypted {
+		t.Fatalf("Incoming connection should be encrypted")
+	}
+	expectHave(t, conn)
+	util.EndTest()
+}
+
+func TestMSEPlaintextDetection(t *testing.T) {
+	util.StartTest("Testing MSE server accepting plaintext connection...")
+	addr := "localhost:6681"
+	encrypted := startMSEServer(t, addr, EncryptionPrefer)
+	conn, err := dialMSEServer(t, addr, EncryptionDisabled)
+	if err != nil {
+		t.Fatalf("DoEncryptedDial error: %s", err.Error())
+	}
+	defer conn.Close()
+	if IsEncrypted(conn) {
+		t.Fatalf("Outgoing connection should be plaintext")
+	}
+	if <-encrypted {
+		t.Fatalf("Incoming connection should be plaintext")
+	}
+	expectHave(t, conn)
+	util.EndTest()
+}
+
+func TestMSEPreferFallsBackToPlaintext(t *testing.T) {
+	util.StartTest("Testing MSE prefer falling back to plaintext...")
+	addr := "localhost:6682"
+	encrypted := startMSEServer(t, addr, EncryptionDisabled)
+	conn, err := dialMSEServer(t, addr, EncryptionPrefer)
+	if err != nil {
+		t.Fatalf("DoEncryptedDial error: %s", err.Error())
+	}
+	defer conn.Close()
+	if IsEncrypted(conn) {
+		t.Fatalf("Outgoing connection should be plaintext")
+	}
+	if <-encrypted {
+		t.Fatalf("Incoming connection should be plaintext")
+	}
+	expectHave(t, conn)
+	util.EndTest()
+}
+
+func TestMSERequireRejectsPlaintext(t *testing.T) {
+	util.StartTest("Testing MSE require policy rejecting plaintext...")
+	addr := "localhost:6683"
+	startMSEServer(t, addr, EncryptionRequire)
+	conn, err := dialMSEServer(t, addr, EncryptionDisabled)
+	if err != nil {
+		t.Fatalf("DoEncryptedDial error: %s", err.Error())
+	}
+	defer conn.Close()
+	expectClosed(t, conn)
+	util.EndTest()
+}
+
+func TestMSERequireToDisabledFails(t *testing.T) {
+	util.StartTest("Testing MSE require policy against plaintext-only peer...")
+	addr := "localhost:6684"
+	startMSEServer(t, addr, EncryptionDisabled)
+	conn, err := dialMSEServer(t, addr, EncryptionRequire)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("Encrypted dial should fail against a plaintext-only peer")
+	}
+	util.EndTest()
+}
+
+func TestMSEUnknownInfoHash(t *testing.T) {
+	util.StartTest("Testing MSE with an unknown info hash...")
+	addr := "localhost:6685"
+	startMSEServer(t, addr, EncryptionPrefer)
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	otherHash := make([]byte, 20)
+	conn, err := DoEncryptedDial(tcpAddr, EncodeHandshake(HandshakeMsg), otherHash, EncryptionRequire)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("Encrypted dial with unknown info hash should fail")
+	}
+	util.EndTest()
+}
+
+func TestParseEncryptionPolicy(t *testing.T) {
+	util.StartTest("Testing parsing encryption policies...")
+	for _, policy := range []EncryptionPolicy{EncryptionDisabled, EncryptionPrefer, EncryptionRequire} {
+		parsed, err := ParseEncryptionPolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Fatalf("Expected %v, got %v (%v)", policy, parsed, err)
+		}
+	}
+	if _, err := ParseEncryptionPolicy("sometimes"); err == nil {
+		t.Fatalf("Expected error parsing bad policy")
+	}
+	util.EndTest()
+}
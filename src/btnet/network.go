@@ -0,0 +1,214 @@
+package btnet
+
+// Networks
+// The peer protocol only needs a byte stream, so where those streams come
+// from is pluggable: TCP, uTP, or in-memory pipes for tests.
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Opens and accepts raw connections between peers. A Network may hold
+// per-client state (e.g. the uTP socket), so don't share one between
+// clients unless it's meant to be shared, like a PipeNetwork.
+type Network interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+var ErrDialTimeout = errors.New("dial: timed out")
+
+// Dial addr on n, giving up after timeout unless it's 0
+func DialTimeout(n Network, addr string, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		return n.Dial(addr)
+	}
+	if _, ok := n.(*TCPNetwork); ok {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		conn, err := n.Dial(addr)
+		result <- dialResult{conn, err}
+	}()
+	select {
+	case r := <-result:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		go func() { // nobody wants it any more
+			if r := <-result; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ErrDialTimeout
+	}
+}
+
+type TCPNetwork struct{}
+
+func (n *TCPNetwork) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+func (n *TCPNetwork) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+// Once listening, connections are dialed from the listening socket so
+// peers see the same port either way
+type UTPNetwork struct {
+	mu     sync.Mutex
+	socket *UTPSocket
+}
+
+func (n *UTPNetwork) Dial(addr string) (net.Conn, error) {
+	n.mu.Lock()
+	socket := n.socket
+	n.mu.Unlock()
+	if socket != nil {
+		return socket.Dial(addr)
+	}
+	return DialUTP(addr)
+}
+
+func (n *UTPNetwork) Listen(addr string) (net.Listener, error) {
+	socket, err := ListenUTP(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	n.socket = socket
+	n.mu.Unlock()
+	return socket, nil
+}
+
+// In-memory network connecting clients with net.Pipe, no ports involved.
+// Addresses are ordinary "ip:port" strings that only mean something
+// within the network.
+type PipeNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*pipeListener
+	nextPort  int
+}
+
+var ErrPipeRefused = errors.New("pipe: connection refused")
+var ErrPipeAddrInUse = errors.New("pipe: address already in use")
+var ErrPipeClosed = errors.New("pipe: use of closed listener")
+
+const pipeEphemeralPort = 49152
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// net.Pipe end reporting the addresses of the pipe network
+type pipeConn struct {
+	net.Conn
+	local  pipeAddr
+	remote pipeAddr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+type pipeListener struct {
+	network *PipeNetwork
+	addr    pipeAddr
+	conns   chan net.Conn
+	closed  chan bool
+	once    sync.Once
+}
+
+func NewPipeNetwork() *PipeNetwork {
+	n := &PipeNetwork{}
+	n.listeners = make(map[string]*pipeListener)
+	n.nextPort = pipeEphemeralPort
+	return n
+}
+
+func (n *PipeNetwork) Listen(addr string) (net.Listener, error) {
+	key, err := pipeKey(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[key]; ok {
+		return nil, ErrPipeAddrInUse
+	}
+	l := &pipeListener{network: n, addr: pipeAddr(key)}
+	l.conns = make(chan net.Conn)
+	l.closed = make(chan bool)
+	n.listeners[key] = l
+	return l, nil
+}
+
+func (n *PipeNetwork) Dial(addr string) (net.Conn, error) {
+	return n.DialFrom("127.0.0.1", addr)
+}
+
+// dial addr so the connection appears to come from ip
+func (n *PipeNetwork) DialFrom(ip string, addr string) (net.Conn, error) {
+	key, err := pipeKey(addr)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	l, ok := n.listeners[key]
+	local := pipeAddr(net.JoinHostPort(ip, strconv.Itoa(n.nextPort)))
+	n.nextPort++
+	n.mu.Unlock()
+	if !ok {
+		return nil, ErrPipeRefused
+	}
+	client, server := net.Pipe()
+	select {
+	case l.conns <- &pipeConn{Conn: server, local: l.addr, remote: local}:
+		return &pipeConn{Conn: client, local: local, remote: l.addr}, nil
+	case <-l.closed:
+		client.Close()
+		server.Close()
+		return nil, ErrPipeRefused
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrPipeClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// normalize addr so "localhost:80" and "127.0.0.1:80" are the same place
+func pipeKey(addr string) (string, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	return tcpAddr.String(), nil
+}
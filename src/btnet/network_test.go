@@ -0,0 +1,111 @@
+package btnet
+
+import (
+	"net"
+	"testing"
+	"time"
+	"util"
+)
+
+func TestPipeNetworkPeerConnection(t *testing.T) {
+	util.StartTest("Testing encrypted peer connection over pipes...")
+	network := NewPipeNetwork()
+	ln, err := network.Listen("10.0.0.1:6881")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	defer ln.Close()
+	if _, err := network.Listen("10.0.0.1:6881"); err != ErrPipeAddrInUse {
+		t.Fatalf("Expected address in use, got %v", err)
+	}
+
+	remotes := make(chan net.Addr, 1)
+	handler := func(conn net.Conn) {
+		defer conn.Close()
+		data, err := ReadHandshake(conn)
+		if err != nil || !util.ByteArrayEquals(data, EncodeHandshake(HandshakeMsg)) {
+			remotes <- nil
+			return
+		}
+		remotes <- conn.RemoteAddr()
+		conn.Write(HaveBytes)
+	}
+	go Serve(ln, handler, makeEncryptionConfig(EncryptionRequire))
+
+	dialer := &Dialer{Encryption: EncryptionRequire, Networks: []Network{network}}
+	addr, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:6881")
+	conn, err := dialer.DialPeer(addr, EncodeHandshake(HandshakeMsg), mseInfoHash)
+	if err != nil {
+		t.Fatalf("DialPeer error: %s", err)
+	}
+	defer conn.Close()
+	if !IsEncrypted(conn) {
+		t.Fatalf("Outgoing connection should be encrypted")
+	}
+	remote := <-remotes
+	if remote == nil || remote.String() != conn.LocalAddr().String() {
+		t.Fatalf("Server saw %v, expected %v", remote, conn.LocalAddr())
+	}
+	expectHave(t, conn)
+	util.EndTest()
+}
+
+func TestPipeNetworkRefused(t *testing.T) {
+	util.StartTest("Testing pipe dial without a listener...")
+	network := NewPipeNetwork()
+	if _, err := network.Dial("10.0.0.1:6881"); err != ErrPipeRefused {
+		t.Fatalf("Expected connection refused, got %v", err)
+	}
+	ln, _ := network.Listen("localhost:6881")
+	ln.Close()
+	if _, err := ln.Accept(); err != ErrPipeClosed {
+		t.Fatalf("Expected closed listener, got %v", err)
+	}
+	if _, err := network.Dial("127.0.0.1:6881"); err != ErrPipeRefused {
+		t.Fatalf("Expected connection refused after close, got %v", err)
+	}
+	util.EndTest()
+}
+
+// a network where dials never connect
+type blackholeNetwork struct{}
+
+func (n *blackholeNetwork) Dial(addr string) (net.Conn, error) {
+	select {}
+}
+
+func (n *blackholeNetwork) Listen(addr string) (net.Listener, error) {
+	return nil, ErrPipeAddrInUse
+}
+
+func TestDialTimeout(t *testing.T) {
+	util.StartTest("Testing giving up on slow dials...")
+	start := time.Now()
+	if _, err := DialTimeout(&blackholeNetwork{}, "10.0.0.1:6881", 50*time.Millisecond); err != ErrDialTimeout {
+		t.Fatalf("Expected dial timeout, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Dial took %s to time out", time.Since(start))
+	}
+
+	network := NewPipeNetwork()
+	ln, _ := network.Listen("10.0.0.1:6881")
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := DialTimeout(network, "10.0.0.1:6881", time.Second)
+	if err != nil {
+		t.Fatalf("DialTimeout error: %s", err)
+	}
+	conn.Close()
+
+	dialer := &Dialer{Networks: []Network{&blackholeNetwork{}, network}, Timeout: 50 * time.Millisecond}
+	addr, _ := net.ResolveTCPAddr("tcp", "10.0.0.2:6881")
+	if _, err := dialer.DialPeer(addr, EncodeHandshake(HandshakeMsg), mseInfoHash); err != ErrPipeRefused {
+		t.Fatalf("Expected to fall through to the pipe network, got %v", err)
+	}
+	util.EndTest()
+}
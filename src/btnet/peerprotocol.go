@@ -3,13 +3,40 @@ package btnet
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net"
 	"sync"
+	"time"
 	"util"
 )
 
 const BT_PROTOCOL string = "BitTorrent protocol"
 
+// how long a peer gets to send its handshake
+const HandshakeTimeout = time.Second * 10
+
+var ErrHandshakeMalformed = errors.New("handshake: malformed")
+var ErrHandshakeProtocol = errors.New("handshake: unsupported protocol")
+var ErrHandshakeInfoHash = errors.New("handshake: info hash doesn't match ours")
+var ErrHandshakeSelf = errors.New("handshake: connected to ourselves")
+var ErrHandshakeDuplicate = errors.New("handshake: already connected to this peer")
+
+// Largest message we'll read, enough for a piece message carrying a
+// whole block or the bitfield of a torrent with a million pieces
+const MaxMessageLength = 1<<17 + 9
+
+// Largest block a peer may request or send
+const MaxBlockLength = 1 << 17
+
+var ErrMessageTooLarge = errors.New("message: longer than MaxMessageLength")
+var ErrMessageLength = errors.New("message: wrong length for its type")
+var ErrMessageType = errors.New("message: unknown type")
+var ErrMessageIndex = errors.New("message: piece index out of range")
+var ErrMessageBlock = errors.New("message: bad block offset or length")
+var ErrBitfieldLength = errors.New("message: bitfield doesn't match number of pieces")
+var ErrBitfieldSpareBits = errors.New("message: bitfield spare bits are set")
+
 type Handshake struct {
 	Pstr     string
 	Reserved [8]byte
@@ -55,13 +82,20 @@ type Peer struct {
 	mu          sync.RWMutex
 	Status      PeerStatus
 	Bitfield    []bool
-	Addr        net.TCPAddr
-	Conn        net.TCPConn
+	Addr        net.TCPAddr // where the peer listens, if we know
+	PeerId      string
+	Outgoing    bool      // we dialed this connection
+	LastActive  time.Time // when the peer last sent something besides a keepalive
+	Upload      *RateLimiter
+	Download    *RateLimiter
+	Conn        net.Conn
 	MsgQueueMu  sync.Mutex
 	MsgQueueSet map[PeerMessageId]bool
 	// MsgPieceSet  map[uint64]bool
 	MsgQueue  chan PeerMessage
 	KeepAlive chan bool
+	Done      chan struct{} // closed by Close
+	closeOnce sync.Once
 }
 
 type PeerMessageId struct {
@@ -83,17 +117,31 @@ func (peer *Peer) AddToMessageQueue(message PeerMessage) {
 		if !ok {
 			peer.MsgQueueSet[hash] = true
 			peer.MsgQueueMu.Unlock()
-			peer.MsgQueue <- message
+			peer.queue(message)
 			return
 		}
 		peer.MsgQueueMu.Unlock()
 		return
 	}
 	// peer.MsgQueueMu.Unlock()
-	peer.MsgQueue <- message
+	peer.queue(message)
 	return
 }
 
+// waits for room in the queue, unless the peer is closed first
+func (peer *Peer) queue(message PeerMessage) {
+	select {
+	case peer.MsgQueue <- message:
+	case <-peer.Done:
+	}
+}
+
+// closes the connection and Done, so nothing waits on the peer any more
+func (peer *Peer) Close() {
+	peer.closeOnce.Do(func() { close(peer.Done) })
+	peer.Conn.Close()
+}
+
 func (peer *Peer) MarkMessageSent(message PeerMessage) {
 	if message.Type == Request || message.Type == Piece {
 		hash := message.Hash()
@@ -103,11 +151,8 @@ func (peer *Peer) MarkMessageSent(message PeerMessage) {
 			delete(peer.MsgQueueSet, hash)
 			peer.MsgQueueMu.Unlock()
 			return
-		} else {
-			panic("wtf")
 		}
-		peer.MsgQueueMu.Unlock()
-		return
+		panic("wtf")
 	}
 	// peer.MsgQueueMu.Unlock()
 	return
@@ -121,25 +166,57 @@ func (p *Peer) GetBitfield() []bool {
 	return result
 }
 
+func (p *Peer) GetAddr() *net.TCPAddr {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	addr := p.Addr
+	return &addr
+}
+
+func (p *Peer) SetAddr(addr net.TCPAddr) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.Addr = addr
+}
+
 func (p *Peer) GetStatus() PeerStatus {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	return p.Status
 }
 
-func (p *Peer) SetBitfield(arr []bool) {
+func (p *Peer) SetBitfield(arr []bool) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	if len(arr) != len(p.Bitfield) {
-		panic("Bitfield lengths don't match")
+		return ErrBitfieldLength
 	}
 	copy(p.Bitfield, arr)
+	return nil
 }
 
-func (p *Peer) SetBitfieldElement(index int32, val bool) {
+func (p *Peer) SetBitfieldElement(index int32, val bool) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	if index < 0 || int(index) >= len(p.Bitfield) {
+		return ErrMessageIndex
+	}
 	p.Bitfield[index] = val
+	return nil
+}
+
+// note that the peer just did something useful
+func (p *Peer) MarkActive() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.LastActive = time.Now()
+}
+
+// returns how long it's been since the peer did something useful
+func (p *Peer) IdleTime() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return time.Since(p.LastActive)
 }
 
 func (p *Peer) SetChoking(val bool) {
@@ -155,7 +232,7 @@ func (p *Peer) SetInterested(val bool) {
 }
 
 // Make sure to start a go routine to kill this connection
-func InitializePeer(addr *net.TCPAddr, infoHash string, peerId string, bitfieldLength int, conn *net.TCPConn, pieceBitmap []bool) *Peer {
+func InitializePeer(addr *net.TCPAddr, infoHash string, peerId string, bitfieldLength int, conn net.Conn, pieceBitmap []bool, dialer *Dialer) (*Peer, error) {
 	// tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	peer := Peer{}
 	// if err != nil {
@@ -170,57 +247,92 @@ func InitializePeer(addr *net.TCPAddr, infoHash string, peerId string, bitfieldL
 	peer.Status.AmInterested = false
 	peer.Status.PeerChoking = false
 	peer.Status.PeerInterested = false
+	peer.LastActive = time.Now()
 	peer.MsgQueue = make(chan PeerMessage, 200)
 	peer.KeepAlive = make(chan bool, 100)
+	peer.Done = make(chan struct{})
 	// Create handshake
-	// Handshake{Pstr: BT_PROTOCOL, InfoHash: []byte(infoHash), PeerId: []byte(peerId)}
+	ours := EncodeHandshake(Handshake{Pstr: BT_PROTOCOL, InfoHash: []byte(infoHash), PeerId: []byte(peerId)})
 	if conn != nil && conn.RemoteAddr() != nil {
 		// This happens if we are not the ones initializing the communication
-		data, err := ReadHandshake(conn)
+		handshake, err := receiveHandshake(conn, infoHash, peerId)
 		if err != nil {
-			util.WPrintf("%s\n", err)
+			util.TPrintf("CR: BAD handshake from %s: %s\n", addr, err)
 			conn.Close()
-			return nil
+			return nil, err
 		}
-		handshake := DecodeHandshake(data)
-		// TODO: Process the handshake and drop connection if needed
-		if len(handshake.InfoHash) != 20 {
-			util.TPrintf("CR: BAD handshake, closing the connection\n")
-			// Badly formatted hsandshake, dont make the connection stick
+		if _, err := conn.Write(ours); err != nil {
 			conn.Close()
-			return nil
+			return nil, err
 		}
-		// TODO: Send bitfield message
-		message := PeerMessage{
-			Type:     Bitfield,
-			Bitfield: pieceBitmap}
-		util.TPrintf("Enqueuing bitfield message %v\n", pieceBitmap)
-		// peer.MsgQueue <- message
-		peer.AddToMessageQueue(message)
-		// cl.SendPeerMessage(&peer.Addr, message)
-		peer.Conn = *conn
+		peer.PeerId = string(handshake.PeerId)
+		peer.Conn = conn
 	} else {
-		handshake := Handshake{Pstr: BT_PROTOCOL, InfoHash: []byte(infoHash), PeerId: []byte(peerId)}
-		data := EncodeHandshake(handshake)
 		// Sending data
 		util.TPrintf("Sending Handshake\n")
-
-		conn, err := DoDial(addr, data)
+		conn, err := dialer.DialPeer(addr, ours, []byte(infoHash))
 		if err != nil {
-			return nil
+			return nil, err
 		}
-		peer.Conn = *conn
-
-		message := PeerMessage{
-			Type:     Bitfield,
-			Bitfield: pieceBitmap}
-		util.TPrintf("Enqueuing bitfield message %v\n", pieceBitmap)
-		// peer.MsgQueue <- message
-		peer.AddToMessageQueue(message)
-		// Read bitfield message that gets sent back
+		handshake, err := receiveHandshake(conn, infoHash, peerId)
+		if err != nil {
+			util.TPrintf("CR: BAD handshake from %s: %s\n", addr, err)
+			conn.Close()
+			return nil, err
+		}
+		peer.PeerId = string(handshake.PeerId)
+		peer.Outgoing = true
+		peer.Conn = conn
+	}
+
+	message := PeerMessage{
+		Type:     Bitfield,
+		Bitfield: pieceBitmap}
+	util.TPrintf("Enqueuing bitfield message %v\n", pieceBitmap)
+	peer.AddToMessageQueue(message)
+	return &peer, nil
+}
+
+// read the peer's handshake and make sure it's for our torrent
+func receiveHandshake(conn net.Conn, infoHash string, peerId string) (Handshake, error) {
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	data, err := ReadHandshake(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return Handshake{}, err
+	}
+	handshake := DecodeHandshake(data)
+	return handshake, ValidateHandshake(handshake, infoHash, peerId)
+}
+
+// Reads the handshake at the start of conn without using it up, so the
+// connection can be handed to whichever torrent it's for. Returns the
+// handshake and a connection that reads it again.
+func PeekHandshake(conn net.Conn) (Handshake, net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
+	data, err := ReadHandshake(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return Handshake{}, nil, err
 	}
+	return DecodeHandshake(data), &bufferedConn{conn, io.MultiReader(bytes.NewReader(data), conn)}, nil
+}
 
-	return &peer
+// returns nil if we should talk to the peer that sent handshake
+func ValidateHandshake(handshake Handshake, infoHash string, peerId string) error {
+	if len(handshake.InfoHash) != 20 || len(handshake.PeerId) != 20 {
+		return ErrHandshakeMalformed
+	}
+	if handshake.Pstr != BT_PROTOCOL {
+		return ErrHandshakeProtocol
+	}
+	if string(handshake.InfoHash) != infoHash {
+		return ErrHandshakeInfoHash
+	}
+	if string(handshake.PeerId) == peerId {
+		return ErrHandshakeSelf
+	}
+	return nil
 }
 
 func DecodeHandshake(data []byte) Handshake {
@@ -229,32 +341,28 @@ func DecodeHandshake(data []byte) Handshake {
 		return Handshake{}
 	}
 
-	pstrbuf := make([]byte, 1)
-	pstrbuf[0] = data[0]
-	var pstrLen uint8
-	pstrLenDecodeBuf := bytes.NewReader(pstrbuf)
-	errBinary := binary.Read(pstrLenDecodeBuf, binary.BigEndian, &pstrLen)
-	if errBinary != nil {
-		util.WPrintf("labtcp DecodeHandshake: %s\n", errBinary)
-	}
-
-	if len(data) < (49 + int(pstrLen)) {
+	pstrLen := int(data[0])
+	if len(data) < 49+pstrLen {
 		util.WPrintf("Badly formatted data\n")
 		return Handshake{}
 	}
 
 	// Decode pstr
-	pstr := string(data[1 : int(pstrLen)+1])
+	pstr := string(data[1 : pstrLen+1])
+
+	// Decode reserved bytes
+	var reserved [8]byte
+	copy(reserved[:], data[pstrLen+1:])
 
 	// Decode infoHash
 	infoHashIndex := pstrLen + 9
-	infoHash := []byte(data[infoHashIndex : infoHashIndex+20])
+	infoHash := data[infoHashIndex : infoHashIndex+20]
 
 	// Decode peerId
 	peerIdIndex := infoHashIndex + 20
-	peerId := []byte(data[peerIdIndex : peerIdIndex+20])
+	peerId := data[peerIdIndex : peerIdIndex+20]
 
-	return Handshake{Pstr: pstr, InfoHash: infoHash, PeerId: peerId}
+	return Handshake{Pstr: pstr, Reserved: reserved, InfoHash: infoHash, PeerId: peerId}
 }
 
 func EncodeHandshake(handshake Handshake) []byte {
@@ -266,7 +374,7 @@ func EncodeHandshake(handshake Handshake) []byte {
 	for i := 1; i < int(pstrlen)+1; i++ {
 		buf[i] = pstr[i-1]
 	}
-	// skip 8 bytes
+	copy(buf[int(pstrlen)+1:], handshake.Reserved[:])
 	infoHashIndex := 9 + int(pstrlen)
 	// infoHash = []byte(handshake.InfoHash)
 	for i := infoHashIndex; i < infoHashIndex+20; i++ {
@@ -279,114 +387,97 @@ func EncodeHandshake(handshake Handshake) []byte {
 	return buf
 }
 
-// fill in a PeerMessage struct from an array of bytes
-func DecodePeerMessage(data []byte, numPieces int) PeerMessage {
-
-	// messageType := data[0]
-	var msglength int32
-	var messageType int8
+// fill in a PeerMessage struct from an array of bytes, rejecting anything
+// that isn't a well formed message for a torrent with numPieces pieces
+func DecodePeerMessage(data []byte, numPieces int) (PeerMessage, error) {
 	peerMessage := PeerMessage{}
-	// b := []byte{0x18, 0x2d, 0x44, 0x54, 0xfb, 0x21, 0x09, 0x40}
-	buf := bytes.NewReader(data)
-
+	if len(data) < 4 {
+		return peerMessage, ErrMessageLength
+	}
 	// First grab the length of the message sent
-	err := binary.Read(buf, binary.BigEndian, &msglength)
-	if err != nil {
-		util.WPrintf("peerprotocol DecodePeerMessage: %s\n", err)
+	msglength := binary.BigEndian.Uint32(data)
+	if msglength > MaxMessageLength {
+		return peerMessage, ErrMessageTooLarge
 	}
-	// peerMessage.Length = int(length) // peerMessage.Length != length
-	if msglength < 1 {
+	if int(msglength) != len(data)-4 {
+		return peerMessage, ErrMessageLength
+	}
+	if msglength == 0 {
 		// This is a keepalive message
 		peerMessage.KeepAlive = true
-		return peerMessage
+		return peerMessage, nil
 	}
 
 	// Now read the message type
-	err = binary.Read(buf, binary.BigEndian, &messageType)
-	if err != nil {
-		util.WPrintf("peerprotocol DecodePeerMessage: %s\n", err)
-	}
-	peerMessage.Type = MessageType(messageType)
+	peerMessage.Type = MessageType(data[4])
+	payload := data[5:]
 
 	// Now for the fun packing the of PeerMessage Struct
 	switch peerMessage.Type {
-	case Choke:
-		// No further information needs to be parsed
-		// fmt.Println("Choke message")
-		// return peerMessage
-		fallthrough
-	case Unchoke:
-		// No further information needs to be parsed
-		// fmt.Println("Unchoke message")
-		// return peerMessage
-		fallthrough
-	case Interested:
-		// No further information needs to be parsed
-		// fmt.Println("Interested message")
-		// return peerMessage
-		fallthrough
-	case NotInterested:
+	case Choke, Unchoke, Interested, NotInterested:
 		// No further information needs to be parsed
-		// fmt.Println("NotInterested message")
-		return peerMessage
+		if len(payload) != 0 {
+			return PeerMessage{}, ErrMessageLength
+		}
 	case Have:
-		// fmt.Println("Have message")
-		var index int32
-		err = binary.Read(buf, binary.BigEndian, &index)
-		checkAndPrintErr(err)
-		peerMessage.Index = index
-		return peerMessage
+		if len(payload) != 4 {
+			return PeerMessage{}, ErrMessageLength
+		}
+		peerMessage.Index = int32(binary.BigEndian.Uint32(payload))
+		if !validIndex(peerMessage.Index, numPieces) {
+			return PeerMessage{}, ErrMessageIndex
+		}
 	case Bitfield:
 		util.TPrintf("Decoding bitfield message\n")
-		bitfield := make([]byte, (msglength - 1))
-		err = binary.Read(buf, binary.BigEndian, &bitfield)
-		checkAndPrintErr(err)
-		peerMessage.Bitfield = util.BytesToBools(bitfield)[:numPieces]
-	case Request:
-		var index int32
-		var begin int32
-		var length int32
-		err = binary.Read(buf, binary.BigEndian, &index)
-		checkAndPrintErr(err)
-		err = binary.Read(buf, binary.BigEndian, &begin)
-		checkAndPrintErr(err)
-		err = binary.Read(buf, binary.BigEndian, &length)
-		checkAndPrintErr(err)
-		peerMessage.Index = index
-		peerMessage.Begin = int(begin)
-		peerMessage.Length = int(length)
+		if len(payload) != (numPieces+7)/8 {
+			return PeerMessage{}, ErrBitfieldLength
+		}
+		bitfield := util.BytesToBools(payload)
+		for _, spare := range bitfield[numPieces:] {
+			if spare {
+				return PeerMessage{}, ErrBitfieldSpareBits
+			}
+		}
+		peerMessage.Bitfield = bitfield[:numPieces]
+	case Request, Cancel:
+		if len(payload) != 12 {
+			return PeerMessage{}, ErrMessageLength
+		}
+		peerMessage.Index = int32(binary.BigEndian.Uint32(payload))
+		peerMessage.Begin = int(int32(binary.BigEndian.Uint32(payload[4:])))
+		peerMessage.Length = int(int32(binary.BigEndian.Uint32(payload[8:])))
+		if !validIndex(peerMessage.Index, numPieces) {
+			return PeerMessage{}, ErrMessageIndex
+		}
+		if !validBlock(peerMessage.Begin, peerMessage.Length) {
+			return PeerMessage{}, ErrMessageBlock
+		}
 	case Piece:
-		var index int32
-		var begin int32
-		block := make([]byte, msglength-9)
-		err = binary.Read(buf, binary.BigEndian, &index)
-		checkAndPrintErr(err)
-		err = binary.Read(buf, binary.BigEndian, &begin)
-		checkAndPrintErr(err)
-		err = binary.Read(buf, binary.BigEndian, &block)
-		checkAndPrintErr(err)
-		peerMessage.Index = index
-		peerMessage.Begin = int(begin)
-		peerMessage.Block = block
-	case Cancel:
-		var index int32
-		var begin int32
-		var length int32
-		err = binary.Read(buf, binary.BigEndian, &index)
-		checkAndPrintErr(err)
-		err = binary.Read(buf, binary.BigEndian, &begin)
-		checkAndPrintErr(err)
-		err = binary.Read(buf, binary.BigEndian, &length)
-		checkAndPrintErr(err)
-		peerMessage.Index = index
-		peerMessage.Begin = int(begin)
-		peerMessage.Length = int(length)
+		if len(payload) < 8 {
+			return PeerMessage{}, ErrMessageLength
+		}
+		peerMessage.Index = int32(binary.BigEndian.Uint32(payload))
+		peerMessage.Begin = int(int32(binary.BigEndian.Uint32(payload[4:])))
+		peerMessage.Block = payload[8:]
+		if !validIndex(peerMessage.Index, numPieces) {
+			return PeerMessage{}, ErrMessageIndex
+		}
+		if !validBlock(peerMessage.Begin, len(peerMessage.Block)) {
+			return PeerMessage{}, ErrMessageBlock
+		}
 	default:
-		util.WPrintf("Unsupported message\n")
-		return PeerMessage{}
+		return PeerMessage{}, ErrMessageType
 	}
 
-	return peerMessage
+	return peerMessage, nil
+}
+
+func validIndex(index int32, numPieces int) bool {
+	return index >= 0 && int(index) < numPieces
+}
+
+func validBlock(begin int, length int) bool {
+	return begin >= 0 && length > 0 && length <= MaxBlockLength
 }
 
 func EncodePeerMessage(msg PeerMessage) []byte {
@@ -35,6 +35,9 @@ var PieceBytes []byte = []byte{0x00, 0x00, 0x00, 0x11, 0x07, 0x00, 0x00, 0x00, 0
 var CancelBytes []byte = []byte{0x00, 0x00, 0x00, 0x0d, 0x08, 0x00, 0x00, 0x00, 0x0b,
 	0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x08}
 
+// enough pieces for every index used above
+const TestNumPieces = 1 << 16
+
 // PeerMessage structs of messages
 var KeepAliveMsg PeerMessage = PeerMessage{KeepAlive: true}
 var ChokeMsg PeerMessage = PeerMessage{Type: Choke}
@@ -101,7 +104,14 @@ func runMessageTests(testname string, msg PeerMessage, bytes []byte, t *testing.
 
 func runDecodeTest(testname string, input []byte, expected PeerMessage, t *testing.T) {
 	util.StartTest("Testing decode " + testname + " message...")
-	actual := DecodePeerMessage(input, 0)
+	numPieces := TestNumPieces
+	if expected.Type == Bitfield {
+		numPieces = len(expected.Bitfield)
+	}
+	actual, err := DecodePeerMessage(input, numPieces)
+	if err != nil {
+		t.Fatalf("Error decoding %v: %s\n", input, err)
+	}
 	if !reflect.DeepEqual(actual, expected) {
 		t.Fatalf("have %v, expected %v\n", actual, expected)
 	}
@@ -119,3 +129,67 @@ func runEncodeTest(testname string, input PeerMessage, expected []byte, t *testi
 
 // TODO: Peer Protocol now handles initializing peers. We should write
 //			 a few tests for that.
+
+func TestValidateHandshake(t *testing.T) {
+	util.StartTest("Testing handshake validation...")
+	infoHash := string(HandshakeMsg.InfoHash)
+	ourId := "-QQ6824-000000000000"
+	if err := ValidateHandshake(HandshakeMsg, infoHash, ourId); err != nil {
+		t.Fatalf("Expected valid handshake, got %s", err)
+	}
+	decoded := DecodeHandshake(EncodeHandshake(HandshakeMsg))
+	if err := ValidateHandshake(decoded, infoHash, ourId); err != nil {
+		t.Fatalf("Expected decoded handshake to be valid, got %s", err)
+	}
+	cases := []struct {
+		handshake Handshake
+		err       error
+	}{
+		{DecodeHandshake([]byte{0x13, 0x00}), ErrHandshakeMalformed},
+		{Handshake{Pstr: "Bittorrent protocol", InfoHash: HandshakeMsg.InfoHash, PeerId: HandshakeMsg.PeerId}, ErrHandshakeProtocol},
+		{Handshake{Pstr: BT_PROTOCOL, InfoHash: make([]byte, 20), PeerId: HandshakeMsg.PeerId}, ErrHandshakeInfoHash},
+		{Handshake{Pstr: BT_PROTOCOL, InfoHash: HandshakeMsg.InfoHash, PeerId: []byte(ourId)}, ErrHandshakeSelf},
+	}
+	for _, c := range cases {
+		if err := ValidateHandshake(c.handshake, infoHash, ourId); err != c.err {
+			t.Fatalf("Expected %v for %v, got %v", c.err, c.handshake, err)
+		}
+	}
+	util.EndTest()
+}
+
+func TestDecodeMalformedMessages(t *testing.T) {
+	util.StartTest("Testing decoding malformed messages...")
+	cases := []struct {
+		input []byte
+		err   error
+	}{
+		{[]byte{}, ErrMessageLength},
+		{[]byte{0x00, 0x00, 0x00, 0x02, 0x01}, ErrMessageLength},
+		{[]byte{0x00, 0x00, 0x00, 0x02, 0x01, 0x00}, ErrMessageLength},
+		{[]byte{0x00, 0x00, 0x00, 0x01, 0x14}, ErrMessageType},
+		{[]byte{0x00, 0x02, 0x00, 0x0a, 0x07}, ErrMessageTooLarge},
+		{[]byte{0x00, 0x00, 0x00, 0x05, 0x04, 0x00, 0x01, 0x00, 0x00}, ErrMessageIndex},
+		{[]byte{0x00, 0x00, 0x00, 0x05, 0x04, 0xff, 0xff, 0xff, 0xff}, ErrMessageIndex},
+		{[]byte{0x00, 0x00, 0x00, 0x02, 0x05, 0x67}, ErrBitfieldLength},
+		{[]byte{0x00, 0x00, 0x00, 0x04, 0x05, 0x67, 0x8f, 0x00}, ErrBitfieldLength},
+		{[]byte{0x00, 0x00, 0x00, 0x0d, 0x06, 0x00, 0x00, 0x00, 0x0b,
+			0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x01, 0x08}, ErrMessageBlock},
+		{[]byte{0x00, 0x00, 0x00, 0x0d, 0x08, 0x00, 0x00, 0x00, 0x0b,
+			0x00, 0x00, 0x01, 0x00, 0x00, 0x02, 0x00, 0x01}, ErrMessageBlock},
+		{[]byte{0x00, 0x00, 0x00, 0x09, 0x07, 0x00, 0x00, 0x00, 0x0b,
+			0x00, 0x00, 0x01, 0x00}, ErrMessageBlock},
+		{[]byte{0x00, 0x00, 0x00, 0x08, 0x07, 0x00, 0x00, 0x00, 0x0b,
+			0x00, 0x00, 0x01}, ErrMessageLength},
+	}
+	for _, c := range cases {
+		if _, err := DecodePeerMessage(c.input, TestNumPieces); err != c.err {
+			t.Fatalf("Expected %v decoding %v, got %v", c.err, c.input, err)
+		}
+	}
+	// 12 pieces leave 4 spare bits in the last byte
+	if _, err := DecodePeerMessage(BitfieldBytes, 12); err != ErrBitfieldSpareBits {
+		t.Fatalf("Expected %v, got %v", ErrBitfieldSpareBits, err)
+	}
+	util.EndTest()
+}
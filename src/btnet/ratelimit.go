@@ -0,0 +1,125 @@
+package btnet
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Largest chunk a limited connection reads or writes at once, so a big
+// write doesn't hog a shared limiter
+const rateChunk = 16384
+
+// Token bucket allowing rate bytes per second, with bursts of up to a
+// tenth of a second's worth. Safe for concurrent use, and a nil or zero
+// rate limiter doesn't limit anything.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   int // bytes per second, 0 for unlimited
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rate int) *RateLimiter {
+	l := &RateLimiter{}
+	l.SetRate(rate)
+	return l
+}
+
+// change the rate, taking effect for the next bytes through
+func (l *RateLimiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.tokens = l.burst()
+	l.last = time.Now()
+}
+
+func (l *RateLimiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *RateLimiter) burst() float64 {
+	if l.rate < 10 {
+		return 1
+	}
+	return float64(l.rate / 10)
+}
+
+// Blocks until n bytes may pass. Callers take their bytes up front,
+// going into debt if need be, then wait until the debt is paid off, so
+// whoever comes next waits behind them.
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if burst := l.burst(); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// Wraps conn so everything read waits on each of download and everything
+// written on each of upload, e.g. the peer's, torrent's and global limits
+func LimitConn(conn net.Conn, upload []*RateLimiter, download []*RateLimiter) net.Conn {
+	return &limitedConn{conn, upload, download}
+}
+
+type limitedConn struct {
+	net.Conn
+	upload   []*RateLimiter
+	download []*RateLimiter
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if len(b) > rateChunk {
+		b = b[:rateChunk]
+	}
+	n, err := c.Conn.Read(b)
+	for _, l := range c.download {
+		l.WaitN(n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		end := written + rateChunk
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk := b[written:end]
+		for _, l := range c.upload {
+			l.WaitN(len(chunk))
+		}
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
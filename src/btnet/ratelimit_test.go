@@ -0,0 +1,131 @@
+package btnet
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+
+// sends size bytes over each of conns at once and returns the achieved
+// rate in bytes per second, counted at the receiving end
+func measureRate(t *testing.T, port string, size int, wrap func(net.Conn, bool) net.Conn, conns int) float64 {
+	ln, err := net.Listen("tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	defer ln.Close()
+	var wg sync.WaitGroup
+	wg.Add(conns)
+	go func() {
+		for i := 0; i < conns; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer wg.Done()
+				defer conn.Close()
+				io.Copy(ioutil.Discard, wrap(conn, false))
+			}()
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < conns; i++ {
+		conn, err := net.Dial("tcp", "localhost:"+port)
+		if err != nil {
+			t.Fatalf("Dial error: %s", err)
+		}
+		go func() {
+			defer conn.Close()
+			wrap(conn, true).Write(make([]byte, size))
+		}()
+	}
+	wg.Wait()
+	return float64(size*conns) / time.Since(start).Seconds()
+}
+
+func expectRate(t *testing.T, name string, rate float64, expected int) {
+	if rate < 0.75*float64(expected) || rate > 1.25*float64(expected) {
+		t.Fatalf("%s: expected about %d bytes/s, got %.0f", name, expected, rate)
+	}
+}
+
+// Tests
+func TestUploadRateLimit(t *testing.T) {
+	util.StartTest("Testing upload rate limit over loopback...")
+	limiter := NewRateLimiter(256 * 1024)
+	rate := measureRate(t, "6697", 128*1024, func(conn net.Conn, dialed bool) net.Conn {
+		if dialed {
+			return LimitConn(conn, []*RateLimiter{limiter}, nil)
+		}
+		return conn
+	}, 1)
+	expectRate(t, "upload", rate, 256*1024)
+	util.EndTest()
+}
+
+func TestDownloadRateLimit(t *testing.T) {
+	util.StartTest("Testing download rate limit over loopback...")
+	limiter := NewRateLimiter(256 * 1024)
+	rate := measureRate(t, "6698", 128*1024, func(conn net.Conn, dialed bool) net.Conn {
+		if !dialed {
+			return LimitConn(conn, nil, []*RateLimiter{limiter})
+		}
+		return conn
+	}, 1)
+	expectRate(t, "download", rate, 256*1024)
+	util.EndTest()
+}
+
+func TestSharedRateLimit(t *testing.T) {
+	util.StartTest("Testing connections sharing a rate limit...")
+	global := NewRateLimiter(256 * 1024)
+	var mu sync.Mutex
+	perConn := []*RateLimiter{}
+	rate := measureRate(t, "6699", 64*1024, func(conn net.Conn, dialed bool) net.Conn {
+		if !dialed {
+			return conn
+		}
+		// each connection alone could go twice as fast as the shared limit
+		own := NewRateLimiter(512 * 1024)
+		mu.Lock()
+		perConn = append(perConn, own)
+		mu.Unlock()
+		return LimitConn(conn, []*RateLimiter{own, global}, nil)
+	}, 2)
+	expectRate(t, "shared", rate, 256*1024)
+	util.EndTest()
+}
+
+func TestChangeRateLimit(t *testing.T) {
+	util.StartTest("Testing changing a rate limit at runtime...")
+	limiter := NewRateLimiter(64 * 1024)
+	limiter.SetRate(256 * 1024)
+	if limiter.Rate() != 256*1024 {
+		t.Fatalf("Expected new rate, got %d", limiter.Rate())
+	}
+	rate := measureRate(t, "6700", 128*1024, func(conn net.Conn, dialed bool) net.Conn {
+		if dialed {
+			return LimitConn(conn, []*RateLimiter{limiter}, nil)
+		}
+		return conn
+	}, 1)
+	expectRate(t, "changed", rate, 256*1024)
+
+	limiter.SetRate(0)
+	start := time.Now()
+	limiter.WaitN(1 << 30)
+	var none *RateLimiter
+	none.WaitN(1 << 30)
+	if time.Since(start) > 10*time.Millisecond || none.Rate() != 0 {
+		t.Fatalf("Rate 0 and nil limiters shouldn't limit")
+	}
+	util.EndTest()
+}
@@ -0,0 +1,819 @@
+package btnet
+
+// uTP (BEP 29)
+// Reliable, ordered byte streams over UDP. Congestion is controlled with
+// LEDBAT, which backs off as soon as it sees queuing delay build up, so
+// transfers yield to other traffic sharing the uplink.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+	"util"
+)
+
+// packet types
+const (
+	utpData  uint8 = 0
+	utpFin   uint8 = 1
+	utpState uint8 = 2
+	utpReset uint8 = 3
+	utpSyn   uint8 = 4
+)
+
+// connection states
+const (
+	utpSynSent = iota
+	utpConnected
+	utpClosed
+)
+
+const (
+	utpVersion        = 1
+	utpHeaderSize     = 20
+	utpMaxPayload     = 1200 // bytes of data per packet, keeps us under common MTUs
+	utpRecvWindow     = 1 << 20
+	utpMaxCwnd        = 1 << 20
+	utpTargetDelay    = 100 * time.Millisecond // LEDBAT queuing delay target
+	utpGain           = 1.0
+	utpMinRTO         = 500 * time.Millisecond
+	utpMaxRTO         = 8 * time.Second
+	utpMaxRetransmits = 8
+	utpTickInterval   = 50 * time.Millisecond
+	utpLingerTimeout  = 3 * time.Second // how long Close waits for our FIN to be acked
+	utpDialTimeout    = 3 * time.Second
+	utpDelayHistory   = 2 // minutes of delay samples kept for base delay
+)
+
+var ErrUTPClosed = errors.New("utp: use of closed connection")
+var ErrUTPReset = errors.New("utp: connection reset by peer")
+var ErrUTPTimeout = &utpTimeoutError{}
+
+// net.Error returned when a deadline or retransmission limit is hit
+type utpTimeoutError struct{}
+
+func (e *utpTimeoutError) Error() string   { return "utp: i/o timeout" }
+func (e *utpTimeoutError) Timeout() bool   { return true }
+func (e *utpTimeoutError) Temporary() bool { return true }
+
+type utpHeader struct {
+	Type          uint8
+	ConnId        uint16
+	Timestamp     uint32 // microseconds
+	TimestampDiff uint32 // microseconds
+	WndSize       uint32
+	SeqNr         uint16
+	AckNr         uint16
+}
+
+type utpPacket struct {
+	header        utpHeader
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+type utpConnKey struct {
+	addr   string
+	recvId uint16
+}
+
+// UDP socket carrying any number of uTP connections. A listening socket
+// implements net.Listener.
+type UTPSocket struct {
+	mu        sync.Mutex
+	conn      *net.UDPConn
+	conns     map[utpConnKey]*UTPConn
+	accept    chan *UTPConn
+	listening bool
+	closed    bool
+}
+
+// One uTP connection, implements net.Conn
+type UTPConn struct {
+	socket *UTPSocket
+	owned  bool // the socket was opened just for this connection
+	raddr  *net.UDPAddr
+	recvId uint16
+	sendId uint16
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	state int
+	err   error // reason the connection stopped, if it has
+
+	// sending
+	seqNr         uint16 // sequence number of the next packet we send
+	inflight      []*utpPacket
+	bytesInFlight int
+	cwnd          float64 // LEDBAT congestion window, in bytes
+	peerWnd       uint32
+	rtt           time.Duration
+	rttVar        time.Duration
+	rto           time.Duration
+	lastAck       uint16
+	dupAcks       int
+	finSent       bool
+	baseDelays    []uint32 // minimum delay sample per minute
+	baseDelayAt   time.Time
+
+	// receiving
+	ackNr      uint16 // last sequence number received in order
+	replyDiff  uint32 // timestamp difference to echo back to the peer
+	recvBuf    bytes.Buffer
+	reorder    map[uint16][]byte
+	gotFin     bool
+	finSeq     uint16
+	eof        bool
+	readClosed bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	done          chan bool
+}
+
+// Open a UDP socket on addr and accept incoming uTP connections on it
+func ListenUTP(addr string) (*UTPSocket, error) {
+	return newUTPSocket(addr, true)
+}
+
+// Dial addr over uTP from a new ephemeral socket
+func DialUTP(addr string) (net.Conn, error) {
+	s, err := newUTPSocket(":0", false)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := s.dial(addr, utpDialTimeout, true)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func newUTPSocket(addr string, listening bool) (*UTPSocket, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &UTPSocket{}
+	s.conn = udpConn
+	s.conns = make(map[utpConnKey]*UTPConn)
+	s.accept = make(chan *UTPConn, 64)
+	s.listening = listening
+	go s.readLoop()
+	return s, nil
+}
+
+// Dial addr over uTP, sharing this socket's port
+func (s *UTPSocket) Dial(addr string) (net.Conn, error) {
+	return s.dial(addr, utpDialTimeout, false)
+}
+
+func (s *UTPSocket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	return s.dial(addr, timeout, false)
+}
+
+func (s *UTPSocket) dial(addr string, timeout time.Duration, owned bool) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrUTPClosed
+	}
+	var recvId uint16
+	for {
+		recvId = uint16(rand.Intn(1 << 16))
+		_, taken := s.conns[utpConnKey{raddr.String(), recvId}]
+		_, takenSend := s.conns[utpConnKey{raddr.String(), recvId + 1}]
+		if !taken && !takenSend {
+			break
+		}
+	}
+	c := newUTPConn(s, raddr, recvId, recvId+1)
+	c.owned = owned
+	s.conns[utpConnKey{raddr.String(), recvId}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = utpSynSent
+	c.seqNr = 1
+	c.sendPacket(utpSyn, nil)
+	deadline := time.Now().Add(timeout)
+	for c.state == utpSynSent {
+		if err := c.wait(deadline); err != nil {
+			c.fail(err)
+			return nil, err
+		}
+	}
+	if c.state != utpConnected {
+		return nil, c.err
+	}
+	util.TPrintf("utp: connected to %s\n", raddr)
+	return c, nil
+}
+
+// net.Listener
+func (s *UTPSocket) Accept() (net.Conn, error) {
+	c, ok := <-s.accept
+	if !ok {
+		return nil, ErrUTPClosed
+	}
+	return c, nil
+}
+
+func (s *UTPSocket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// close the socket, resetting every connection on it
+func (s *UTPSocket) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	conns := []*UTPConn{}
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.mu.Lock()
+		if c.state != utpClosed {
+			c.sendPacket(utpReset, nil)
+			c.fail(ErrUTPClosed)
+		}
+		c.mu.Unlock()
+	}
+	return s.conn.Close()
+}
+
+func (s *UTPSocket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if !closed {
+				util.WPrintf("utp: reading from %s: %s\n", s.conn.LocalAddr(), err)
+				s.Close()
+			}
+			close(s.accept)
+			return
+		}
+		header, payload, err := decodeUTPPacket(buf[:n])
+		if err != nil {
+			util.TPrintf("utp: dropping packet from %s: %s\n", addr, err)
+			continue
+		}
+		s.dispatch(addr, header, append([]byte{}, payload...))
+	}
+}
+
+func (s *UTPSocket) dispatch(addr *net.UDPAddr, header utpHeader, payload []byte) {
+	s.mu.Lock()
+	if header.Type == utpSyn {
+		key := utpConnKey{addr.String(), header.ConnId + 1}
+		c, ok := s.conns[key]
+		if !ok {
+			if !s.listening || s.closed {
+				s.mu.Unlock()
+				s.sendReset(addr, header)
+				return
+			}
+			c = newUTPConn(s, addr, header.ConnId+1, header.ConnId)
+			c.state = utpConnected
+			c.seqNr = uint16(rand.Intn(1 << 16))
+			c.ackNr = header.SeqNr
+			s.conns[key] = c
+			select {
+			case s.accept <- c:
+			default:
+				delete(s.conns, key)
+				s.mu.Unlock()
+				s.sendReset(addr, header)
+				return
+			}
+		}
+		s.mu.Unlock()
+		c.mu.Lock()
+		c.receiveTimestamp(header)
+		c.sendPacket(utpState, nil)
+		c.mu.Unlock()
+		return
+	}
+	c, ok := s.conns[utpConnKey{addr.String(), header.ConnId}]
+	s.mu.Unlock()
+	if !ok {
+		if header.Type != utpReset {
+			s.sendReset(addr, header)
+		}
+		return
+	}
+	c.receive(header, payload)
+}
+
+func (s *UTPSocket) sendReset(addr *net.UDPAddr, header utpHeader) {
+	reset := utpHeader{Type: utpReset, ConnId: header.ConnId, Timestamp: utpNow(), AckNr: header.SeqNr}
+	s.conn.WriteToUDP(encodeUTPPacket(reset, nil), addr)
+}
+
+func (s *UTPSocket) remove(c *UTPConn) {
+	s.mu.Lock()
+	key := utpConnKey{c.raddr.String(), c.recvId}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+	s.mu.Unlock()
+}
+
+func newUTPConn(s *UTPSocket, raddr *net.UDPAddr, recvId uint16, sendId uint16) *UTPConn {
+	c := &UTPConn{}
+	c.socket = s
+	c.raddr = raddr
+	c.recvId = recvId
+	c.sendId = sendId
+	c.cond = sync.NewCond(&c.mu)
+	c.cwnd = 2 * utpMaxPayload
+	c.peerWnd = utpRecvWindow
+	c.rto = time.Second
+	c.reorder = make(map[uint16][]byte)
+	c.baseDelayAt = time.Now()
+	c.done = make(chan bool)
+	go c.tick()
+	return c
+}
+
+// Read data received in order, blocking until some is available
+func (c *UTPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.recvBuf.Len() == 0 {
+		if c.readClosed {
+			return 0, ErrUTPClosed
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+	wasFull := utpRecvWindow-c.recvBuf.Len() < utpMaxPayload
+	n, _ := c.recvBuf.Read(b)
+	if wasFull && c.state == utpConnected {
+		// window update, the peer may have stopped sending
+		c.sendPacket(utpState, nil)
+	}
+	return n, nil
+}
+
+// Write b, blocking while the congestion or receive window is full
+func (c *UTPConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		if c.finSent || c.state == utpClosed {
+			if c.err != nil {
+				return written, c.err
+			}
+			return written, ErrUTPClosed
+		}
+		size := len(b) - written
+		if size > utpMaxPayload {
+			size = utpMaxPayload
+		}
+		if c.bytesInFlight > 0 && c.bytesInFlight+size > c.window() {
+			if err := c.wait(c.writeDeadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		c.sendPacket(utpData, append([]byte{}, b[written:written+size]...))
+		written += size
+	}
+	return written, nil
+}
+
+// Close sends a FIN and lets the connection linger in the background
+// until it's acknowledged
+func (c *UTPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readClosed {
+		return nil
+	}
+	c.readClosed = true
+	if c.state == utpConnected && !c.finSent {
+		c.sendPacket(utpFin, nil)
+		c.finSent = true
+	}
+	if c.state != utpConnected || len(c.inflight) == 0 {
+		c.fail(ErrUTPClosed)
+	}
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *UTPConn) LocalAddr() net.Addr {
+	return c.socket.conn.LocalAddr()
+}
+
+func (c *UTPConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *UTPConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *UTPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *UTPConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.cond.Broadcast()
+	return nil
+}
+
+// wait on the condition variable until woken or deadline passes.
+// must hold c.mu
+func (c *UTPConn) wait(deadline time.Time) error {
+	if !deadline.IsZero() {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return ErrUTPTimeout
+		}
+		timer := time.AfterFunc(timeout, func() {
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		})
+		defer timer.Stop()
+	}
+	c.cond.Wait()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return ErrUTPTimeout
+	}
+	return nil
+}
+
+// the number of bytes we may have in flight. must hold c.mu
+func (c *UTPConn) window() int {
+	wnd := int(c.cwnd)
+	if int(c.peerWnd) < wnd {
+		wnd = int(c.peerWnd)
+	}
+	return wnd
+}
+
+// build and send a packet; data, FIN and SYN packets are kept until
+// acknowledged. must hold c.mu
+func (c *UTPConn) sendPacket(packetType uint8, payload []byte) {
+	header := utpHeader{Type: packetType, ConnId: c.sendId, SeqNr: c.seqNr, AckNr: c.ackNr}
+	if packetType == utpSyn {
+		header.ConnId = c.recvId
+	}
+	if packetType == utpData || packetType == utpFin || packetType == utpSyn {
+		p := &utpPacket{header: header, payload: payload}
+		c.inflight = append(c.inflight, p)
+		c.bytesInFlight += len(payload)
+		c.seqNr++
+		c.transmit(p)
+		return
+	}
+	c.transmit(&utpPacket{header: header})
+}
+
+// (re)send a packet with fresh timestamp, ack and window fields.
+// must hold c.mu
+func (c *UTPConn) transmit(p *utpPacket) {
+	p.header.Timestamp = utpNow()
+	p.header.TimestampDiff = c.replyDiff
+	p.header.WndSize = uint32(utpRecvWindow - c.recvBuf.Len())
+	if p.header.Type != utpSyn {
+		p.header.AckNr = c.ackNr
+	}
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.socket.conn.WriteToUDP(encodeUTPPacket(p.header, p.payload), c.raddr)
+}
+
+// must hold c.mu
+func (c *UTPConn) receiveTimestamp(header utpHeader) {
+	c.replyDiff = utpNow() - header.Timestamp
+}
+
+func (c *UTPConn) receive(header utpHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == utpClosed {
+		return
+	}
+	c.receiveTimestamp(header)
+	c.peerWnd = header.WndSize
+	if header.Type == utpReset {
+		c.fail(ErrUTPReset)
+		return
+	}
+	if c.state == utpSynSent {
+		if header.Type != utpState {
+			return
+		}
+		c.state = utpConnected
+		c.ackNr = header.SeqNr - 1
+		c.lastAck = header.AckNr - 1
+	}
+
+	c.processAck(header.AckNr, header.TimestampDiff)
+
+	if header.Type == utpData || header.Type == utpFin {
+		if header.Type == utpFin {
+			c.gotFin = true
+			c.finSeq = header.SeqNr
+		}
+		if header.SeqNr == c.ackNr+1 {
+			c.deliver(header.SeqNr, payload)
+			for {
+				next, ok := c.reorder[c.ackNr+1]
+				if !ok {
+					break
+				}
+				delete(c.reorder, c.ackNr+1)
+				c.deliver(c.ackNr+1, next)
+			}
+		} else if seqAfter(header.SeqNr, c.ackNr) && header.SeqNr-c.ackNr < utpRecvWindow/utpMaxPayload {
+			c.reorder[header.SeqNr] = payload
+		}
+		c.sendPacket(utpState, nil)
+	}
+
+	if c.readClosed && c.finSent && len(c.inflight) == 0 {
+		c.fail(ErrUTPClosed)
+	}
+	c.cond.Broadcast()
+}
+
+// must hold c.mu
+func (c *UTPConn) deliver(seq uint16, payload []byte) {
+	c.ackNr = seq
+	if c.gotFin && seq == c.finSeq {
+		c.eof = true
+		return
+	}
+	if !c.readClosed {
+		c.recvBuf.Write(payload)
+	}
+}
+
+// drop acknowledged packets from the send queue and adjust the congestion
+// window. must hold c.mu
+func (c *UTPConn) processAck(ackNr uint16, delaySample uint32) {
+	acked := 0
+	for len(c.inflight) > 0 && !seqAfter(c.inflight[0].header.SeqNr, ackNr) {
+		p := c.inflight[0]
+		c.inflight = c.inflight[1:]
+		c.bytesInFlight -= len(p.payload)
+		acked += len(p.payload)
+		if p.transmissions == 1 {
+			c.updateRTT(time.Since(p.sentAt))
+		}
+		if acked == 0 {
+			acked = 1 // SYN and FIN carry no data but still count as progress
+		}
+	}
+	if acked > 0 {
+		c.dupAcks = 0
+		c.updateCwnd(acked, delaySample)
+	} else if ackNr == c.lastAck && len(c.inflight) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			// fast retransmit, treat as loss
+			util.TPrintf("utp: fast retransmit of %d to %s\n", c.inflight[0].header.SeqNr, c.raddr)
+			c.cwnd = maxFloat(c.cwnd/2, utpMaxPayload)
+			c.transmit(c.inflight[0])
+		}
+	}
+	c.lastAck = ackNr
+}
+
+// LEDBAT: grow the window while queuing delay is under target, shrink it
+// proportionally once we're over. must hold c.mu
+func (c *UTPConn) updateCwnd(acked int, delaySample uint32) {
+	if delaySample == 0 {
+		// the peer hasn't measured our delay yet
+		c.cwnd += float64(acked) * utpMaxPayload / c.cwnd
+	} else {
+		c.addDelaySample(delaySample)
+		queuing := time.Duration(delaySample-c.baseDelay()) * time.Microsecond
+		offTarget := float64(utpTargetDelay-queuing) / float64(utpTargetDelay)
+		c.cwnd += utpGain * offTarget * float64(acked) * utpMaxPayload / c.cwnd
+	}
+	c.cwnd = minFloat(maxFloat(c.cwnd, utpMaxPayload), utpMaxCwnd)
+}
+
+// keep the minimum delay seen in each of the last few minutes.
+// must hold c.mu
+func (c *UTPConn) addDelaySample(sample uint32) {
+	if len(c.baseDelays) == 0 || time.Since(c.baseDelayAt) > time.Minute {
+		c.baseDelays = append(c.baseDelays, sample)
+		if len(c.baseDelays) > utpDelayHistory {
+			c.baseDelays = c.baseDelays[1:]
+		}
+		c.baseDelayAt = time.Now()
+		return
+	}
+	last := len(c.baseDelays) - 1
+	if sample < c.baseDelays[last] {
+		c.baseDelays[last] = sample
+	}
+}
+
+// must hold c.mu
+func (c *UTPConn) baseDelay() uint32 {
+	base := c.baseDelays[0]
+	for _, d := range c.baseDelays {
+		if d < base {
+			base = d
+		}
+	}
+	return base
+}
+
+// must hold c.mu
+func (c *UTPConn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < utpMinRTO {
+		c.rto = utpMinRTO
+	}
+}
+
+// retransmit timer
+func (c *UTPConn) tick() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+	closedAt := time.Time{}
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		if c.readClosed && closedAt.IsZero() {
+			closedAt = time.Now()
+		}
+		if !closedAt.IsZero() && time.Since(closedAt) > utpLingerTimeout {
+			c.fail(ErrUTPClosed)
+		} else if len(c.inflight) > 0 && time.Since(c.inflight[0].sentAt) > c.rto {
+			p := c.inflight[0]
+			if p.transmissions > utpMaxRetransmits {
+				util.WPrintf("utp: %s timed out\n", c.raddr)
+				c.fail(ErrUTPTimeout)
+			} else {
+				// timeout, back off to a single packet
+				c.cwnd = utpMaxPayload
+				c.rto *= 2
+				if c.rto > utpMaxRTO {
+					c.rto = utpMaxRTO
+				}
+				c.transmit(p)
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// stop the connection for good. must hold c.mu
+func (c *UTPConn) fail(err error) {
+	if c.state == utpClosed {
+		return
+	}
+	c.state = utpClosed
+	c.err = err
+	close(c.done)
+	c.cond.Broadcast()
+	go func() {
+		c.socket.remove(c)
+		if c.owned {
+			c.socket.Close()
+		}
+	}()
+}
+
+func encodeUTPPacket(header utpHeader, payload []byte) []byte {
+	buf := make([]byte, utpHeaderSize+len(payload))
+	buf[0] = header.Type<<4 | utpVersion
+	buf[1] = 0 // no extensions
+	binary.BigEndian.PutUint16(buf[2:], header.ConnId)
+	binary.BigEndian.PutUint32(buf[4:], header.Timestamp)
+	binary.BigEndian.PutUint32(buf[8:], header.TimestampDiff)
+	binary.BigEndian.PutUint32(buf[12:], header.WndSize)
+	binary.BigEndian.PutUint16(buf[16:], header.SeqNr)
+	binary.BigEndian.PutUint16(buf[18:], header.AckNr)
+	copy(buf[utpHeaderSize:], payload)
+	return buf
+}
+
+func decodeUTPPacket(data []byte) (utpHeader, []byte, error) {
+	header := utpHeader{}
+	if len(data) < utpHeaderSize {
+		return header, nil, errors.New("short packet")
+	}
+	if data[0]&0x0f != utpVersion {
+		return header, nil, errors.New("unsupported version")
+	}
+	header.Type = data[0] >> 4
+	if header.Type > utpSyn {
+		return header, nil, errors.New("unknown packet type")
+	}
+	header.ConnId = binary.BigEndian.Uint16(data[2:])
+	header.Timestamp = binary.BigEndian.Uint32(data[4:])
+	header.TimestampDiff = binary.BigEndian.Uint32(data[8:])
+	header.WndSize = binary.BigEndian.Uint32(data[12:])
+	header.SeqNr = binary.BigEndian.Uint16(data[16:])
+	header.AckNr = binary.BigEndian.Uint16(data[18:])
+
+	// skip over any extensions, e.g. selective acks
+	extension := data[1]
+	offset := utpHeaderSize
+	for extension != 0 {
+		if len(data) < offset+2 {
+			return header, nil, errors.New("truncated extension")
+		}
+		extension = data[offset]
+		length := int(data[offset+1])
+		offset += 2 + length
+		if len(data) < offset {
+			return header, nil, errors.New("truncated extension")
+		}
+	}
+	return header, data[offset:], nil
+}
+
+// returns true if sequence number a comes after b, allowing for wraparound
+func seqAfter(a uint16, b uint16) bool {
+	return int16(a-b) > 0
+}
+
+func utpNow() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
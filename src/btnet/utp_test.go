@@ -0,0 +1,286 @@
+package btnet
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+
+// forwards UDP packets between one client and addr, dropping a fraction of
+// them in both directions
+func startLossyProxy(t *testing.T, addr string, dropRate float64) string {
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Error starting proxy: %s", err)
+	}
+	back, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Error starting proxy: %s", err)
+	}
+	target, _ := net.ResolveUDPAddr("udp", addr)
+	clients := make(chan *net.UDPAddr, 1)
+	go func() {
+		buf := make([]byte, 65536)
+		var client *net.UDPAddr
+		for {
+			n, from, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if client == nil {
+				client = from
+				clients <- from
+			}
+			if rand.Float64() >= dropRate {
+				back.WriteToUDP(buf[:n], target)
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, 65536)
+		client := <-clients
+		for {
+			n, _, err := back.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if rand.Float64() >= dropRate {
+				front.WriteToUDP(buf[:n], client)
+			}
+		}
+	}()
+	return front.LocalAddr().String()
+}
+
+// accepts one connection on sock and echoes everything back
+func startEchoServer(sock *UTPSocket) {
+	go func() {
+		conn, err := sock.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+}
+
+func echoRoundTrip(t *testing.T, conn net.Conn, size int) {
+	data := make([]byte, size)
+	rand.Read(data)
+	go conn.Write(data)
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	received := make([]byte, size)
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatalf("Error reading echo: %s", err)
+	}
+	if !bytes.Equal(data, received) {
+		t.Fatalf("Echoed data doesn't match")
+	}
+}
+
+// Tests
+func TestUTPPacketEncoding(t *testing.T) {
+	util.StartTest("Testing uTP packet encoding...")
+	header := utpHeader{Type: utpData, ConnId: 1234, Timestamp: 5678, TimestampDiff: 91011,
+		WndSize: 1 << 20, SeqNr: 65535, AckNr: 42}
+	payload := []byte{0xde, 0xad, 0xbe, 0xef}
+	decoded, decodedPayload, err := decodeUTPPacket(encodeUTPPacket(header, payload))
+	if err != nil {
+		t.Fatalf("Error decoding packet: %s", err)
+	}
+	if decoded != header || !bytes.Equal(decodedPayload, payload) {
+		t.Fatalf("have %v %v, expected %v %v", decoded, decodedPayload, header, payload)
+	}
+	if _, _, err := decodeUTPPacket(payload); err == nil {
+		t.Fatalf("Expected error decoding short packet")
+	}
+	if !seqAfter(0, 65535) || seqAfter(65535, 0) {
+		t.Fatalf("Sequence number comparison doesn't wrap around")
+	}
+	util.EndTest()
+}
+
+func TestUTPEcho(t *testing.T) {
+	util.StartTest("Testing uTP echo over loopback...")
+	sock, err := ListenUTP("localhost:6690")
+	if err != nil {
+		t.Fatalf("ListenUTP error: %s", err)
+	}
+	defer sock.Close()
+	startEchoServer(sock)
+
+	conn, err := DialUTP("localhost:6690")
+	if err != nil {
+		t.Fatalf("DialUTP error: %s", err)
+	}
+	defer conn.Close()
+	echoRoundTrip(t, conn, 1<<20)
+	util.EndTest()
+}
+
+func TestUTPLossyLink(t *testing.T) {
+	util.StartTest("Testing uTP over a lossy link...")
+	sock, err := ListenUTP("localhost:6691")
+	if err != nil {
+		t.Fatalf("ListenUTP error: %s", err)
+	}
+	defer sock.Close()
+	startEchoServer(sock)
+
+	proxy := startLossyProxy(t, "localhost:6691", 0.05)
+	conn, err := DialUTP(proxy)
+	if err != nil {
+		t.Fatalf("DialUTP error: %s", err)
+	}
+	defer conn.Close()
+	echoRoundTrip(t, conn, 256*1024)
+	util.EndTest()
+}
+
+func TestUTPClose(t *testing.T) {
+	util.StartTest("Testing uTP close...")
+	sock, err := ListenUTP("localhost:6692")
+	if err != nil {
+		t.Fatalf("ListenUTP error: %s", err)
+	}
+	defer sock.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := sock.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	conn, err := DialUTP("localhost:6692")
+	if err != nil {
+		t.Fatalf("DialUTP error: %s", err)
+	}
+	server := <-accepted
+	conn.Write([]byte("bye"))
+	conn.Close()
+
+	server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatalf("Expected EOF after close, got %s", err)
+	}
+	if string(data) != "bye" {
+		t.Fatalf("Expected data before close, got %v", data)
+	}
+	if _, err := conn.Write([]byte("more")); err == nil {
+		t.Fatalf("Expected error writing to closed connection")
+	}
+	util.EndTest()
+}
+
+func TestUTPDeadline(t *testing.T) {
+	util.StartTest("Testing uTP read deadline...")
+	sock, err := ListenUTP("localhost:6693")
+	if err != nil {
+		t.Fatalf("ListenUTP error: %s", err)
+	}
+	defer sock.Close()
+	go sock.Accept()
+	conn, err := DialUTP("localhost:6693")
+	if err != nil {
+		t.Fatalf("DialUTP error: %s", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Expected timeout error, got %v", err)
+	}
+	util.EndTest()
+}
+
+func TestUTPDialNoListener(t *testing.T) {
+	util.StartTest("Testing uTP dial without a listener...")
+	sock, err := newUTPSocket("localhost:6694", false)
+	if err != nil {
+		t.Fatalf("newUTPSocket error: %s", err)
+	}
+	defer sock.Close()
+	if conn, err := DialUTP("localhost:6694"); err == nil {
+		conn.Close()
+		t.Fatalf("Expected dial to be reset")
+	}
+	util.EndTest()
+}
+
+func TestLEDBAT(t *testing.T) {
+	util.StartTest("Testing LEDBAT congestion window...")
+	c := &UTPConn{cwnd: 10 * utpMaxPayload}
+	c.addDelaySample(10000) // 10ms base delay
+	start := c.cwnd
+	for i := 0; i < 10; i++ {
+		c.updateCwnd(utpMaxPayload, 20000) // 10ms queuing, under target
+	}
+	if c.cwnd <= start {
+		t.Fatalf("Window should grow under target delay: %v -> %v", start, c.cwnd)
+	}
+	grown := c.cwnd
+	for i := 0; i < 10; i++ {
+		c.updateCwnd(utpMaxPayload, 400000) // 390ms queuing, over target
+	}
+	if c.cwnd >= grown {
+		t.Fatalf("Window should shrink over target delay: %v -> %v", grown, c.cwnd)
+	}
+	for i := 0; i < 1000; i++ {
+		c.updateCwnd(utpMaxPayload, 4000000)
+	}
+	if c.cwnd < utpMaxPayload {
+		t.Fatalf("Window should never drop below one packet: %v", c.cwnd)
+	}
+	util.EndTest()
+}
+
+func TestUTPPeerConnection(t *testing.T) {
+	util.StartTest("Testing encrypted peer connection over uTP...")
+	encrypted := make(chan bool, 1)
+	handler := func(conn net.Conn) {
+		defer conn.Close()
+		data, err := ReadHandshake(conn)
+		if err != nil || !util.ByteArrayEquals(data, EncodeHandshake(HandshakeMsg)) {
+			encrypted <- false
+			return
+		}
+		encrypted <- IsEncrypted(conn)
+		conn.Write(HaveBytes)
+		util.Wait(200)
+	}
+	sock := StartUTPServer("localhost:6695", handler, makeEncryptionConfig(EncryptionRequire))
+	if sock == nil {
+		t.Fatalf("Could not start uTP server")
+	}
+	defer sock.Close()
+
+	network := &UTPNetwork{}
+	local, err := network.Listen("localhost:6696")
+	if err != nil {
+		t.Fatalf("Listen error: %s", err)
+	}
+	defer local.Close()
+	dialer := &Dialer{Encryption: EncryptionRequire, Networks: []Network{network}}
+	addr, _ := net.ResolveTCPAddr("tcp", "localhost:6695")
+	conn, err := dialer.DialPeer(addr, EncodeHandshake(HandshakeMsg), mseInfoHash)
+	if err != nil {
+		t.Fatalf("DialPeer error: %s", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*encryptedConn).Conn.(*UTPConn); !ok {
+		t.Fatalf("Expected connection over uTP")
+	}
+	if !<-encrypted {
+		t.Fatalf("Incoming connection should be encrypted")
+	}
+	expectHave(t, conn)
+	util.EndTest()
+}
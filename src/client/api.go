@@ -0,0 +1,593 @@
+package btclient
+
+// Control API
+// A JSON API over HTTP for driving a session from other programs. Every
+// request needs the API's token, as "Authorization: Bearer <token>" or as
+// the password of basic auth. EventSource clients, which can't set
+// headers, may instead pass it to GET /api/events as a token query
+// parameter. Since browsers remember basic auth, requests that change
+// anything with it must be sent as application/json, which a page on
+// another site can't do without our say so.
+//
+//   GET    /api/torrents                      list torrents
+//   POST   /api/torrents                      add a torrent, see addRequest
+//   GET    /api/torrents/<hash>               one torrent, with its files
+//   DELETE /api/torrents/<hash>?delete=true   remove it, and its data
+//   POST   /api/torrents/<hash>/pause
+//   POST   /api/torrents/<hash>/resume
+//   PUT    /api/torrents/<hash>/limits        {"upload": 0, "download": 0}
+//   PUT    /api/torrents/<hash>/queue         {"position": 0, "force": false}
+//   PUT    /api/torrents/<hash>/files/<index> {"priority": "high"}
+//   GET    /api/limits                        the session's limits
+//   PUT    /api/limits                        {"upload": 0, "download": 0}
+//   GET    /api/events                        server-sent events, see apiEvent
+//
+// Limits are in bytes per second, 0 for unlimited. Errors come back as
+// {"error": "..."} with a 4xx or 5xx status.
+//
+// Torrents are added from .torrent files only. This client can't fetch a
+// torrent's metadata from peers, so adding a magnet link is answered with
+// 501 Not Implemented.
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"fs"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// largest .torrent file the API will take
+const MaxTorrentSize int64 = 10 << 20
+
+// how long fetching a .torrent file from a URL may take
+const FetchTimeout time.Duration = 30 * time.Second
+
+var ErrMagnet = errors.New("api: magnet links aren't supported, this client can't fetch metadata from peers")
+var ErrNoTorrent = errors.New("api: give a torrent or url")
+var ErrTorrentTooLarge = fmt.Errorf("api: torrent is larger than %d bytes", MaxTorrentSize)
+var ErrOutsideDir = errors.New("api: paths must be inside the API's directory")
+var ErrForgery = errors.New("api: send changes with a bearer token or as application/json")
+
+// Where added torrents and what they download go, and the token every
+// request must carry
+type APIConfig struct {
+	Token string
+	Dir   string
+}
+
+type api struct {
+	s      *Session
+	config APIConfig
+}
+
+// POST /api/torrents, with the .torrent file base64 encoded in Torrent or
+// at URL. Magnet is refused with 501. Output defaults to the torrent's
+// name in the API's directory, with its info hash added if another
+// torrent has that name, and can't be where another torrent writes. Seed
+// is what to seed from, if we already have the data. Both are taken
+// relative to the API's directory and must be inside it.
+type addRequest struct {
+	Torrent string `json:"torrent"`
+	URL     string `json:"url"`
+	Magnet  string `json:"magnet"`
+	Output  string `json:"output"`
+	Seed    string `json:"seed"`
+	Paused  bool   `json:"paused"`
+}
+
+type apiTorrent struct {
+	InfoHash      string     `json:"info_hash"`
+	Name          string     `json:"name"`
+	State         State      `json:"state"`
+	Size          int64      `json:"size"`
+	Progress      float64    `json:"progress"` // of the whole torrent, 0 to 1
+	Left          int64      `json:"left"`     // bytes of wanted files
+	Uploaded      int64      `json:"uploaded"`
+	Downloaded    int64      `json:"downloaded"`
+	Ratio         float64    `json:"ratio"`
+	UploadRate    float64    `json:"upload_rate"`
+	DownloadRate  float64    `json:"download_rate"`
+	UploadLimit   int        `json:"upload_limit"`
+	DownloadLimit int        `json:"download_limit"`
+	Peers         int        `json:"peers"`
+	QueuePosition int        `json:"queue_position"`
+	Forced        bool       `json:"forced"`
+	SeedTime      apiSeconds `json:"seed_time"`
+	Files         []apiFile  `json:"files,omitempty"`
+	SeedGoals     *apiGoals  `json:"seed_goals,omitempty"`
+}
+
+type apiFile struct {
+	Path     string `json:"path"`
+	Length   int64  `json:"length"`
+	Done     int64  `json:"done"`
+	Priority string `json:"priority"`
+}
+
+type apiGoals struct {
+	Ratio    float64    `json:"ratio"`
+	SeedTime apiSeconds `json:"seed_time"`
+	Action   string     `json:"action"`
+}
+
+// a duration in whole seconds
+type apiSeconds int64
+
+type apiLimits struct {
+	Upload   int `json:"upload"`
+	Download int `json:"download"`
+}
+
+type apiQueue struct {
+	Position *int  `json:"position"`
+	Force    *bool `json:"force"`
+}
+
+type apiPriority struct {
+	Priority string `json:"priority"`
+}
+
+// Sent as "event: <type>" with the event as data, see SessionEvent.
+// Subscribers get an added event for every torrent there already is, then
+// added, removed and state events as things change.
+type apiEvent struct {
+	Type     string `json:"type"`
+	InfoHash string `json:"info_hash"`
+	Name     string `json:"name"`
+	State    State  `json:"state,omitempty"`
+}
+
+// returns a handler for the API, see the top of api.go
+func (s *Session) APIHandler(config APIConfig) http.Handler {
+	return &api{s: s, config: config}
+}
+
+func (a *api) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, errors.New("api: missing or wrong token"))
+		return
+	}
+	if !safeFromForgery(r) {
+		writeError(w, http.StatusForbidden, ErrForgery)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "api" {
+		writeError(w, http.StatusNotFound, errors.New("api: no such endpoint"))
+		return
+	}
+	switch {
+	case len(parts) == 2 && parts[1] == "torrents":
+		a.route(w, r, map[string]http.HandlerFunc{"GET": a.listTorrents, "POST": a.addTorrent})
+	case len(parts) == 2 && parts[1] == "limits":
+		a.route(w, r, map[string]http.HandlerFunc{"GET": a.getLimits, "PUT": a.setLimits})
+	case len(parts) == 2 && parts[1] == "events":
+		a.route(w, r, map[string]http.HandlerFunc{"GET": a.events})
+	case len(parts) >= 3 && parts[1] == "torrents":
+		cl, ok := a.s.Torrent(parts[2])
+		if !ok {
+			writeError(w, http.StatusNotFound, ErrUnknownTorrent)
+			return
+		}
+		a.torrent(w, r, cl, parts[3:])
+	default:
+		writeError(w, http.StatusNotFound, errors.New("api: no such endpoint"))
+	}
+}
+
+func (a *api) authorized(r *http.Request) bool {
+	token := ""
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	} else if r.Method == "GET" && strings.Trim(r.URL.Path, "/") == "api/events" {
+		token = r.URL.Query().Get("token")
+	}
+	return a.config.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Token)) == 1
+}
+
+// Whether r can't have come from a form or script on another site: it
+// only reads, carries a bearer token a browser wouldn't add by itself, or
+// is JSON, which browsers won't send across sites without a preflight.
+func safeFromForgery(r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+		return true
+	}
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// calls the handler for r's method
+func (a *api) route(w http.ResponseWriter, r *http.Request, handlers map[string]http.HandlerFunc) {
+	handler, ok := handlers[r.Method]
+	if !ok {
+		methods := []string{}
+		for method := range handlers {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, errors.New("api: method not allowed"))
+		return
+	}
+	handler(w, r)
+}
+
+// handles /api/torrents/<hash>/rest...
+func (a *api) torrent(w http.ResponseWriter, r *http.Request, cl *BTClient, rest []string) {
+	with := func(handler func(http.ResponseWriter, *http.Request, *BTClient)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { handler(w, r, cl) }
+	}
+	switch {
+	case len(rest) == 0:
+		a.route(w, r, map[string]http.HandlerFunc{"GET": with(a.getTorrent), "DELETE": with(a.removeTorrent)})
+	case len(rest) == 1 && rest[0] == "pause":
+		a.route(w, r, map[string]http.HandlerFunc{"POST": with(a.pauseTorrent)})
+	case len(rest) == 1 && rest[0] == "resume":
+		a.route(w, r, map[string]http.HandlerFunc{"POST": with(a.resumeTorrent)})
+	case len(rest) == 1 && rest[0] == "limits":
+		a.route(w, r, map[string]http.HandlerFunc{"PUT": with(a.setTorrentLimits)})
+	case len(rest) == 1 && rest[0] == "queue":
+		a.route(w, r, map[string]http.HandlerFunc{"PUT": with(a.setQueue)})
+	case len(rest) == 2 && rest[0] == "files":
+		file, err := strconv.Atoi(rest[1])
+		if err != nil {
+			writeError(w, http.StatusNotFound, ErrFileIndex)
+			return
+		}
+		a.route(w, r, map[string]http.HandlerFunc{"PUT": func(w http.ResponseWriter, r *http.Request) {
+			a.setPriority(w, r, cl, file)
+		}})
+	default:
+		writeError(w, http.StatusNotFound, errors.New("api: no such endpoint"))
+	}
+}
+
+func (a *api) listTorrents(w http.ResponseWriter, r *http.Request) {
+	torrents := []apiTorrent{}
+	for _, cl := range a.s.Torrents() {
+		torrents = append(torrents, a.describe(cl, false))
+	}
+	writeJSON(w, http.StatusOK, torrents)
+}
+
+func (a *api) getTorrent(w http.ResponseWriter, r *http.Request, cl *BTClient) {
+	writeJSON(w, http.StatusOK, a.describe(cl, true))
+}
+
+// what the API says about cl, with its files and goals if detailed
+func (a *api) describe(cl *BTClient, detailed bool) apiTorrent {
+	stats := cl.Stats()
+	files := cl.Files()
+	size, done := int64(0), int64(0)
+	for _, file := range files {
+		size += file.Length
+		done += file.Done
+	}
+	upload, download := cl.RateLimits()
+	position, _ := a.s.QueuePosition(cl.InfoHash())
+	t := apiTorrent{
+		InfoHash:      cl.InfoHash(),
+		Name:          cl.Name(),
+		State:         cl.State(),
+		Size:          size,
+		Left:          stats.Left,
+		Uploaded:      stats.Uploaded,
+		Downloaded:    stats.Downloaded,
+		Ratio:         stats.Ratio,
+		UploadRate:    stats.UploadRate,
+		DownloadRate:  stats.DownloadRate,
+		UploadLimit:   upload,
+		DownloadLimit: download,
+		Peers:         len(cl.atomicGetPeerIds()),
+		QueuePosition: position,
+		Forced:        a.s.Forced(cl.InfoHash()),
+		SeedTime:      apiSeconds(stats.SeedTime / time.Second)}
+	if size > 0 {
+		t.Progress = float64(done) / float64(size)
+	}
+	if detailed {
+		for _, file := range files {
+			t.Files = append(t.Files, apiFile{Path: file.Path, Length: file.Length, Done: file.Done,
+				Priority: file.Priority.String()})
+		}
+		goals := cl.SeedGoals()
+		t.SeedGoals = &apiGoals{Ratio: goals.Ratio, SeedTime: apiSeconds(goals.SeedTime / time.Second),
+			Action: goals.Action.String()}
+	}
+	return t
+}
+
+func (a *api) addTorrent(w http.ResponseWriter, r *http.Request) {
+	var req addRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	var data []byte
+	var err error
+	switch {
+	case req.Magnet != "":
+		writeError(w, http.StatusNotImplemented, ErrMagnet)
+		return
+	case req.Torrent != "":
+		data, err = base64.StdEncoding.DecodeString(req.Torrent)
+	case req.URL != "":
+		data, err = fetchTorrent(req.URL)
+	default:
+		err = ErrNoTorrent
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	output, err := a.inDir(req.Output)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	seed, err := a.inDir(req.Seed)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	cl, err := a.add(data, a.config.Dir, output, seed, req.Paused)
+	switch err {
+	case nil:
+	case ErrDuplicateTorrent, ErrOutputInUse:
+		writeError(w, http.StatusConflict, err)
+		return
+	default:
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, a.describe(cl, true))
+}
+
+// Adds the .torrent file data to the session, to download to output, or
+// failing that to the torrent's name in dir, with its info hash added if
+// another torrent has that name. Returns the torrent that's already there
+// along with ErrDuplicateTorrent, if it's still there.
+func (a *api) add(data []byte, dir string, output string, seed string, paused bool) (*BTClient, error) {
+	path, err := a.saveTorrent(data)
+	if err != nil {
+		return nil, err
+	}
+	infoHash := strings.TrimSuffix(filepath.Base(path), ".torrent")
+	persister := MakePersister(filepath.Join(a.config.Dir, infoHash+".p"))
+	var cl *BTClient
+	if output != "" {
+		cl, err = a.s.AddTorrent(path, seed, output, persister)
+	} else {
+		name := safeName(fs.Read(path).Name, infoHash)
+		cl, err = a.s.AddTorrent(path, seed, filepath.Join(dir, name), persister)
+		if err == ErrOutputInUse {
+			cl, err = a.s.AddTorrent(path, seed, filepath.Join(dir, name+"-"+infoHash), persister)
+		}
+	}
+	if err == ErrDuplicateTorrent {
+		cl, _ = a.s.Torrent(infoHash)
+		return cl, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if paused {
+		cl.Pause()
+	}
+	return cl, nil
+}
+
+// path resolved against the API's directory, or an error if it's outside
+// it, so clients can't read or write anywhere else
+func (a *api) inDir(path string) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	dir, err := filepath.Abs(a.config.Dir)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	rel, err := filepath.Rel(dir, filepath.Clean(path))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", ErrOutsideDir
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// fetches a .torrent file, giving up on slow or oversized ones
+func fetchTorrent(url string) ([]byte, error) {
+	client := http.Client{Timeout: FetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("api: fetching %s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxTorrentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > MaxTorrentSize {
+		return nil, ErrTorrentTooLarge
+	}
+	return data, nil
+}
+
+// saves a .torrent file's data in the API's directory, named by its info
+// hash, returning the path
+func (a *api) saveTorrent(data []byte) (string, error) {
+	tmp, err := ioutil.TempFile(a.config.Dir, "add")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	infoHash, err := readInfoHash(tmp.Name())
+	if err != nil {
+		return "", errors.New("api: not a valid torrent")
+	}
+	path := filepath.Join(a.config.Dir, fmt.Sprintf("%x.torrent", infoHash))
+	return path, os.Rename(tmp.Name(), path)
+}
+
+// a torrent's name made safe to use as a file name, or infoHash if
+// there's nothing left of it
+func safeName(name string, infoHash string) string {
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		return infoHash
+	}
+	return name
+}
+
+func (a *api) removeTorrent(w http.ResponseWriter, r *http.Request, cl *BTClient) {
+	deleteData := r.URL.Query().Get("delete") == "true"
+	if err := a.s.RemoveTorrent(cl.InfoHash(), deleteData); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *api) pauseTorrent(w http.ResponseWriter, r *http.Request, cl *BTClient) {
+	cl.Pause()
+	writeJSON(w, http.StatusOK, a.describe(cl, false))
+}
+
+func (a *api) resumeTorrent(w http.ResponseWriter, r *http.Request, cl *BTClient) {
+	cl.Resume()
+	writeJSON(w, http.StatusOK, a.describe(cl, false))
+}
+
+func (a *api) setTorrentLimits(w http.ResponseWriter, r *http.Request, cl *BTClient) {
+	var limits apiLimits
+	if !readJSON(w, r, &limits) {
+		return
+	}
+	cl.SetRateLimits(limits.Upload, limits.Download)
+	writeJSON(w, http.StatusOK, a.describe(cl, false))
+}
+
+func (a *api) setQueue(w http.ResponseWriter, r *http.Request, cl *BTClient) {
+	var queue apiQueue
+	if !readJSON(w, r, &queue) {
+		return
+	}
+	if queue.Position != nil {
+		a.s.SetQueuePosition(cl.InfoHash(), *queue.Position)
+	}
+	if queue.Force != nil {
+		a.s.ForceStart(cl.InfoHash(), *queue.Force)
+	}
+	writeJSON(w, http.StatusOK, a.describe(cl, false))
+}
+
+func (a *api) setPriority(w http.ResponseWriter, r *http.Request, cl *BTClient, file int) {
+	var req apiPriority
+	if !readJSON(w, r, &req) {
+		return
+	}
+	priority, err := ParsePriority(req.Priority)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := cl.SetFilePriority(file, priority); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.describe(cl, true))
+}
+
+func (a *api) getLimits(w http.ResponseWriter, r *http.Request) {
+	conns := a.s.Connections()
+	writeJSON(w, http.StatusOK, apiLimits{Upload: conns.Upload.Rate(), Download: conns.Download.Rate()})
+}
+
+func (a *api) setLimits(w http.ResponseWriter, r *http.Request) {
+	var limits apiLimits
+	if !readJSON(w, r, &limits) {
+		return
+	}
+	a.s.Connections().SetRateLimits(limits.Upload, limits.Download)
+	a.getLimits(w, r)
+}
+
+// streams events until the subscriber or the session goes away, or the
+// subscriber falls too far behind
+func (a *api) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("api: can't stream events"))
+		return
+	}
+	events, unsubscribe := a.s.Subscribe()
+	defer unsubscribe()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return // it can reconnect and start again
+			}
+			data, _ := json.Marshal(apiEvent{Type: event.Type, InfoHash: event.InfoHash, Name: event.Name,
+				State: event.State})
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-a.s.ctx.Done():
+			return
+		}
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(io.LimitReader(r.Body, 2*MaxTorrentSize))
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("api: bad request body: %s", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,318 @@
+package btclient
+
+import (
+	"btnet"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"util"
+)
+
+const APIToken = "secret"
+
+// Helpers
+
+// starts a session with the API in front of it, keeping what's added in a
+// temporary directory
+func makeAPI(t *testing.T) (*Session, *httptest.Server, string) {
+	s := makeQueueSession(t, btnet.NewPipeNetwork(), DefaultConfig())
+	dir, _ := ioutil.TempDir("", "tapi")
+	server := httptest.NewServer(s.APIHandler(APIConfig{Token: APIToken, Dir: dir}))
+	return s, server, dir
+}
+
+// sends body as JSON with token, decodes the response into out if it
+// isn't nil, and returns the status
+func apiRequest(t *testing.T, method string, url string, token string, body interface{}, out interface{}) int {
+	var reader *bytes.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	req, _ := http.NewRequest(method, url, reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Couldn't %s %s: %s", method, url, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode
+}
+
+func torrentData(path string) string {
+	data, _ := ioutil.ReadFile(path)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// reads server-sent events until one of type eventType, failing after a while
+func expectEvent(t *testing.T, events *bufio.Reader, eventType string) apiEvent {
+	found := make(chan apiEvent, 1)
+	go func() {
+		for {
+			line, err := events.ReadString('\n')
+			if err != nil {
+				close(found)
+				return
+			}
+			if strings.TrimSpace(line) != "event: "+eventType {
+				continue
+			}
+			data, _ := events.ReadString('\n')
+			var event apiEvent
+			json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &event)
+			found <- event
+			return
+		}
+	}()
+	select {
+	case event, ok := <-found:
+		if ok {
+			return event
+		}
+	case <-time.After(3 * time.Second):
+	}
+	t.Fatalf("Expected a %s event", eventType)
+	return apiEvent{}
+}
+
+// Tests
+func TestAPIAuth(t *testing.T) {
+	util.StartTest("Testing the control API turning away requests without its token...")
+	s, server, dir := makeAPI(t)
+	defer os.RemoveAll(dir)
+	defer s.Close(context.Background())
+	defer server.Close()
+
+	var body map[string]string
+	if status := apiRequest(t, "GET", server.URL+"/api/torrents", "", nil, &body); status != http.StatusUnauthorized {
+		t.Fatalf("Expected a request without a token to be unauthorized, got %d", status)
+	}
+	if body["error"] == "" {
+		t.Fatalf("Expected an error message")
+	}
+	if status := apiRequest(t, "GET", server.URL+"/api/torrents", "wrong", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("Expected a request with the wrong token to be unauthorized, got %d", status)
+	}
+	if status := apiRequest(t, "GET", server.URL+"/api/torrents?token="+APIToken, "", nil, nil); status != http.StatusUnauthorized {
+		t.Fatalf("Expected the token to work as a query parameter only for events, got %d", status)
+	}
+
+	// with basic auth a browser could send it from anywhere, so changes must be JSON
+	limits := strings.NewReader(`{"upload": 1000, "download": 0}`)
+	req, _ := http.NewRequest("PUT", server.URL+"/api/limits", limits)
+	req.SetBasicAuth("admin", APIToken)
+	req.Header.Set("Content-Type", "text/plain")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected a change that isn't JSON to be forbidden, got %v", resp.StatusCode)
+	}
+	if upload := s.Connections().Upload.Rate(); upload != 0 {
+		t.Fatalf("Expected the forbidden change not to be made, upload limit is %d", upload)
+	}
+	limits = strings.NewReader(`{"upload": 1000, "download": 0}`)
+	req, _ = http.NewRequest("PUT", server.URL+"/api/limits", limits)
+	req.SetBasicAuth("admin", APIToken)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a JSON change with basic auth to be allowed, got %v", resp.StatusCode)
+	}
+	if status := apiRequest(t, "GET", server.URL+"/api/nothing", APIToken, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("Expected a missing endpoint not to be found, got %d", status)
+	}
+	if status := apiRequest(t, "DELETE", server.URL+"/api/torrents", APIToken, nil, nil); status != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected DELETE not to be allowed on the list, got %d", status)
+	}
+	util.EndTest()
+}
+
+func TestAPIControl(t *testing.T) {
+	util.StartTest("Testing adding and controlling torrents over the control API...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	s, server, dir := makeAPI(t)
+	defer os.RemoveAll(dir)
+	defer s.Close(context.Background())
+	defer server.Close()
+	api := server.URL + "/api"
+	torrent := makeQueueTorrent(tracker.URL, "a.jpg")
+
+	// seeds and outputs are kept to the API's directory
+	for _, req := range []addRequest{{Seed: MalformedSeedFile}, {Seed: "../seed.jpg"}, {Output: "/tmp/a.jpg"},
+		{Output: "sub/../../a.jpg"}, {Output: "."}} {
+		req.Torrent = torrentData(torrent)
+		if status := apiRequest(t, "POST", api+"/torrents", APIToken, req, nil); status != http.StatusBadRequest {
+			t.Fatalf("Expected %+v outside the API's directory to be refused, got %d", req, status)
+		}
+	}
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+	ioutil.WriteFile(filepath.Join(dir, "seed.jpg"), seed, 0644)
+
+	var added apiTorrent
+	status := apiRequest(t, "POST", api+"/torrents", APIToken,
+		addRequest{Torrent: torrentData(torrent), Seed: "seed.jpg"}, &added)
+	if status != http.StatusCreated || added.Name != "a.jpg" || len(added.Files) != 1 {
+		t.Fatalf("Expected a.jpg to be added, got %d: %+v", status, added)
+	}
+	cl, ok := s.Torrent(added.InfoHash)
+	if !ok {
+		t.Fatalf("Expected a.jpg to join the session")
+	}
+	awaitState(t, cl, StateSeeding)
+	status = apiRequest(t, "POST", api+"/torrents", APIToken, addRequest{Torrent: torrentData(torrent)}, nil)
+	if status != http.StatusConflict {
+		t.Fatalf("Expected adding a.jpg again to conflict, got %d", status)
+	}
+	status = apiRequest(t, "POST", api+"/torrents", APIToken, addRequest{Magnet: "magnet:?xt=urn:btih:00"}, nil)
+	if status != http.StatusNotImplemented {
+		t.Fatalf("Expected magnet links not to be supported, got %d", status)
+	}
+	status = apiRequest(t, "POST", api+"/torrents", APIToken, addRequest{Torrent: "bm90IGEgdG9ycmVudA=="}, nil)
+	if status != http.StatusBadRequest {
+		t.Fatalf("Expected a bad torrent to be refused, got %d", status)
+	}
+
+	// from a URL, paused
+	other := makeQueueTorrent(tracker.URL, "b.jpg")
+	files := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir(other))))
+	defer files.Close()
+	var fetched apiTorrent
+	status = apiRequest(t, "POST", api+"/torrents", APIToken,
+		addRequest{URL: files.URL + "/" + filepath.Base(other), Paused: true}, &fetched)
+	if status != http.StatusCreated || fetched.State != StatePaused {
+		t.Fatalf("Expected b.jpg to be added paused, got %d: %+v", status, fetched)
+	}
+
+	huge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, MaxTorrentSize+1))
+	}))
+	defer huge.Close()
+	var refused map[string]string
+	status = apiRequest(t, "POST", api+"/torrents", APIToken, addRequest{URL: huge.URL}, &refused)
+	if status != http.StatusBadRequest || refused["error"] != ErrTorrentTooLarge.Error() {
+		t.Fatalf("Expected a torrent that's too large to be refused, got %d: %v", status, refused)
+	}
+
+	var torrents []apiTorrent
+	if apiRequest(t, "GET", api+"/torrents", APIToken, nil, &torrents); len(torrents) != 2 ||
+		torrents[0].InfoHash != added.InfoHash || torrents[0].Progress != 1 || torrents[1].Progress != 0 {
+		t.Fatalf("Expected a.jpg done and b.jpg not started, have %+v", torrents)
+	}
+
+	var got apiTorrent
+	apiRequest(t, "POST", api+"/torrents/"+added.InfoHash+"/pause", APIToken, nil, &got)
+	if got.State != StatePaused {
+		t.Fatalf("Expected a.jpg to be paused, is %s", got.State)
+	}
+	apiRequest(t, "POST", api+"/torrents/"+added.InfoHash+"/resume", APIToken, nil, nil)
+	awaitState(t, cl, StateSeeding)
+
+	apiRequest(t, "PUT", api+"/torrents/"+added.InfoHash+"/limits", APIToken, apiLimits{Upload: 1000, Download: 2000}, &got)
+	if got.UploadLimit != 1000 || got.DownloadLimit != 2000 {
+		t.Fatalf("Expected limits of 1000 and 2000, have %d and %d", got.UploadLimit, got.DownloadLimit)
+	}
+	apiRequest(t, "PUT", api+"/torrents/"+added.InfoHash+"/files/0", APIToken, apiPriority{Priority: "high"}, &got)
+	if got.Files[0].Priority != "high" {
+		t.Fatalf("Expected a.jpg's file to be high priority, is %s", got.Files[0].Priority)
+	}
+	status = apiRequest(t, "PUT", api+"/torrents/"+added.InfoHash+"/files/1", APIToken, apiPriority{Priority: "high"}, nil)
+	if status != http.StatusNotFound {
+		t.Fatalf("Expected setting a missing file's priority to fail, got %d", status)
+	}
+	position := 1
+	apiRequest(t, "PUT", api+"/torrents/"+added.InfoHash+"/queue", APIToken, apiQueue{Position: &position}, &got)
+	if got.QueuePosition != 1 {
+		t.Fatalf("Expected a.jpg to move to 1 in the queue, at %d", got.QueuePosition)
+	}
+
+	var limits apiLimits
+	apiRequest(t, "PUT", api+"/limits", APIToken, apiLimits{Upload: 3000, Download: 4000}, &limits)
+	if limits.Upload != 3000 || s.Connections().Download.Rate() != 4000 {
+		t.Fatalf("Expected session limits of 3000 and 4000, have %+v", limits)
+	}
+
+	// torrents can't share where they write
+	twin := filepath.Join(dir, "twin.jpg")
+	ioutil.WriteFile(twin, []byte("another a.jpg"), 0644)
+	fs.Write(twin+".torrent", fs.GetMetadata(twin, tracker.URL, "a.jpg"))
+	var twinAdded apiTorrent
+	status = apiRequest(t, "POST", api+"/torrents", APIToken,
+		addRequest{Torrent: torrentData(twin + ".torrent"), Paused: true}, &twinAdded)
+	if status != http.StatusCreated {
+		t.Fatalf("Expected another a.jpg to be added, got %d", status)
+	}
+	if twinCl, _ := s.Torrent(twinAdded.InfoHash); twinCl.outputPath != filepath.Join(dir, "a.jpg-"+twinAdded.InfoHash) {
+		t.Fatalf("Expected another a.jpg to get its own output, have %s", twinCl.outputPath)
+	}
+	fs.Write(twin+".torrent", fs.GetMetadata(twin, tracker.URL, "c.jpg"))
+	status = apiRequest(t, "POST", api+"/torrents", APIToken,
+		addRequest{Torrent: torrentData(twin + ".torrent"), Output: "a.jpg"}, nil)
+	if status != http.StatusConflict {
+		t.Fatalf("Expected an output another torrent has to conflict, got %d", status)
+	}
+	apiRequest(t, "DELETE", api+"/torrents/"+twinAdded.InfoHash, APIToken, nil, nil)
+
+	status = apiRequest(t, "DELETE", api+"/torrents/"+added.InfoHash+"?delete=true", APIToken, nil, nil)
+	if status != http.StatusNoContent {
+		t.Fatalf("Expected a.jpg to be removed, got %d", status)
+	}
+	if status = apiRequest(t, "GET", api+"/torrents/"+added.InfoHash, APIToken, nil, nil); status != http.StatusNotFound {
+		t.Fatalf("Expected a.jpg to be gone, got %d", status)
+	}
+	util.EndTest()
+}
+
+func TestAPIEvents(t *testing.T) {
+	util.StartTest("Testing subscribing to events over the control API...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	s, server, dir := makeAPI(t)
+	defer os.RemoveAll(dir)
+	defer s.Close(context.Background())
+	defer server.Close()
+	a := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "a.jpg"), MalformedSeedFile)
+	awaitState(t, a, StateSeeding)
+
+	resp, err := http.Get(server.URL + "/api/events?token=" + APIToken)
+	if err != nil {
+		t.Fatalf("Couldn't subscribe to events: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+	events := bufio.NewReader(resp.Body)
+	if event := expectEvent(t, events, "added"); event.InfoHash != a.InfoHash() || event.State != StateSeeding {
+		t.Fatalf("Expected a.jpg to be there already, got %+v", event)
+	}
+
+	a.Pause()
+	if event := expectEvent(t, events, "state"); event.InfoHash != a.InfoHash() || event.State != StatePaused {
+		t.Fatalf("Expected a.jpg to be paused, got %+v", event)
+	}
+	b := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "b.jpg"), MalformedSeedFile)
+	if event := expectEvent(t, events, "added"); event.InfoHash != b.InfoHash() {
+		t.Fatalf("Expected b.jpg to be added, got %+v", event)
+	}
+	s.RemoveTorrent(a.InfoHash(), false)
+	if event := expectEvent(t, events, "removed"); event.InfoHash != a.InfoHash() {
+		t.Fatalf("Expected a.jpg to be removed, got %+v", event)
+	}
+	util.EndTest()
+}
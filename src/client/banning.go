@@ -0,0 +1,211 @@
+package btclient
+
+import (
+	"btnet"
+	"crypto/sha1"
+	"fs"
+	"net"
+	"sort"
+	"util"
+)
+
+// peers are banned by ip once they've sent this many bad pieces
+const MaxBadPieces int = 2
+
+// goes at downloading a failed piece from one peer before giving up on
+// finding out who sent bad data
+const MaxPinnedTries int = 5
+
+// a block of a piece that failed the hash check, kept until the piece is
+// downloaded correctly so we can tell who sent bad data
+type suspectBlock struct {
+	ip   string
+	hash [20]byte
+}
+
+// peers are banned by ip, since a new peer id is free
+func ipOf(peer *btnet.Peer) string {
+	if addr, err := tcpAddrOf(peer.Conn.RemoteAddr()); err == nil {
+		return addr.IP.String()
+	}
+	return peer.GetAddr().IP.String()
+}
+
+// the bytes of block in piece, must hold lock
+func (cl *BTClient) blockData(piece int, block int) []byte {
+	begin := block * fs.BlockSize
+	return cl.Pieces[piece].Data[begin : begin+cl.blockLength(piece, block)]
+}
+
+// remember that ip sent the bytes [begin, end) of piece, must hold lock
+func (cl *BTClient) attribute(piece int, begin int, end int, ip string) {
+	if _, ok := cl.senders[piece]; !ok {
+		cl.senders[piece] = make(map[int]string)
+	}
+	for block := begin / fs.BlockSize; block*fs.BlockSize < end; block++ {
+		cl.senders[piece][block] = ip
+	}
+}
+
+// Called with the lock held when piece fails the hash check. If a single
+// peer sent all of it, it's to blame. Otherwise remember what everyone
+// sent and download the piece again from just one of them, so we can
+// compare once it's right.
+func (cl *BTClient) pieceFailed(piece int) {
+	ips := []string{}
+	seen := make(map[string]bool)
+	for _, ip := range cl.senders[piece] {
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 1 {
+		cl.addBadPiece(ips[0])
+		cl.unpin(piece)
+	} else if len(ips) > 1 {
+		suspects := make(map[int]suspectBlock)
+		for block, ip := range cl.senders[piece] {
+			suspects[block] = suspectBlock{ip, sha1.Sum(cl.blockData(piece, block))}
+		}
+		cl.suspects[piece] = suspects
+		// the least suspicious sender is the most likely to get it right
+		sort.Slice(ips, func(i, j int) bool {
+			if cl.badPieces[ips[i]] != cl.badPieces[ips[j]] {
+				return cl.badPieces[ips[i]] < cl.badPieces[ips[j]]
+			}
+			return ips[i] < ips[j]
+		})
+		cl.pinned[piece] = ips[0]
+		util.WPrintf("%s: piece %d failed, downloading it again from %s\n", cl.port, piece, ips[0])
+	}
+	delete(cl.senders, piece)
+	delete(cl.received, piece)
+	cl.loseRequests()
+}
+
+// Called with the lock held when piece passes the hash check. Anyone who
+// sent a block that differs from the verified one sent bad data.
+func (cl *BTClient) piecePassed(piece int) {
+	culprits := make(map[string]bool)
+	for block, suspect := range cl.suspects[piece] {
+		if suspect.hash != sha1.Sum(cl.blockData(piece, block)) {
+			culprits[suspect.ip] = true
+		}
+	}
+	for ip := range culprits {
+		cl.addBadPiece(ip)
+	}
+	delete(cl.suspects, piece)
+	delete(cl.senders, piece)
+	cl.unpin(piece)
+	delete(cl.received, piece)
+}
+
+// count a bad piece against ip, banning it if it's had enough, must hold lock
+func (cl *BTClient) addBadPiece(ip string) {
+	cl.badPieces[ip]++
+	util.WPrintf("%s: %s sent bad data (%d pieces)\n", cl.port, ip, cl.badPieces[ip])
+	if cl.badPieces[ip] < MaxBadPieces || cl.banned[ip] {
+		return
+	}
+	util.WPrintf("%s: banning %s\n", cl.port, ip)
+	cl.banned[ip] = true
+	for _, peer := range cl.peers {
+		if ipOf(peer) == ip {
+			peer.Conn.Close()
+		}
+	}
+}
+
+func (cl *BTClient) atomicIsBanned(ip string) bool {
+	cl.lock("banning/atomicIsBanned")
+	defer cl.unlock("banning/atomicIsBanned")
+	return cl.banned[ip]
+}
+
+// returns the sorted list of banned ips, must hold lock
+func (cl *BTClient) bannedIps() []string {
+	ips := []string{}
+	for ip := range cl.banned {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// returns true unless ip is blocklisted or banned
+func (cl *BTClient) allowedIP(ip net.IP) bool {
+	return !cl.blocklist.Contains(ip) && !cl.atomicIsBanned(ip.String())
+}
+
+// returns false for addresses we can't make out, too
+func (cl *BTClient) allowedAddr(addr net.Addr) bool {
+	tcpAddr, err := tcpAddrOf(addr)
+	return err == nil && cl.allowedIP(tcpAddr.IP)
+}
+
+// rereads the blocklist whenever its file changes, dropping peers it now blocks
+func (cl *BTClient) watchBlocklist() {
+	for cl.wait(BlocklistInterval) {
+		changed, err := cl.blocklist.Reload()
+		if err != nil {
+			util.WPrintf("%s: could not reread blocklist: %s\n", cl.port, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		util.IPrintf("%s: blocklist now has %d ranges\n", cl.port, cl.blocklist.Len())
+		cl.atomicDropBlocked()
+	}
+}
+
+// hangs up on peers the blocklist blocks
+func (cl *BTClient) atomicDropBlocked() {
+	cl.lock("banning/atomicDropBlocked")
+	defer cl.unlock("banning/atomicDropBlocked")
+	for _, peer := range cl.peers {
+		if cl.blocklist.Contains(net.ParseIP(ipOf(peer))) {
+			peer.Conn.Close()
+		}
+	}
+}
+
+// returns the ip piece is being downloaded from while we look for
+// whoever sent bad data, or "" if any peer will do
+func (cl *BTClient) atomicGetPinned(piece int) string {
+	cl.lock("banning/atomicGetPinned")
+	defer cl.unlock("banning/atomicGetPinned")
+	return cl.pinned[piece]
+}
+
+func (cl *BTClient) atomicUnpin(piece int) {
+	cl.lock("banning/atomicUnpin")
+	defer cl.unlock("banning/atomicUnpin")
+	cl.unpin(piece)
+}
+
+// must hold lock
+func (cl *BTClient) unpin(piece int) {
+	delete(cl.pinned, piece)
+	delete(cl.pinnedTries, piece)
+}
+
+// Counts another go at downloading piece from the peer it's pinned to.
+// The peer may keep choking us or not have the piece, so after
+// MaxPinnedTries any peer will do, and with nothing to compare against
+// the suspects are let off.
+func (cl *BTClient) atomicTryPinned(piece int) {
+	cl.lock("banning/atomicTryPinned")
+	defer cl.unlock("banning/atomicTryPinned")
+	if _, ok := cl.pinned[piece]; !ok {
+		return
+	}
+	cl.pinnedTries[piece]++
+	if cl.pinnedTries[piece] > MaxPinnedTries {
+		util.WPrintf("%s: giving up downloading piece %d from %s\n", cl.port, piece, cl.pinned[piece])
+		cl.unpin(piece)
+		delete(cl.suspects, piece)
+	}
+}
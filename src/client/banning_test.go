@@ -0,0 +1,230 @@
+package btclient
+
+import (
+	"btnet"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+func sendPieceData(conn net.Conn, index int, begin int, data []byte) {
+	msg := btnet.PeerMessage{Type: btnet.Piece, Index: int32(index), Begin: begin, Block: data}
+	conn.Write(btnet.EncodePeerMessage(msg))
+}
+
+func corrupt(data []byte) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	result[len(result)/2] ^= 0xff
+	return result
+}
+
+func (cl *BTClient) atomicGetBadPieces(ip string) int {
+	cl.lock("client/atomicGetBadPieces")
+	defer cl.unlock("client/atomicGetBadPieces")
+	return cl.badPieces[ip]
+}
+
+// Tests
+func TestBanSingleBadSender(t *testing.T) {
+	util.StartTest("Testing banning a peer that sends whole bad pieces...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLeecherOnPipes(network, "/tmp/persister/tbansingle.p")
+	defer cl.Kill()
+	util.Wait(100)
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+	pieceLen := cl.pieceLength(0)
+
+	conn := connectFrom(t, cl, network, "10.0.0.2", makePeerId(400))
+	if conn == nil {
+		t.Fatalf("Client refused a well behaved peer")
+	}
+	defer conn.Close()
+	for i := 0; i < MaxBadPieces-1; i++ {
+		sendPieceData(conn, 0, 0, corrupt(seed[:pieceLen]))
+	}
+	util.Wait(100)
+	if bad := cl.atomicGetBadPieces("10.0.0.2"); bad != MaxBadPieces-1 || cl.atomicIsBanned("10.0.0.2") {
+		t.Fatalf("Expected %d bad pieces and no ban, got %d", MaxBadPieces-1, bad)
+	}
+
+	sendPieceData(conn, 1, 0, corrupt(seed[pieceLen:]))
+	expectDisconnect(t, cl, conn, "banned peer")
+	if !cl.atomicIsBanned("10.0.0.2") {
+		t.Fatalf("Peer should be banned after %d bad pieces", MaxBadPieces)
+	}
+	if status, _ := cl.GetStatusString(); !strings.Contains(status, "Banned peers: 10.0.0.2\n") {
+		t.Fatalf("Ban missing from status %q", status)
+	}
+	if again := connectFrom(t, cl, network, "10.0.0.2", makePeerId(401)); again != nil {
+		again.Close()
+		t.Fatalf("Client accepted a banned ip under a new peer id")
+	}
+	if other := connectFrom(t, cl, network, "10.0.0.3", makePeerId(402)); other == nil {
+		t.Fatalf("Client refused a peer from another ip")
+	} else {
+		other.Close()
+	}
+	util.EndTest()
+}
+
+func TestFindBadSenderAmongMany(t *testing.T) {
+	util.StartTest("Testing finding who sent a bad block by downloading again...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLeecherOnPipes(network, "/tmp/persister/tbanmany.p")
+	defer cl.Kill()
+	util.Wait(100)
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+
+	good := connectFrom(t, cl, network, "10.0.0.2", makePeerId(500))
+	bad := connectFrom(t, cl, network, "10.0.0.3", makePeerId(501))
+	if good == nil || bad == nil {
+		t.Fatalf("Client refused a well behaved peer")
+	}
+	defer good.Close()
+	defer bad.Close()
+	firstLen := cl.blockLength(0, 0)
+	secondLen := cl.blockLength(0, 1)
+
+	sendPieceData(good, 0, 0, seed[:firstLen])
+	util.Wait(50)
+	sendPieceData(bad, 0, firstLen, corrupt(seed[firstLen:firstLen+secondLen]))
+	util.Wait(100)
+	if cl.atomicGetBitmapElement(0) || cl.atomicGetBadPieces("10.0.0.2") != 0 || cl.atomicGetBadPieces("10.0.0.3") != 0 {
+		t.Fatalf("Nobody can be blamed yet for a piece with two senders")
+	}
+	if pinned := cl.atomicGetPinned(0); pinned != "10.0.0.2" {
+		t.Fatalf("Expected piece to be downloaded again from 10.0.0.2, got %q", pinned)
+	}
+
+	// only the pinned peer's data counts until the piece is right
+	sendPieceData(bad, 0, 0, corrupt(seed[:firstLen]))
+	sendPieceData(good, 0, 0, seed[:firstLen+secondLen])
+	util.Wait(100)
+	if !cl.atomicGetBitmapElement(0) {
+		t.Fatalf("Piece should pass once downloaded from one good peer")
+	}
+	if cl.atomicGetBadPieces("10.0.0.3") != 1 || cl.atomicGetBadPieces("10.0.0.2") != 0 {
+		t.Fatalf("Expected the second sender to be blamed, have %d and %d",
+			cl.atomicGetBadPieces("10.0.0.2"), cl.atomicGetBadPieces("10.0.0.3"))
+	}
+	if cl.atomicGetPinned(0) != "" {
+		t.Fatalf("Piece should be unpinned once it passes")
+	}
+	util.EndTest()
+}
+
+func TestGiveUpOnPinnedPeer(t *testing.T) {
+	util.StartTest("Testing giving up on a pinned peer that won't send the piece...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLeecherOnPipes(network, "/tmp/persister/tbanpinned.p")
+	defer cl.Kill()
+	util.Wait(100)
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+
+	// the pinned peer stays connected but keeps choking us
+	pinned := connectFrom(t, cl, network, "10.0.0.2", makePeerId(510))
+	other := connectFrom(t, cl, network, "10.0.0.3", makePeerId(511))
+	if pinned == nil || other == nil {
+		t.Fatalf("Client refused a well behaved peer")
+	}
+	defer pinned.Close()
+	defer other.Close()
+	firstLen := cl.blockLength(0, 0)
+	secondLen := cl.blockLength(0, 1)
+	sendPieceData(pinned, 0, 0, seed[:firstLen])
+	util.Wait(50)
+	sendPieceData(other, 0, firstLen, corrupt(seed[firstLen:firstLen+secondLen]))
+	util.Wait(100)
+	if got := cl.atomicGetPinned(0); got != "10.0.0.2" {
+		t.Fatalf("Expected piece to be downloaded again from 10.0.0.2, got %q", got)
+	}
+	for _, conn := range []net.Conn{pinned, other} {
+		conn.Write(btnet.EncodePeerMessage(btnet.PeerMessage{Type: btnet.Have, Index: 0}))
+	}
+	pinned.Write(btnet.EncodePeerMessage(btnet.PeerMessage{Type: btnet.Choke}))
+
+	for i := 0; i < 100 && cl.atomicGetPinned(0) != ""; i++ {
+		util.Wait(100)
+	}
+	if cl.atomicGetPinned(0) != "" {
+		t.Fatalf("Expected to give up on 10.0.0.2 after %d tries", MaxPinnedTries)
+	}
+	sendPieceData(other, 0, 0, seed[:firstLen+secondLen])
+	util.Wait(100)
+	if !cl.atomicGetBitmapElement(0) {
+		t.Fatalf("Piece should be downloaded from anyone once unpinned")
+	}
+	if cl.atomicGetBadPieces("10.0.0.2") != 0 || cl.atomicGetBadPieces("10.0.0.3") != 0 {
+		t.Fatalf("Nobody should be blamed once the suspects are let off")
+	}
+	util.EndTest()
+}
+
+func TestBlocklist(t *testing.T) {
+	util.StartTest("Testing refusing blocklisted peers...")
+	file, _ := ioutil.TempFile("", "blocklist")
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+	ioutil.WriteFile(path, []byte("Blocked:10.0.0.3-10.0.0.3\n"), 0644)
+
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	config.BlocklistPath = path
+	cl := makeLeecherWithConfig("/tmp/persister/tblocklist.p", config)
+	defer cl.Kill()
+	util.Wait(100)
+
+	if conn := connectFrom(t, cl, network, "10.0.0.3", makePeerId(600)); conn != nil {
+		conn.Close()
+		t.Fatalf("Client accepted a blocklisted peer")
+	}
+	allowed := connectFrom(t, cl, network, "10.0.0.2", makePeerId(601))
+	if allowed == nil {
+		t.Fatalf("Client refused a peer that isn't blocklisted")
+	}
+	defer allowed.Close()
+
+	// we shouldn't dial blocked peers either
+	ln, _ := network.Listen("10.0.0.3:6881")
+	defer ln.Close()
+	dialed := make(chan bool, 1)
+	go func() {
+		if _, err := ln.Accept(); err == nil {
+			dialed <- true
+		}
+	}()
+	blockedAddr, _ := net.ResolveTCPAddr("tcp", "10.0.0.3:6881")
+	cl.SetupPeerConnections(blockedAddr, nil)
+	select {
+	case <-dialed:
+		t.Fatalf("Client dialed a blocklisted peer")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// connected peers are dropped once the list changes to block them
+	ioutil.WriteFile(path, []byte("10.0.0.0/24\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	allowed.SetReadDeadline(time.Now().Add(time.Duration(3*BlocklistInterval) * time.Millisecond))
+	for {
+		if _, err := btnet.ReadMessage(allowed); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				t.Fatalf("Client kept a peer after blocklisting it")
+			}
+			break
+		}
+	}
+	if conn := connectFrom(t, cl, network, "10.0.0.2", makePeerId(602)); conn != nil {
+		conn.Close()
+		t.Fatalf("Client accepted a peer after blocklisting it")
+	}
+	util.EndTest()
+}
@@ -2,21 +2,33 @@ package btclient
 
 import (
 	"btnet"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"fs"
 	"math/rand"
+	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"util"
 )
 
 // TODO: pruning client's peer list when tracker says that peer is down
-// TODO: kill underlying TCP connections when client is killed
 
 const NumDownloaders int = 5
 const NumUpdates int = 8
 
+// peers are refused once they break the protocol this many times
+const MaxPeerStrikes int = 3
+
+// milliseconds between checks for changes to the blocklist
+const BlocklistInterval int = 1000
+
+// milliseconds between checks of the alternate speed schedule
+const ScheduleInterval int = 1000
+
 type status string
 
 const (
@@ -27,10 +39,24 @@ const (
 
 type BTClient struct {
 	mu        sync.Mutex
+	config    Config
+	dialer    *btnet.Dialer
 	persister *Persister
-	alive     bool
+	session   *Session // nil if the client listens for itself
 	updates   []string
 
+	ctx       context.Context // done once the client is told to shut down
+	cancel    context.CancelFunc
+	run       context.Context // done once the client is paused or told to shut down
+	pauseRun  context.CancelFunc
+	paused    bool
+	queued    bool           // paused by the session's queue rather than by hand
+	control   sync.Mutex     // held while pausing or resuming
+	stopping  bool           // listeners and peers have been closed
+	wg        sync.WaitGroup // every goroutine but finish
+	stopped   chan struct{}  // closed once shutdown is complete
+	listeners []net.Listener
+
 	ip          string
 	port        string
 	peerId      string
@@ -42,21 +68,103 @@ type BTClient struct {
 	heartbeatInterval int // number of seconds
 	status            status
 
-	numPieces    int
-	blockBitmap  map[int][]bool
-	neededPieces chan int
-	Pieces       []fs.Piece
-	PieceBitmap  []bool
+	numPieces   int
+	received    map[int]fs.Extents    // bytes received of pieces in progress
+	pickOrder   []int                 // pieces in the order to try them, within a priority
+	picking     map[int]int           // downloaders working on each piece
+	deadlines   map[int]time.Time     // pieces wanted by a certain time
+	held        map[int]*deadlineHold // deadlines readers rely on
+	Pieces      []fs.Piece
+	PieceBitmap []bool
+	pieceDone   []chan struct{} // closed once each piece is verified
+	numDone     int
+
+	filePriorities []Priority
+	piecePriority  []Priority    // of the most wanted file each piece overlaps
+	wantedLeft     int           // pieces of wanted files we don't have yet
+	complete       chan struct{} // closed while every wanted piece is verified
+	filesChanged   chan struct{} // closed and replaced when file priorities change
+	workChanged    chan struct{} // closed and replaced when there may be more to pick
+	requestsLost   chan struct{} // closed and replaced when requests may go unanswered
+	written        []bool        // files written out to outputPath
+
+	peers       map[string]*btnet.Peer  // map from peer id to Peer
+	listenAddrs map[string]*net.TCPAddr // map from peer id to where it listens
+	strikes     map[string]int          // protocol violations by peer id
+	peerRates   map[string]*peerRate    // bytes received by peer id
+
+	senders     map[int]map[int]string       // piece -> block -> ip that sent it
+	suspects    map[int]map[int]suspectBlock // blocks of pieces that failed the hash check
+	pinned      map[int]string               // piece -> ip it's being downloaded again from
+	pinnedTries map[int]int                  // goes at downloading pinned pieces
+	badPieces   map[string]int               // pieces that failed because of ip
+	banned      map[string]bool
+	blocklist   *btnet.Blocklist // nil if there isn't one
+
+	dialQueue   dialQueue                 // peers waiting to be dialed, best first
+	queuedDials map[string]*dialCandidate // by peer id
+	dialing     int                       // dials in progress
+	dialWake    chan bool                 // holds a value when there may be someone to dial
+	dialRecords map[string]*dialRecord    // by peer id
+
+	upload    *btnet.RateLimiter
+	download  *btnet.RateLimiter
+	altSpeed  bool // using the alternate limits
+	scheduled bool // whether the schedule said to when we last looked
+
+	uploaded    int64         // bytes of blocks sent
+	downloaded  int64         // bytes of blocks received
+	seedTime    time.Duration // spent seeding while running
+	ownGoals    bool          // seed goals were set for this torrent rather than its session
+	goalReached bool          // a seed goal has been acted on
 
-	// This string is going to be the TCP addr
-	peers map[string]*btnet.Peer // map from IP to Peer
+	lastUploaded   int64   // uploaded when the rates were last measured
+	lastDownloaded int64   // downloaded then
+	uploadRate     float64 // bytes per second
+	downloadRate   float64
 }
 
 func StartBTClient(ip string, port int, metadataPath string, seedPath string, outputPath string, persister *Persister) *BTClient {
+	return StartBTClientWithConfig(ip, port, metadataPath, seedPath, outputPath, persister, DefaultConfig())
+}
+
+func StartBTClientWithConfig(ip string, port int, metadataPath string, seedPath string, outputPath string, persister *Persister, config Config) *BTClient {
+	return startBTClient(ip, port, metadataPath, seedPath, outputPath, persister, config, nil)
+}
+
+// starts a client, listening for connections itself unless it's one of
+// session's torrents, which wait for the session's queue to resume them
+func startBTClient(ip string, port int, metadataPath string, seedPath string, outputPath string, persister *Persister, config Config, session *Session) *BTClient {
 
 	cl := &BTClient{}
+	cl.config = config
+	cl.session = session
+	if len(cl.config.Networks) == 0 {
+		cl.config.Networks = []btnet.Network{&btnet.TCPNetwork{}}
+	}
+	if cl.config.MaxPeers <= 0 {
+		cl.config.MaxPeers = DefaultMaxPeers
+	}
+	if cl.config.Connections == nil {
+		cl.config.Connections = NewConnManager(DefaultMaxConns, DefaultMaxHalfOpen)
+	}
+	if cl.config.Clock == nil {
+		cl.config.Clock = time.Now
+	}
+	cl.dialer = &btnet.Dialer{Encryption: config.Encryption, Networks: cl.config.Networks, Timeout: DialTimeout}
 	cl.persister = persister
-	cl.alive = true
+	parent := config.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	cl.ctx, cl.cancel = context.WithCancel(parent)
+	cl.run, cl.pauseRun = context.WithCancel(cl.ctx)
+	if session != nil {
+		cl.paused = true
+		cl.queued = true
+		cl.pauseRun()
+	}
+	cl.stopped = make(chan struct{})
 	cl.updates = make([]string, NumUpdates, NumUpdates)
 
 	cl.ip = ip
@@ -71,16 +179,57 @@ func StartBTClient(ip string, port int, metadataPath string, seedPath string, ou
 	cl.status = Started
 
 	cl.numPieces = len(cl.torrentMeta.PieceHashes)
-	cl.blockBitmap = make(map[int][]bool)
-	cl.neededPieces = make(chan int, 100)
+	cl.received = make(map[int]fs.Extents)
+	cl.pickOrder = rand.Perm(cl.numPieces)
+	cl.picking = make(map[int]int)
+	cl.deadlines = make(map[int]time.Time)
+	cl.held = make(map[int]*deadlineHold)
 	cl.Pieces = make([]fs.Piece, cl.numPieces, cl.numPieces)
 	for i := range cl.Pieces {
 		piece := &cl.Pieces[i]
-		piece.Blocks = make([]fs.Block, cl.numBlocks(i), cl.numBlocks(i))
+		piece.Data = make([]byte, cl.pieceLength(i), cl.pieceLength(i))
 	}
 	cl.PieceBitmap = make([]bool, cl.numPieces, cl.numPieces)
+	cl.pieceDone = make([]chan struct{}, cl.numPieces)
+	for i := range cl.pieceDone {
+		cl.pieceDone[i] = make(chan struct{})
+	}
+	cl.filePriorities = make([]Priority, len(cl.torrentMeta.Files))
+	for i := range cl.filePriorities {
+		cl.filePriorities[i] = PriorityNormal
+	}
+	cl.complete = make(chan struct{})
+	cl.filesChanged = make(chan struct{})
+	cl.workChanged = make(chan struct{})
+	cl.requestsLost = make(chan struct{})
+	cl.written = make([]bool, len(cl.torrentMeta.Files))
+	cl.updatePiecePriorities()
 
 	cl.peers = make(map[string]*btnet.Peer)
+	cl.listenAddrs = make(map[string]*net.TCPAddr)
+	cl.strikes = make(map[string]int)
+	cl.peerRates = make(map[string]*peerRate)
+
+	cl.senders = make(map[int]map[int]string)
+	cl.suspects = make(map[int]map[int]suspectBlock)
+	cl.pinned = make(map[int]string)
+	cl.pinnedTries = make(map[int]int)
+	cl.badPieces = make(map[string]int)
+	cl.banned = make(map[string]bool)
+	cl.upload = btnet.NewRateLimiter(config.UploadRate)
+	cl.download = btnet.NewRateLimiter(config.DownloadRate)
+	cl.atomicCheckSchedule()
+	cl.queuedDials = make(map[string]*dialCandidate)
+	cl.dialWake = make(chan bool, 1)
+	cl.dialRecords = make(map[string]*dialRecord)
+	if session != nil {
+		cl.blocklist = session.blocklist // the session reads and watches it
+	} else if config.BlocklistPath != "" {
+		cl.blocklist = btnet.NewBlocklist(config.BlocklistPath)
+		if _, err := cl.blocklist.Reload(); err != nil {
+			util.WPrintf("%s: could not read blocklist: %s\n", cl.port, err)
+		}
+	}
 
 	cl.loadPieces(persister.ReadState())
 
@@ -89,101 +238,205 @@ func StartBTClient(ip string, port int, metadataPath string, seedPath string, ou
 	if seedPath != "" {
 		cl.Seed(seedPath)
 	}
-	go cl.main()
+	go cl.finish()
+	cl.spawn(cl.main)
 
 	return cl
 }
 
-// sends shutdown message
+// shuts down and waits until it's done
 func (cl *BTClient) Kill() {
-	cl.lock("killing")
-	cl.alive = false
-	cl.unlock("killing")
+	cl.Close(context.Background())
 }
 
-// returns true if the client has been ordered to shut down
+// Stops accepting connections and hangs up on every peer, then saves
+// progress and tells the tracker we've stopped. Returns once every
+// goroutine has exited, or with ctx's error if ctx is done first, in
+// which case shutdown carries on without us.
+func (cl *BTClient) Close(ctx context.Context) error {
+	cl.stop()
+	select {
+	case <-cl.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// closed once the client has shut down, however it was told to
+func (cl *BTClient) Stopped() <-chan struct{} {
+	return cl.stopped
+}
+
+// closed once every piece of the wanted files has been downloaded and
+// verified, until more files are wanted
+func (cl *BTClient) Completed() <-chan struct{} {
+	cl.lock("client/Completed")
+	defer cl.unlock("client/Completed")
+	return cl.complete
+}
+
+// tells everything to shut down without waiting for it
+func (cl *BTClient) stop() {
+	cl.lock("client/stop")
+	defer cl.unlock("client/stop")
+	if cl.stopping {
+		return
+	}
+	cl.stopping = true
+	cl.publish("state")
+	cl.cancel()
+	for _, ln := range cl.listeners {
+		ln.Close()
+	}
+	for _, peer := range cl.peers {
+		peer.Close()
+	}
+}
+
+// waits for shutdown and every goroutine to exit, then saves progress
+// and tells the tracker we've stopped
+func (cl *BTClient) finish() {
+	<-cl.ctx.Done()
+	cl.stop() // in case it was config.Context that was cancelled
+	cl.wg.Wait()
+	cl.lock("client/finish")
+	pieces := make([]fs.Piece, len(cl.Pieces))
+	copy(pieces, cl.Pieces)
+	pieceBitmap := make([]bool, len(cl.PieceBitmap))
+	copy(pieceBitmap, cl.PieceBitmap)
+	paused := cl.paused
+	cl.unlock("client/finish")
+	cl.persister.persistPieces(pieces, pieceBitmap)
+	if !paused { // pausing told the tracker already
+		cl.announceStopped()
+	}
+	util.IPrintf("%s: shut down\n", cl.port)
+	close(cl.stopped)
+}
+
+// runs f in a goroutine that pausing and shutdown wait for, unless we're
+// already paused or shutting down
+func (cl *BTClient) spawn(f func()) {
+	cl.lock("client/spawn")
+	defer cl.unlock("client/spawn")
+	if cl.run.Err() != nil {
+		return
+	}
+	cl.wg.Add(1)
+	go func() {
+		defer cl.wg.Done()
+		f()
+	}()
+}
+
+// returns true if the client has been paused or ordered to shut down
 func (cl *BTClient) CheckShutdown() bool {
-	cl.lock("checking shutdown")
-	defer cl.unlock("checking shutdown")
-	return !cl.alive
+	cl.lock("client/CheckShutdown")
+	defer cl.unlock("client/CheckShutdown")
+	return cl.run.Err() != nil
+}
+
+// waits for ms milliseconds, returns false if we're paused or shut down first
+func (cl *BTClient) wait(ms int) bool {
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		return true
+	case <-cl.run.Done():
+		return false
+	}
 }
 
-// returns true if file download is done
+// the torrent's name
+func (cl *BTClient) Name() string {
+	return cl.torrentMeta.Name
+}
+
+// the torrent's info hash in hex
+func (cl *BTClient) InfoHash() string {
+	return hex.EncodeToString([]byte(cl.infoHash))
+}
+
+// returns true if every wanted file is downloaded, writing out any that
+// haven't been yet
 func (cl *BTClient) CheckDone() bool {
 	cl.lock("checking done")
-	if util.AllTrue(cl.PieceBitmap) { // if done, save piece
-		if cl.status != Completed {
-			pieces := make([]fs.Piece, len(cl.Pieces))
-			copy(pieces, cl.Pieces)
-			cl.status = Completed
-			util.IPrintf("%s: Done downloading, writing to %s\n", cl.port, cl.outputPath)
-			cl.unlock("checking done")
-			fs.CombinePieces(cl.outputPath, pieces, cl.torrentMeta.Files[0].Length)
-		} else {
-			cl.unlock("checking done")
+	if cl.wantedLeft > 0 {
+		cl.unlock("checking done")
+		return false
+	}
+	files := []int{}
+	for i, priority := range cl.filePriorities {
+		if priority != PrioritySkip && !cl.written[i] {
+			cl.written[i] = true
+			files = append(files, i)
 		}
-		return true
 	}
+	if cl.status != Completed {
+		cl.status = Completed
+		util.IPrintf("%s: Done downloading, writing to %s\n", cl.port, cl.outputPath)
+	}
+	pieces := make([]fs.Piece, len(cl.Pieces))
+	copy(pieces, cl.Pieces)
 	cl.unlock("checking done")
-	return false
+	if cl.outputPath != "" {
+		for _, file := range files {
+			cl.writeFile(file, pieces)
+		}
+	}
+	return true
 }
 
-// check whether download is finished and combines and saves output if it's done
+// saves output whenever the wanted files are done
 func (cl *BTClient) CheckSaveOutput() {
 	for {
-		if cl.CheckShutdown() {
-			return
-		}
-		if cl.CheckDone() {
+		cl.lock("client/CheckSaveOutput")
+		complete, changed := cl.complete, cl.filesChanged
+		cl.unlock("client/CheckSaveOutput")
+		select {
+		case <-complete:
+			cl.CheckDone()
+			select {
+			case <-changed: // there may be more to write
+			case <-cl.run.Done():
+				return
+			}
+		case <-changed:
+		case <-cl.run.Done():
 			return
 		}
-		util.Wait(100)
 	}
 }
 
 func (cl *BTClient) main() {
 	rand.Seed(time.Now().UnixNano())
-	go cl.trackerHeartbeat() // start sending heartbeats to tracker
-	go cl.startTCPServer()   // start TCP server for communicating with peers
-
-	go func() { // adding the initially needed pieces to the needed queue
-		for _, i := range rand.Perm(cl.numPieces) {
-			if !cl.atomicGetBitmapElement(i) {
-				cl.neededPieces <- i
-			}
-		}
-	}()
-
-	for i := 0; i < NumDownloaders; i++ {
-		go cl.downloadPieces()
+	if cl.session == nil {
+		cl.startServers() // listen before dialing anyone, so uTP can dial from the same port
 	}
-
-	if cl.outputPath != "" {
-		go cl.CheckSaveOutput()
+	cl.spawn(cl.trackerHeartbeat) // start sending heartbeats to tracker
+	cl.spawn(cl.dialPeers)
+	if cl.blocklist != nil && cl.session == nil {
+		cl.spawn(cl.watchBlocklist)
+	}
+	if cl.config.AltSchedule != nil {
+		cl.spawn(cl.watchSchedule)
 	}
+	cl.spawn(cl.watchGoals)
+	cl.spawn(cl.measureRates)
 
-	for {
-		if cl.CheckShutdown() {
-			return
-		}
-		util.Wait(100)
+	cl.spawn(cl.downloadWanted)
+
+	if cl.outputPath != "" {
+		cl.spawn(cl.CheckSaveOutput)
 	}
 }
 
 func (cl *BTClient) GetStatusString() (string, int) {
-	// Here we are dividing by two because of the way the code is
-	// currently structured.
-	// tl;dr: we dont want to repeat a large chunks of code, so
-	// we have a single message handler and peer list for incoming
-	// and outgoing messages. Because when dialing a TCP connection
-	// opens a new port and binds it to the target peer's listen port,
-	// we have two ports for every known peer, the port the peer is
-	// listening on and a port that we can use to respond to a requesting
-	// peers messages.
-	// TODO: Split up the listen messageHandler and the request->response
-	//       messageHandler
 	cl.lock("status string")
-	numPeers := len(cl.peers) / 2
+	numPeers := len(cl.peers)
+	state := cl.state()
+	stats := cl.stats()
+	banned := cl.bannedIps()
 	update := ""
 	for _, s := range cl.updates {
 		update += s + "\n"
@@ -191,9 +444,17 @@ func (cl *BTClient) GetStatusString() (string, int) {
 	extraLines := len(cl.updates)
 	cl.unlock("status string")
 	output := fmt.Sprintf("Known peers: %d\n", numPeers)
+	if len(banned) == 0 {
+		output += "Banned peers: none\n"
+	} else {
+		output += "Banned peers: " + strings.Join(banned, ", ") + "\n"
+	}
+	output += fmt.Sprintf("State: %s\n", state)
+	output += fmt.Sprintf("Uploaded: %d bytes, downloaded: %d bytes, ratio: %.2f\n",
+		stats.Uploaded, stats.Downloaded, stats.Ratio)
 	output += "Download status: "
 	bitfield, lines := util.BitfieldToString(cl.PieceBitmap, 40)
 	output += bitfield + "\n--------\n"
 	output += update
-	return output, lines + 3 + extraLines
+	return output, lines + 6 + extraLines
 }
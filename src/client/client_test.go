@@ -3,6 +3,7 @@ package btclient
 import (
 	"btnet"
 	"net"
+	"strings"
 	"testing"
 	"time"
 	"util"
@@ -20,6 +21,26 @@ func makeTestClient(port int) *BTClient {
 	return StartBTClient("localhost", port, TestFile, "", "", persister)
 }
 
+func makeTestHandshake(cl *BTClient) btnet.Handshake {
+	return btnet.Handshake{
+		Pstr:     "BitTorrent protocol",
+		InfoHash: []byte(cl.infoHash),
+		PeerId: []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19,
+			0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}}
+}
+
+// the client should answer our handshake with its own
+func expectHandshake(t *testing.T, cl *BTClient, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := btnet.ReadHandshake(conn)
+	conn.SetReadDeadline(time.Time{})
+	reply := btnet.DecodeHandshake(data)
+	if err != nil || string(reply.InfoHash) != cl.infoHash || string(reply.PeerId) != cl.peerId {
+		cl.Kill()
+		t.Fatalf("Expected handshake reply, got %v (%v)\n", reply, err)
+	}
+}
+
 // Tests
 func TestMakeClient(t *testing.T) {
 	util.StartTest("Testing basic starting and killing of client...")
@@ -46,12 +67,7 @@ func TestClientTCPServerNice(t *testing.T) {
 	}
 
 	// First send handshake
-	handshake := btnet.Handshake{
-		Pstr: "BitTorrent protocol",
-		InfoHash: []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09,
-			0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19},
-		PeerId: []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19,
-			0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}}
+	handshake := makeTestHandshake(cl)
 	data := btnet.EncodeHandshake(handshake)
 	// Sending KeepAlive
 	connection, err := btnet.DoDial(tcpAddr, data)
@@ -59,15 +75,20 @@ func TestClientTCPServerNice(t *testing.T) {
 		cl.Kill()
 		t.Fatalf("DoDial error: %s", err.Error())
 	}
+	expectHandshake(t, cl, connection)
 	util.Wait(100)
-	_, ok := cl.atomicGetPeer(connection.LocalAddr().String())
+	_, ok := cl.atomicGetPeer(string(handshake.PeerId))
 	if !ok {
 		cl.Kill()
 		t.Fatalf("A peer should be connected\n")
 	}
 
 	returnedData, err := btnet.ReadMessage(connection)
-	decodedMsg := btnet.DecodePeerMessage(returnedData, len(cl.torrentMeta.PieceHashes))
+	if err != nil {
+		cl.Kill()
+		t.Fatalf("ReadMessage error: %s", err.Error())
+	}
+	decodedMsg, err := btnet.DecodePeerMessage(returnedData, len(cl.torrentMeta.PieceHashes))
 	if err != nil || decodedMsg.Type != 5 {
 		cl.Kill()
 		t.Fatalf("Did not recieve bitfield message\n%v\n", decodedMsg)
@@ -78,7 +99,7 @@ func TestClientTCPServerNice(t *testing.T) {
 	data = btnet.EncodePeerMessage(msg)
 	connection.Write(data)
 	util.Wait(100)
-	_, ok = cl.atomicGetPeer(connection.LocalAddr().String())
+	_, ok = cl.atomicGetPeer(string(handshake.PeerId))
 	if !ok {
 		cl.Kill()
 		t.Fatalf("Client should be connected\n")
@@ -128,12 +149,7 @@ func TestClientTCPServer(t *testing.T) {
 
 	util.Wait(1000)
 	// First send handshake
-	handshake := btnet.Handshake{
-		Pstr: "BitTorrent protocol",
-		InfoHash: []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09,
-			0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19},
-		PeerId: []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19,
-			0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}}
+	handshake := makeTestHandshake(cl)
 	data := btnet.EncodeHandshake(handshake)
 	// Sending KeepAlive
 	connection, err = btnet.DoDial(tcpAddr, data)
@@ -141,8 +157,10 @@ func TestClientTCPServer(t *testing.T) {
 		cl.Kill()
 		t.Fatalf("DoDial error: %s", err.Error())
 	}
+	defer connection.Close()
+	expectHandshake(t, cl, connection)
 	util.Wait(100)
-	_, ok := cl.atomicGetPeer(connection.LocalAddr().String())
+	_, ok := cl.atomicGetPeer(string(handshake.PeerId))
 	if !ok {
 		cl.Kill()
 		t.Fatalf("A peer should be connected\n")
@@ -151,7 +169,7 @@ func TestClientTCPServer(t *testing.T) {
 	msg := btnet.PeerMessage{Type: btnet.Interested}
 	data = btnet.EncodePeerMessage(msg)
 	util.Wait(100)
-	_, ok = cl.atomicGetPeer(connection.LocalAddr().String())
+	_, ok = cl.atomicGetPeer(string(handshake.PeerId))
 	if !ok {
 		cl.Kill()
 		t.Fatalf("Client should be connected\n")
@@ -189,3 +207,136 @@ func TestTwoPeers(t *testing.T) {
 	second.Kill()
 	util.EndTest()
 }
+
+func TestClientRejectsBadHandshakes(t *testing.T) {
+	util.StartTest("Testing client rejecting bad handshakes...")
+	cl := makeTestClient(6671)
+	util.Wait(1000)
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", "localhost:6671")
+
+	wrongHash := makeTestHandshake(cl)
+	wrongHash.InfoHash = make([]byte, 20)
+	wrongProtocol := makeTestHandshake(cl)
+	wrongProtocol.Pstr = "BitTorrent protocoL"
+	self := makeTestHandshake(cl)
+	self.PeerId = []byte(cl.peerId)
+	for _, handshake := range []btnet.Handshake{wrongHash, wrongProtocol, self} {
+		connection, err := btnet.DoDial(tcpAddr, btnet.EncodeHandshake(handshake))
+		if err != nil {
+			cl.Kill()
+			t.Fatalf("DoDial error: %s", err.Error())
+		}
+		connection.SetReadDeadline(time.Now().Add(time.Second))
+		if data, err := btnet.ReadHandshake(connection); err == nil && len(data) > 0 {
+			cl.Kill()
+			t.Fatalf("Client should not answer handshake %v\n", handshake)
+		}
+		connection.Close()
+		if cl.atomicGetNumPeers() > 0 {
+			cl.Kill()
+			t.Fatalf("There should be no peers connected\n")
+		}
+	}
+
+	// a second connection from the same peer id gets dropped
+	data := btnet.EncodeHandshake(makeTestHandshake(cl))
+	first, err := btnet.DoDial(tcpAddr, data)
+	if err != nil {
+		cl.Kill()
+		t.Fatalf("DoDial error: %s", err.Error())
+	}
+	defer first.Close()
+	expectHandshake(t, cl, first)
+	util.Wait(100)
+	second, err := btnet.DoDial(tcpAddr, data)
+	if err != nil {
+		cl.Kill()
+		t.Fatalf("DoDial error: %s", err.Error())
+	}
+	defer second.Close()
+	util.Wait(100)
+	peer, ok := cl.atomicGetPeer(string(makeTestHandshake(cl).PeerId))
+	if !ok || peer.Conn.RemoteAddr().String() != first.LocalAddr().String() || cl.atomicGetNumPeers() != 1 {
+		cl.Kill()
+		t.Fatalf("Duplicate peer should be dropped\n")
+	}
+	cl.Kill()
+	util.EndTest()
+}
+
+func TestSimultaneousDial(t *testing.T) {
+	util.StartTest("Testing peers dialing each other at once...")
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{btnet.NewPipeNetwork()}
+	first := StartBTClientWithConfig("10.0.0.1", 6881, TestFile, "", "", MakePersister("/tmp/persister/tclient.p"), config)
+	second := StartBTClientWithConfig("10.0.0.2", 6881, TestFile, "", "", MakePersister("/tmp/persister/tclient2.p"), config)
+	defer first.Kill()
+	defer second.Kill()
+	util.Wait(100)
+	firstAddr, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:6881")
+	secondAddr, _ := net.ResolveTCPAddr("tcp", "10.0.0.2:6881")
+	go first.SetupPeerConnections(secondAddr, nil)
+	go second.SetupPeerConnections(firstAddr, nil)
+	util.Wait(500)
+
+	if first.atomicGetNumPeers() != 1 || second.atomicGetNumPeers() != 1 {
+		t.Fatalf("Expected one peer each, have %d and %d\n", first.atomicGetNumPeers(), second.atomicGetNumPeers())
+	}
+	toSecond, _ := first.atomicGetPeer(second.peerId)
+	toFirst, _ := second.atomicGetPeer(first.peerId)
+	if toSecond == nil || toFirst == nil {
+		t.Fatalf("Peers should be keyed by peer id\n")
+	}
+	if toSecond.Conn.LocalAddr().String() != toFirst.Conn.RemoteAddr().String() {
+		t.Fatalf("Peers kept different connections: %s and %s\n",
+			toSecond.Conn.LocalAddr(), toFirst.Conn.RemoteAddr())
+	}
+	if toSecond.GetAddr().String() != secondAddr.String() || toFirst.GetAddr().String() != firstAddr.String() {
+		t.Fatalf("Peers should know each other's listen address\n")
+	}
+	if status, _ := first.GetStatusString(); !strings.HasPrefix(status, "Known peers: 1\n") {
+		t.Fatalf("Unexpected status %q\n", status)
+	}
+	util.EndTest()
+}
+
+// an address that doesn't resolve
+type badAddr struct{}
+
+func (badAddr) Network() string { return "tcp" }
+func (badAddr) String() string  { return "not an address" }
+
+type badAddrConn struct {
+	net.Conn
+}
+
+func (badAddrConn) RemoteAddr() net.Addr { return badAddr{} }
+
+func TestUnresolvableAddress(t *testing.T) {
+	util.StartTest("Testing client dropping connections it can't find the address of...")
+	cl := makeSeederOnPipes(btnet.NewPipeNetwork())
+	defer cl.Kill()
+	if cl.allowedAddr(badAddr{}) {
+		t.Fatalf("An unresolvable address shouldn't be allowed")
+	}
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	cl.messageHandler(badAddrConn{ours})
+	closed := make(chan error, 1)
+	go func() {
+		_, err := theirs.Read(make([]byte, 1))
+		closed <- err
+	}()
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Fatalf("Expected the connection to be closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection to be closed")
+	}
+	if cl.atomicGetNumPeers() != 0 {
+		t.Fatalf("There should be no peers connected")
+	}
+	util.EndTest()
+}
@@ -0,0 +1,55 @@
+package btclient
+
+import (
+	"btnet"
+	"context"
+	"time"
+)
+
+// Tunable client settings
+type Config struct {
+	Context context.Context // the client shuts down once it's done, if set
+
+	Encryption btnet.EncryptionPolicy // message stream encryption policy for peer connections
+	Networks   []btnet.Network        // listened on and dialed in order, TCP if empty
+
+	// P2P, DAT or CIDR list of addresses to refuse, reread when it changes.
+	// A session reads it once for all its torrents.
+	BlocklistPath string
+
+	MaxPeers    int          // connections for this torrent
+	Connections *ConnManager // limits shared with other clients, the client's own if nil
+
+	// bytes per second for this torrent and for each of its peers, 0 for unlimited
+	UploadRate       int
+	DownloadRate     int
+	PeerUploadRate   int
+	PeerDownloadRate int
+
+	// used instead of the torrent's limits while AltSchedule says so, or
+	// when switched on by hand
+	AltUploadRate   int
+	AltDownloadRate int
+	AltSchedule     *SpeedSchedule // nil to only switch by hand
+
+	Clock func() time.Time // the time the schedule goes by, time.Now if nil
+
+	// torrents a session downloads and seeds at once, 0 for no limit, and
+	// how long a download can go without finishing a piece before it stops
+	// counting towards the limit, 0 for ever
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	StallTimeout       time.Duration
+
+	SeedGoals SeedGoals // when to stop seeding, a session's torrents share its goals
+
+	Sequential bool // pick pieces in order, for playing media while it downloads
+}
+
+// returns the settings used by StartBTClient
+func DefaultConfig() Config {
+	return Config{
+		Encryption: btnet.EncryptionPrefer,
+		Networks:   []btnet.Network{&btnet.TCPNetwork{}},
+		MaxPeers:   DefaultMaxPeers}
+}
@@ -0,0 +1,237 @@
+package btclient
+
+// Connection management
+// Each client has its own limit on peers, and clients sharing a
+// ConnManager share a global limit and a limit on dials in progress.
+// Peers we hear about wait in a dial queue, best first, until there's
+// room for them.
+
+import (
+	"btnet"
+	"container/heap"
+	"net"
+	"sync"
+	"time"
+	"util"
+)
+
+const DefaultMaxPeers int = 50
+const DefaultMaxConns int = 200
+const DefaultMaxHalfOpen int = 8
+
+// peers that haven't sent anything useful for this long may be dropped
+// to make room for new ones
+const MinEvictionIdle = time.Second * 10
+
+// Limits shared by every client given the same ConnManager
+type ConnManager struct {
+	mu       sync.Mutex
+	maxConns int
+	conns    int
+	halfOpen chan bool // holds a value for every dial in progress
+
+	Upload   *btnet.RateLimiter
+	Download *btnet.RateLimiter
+}
+
+func NewConnManager(maxConns int, maxHalfOpen int) *ConnManager {
+	m := &ConnManager{maxConns: maxConns, halfOpen: make(chan bool, maxHalfOpen)}
+	m.Upload = btnet.NewRateLimiter(0)
+	m.Download = btnet.NewRateLimiter(0)
+	return m
+}
+
+// change the global limits in bytes per second, 0 for unlimited
+func (m *ConnManager) SetRateLimits(upload int, download int) {
+	m.Upload.SetRate(upload)
+	m.Download.SetRate(download)
+}
+
+// takes a connection slot, returns false if there aren't any left
+func (m *ConnManager) tryOpen() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns >= m.maxConns {
+		return false
+	}
+	m.conns++
+	return true
+}
+
+// gives back a slot taken by tryOpen
+func (m *ConnManager) closed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns--
+}
+
+// blocks until fewer than the maximum number of dials are in progress
+func (m *ConnManager) startDial() {
+	m.halfOpen <- true
+}
+
+func (m *ConnManager) endDial() {
+	<-m.halfOpen
+}
+
+func (m *ConnManager) NumConns() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conns
+}
+
+func (m *ConnManager) NumHalfOpen() int {
+	return len(m.halfOpen)
+}
+
+// a peer we've heard of and might dial
+type dialCandidate struct {
+	peerId   string
+	addr     *net.TCPAddr
+	priority int
+	index    int // in the dial queue
+}
+
+// heap of candidates, highest priority first
+type dialQueue []*dialCandidate
+
+func (q dialQueue) Len() int           { return len(q) }
+func (q dialQueue) Less(i, j int) bool { return q[i].priority > q[j].priority }
+func (q dialQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *dialQueue) Push(x interface{}) {
+	c := x.(*dialCandidate)
+	c.index = len(*q)
+	*q = append(*q, c)
+}
+
+func (q *dialQueue) Pop() interface{} {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// how we've got on with a peer id in the past
+type dialRecord struct {
+	successes int
+	failures  int
+}
+
+// Peers that have connected before rank above strangers, and failed
+// dials and bad behaviour push a peer down the queue. Must hold lock.
+func (cl *BTClient) dialPriority(peerId string, addr *net.TCPAddr) int {
+	priority := 0
+	if record, ok := cl.dialRecords[peerId]; ok {
+		priority += 2*record.successes - 3*record.failures
+	}
+	priority -= 4 * cl.strikes[peerId]
+	priority -= 8 * cl.badPieces[addr.IP.String()]
+	return priority
+}
+
+// queue peerId to be dialed at addr once there's room, unless we're
+// already connected or it's already queued
+func (cl *BTClient) atomicQueueDial(peerId string, addr *net.TCPAddr) {
+	cl.lock("connmanager/atomicQueueDial")
+	defer cl.unlock("connmanager/atomicQueueDial")
+	if _, ok := cl.peers[peerId]; ok {
+		return
+	}
+	if c, ok := cl.queuedDials[peerId]; ok {
+		c.addr = addr
+		return
+	}
+	c := &dialCandidate{peerId: peerId, addr: addr, priority: cl.dialPriority(peerId, addr)}
+	heap.Push(&cl.dialQueue, c)
+	cl.queuedDials[peerId] = c
+	cl.wakeDialer()
+}
+
+// takes the best candidate off the dial queue if there's room for
+// another connection
+func (cl *BTClient) atomicNextDial() (*dialCandidate, bool) {
+	cl.lock("connmanager/atomicNextDial")
+	defer cl.unlock("connmanager/atomicNextDial")
+	for len(cl.peers)+cl.dialing < cl.config.MaxPeers && cl.dialQueue.Len() > 0 {
+		c := heap.Pop(&cl.dialQueue).(*dialCandidate)
+		delete(cl.queuedDials, c.peerId)
+		if _, ok := cl.peers[c.peerId]; ok {
+			continue
+		}
+		cl.dialing++
+		return c, true
+	}
+	return nil, false
+}
+
+func (cl *BTClient) atomicDialDone(c *dialCandidate) {
+	cl.lock("connmanager/atomicDialDone")
+	defer cl.unlock("connmanager/atomicDialDone")
+	cl.dialing--
+	cl.wakeDialer()
+	if _, ok := cl.dialRecords[c.peerId]; !ok {
+		cl.dialRecords[c.peerId] = &dialRecord{}
+	}
+	if _, ok := cl.peers[c.peerId]; ok {
+		cl.dialRecords[c.peerId].successes++
+	} else {
+		cl.dialRecords[c.peerId].failures++
+	}
+}
+
+// tell dialPeers there may be someone to dial
+func (cl *BTClient) wakeDialer() {
+	select {
+	case cl.dialWake <- true:
+	default: // it's been told already
+	}
+}
+
+// dial queued peers as room allows
+func (cl *BTClient) dialPeers() {
+	for !cl.CheckShutdown() {
+		c, ok := cl.atomicNextDial()
+		if !ok {
+			select {
+			case <-cl.dialWake:
+			case <-cl.run.Done():
+			}
+			continue
+		}
+		cl.spawn(func() {
+			util.TPrintf("%s: dialing %s at %v\n", cl.port, c.peerId, c.addr)
+			cl.SetupPeerConnections(c.addr, nil)
+			cl.atomicDialDone(c)
+		})
+	}
+}
+
+// Takes a connection slot for a new peer, dropping our longest idle
+// peer if we're at a limit and it's been idle long enough. Returns
+// false if there's no room. Must hold lock.
+func (cl *BTClient) makeRoom() bool {
+	if len(cl.peers) < cl.config.MaxPeers && cl.config.Connections.tryOpen() {
+		return true
+	}
+	var idlest *btnet.Peer
+	for _, peer := range cl.peers {
+		if peer.IdleTime() >= MinEvictionIdle && (idlest == nil || peer.IdleTime() > idlest.IdleTime()) {
+			idlest = peer
+		}
+	}
+	if idlest == nil {
+		return false
+	}
+	util.TPrintf("%s: dropping idle peer %s to make room\n", cl.port, idlest.Conn.RemoteAddr())
+	idlest.Conn.Close()
+	delete(cl.peers, idlest.PeerId)
+	delete(cl.peerRates, idlest.PeerId)
+	cl.config.Connections.closed()
+	cl.loseRequests()
+	return len(cl.peers) < cl.config.MaxPeers && cl.config.Connections.tryOpen()
+}
@@ -0,0 +1,185 @@
+package btclient
+
+import (
+	"btnet"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+func makeLimitedClient(network *btnet.PipeNetwork, ip string, maxPeers int, conns *ConnManager) *BTClient {
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	config.MaxPeers = maxPeers
+	config.Connections = conns
+	persister := MakePersister("/tmp/persister/tlimited" + ip + ".p")
+	return StartBTClientWithConfig(ip, 6881, MalformedTorrentFile, MalformedSeedFile, "", persister, config)
+}
+
+// connect and wait for the bitfield, so we know the client kept us
+func expectKept(t *testing.T, cl *BTClient, network *btnet.PipeNetwork, ip string, peerId string) net.Conn {
+	conn := connectFrom(t, cl, network, ip, peerId)
+	if conn == nil {
+		cl.Kill()
+		t.Fatalf("Client refused %s", ip)
+	}
+	expectMessage(t, cl, conn, btnet.Bitfield)
+	return conn
+}
+
+// Tests
+func TestMaxPeers(t *testing.T) {
+	util.StartTest("Testing the per torrent connection limit...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLimitedClient(network, "10.0.0.1", 2, nil)
+	defer cl.Kill()
+	util.Wait(100)
+
+	first := expectKept(t, cl, network, "10.0.0.2", makePeerId(700))
+	defer first.Close()
+	second := expectKept(t, cl, network, "10.0.0.3", makePeerId(701))
+	defer second.Close()
+	if third := connectFrom(t, cl, network, "10.0.0.4", makePeerId(702)); third != nil {
+		expectDisconnect(t, cl, third, "peer past the limit")
+		third.Close()
+	}
+	if n := cl.atomicGetNumPeers(); n != 2 {
+		t.Fatalf("Expected 2 peers, have %d", n)
+	}
+	if n := cl.config.Connections.NumConns(); n != 2 {
+		t.Fatalf("Expected 2 connections counted, have %d", n)
+	}
+
+	// a slot frees up when a peer leaves
+	first.Close()
+	util.Wait(100)
+	fourth := expectKept(t, cl, network, "10.0.0.5", makePeerId(703))
+	defer fourth.Close()
+	if n := cl.config.Connections.NumConns(); n != 2 {
+		t.Fatalf("Expected 2 connections counted, have %d", n)
+	}
+	util.EndTest()
+}
+
+func TestEvictIdlePeer(t *testing.T) {
+	util.StartTest("Testing dropping idle peers to make room...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLimitedClient(network, "10.0.0.1", 1, nil)
+	defer cl.Kill()
+	util.Wait(100)
+
+	idle := expectKept(t, cl, network, "10.0.0.2", makePeerId(800))
+	defer idle.Close()
+	// a peer that's only just connected isn't idle yet
+	if busy := connectFrom(t, cl, network, "10.0.0.3", makePeerId(801)); busy != nil {
+		expectDisconnect(t, cl, busy, "peer past the limit")
+		busy.Close()
+	}
+
+	peer, _ := cl.atomicGetPeer(makePeerId(800))
+	peer.LastActive = time.Now().Add(-MinEvictionIdle)
+	newer := expectKept(t, cl, network, "10.0.0.4", makePeerId(802))
+	defer newer.Close()
+	expectDisconnect(t, cl, idle, "idle peer")
+	if _, ok := cl.atomicGetPeer(makePeerId(802)); !ok || cl.atomicGetNumPeers() != 1 {
+		t.Fatalf("Idle peer should be replaced by the new one")
+	}
+	util.EndTest()
+}
+
+func TestSharedConnLimit(t *testing.T) {
+	util.StartTest("Testing a connection limit shared between torrents...")
+	network := btnet.NewPipeNetwork()
+	conns := NewConnManager(2, 1)
+	first := makeLimitedClient(network, "10.0.0.1", 10, conns)
+	defer first.Kill()
+	second := makeLimitedClient(network, "10.0.0.2", 10, conns)
+	defer second.Kill()
+	util.Wait(100)
+
+	a := expectKept(t, first, network, "10.0.0.3", makePeerId(900))
+	defer a.Close()
+	b := expectKept(t, second, network, "10.0.0.3", makePeerId(901))
+	defer b.Close()
+	if c := connectFrom(t, first, network, "10.0.0.4", makePeerId(902)); c != nil {
+		expectDisconnect(t, first, c, "peer past the global limit")
+		c.Close()
+	}
+	if conns.NumConns() != 2 || first.atomicGetNumPeers() != 1 || second.atomicGetNumPeers() != 1 {
+		t.Fatalf("Expected one peer each, have %d and %d", first.atomicGetNumPeers(), second.atomicGetNumPeers())
+	}
+	util.EndTest()
+}
+
+func TestHalfOpenLimit(t *testing.T) {
+	util.StartTest("Testing the limit on dials in progress...")
+	conns := NewConnManager(10, 2)
+	conns.startDial()
+	conns.startDial()
+	started := make(chan bool)
+	go func() {
+		conns.startDial()
+		started <- true
+	}()
+	select {
+	case <-started:
+		t.Fatalf("Third dial shouldn't start while two are in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	conns.endDial()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("Third dial should start once one finishes")
+	}
+	if conns.NumHalfOpen() != 2 {
+		t.Fatalf("Expected 2 dials in progress, have %d", conns.NumHalfOpen())
+	}
+	util.EndTest()
+}
+
+func TestDialQueuePriority(t *testing.T) {
+	util.StartTest("Testing dialing the best peers first...")
+	cl := &BTClient{config: Config{MaxPeers: 2}}
+	cl.peers = make(map[string]*btnet.Peer)
+	cl.queuedDials = make(map[string]*dialCandidate)
+	cl.dialRecords = make(map[string]*dialRecord)
+	cl.strikes = make(map[string]int)
+	cl.badPieces = make(map[string]int)
+
+	cl.dialRecords["flaky"] = &dialRecord{failures: 2}
+	cl.dialRecords["good"] = &dialRecord{successes: 2, failures: 1}
+	cl.strikes["rude"] = 1
+	cl.badPieces["10.0.0.4"] = 1
+	for i, peerId := range []string{"flaky", "stranger", "rude", "liar", "good"} {
+		addr, _ := net.ResolveTCPAddr("tcp", "10.0.0."+strconv.Itoa(i+1)+":6881")
+		cl.atomicQueueDial(peerId, addr)
+	}
+	cl.atomicQueueDial("good", &net.TCPAddr{}) // already queued
+
+	order := []string{}
+	for {
+		c, ok := cl.atomicNextDial()
+		if !ok {
+			if cl.dialing == 0 {
+				break
+			}
+			cl.atomicDialDone(&dialCandidate{peerId: order[len(order)-1]})
+			continue
+		}
+		order = append(order, c.peerId)
+	}
+	expected := []string{"good", "stranger", "rude", "flaky", "liar"}
+	for i := range expected {
+		if i >= len(order) || order[i] != expected[i] {
+			t.Fatalf("Expected dial order %v, got %v", expected, order)
+		}
+	}
+	if cl.dialRecords["stranger"].failures != 1 {
+		t.Fatalf("Failed dials should be recorded")
+	}
+	util.EndTest()
+}
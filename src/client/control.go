@@ -0,0 +1,137 @@
+package btclient
+
+// Pausing and removing
+// A paused torrent hangs up on its peers and stops listening, dialing and
+// announcing, but keeps what it has downloaded in memory until it's
+// resumed. A session's queue pauses torrents the same way while they wait
+// their turn. Removing a torrent shuts it down for good, optionally
+// deleting what it downloaded.
+
+import (
+	"context"
+	"os"
+	"util"
+)
+
+// what a torrent is up to
+type State string
+
+const (
+	StateDownloading State = "downloading"
+	StateSeeding     State = "seeding"
+	StatePaused      State = "paused"
+	StateQueued      State = "queued"
+	StateStopped     State = "stopped"
+)
+
+func (cl *BTClient) State() State {
+	cl.lock("control/State")
+	defer cl.unlock("control/State")
+	return cl.state()
+}
+
+// must hold lock
+func (cl *BTClient) state() State {
+	switch {
+	case cl.stopping:
+		return StateStopped
+	case cl.paused && cl.queued:
+		return StateQueued
+	case cl.paused:
+		return StatePaused
+	case cl.wantedLeft == 0:
+		return StateSeeding
+	}
+	return StateDownloading
+}
+
+// tells our session, if we're in one, that eventType happened to us
+func (cl *BTClient) atomicPublish(eventType string) {
+	cl.lock("control/atomicPublish")
+	defer cl.unlock("control/atomicPublish")
+	cl.publish(eventType)
+}
+
+// must hold lock
+func (cl *BTClient) publish(eventType string) {
+	if cl.session != nil {
+		cl.session.publish(SessionEvent{Type: eventType, InfoHash: cl.InfoHash(), Name: cl.Name(), State: cl.state()})
+	}
+}
+
+// Hangs up on every peer and stops listening, dialing and announcing,
+// then tells the tracker we've stopped. Returns once everything has
+// stopped, or right away if we're already paused or shutting down.
+// Pausing a queued torrent takes it out of its session's queue.
+func (cl *BTClient) Pause() {
+	cl.pause(false)
+}
+
+// pauses, for the queue if queued is set
+func (cl *BTClient) pause(queued bool) {
+	cl.control.Lock()
+	defer cl.control.Unlock()
+	cl.lock("control/Pause")
+	if cl.paused {
+		cl.queued = cl.queued && queued
+		cl.publish("state")
+	}
+	if cl.paused || cl.stopping {
+		cl.unlock("control/Pause")
+		return
+	}
+	cl.paused = true
+	cl.queued = queued
+	cl.publish("state")
+	cl.pauseRun()
+	for _, ln := range cl.listeners {
+		ln.Close()
+	}
+	cl.listeners = nil
+	for _, peer := range cl.peers {
+		peer.Close()
+	}
+	cl.unlock("control/Pause")
+	cl.wg.Wait()
+	cl.announceStopped()
+	util.IPrintf("%s: paused\n", cl.port)
+}
+
+// picks up where Pause left off, unless we're shutting down
+func (cl *BTClient) Resume() {
+	cl.resume(false)
+}
+
+// resumes, only if the queue paused us if queued is set
+func (cl *BTClient) resume(queued bool) {
+	cl.control.Lock()
+	defer cl.control.Unlock()
+	cl.lock("control/Resume")
+	if !cl.paused || cl.stopping || (queued && !cl.queued) {
+		cl.unlock("control/Resume")
+		return
+	}
+	cl.paused = false
+	cl.queued = false
+	cl.publish("state")
+	cl.run, cl.pauseRun = context.WithCancel(cl.ctx)
+	cl.unlock("control/Resume")
+	util.IPrintf("%s: resumed\n", cl.port)
+	cl.spawn(cl.main)
+}
+
+// Shuts down for good, then deletes the downloaded files and saved
+// progress if deleteData is set
+func (cl *BTClient) Remove(deleteData bool) error {
+	cl.Kill()
+	if !deleteData {
+		return nil
+	}
+	if err := os.Remove(cl.persister.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if cl.outputPath != "" {
+		return cl.deleteOutput()
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package btclient
+
+import (
+	"btnet"
+	"fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+func expectState(t *testing.T, cl *BTClient, state State) {
+	if got := cl.State(); got != state {
+		cl.Kill()
+		t.Fatalf("Expected client to be %s, is %s", state, got)
+	}
+}
+
+// returns the last event the tracker heard, waiting up to a second for one
+func lastEvent(events chan string) string {
+	last := ""
+	select {
+	case last = <-events:
+	case <-time.After(time.Second):
+	}
+	for len(events) > 0 {
+		last = <-events
+	}
+	return last
+}
+
+// Tests
+func TestPauseResume(t *testing.T) {
+	util.StartTest("Testing pausing and resuming a torrent...")
+	events := make(chan string, 100)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+	}))
+	defer tracker.Close()
+	torrent := "/tmp/tpause.torrent"
+	fs.Write(torrent, fs.GetMetadata(MalformedSeedFile, tracker.URL, "puppy.jpg"))
+
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	os.Remove("/tmp/tpause.p")
+	cl := StartBTClientWithConfig("10.0.0.1", 6881, torrent, "", "", MakePersister("/tmp/tpause.p"), config)
+	defer cl.Kill()
+	util.Wait(100)
+	expectState(t, cl, StateDownloading)
+	if event := lastEvent(events); event != string(Started) {
+		t.Fatalf("Expected the tracker to hear we started, heard %q", event)
+	}
+
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+	conn := connectToClient(t, cl, network, makePeerId(1500))
+	if conn == nil {
+		t.Fatalf("Client refused a well behaved peer")
+	}
+	defer conn.Close()
+	conn.Write(btnet.EncodePeerMessage(btnet.PeerMessage{Type: btnet.Piece, Index: 0, Begin: 0,
+		Block: seed[:cl.pieceLength(0)]}))
+	select {
+	case <-cl.pieceDone[0]:
+	case <-time.After(time.Second):
+		t.Fatalf("Piece 0 should be done")
+	}
+
+	cl.Pause()
+	expectState(t, cl, StatePaused)
+	expectDisconnect(t, cl, conn, "peer when paused")
+	if conn, err := network.DialFrom("10.0.0.3", "10.0.0.1:6881"); err == nil {
+		conn.Close()
+		t.Fatalf("Paused client still accepting connections")
+	}
+	if event := lastEvent(events); event != string(Stopped) {
+		t.Fatalf("Expected the tracker to hear we stopped, heard %q", event)
+	}
+	util.Wait(1500)
+	if event := lastEvent(events); event != "" {
+		t.Fatalf("Paused client still announcing, heard %q", event)
+	}
+	if !cl.AtomicGetBitmap()[0] {
+		t.Fatalf("Expected piece 0 to be kept while paused")
+	}
+	cl.Pause() // again, which is fine
+
+	cl.Resume()
+	util.Wait(100)
+	expectState(t, cl, StateDownloading)
+	if event := lastEvent(events); event != string(Started) {
+		t.Fatalf("Expected the tracker to hear we started again, heard %q", event)
+	}
+	conn = connectToClient(t, cl, network, makePeerId(1501))
+	if conn == nil {
+		t.Fatalf("Resumed client refused a well behaved peer")
+	}
+	defer conn.Close()
+	for i := 1; i < cl.numPieces; i++ {
+		begin := i * int(cl.torrentMeta.PieceLen)
+		conn.Write(btnet.EncodePeerMessage(btnet.PeerMessage{Type: btnet.Piece, Index: int32(i), Begin: 0,
+			Block: seed[begin : begin+cl.pieceLength(i)]}))
+	}
+	select {
+	case <-cl.Completed():
+	case <-time.After(time.Second):
+		t.Fatalf("Resumed client should have finished downloading")
+	}
+	expectState(t, cl, StateSeeding)
+
+	cl.Kill()
+	expectState(t, cl, StateStopped)
+	cl.Resume() // does nothing once stopped
+	expectState(t, cl, StateStopped)
+	util.EndTest()
+}
+
+func TestRemove(t *testing.T) {
+	util.StartTest("Testing removing a torrent and its data...")
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	output := "/tmp/tremove.out"
+	persister := MakePersister("/tmp/tremove.p")
+	cl := StartBTClientWithConfig("10.0.0.1", 6881, MalformedTorrentFile, MalformedSeedFile, output, persister, config)
+	for i := 0; i < 10; i++ {
+		if cl.CheckDone() {
+			break
+		}
+		util.Wait(100)
+	}
+	if _, err := os.Stat(output); err != nil {
+		cl.Kill()
+		t.Fatalf("Expected the output to be written: %s", err)
+	}
+
+	if err := cl.Remove(true); err != nil {
+		t.Fatalf("Couldn't remove torrent: %s", err)
+	}
+	expectState(t, cl, StateStopped)
+	for _, path := range []string{output, persister.Path} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be deleted", path)
+		}
+	}
+	util.EndTest()
+}
+
+// makes a directory holding a.jpg and sub/b.png and a torrent of it
+func makeNestedTorrent(trackerUrl string) (string, string) {
+	dir, _ := ioutil.TempDir("", "tnested")
+	puppy, _ := ioutil.ReadFile(MalformedSeedFile)
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a.jpg"), puppy, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "b.png"), puppy, 0644)
+	torrent := dir + ".torrent"
+	fs.Write(torrent, fs.GetDirMetadata(dir, trackerUrl, "nested"))
+	return dir, torrent
+}
+
+func TestRemoveMultiFile(t *testing.T) {
+	util.StartTest("Testing removing a multi-file torrent's data and nothing else...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	dir, torrent := makeNestedTorrent(tracker.URL)
+	defer os.RemoveAll(dir)
+	defer os.Remove(torrent)
+	output, _ := ioutil.TempDir("", "tremove-out")
+	defer os.RemoveAll(output)
+	keep := filepath.Join(output, "keep.txt")
+	ioutil.WriteFile(keep, []byte("not the torrent's"), 0644)
+
+	cl := startFilesClient(btnet.NewPipeNetwork(), "10.0.0.1", torrent, dir, output)
+	for i := 0; i < 10 && !cl.CheckDone(); i++ {
+		util.Wait(100)
+	}
+	if !fileExists(filepath.Join(output, "sub", "b.png")) {
+		cl.Kill()
+		t.Fatalf("Expected the output to be written")
+	}
+
+	if err := cl.Remove(true); err != nil {
+		t.Fatalf("Couldn't remove torrent: %s", err)
+	}
+	for _, path := range []string{filepath.Join(output, "a.jpg"), filepath.Join(output, "sub")} {
+		if fileExists(path) {
+			t.Fatalf("Expected %s to be deleted", path)
+		}
+	}
+	if !fileExists(keep) {
+		t.Fatalf("Expected a file that isn't the torrent's to be left alone")
+	}
+	util.EndTest()
+}
@@ -0,0 +1,172 @@
+package btclient
+
+// Sequential downloads and deadlines
+// In sequential mode the picker goes for the first piece it still needs
+// rather than a random one, so media can play while it downloads. Pieces
+// can also be given a deadline: they're picked before anything else,
+// earliest deadline first, by up to DeadlineDownloaders downloaders at
+// once, and their blocks are requested from the fastest peers first.
+
+import (
+	"btnet"
+	"errors"
+	"sort"
+	"time"
+)
+
+// downloaders that may work on a piece with a deadline at once
+const DeadlineDownloaders int = 2
+
+var ErrPieceIndex = errors.New("deadlines: no such piece")
+
+// readers relying on a piece's deadline
+type deadlineHold struct {
+	readers int
+	set     bool // the first of them set it, so it goes once they're done
+}
+
+// bytes a peer has sent us since it first sent something
+type peerRate struct {
+	bytes int64
+	since time.Time
+}
+
+// bytes per second
+func (r *peerRate) rate(now time.Time) float64 {
+	elapsed := now.Sub(r.since).Seconds()
+	if elapsed < 1 {
+		elapsed = 1 // one block doesn't make a peer fast
+	}
+	return float64(r.bytes) / elapsed
+}
+
+// picks pieces in order rather than at random, within a priority
+func (cl *BTClient) SetSequential(sequential bool) {
+	cl.lock("deadlines/SetSequential")
+	defer cl.unlock("deadlines/SetSequential")
+	cl.config.Sequential = sequential
+}
+
+func (cl *BTClient) Sequential() bool {
+	cl.lock("deadlines/Sequential")
+	defer cl.unlock("deadlines/Sequential")
+	return cl.config.Sequential
+}
+
+// Asks for piece to be downloaded by deadline, before pieces without one.
+// Pieces of skipped files are left alone until their file is wanted.
+func (cl *BTClient) SetPieceDeadline(piece int, deadline time.Time) error {
+	cl.lock("deadlines/SetPieceDeadline")
+	defer cl.unlock("deadlines/SetPieceDeadline")
+	if piece < 0 || piece >= cl.numPieces {
+		return ErrPieceIndex
+	}
+	if !cl.PieceBitmap[piece] {
+		cl.deadlines[piece] = deadline
+		if hold, ok := cl.held[piece]; ok {
+			hold.set = false // outlives the readers
+		}
+		cl.wakePickers()
+	}
+	return nil
+}
+
+func (cl *BTClient) ClearPieceDeadline(piece int) {
+	cl.lock("deadlines/ClearPieceDeadline")
+	defer cl.unlock("deadlines/ClearPieceDeadline")
+	delete(cl.deadlines, piece)
+}
+
+// returns piece's deadline, if it has one
+func (cl *BTClient) PieceDeadline(piece int) (time.Time, bool) {
+	cl.lock("deadlines/PieceDeadline")
+	defer cl.unlock("deadlines/PieceDeadline")
+	deadline, ok := cl.deadlines[piece]
+	return deadline, ok
+}
+
+// Gives piece a deadline for a reader, unless it has one already, and
+// keeps it until every reader holding it releases it
+func (cl *BTClient) holdPieceDeadline(piece int, deadline time.Time) {
+	cl.lock("deadlines/holdPieceDeadline")
+	defer cl.unlock("deadlines/holdPieceDeadline")
+	hold, ok := cl.held[piece]
+	if !ok {
+		hold = &deadlineHold{}
+		cl.held[piece] = hold
+	}
+	hold.readers++
+	if _, ok := cl.deadlines[piece]; !ok && !cl.PieceBitmap[piece] {
+		cl.deadlines[piece] = deadline
+		hold.set = true
+		cl.wakePickers()
+	}
+}
+
+// lets go of a reader's hold on piece's deadline, taking the deadline away
+// if the last reader holding it set it
+func (cl *BTClient) releasePieceDeadline(piece int) {
+	cl.lock("deadlines/releasePieceDeadline")
+	defer cl.unlock("deadlines/releasePieceDeadline")
+	hold, ok := cl.held[piece]
+	if !ok {
+		return
+	}
+	hold.readers--
+	if hold.readers > 0 {
+		return
+	}
+	delete(cl.held, piece)
+	if hold.set {
+		delete(cl.deadlines, piece)
+	}
+}
+
+// returns the unfinished piece with the earliest deadline that isn't being
+// downloaded by too many downloaders yet, of those available marks if it
+// isn't nil, must hold lock
+func (cl *BTClient) urgentPiece(available []bool) (int, bool) {
+	urgent := -1
+	for piece, deadline := range cl.deadlines {
+		if cl.picking[piece] >= DeadlineDownloaders || cl.piecePriority[piece] == PrioritySkip ||
+			(available != nil && !available[piece]) {
+			continue
+		}
+		if urgent == -1 || deadline.Before(cl.deadlines[urgent]) ||
+			(deadline.Equal(cl.deadlines[urgent]) && piece < urgent) {
+			urgent = piece
+		}
+	}
+	return urgent, urgent != -1
+}
+
+func (cl *BTClient) atomicHasDeadline(piece int) bool {
+	cl.lock("deadlines/atomicHasDeadline")
+	defer cl.unlock("deadlines/atomicHasDeadline")
+	_, ok := cl.deadlines[piece]
+	return ok
+}
+
+// counts a block from peer towards its rate, must hold lock
+func (cl *BTClient) addReceived(peer *btnet.Peer, n int) {
+	r, ok := cl.peerRates[peer.PeerId]
+	if !ok {
+		r = &peerRate{since: time.Now()}
+		cl.peerRates[peer.PeerId] = r
+	}
+	r.bytes += int64(n)
+}
+
+// sorts peers fastest first, peers that haven't sent anything last
+func (cl *BTClient) atomicSortByRate(peers []*btnet.Peer) {
+	cl.lock("deadlines/atomicSortByRate")
+	defer cl.unlock("deadlines/atomicSortByRate")
+	now := time.Now()
+	rates := make(map[*btnet.Peer]float64)
+	for _, peer := range peers {
+		if r, ok := cl.peerRates[peer.PeerId]; ok {
+			rates[peer] = r.rate(now)
+		}
+	}
+	sort.SliceStable(peers, func(i, j int) bool { return rates[peers[i]] > rates[peers[j]] })
+}
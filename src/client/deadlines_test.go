@@ -0,0 +1,129 @@
+package btclient
+
+import (
+	"btnet"
+	"os"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+
+// picks pieces until there are none left to pick
+func pickAll(cl *BTClient) []int {
+	picked := []int{}
+	for {
+		piece, ok := cl.atomicPickPiece(nil)
+		if !ok {
+			return picked
+		}
+		picked = append(picked, piece)
+	}
+}
+
+// Tests
+func TestSequentialPicking(t *testing.T) {
+	util.StartTest("Testing picking pieces in order...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	dir, torrent := makeFilesTorrent(tracker.URL)
+	defer os.RemoveAll(dir)
+	cl := startFilesClient(btnet.NewPipeNetwork(), "10.0.0.2", torrent, "", "")
+	defer cl.Kill()
+	cl.Pause() // so only we pick
+
+	cl.SetSequential(true)
+	if !cl.Sequential() {
+		t.Fatalf("Expected sequential mode to be on")
+	}
+	picked := pickAll(cl)
+	if len(picked) != cl.numPieces {
+		t.Fatalf("Expected every piece to be picked once, picked %v", picked)
+	}
+	for i, piece := range picked {
+		if piece != i {
+			t.Fatalf("Expected pieces to be picked in order, picked %v", picked)
+		}
+	}
+
+	// priorities still come first
+	for i := 0; i < cl.numPieces; i++ {
+		cl.atomicDonePicking(i)
+	}
+	cl.SetFilePriority(2, PriorityHigh)
+	if piece, _ := cl.atomicPickPiece(nil); piece != cl.numPieces-3 {
+		t.Fatalf("Expected the first piece of c.jpg, got %d", piece)
+	}
+	util.EndTest()
+}
+
+func TestPieceDeadlines(t *testing.T) {
+	util.StartTest("Testing picking pieces with deadlines first...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	dir, torrent := makeFilesTorrent(tracker.URL)
+	defer os.RemoveAll(dir)
+	cl := startFilesClient(btnet.NewPipeNetwork(), "10.0.0.2", torrent, "", "")
+	defer cl.Kill()
+	cl.Pause()
+	cl.SetSequential(true)
+
+	now := time.Now()
+	cl.SetPieceDeadline(30, now.Add(2*time.Second))
+	cl.SetPieceDeadline(20, now.Add(time.Second))
+	cl.SetPieceDeadline(10, now.Add(time.Second))
+	if err := cl.SetPieceDeadline(cl.numPieces, now); err != ErrPieceIndex {
+		t.Fatalf("Expected a deadline for a missing piece to fail, got %v", err)
+	}
+	cl.ClearPieceDeadline(10)
+	if _, ok := cl.PieceDeadline(10); ok {
+		t.Fatalf("Expected piece 10's deadline to be cleared")
+	}
+
+	// earliest first, each picked by more than one downloader
+	want := []int{20, 20, 30, 30, 0, 1}
+	for _, piece := range want {
+		if got, _ := cl.atomicPickPiece(nil); got != piece {
+			t.Fatalf("Expected to pick %v in order, got %d instead of %d", want, got, piece)
+		}
+	}
+
+	// finished pieces don't need their deadline
+	cl.lock("deadlines_test/TestPieceDeadlines")
+	cl.setPieceDone(20)
+	cl.unlock("deadlines_test/TestPieceDeadlines")
+	if _, ok := cl.PieceDeadline(20); ok {
+		t.Fatalf("Expected piece 20's deadline to go once it's done")
+	}
+
+	// nor are skipped files hurried
+	cl.atomicDonePicking(30)
+	cl.SetFilePriority(1, PrioritySkip)
+	if got, _ := cl.atomicPickPiece(nil); got == 30 {
+		t.Fatalf("Expected piece 30 of skipped b.png not to be picked")
+	}
+	util.EndTest()
+}
+
+func TestFastestPeersFirst(t *testing.T) {
+	util.StartTest("Testing ordering peers by how fast they send...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLeecherOnPipes(network, "/tmp/persister/tdeadline.p")
+	defer cl.Kill()
+	slow := &btnet.Peer{PeerId: makePeerId(1800)}
+	fast := &btnet.Peer{PeerId: makePeerId(1801)}
+	silent := &btnet.Peer{PeerId: makePeerId(1802)}
+	cl.lock("deadlines_test/TestFastestPeersFirst")
+	cl.addReceived(slow, 16384)
+	cl.addReceived(fast, 16384)
+	cl.addReceived(fast, 16384)
+	cl.unlock("deadlines_test/TestFastestPeersFirst")
+
+	peers := []*btnet.Peer{silent, slow, fast}
+	cl.atomicSortByRate(peers)
+	if peers[0] != fast || peers[1] != slow || peers[2] != silent {
+		t.Fatalf("Expected the fast peer, then the slow one, then the silent one")
+	}
+	util.EndTest()
+}
@@ -1,67 +1,199 @@
 package btclient
 
 import (
+	"sync"
 	"time"
 	"util"
 )
 
-func (cl *BTClient) downloadPiece(piece int) {
-	cl.lock("downloader/downloadPiece")
-	if _, ok := cl.blockBitmap[piece]; !ok {
-		cl.blockBitmap[piece] = make([]bool, cl.numBlocks(piece), cl.numBlocks(piece))
-	}
-	cl.unlock("downloader/downloadPiece")
+// how long to wait for the blocks of a piece before letting it be picked
+// again, in case a peer never answers our requests
+const RequestTimeout time.Duration = 2 * time.Second
+
+// requests piece's blocks, returns false if there was nobody to ask
+func (cl *BTClient) downloadPiece(piece int) bool {
+	cl.atomicTryPinned(piece)
+	requested := false
 	for i := 0; i < cl.numBlocks(piece); i++ {
-		cl.requestBlock(piece, i)
+		if cl.requestBlock(piece, i) {
+			requested = true
+		}
 	}
+	return requested
 }
 
-// grab pieces off the needed queue and try downloading them
-// re-adds pieces to queue if they weren't successfully downloaded
-func (cl *BTClient) downloadPieces() {
+// runs the downloaders until every wanted piece is done, and again
+// whenever more are wanted
+func (cl *BTClient) downloadWanted() {
 	for {
-		piece := <-cl.neededPieces
-		if cl.CheckShutdown() {
+		var wg sync.WaitGroup
+		for i := 0; i < NumDownloaders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cl.downloadPieces()
+			}()
+		}
+		wg.Wait()
+		if !cl.waitUntilWanted() {
 			return
 		}
+	}
+}
 
-		if !cl.atomicGetBitmapElement(piece) {
-			util.TPrintf("%s: trying to download piece %d\n", cl.port, piece)
-			cl.downloadPiece(piece)
+// waits for a wanted piece to be missing, returns false if we're paused
+// or shut down first
+func (cl *BTClient) waitUntilWanted() bool {
+	for !cl.CheckShutdown() {
+		cl.lock("downloading/waitUntilWanted")
+		complete, changed := cl.complete, cl.filesChanged
+		cl.unlock("downloading/waitUntilWanted")
+		select {
+		case <-complete:
+		default:
+			return true
+		}
+		select {
+		case <-changed:
+		case <-cl.run.Done():
+			return false
 		}
+	}
+	return false
+}
 
-		cl.waitUntilDownloaded(piece)
+// pick the most wanted pieces a peer can send us and try downloading them,
+// until every wanted piece is done
+// pieces that weren't successfully downloaded get picked again later
+func (cl *BTClient) downloadPieces() {
+	for !cl.CheckShutdown() {
+		cl.lock("downloading/downloadPieces")
+		complete, changed, lost := cl.complete, cl.workChanged, cl.requestsLost
+		cl.unlock("downloading/downloadPieces")
+		piece, ok := cl.atomicPickPiece(cl.atomicAvailablePieces())
+		if !ok {
+			// nothing we can download until something changes
+			select {
+			case <-changed:
+				continue
+			case <-complete:
+			case <-cl.run.Done():
+			}
+			return
+		}
+
+		util.TPrintf("%s: trying to download piece %d\n", cl.port, piece)
+		if cl.downloadPiece(piece) {
+			cl.waitUntilDownloaded(piece, lost)
+		}
+		cl.atomicDonePicking(piece)
 
 		if !cl.atomicGetBitmapElement(piece) {
 			util.TPrintf("%s: piece %d was not downloaded\n", cl.port, piece)
-			// piece still not downloaded, add it back to queue
-			go func() {
-				cl.neededPieces <- piece
-			}()
 		}
 	}
 }
 
-func (cl *BTClient) waitUntilDownloaded(piece int) {
-	downloaded := make(chan bool, 1)
-	go func() {
-		for {
-			if cl.CheckShutdown() {
-				return
-			}
-			cl.lock("downloading/waitUntilDownloaded")
-			done := cl.PieceBitmap[piece]
-			cl.unlock("downloading/waitUntilDownloaded")
-			if done {
-				downloaded <- true
-				return
+// Returns the most urgent piece with a deadline, if there is one.
+// Otherwise returns the first piece in pick order, or in sequential mode
+// the lowest numbered piece, of the highest priority we still need that
+// nobody else is downloading. Picked pieces move to the back of the pick
+// order so other pieces get a go before they're tried again. If available
+// isn't nil only the pieces it marks are picked.
+func (cl *BTClient) atomicPickPiece(available []bool) (int, bool) {
+	cl.lock("downloading/atomicPickPiece")
+	defer cl.unlock("downloading/atomicPickPiece")
+	if piece, ok := cl.urgentPiece(available); ok {
+		cl.picking[piece]++
+		return piece, true
+	}
+	order := cl.pickOrder
+	if cl.config.Sequential {
+		order = make([]int, cl.numPieces)
+		for i := range order {
+			order[i] = i
+		}
+	}
+	best := -1
+	for _, piece := range order {
+		if cl.PieceBitmap[piece] || cl.picking[piece] > 0 || cl.piecePriority[piece] == PrioritySkip ||
+			(available != nil && !available[piece]) {
+			continue
+		}
+		if best == -1 || cl.piecePriority[piece] > cl.piecePriority[best] {
+			best = piece
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	for i, piece := range cl.pickOrder {
+		if piece == best {
+			cl.pickOrder = append(append(cl.pickOrder[:i:i], cl.pickOrder[i+1:]...), piece)
+			break
+		}
+	}
+	cl.picking[best]++
+	return best, true
+}
+
+// pieces some peer that isn't choking us has
+func (cl *BTClient) atomicAvailablePieces() []bool {
+	cl.lock("downloading/atomicAvailablePieces")
+	peers := cl.getRandomPeerOrder()
+	cl.unlock("downloading/atomicAvailablePieces")
+	available := make([]bool, cl.numPieces)
+	for _, peer := range peers {
+		if peer.GetStatus().PeerChoking {
+			continue
+		}
+		for piece, has := range peer.GetBitfield() {
+			if has && piece < len(available) {
+				available[piece] = true
 			}
-			util.Wait(10)
 		}
-	}()
+	}
+	return available
+}
+
+func (cl *BTClient) atomicDonePicking(piece int) {
+	cl.lock("downloading/atomicDonePicking")
+	defer cl.unlock("downloading/atomicDonePicking")
+	cl.picking[piece]--
+	if cl.picking[piece] <= 0 {
+		delete(cl.picking, piece)
+	}
+	if !cl.PieceBitmap[piece] {
+		cl.wakePickers() // another downloader may have a go
+	}
+}
 
+// waits for piece to be verified, or for its requests to be lost or go
+// unanswered
+func (cl *BTClient) waitUntilDownloaded(piece int, lost <-chan struct{}) {
 	select {
-	case <-downloaded:
-	case <-time.After(time.Millisecond * 500):
+	case <-cl.pieceDone[piece]:
+	case <-lost:
+	case <-time.After(RequestTimeout):
+	case <-cl.run.Done():
 	}
 }
+
+// tells idle downloaders there may be something new to pick, must hold lock
+func (cl *BTClient) wakePickers() {
+	close(cl.workChanged)
+	cl.workChanged = make(chan struct{})
+}
+
+func (cl *BTClient) atomicWakePickers() {
+	cl.lock("downloading/atomicWakePickers")
+	defer cl.unlock("downloading/atomicWakePickers")
+	cl.wakePickers()
+}
+
+// tells downloaders the blocks they asked for may never come, because a
+// peer went away or a piece failed its check, must hold lock
+func (cl *BTClient) loseRequests() {
+	close(cl.requestsLost)
+	cl.requestsLost = make(chan struct{})
+}
@@ -0,0 +1,210 @@
+package btclient
+
+// File priorities
+// Each file in a torrent can be skipped or downloaded at a low, normal or
+// high priority, and the piece picker goes for the pieces of the highest
+// priority files first. A piece gets the priority of the most wanted file
+// it overlaps, so pieces shared with skipped files are still downloaded
+// when their neighbours are wanted. Those only live in our saved progress,
+// which serves as the partfile: skipped files are never written out.
+
+import (
+	"errors"
+	"fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var ErrFileIndex = errors.New("files: no such file")
+var ErrPriority = errors.New("files: invalid priority")
+
+type Priority int
+
+const (
+	PrioritySkip Priority = iota // don't download
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return "unknown"
+}
+
+func ParsePriority(str string) (Priority, error) {
+	switch strings.ToLower(str) {
+	case "skip":
+		return PrioritySkip, nil
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	}
+	return PriorityNormal, errors.New("invalid priority " + str)
+}
+
+// A file in the torrent
+type FileInfo struct {
+	Path     string // the torrent's name, then the file's path within it
+	Length   int64
+	Priority Priority
+	Done     int64 // bytes of the file in pieces we have
+}
+
+// returns the torrent's files in the order they're stored
+func (cl *BTClient) Files() []FileInfo {
+	cl.lock("files/Files")
+	defer cl.unlock("files/Files")
+	offsets := cl.torrentMeta.FileOffsets()
+	pieceLen := cl.torrentMeta.PieceLen
+	files := []FileInfo{}
+	for i, file := range cl.torrentMeta.Files {
+		path := cl.torrentMeta.Name
+		if len(cl.torrentMeta.Files) > 1 {
+			path += "/" + strings.Join(file.Path, "/")
+		}
+		done := int64(0)
+		start, end := offsets[i], offsets[i]+file.Length
+		for piece := start / pieceLen; piece*pieceLen < end; piece++ {
+			if !cl.PieceBitmap[piece] {
+				continue
+			}
+			begin, finish := piece*pieceLen, (piece+1)*pieceLen
+			if begin < start {
+				begin = start
+			}
+			if finish > end {
+				finish = end
+			}
+			done += finish - begin
+		}
+		files = append(files, FileInfo{Path: path, Length: file.Length,
+			Priority: cl.filePriorities[i], Done: done})
+	}
+	return files
+}
+
+// Sets the priority of the file at the given index in Files. Wanting a
+// file we skipped means we're downloading again, and its pieces are
+// written out once they're all here.
+func (cl *BTClient) SetFilePriority(file int, priority Priority) error {
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return ErrPriority
+	}
+	cl.lock("files/SetFilePriority")
+	defer cl.unlock("files/SetFilePriority")
+	if file < 0 || file >= len(cl.filePriorities) {
+		return ErrFileIndex
+	}
+	cl.filePriorities[file] = priority
+	if priority == PrioritySkip {
+		cl.written[file] = false
+	}
+	cl.updatePiecePriorities()
+	return nil
+}
+
+// works out each piece's priority from the files it overlaps, and how many
+// wanted pieces are left, must hold lock
+func (cl *BTClient) updatePiecePriorities() {
+	if cl.piecePriority == nil {
+		cl.piecePriority = make([]Priority, cl.numPieces)
+	}
+	for i := range cl.piecePriority {
+		cl.piecePriority[i] = PrioritySkip
+	}
+	offsets := cl.torrentMeta.FileOffsets()
+	pieceLen := cl.torrentMeta.PieceLen
+	for i, file := range cl.torrentMeta.Files {
+		if file.Length == 0 {
+			continue
+		}
+		first := offsets[i] / pieceLen
+		last := (offsets[i] + file.Length - 1) / pieceLen
+		for piece := first; piece <= last; piece++ {
+			if cl.filePriorities[i] > cl.piecePriority[piece] {
+				cl.piecePriority[piece] = cl.filePriorities[i]
+			}
+		}
+	}
+
+	cl.wantedLeft = 0
+	for i, done := range cl.PieceBitmap {
+		if !done && cl.piecePriority[i] != PrioritySkip {
+			cl.wantedLeft++
+		}
+	}
+	select {
+	case <-cl.complete:
+		if cl.wantedLeft > 0 {
+			cl.complete = make(chan struct{})
+		}
+	default:
+		if cl.wantedLeft == 0 {
+			close(cl.complete)
+		}
+	}
+	close(cl.filesChanged)
+	cl.filesChanged = make(chan struct{})
+	cl.wakePickers()
+	cl.publish("state")
+}
+
+// where the file at index file is written, multi-file torrents' files
+// going under outputPath
+func (cl *BTClient) filePath(file int) string {
+	if len(cl.torrentMeta.Files) == 1 {
+		return cl.outputPath
+	}
+	return filepath.Join(append([]string{cl.outputPath}, cl.torrentMeta.Files[file].Path...)...)
+}
+
+// Deletes the files writeFile wrote, then the directories that leaves
+// empty, deepest first, up to and including outputPath. Anything else
+// that's there is left alone.
+func (cl *BTClient) deleteOutput() error {
+	dirs := make(map[string]bool)
+	for i := range cl.torrentMeta.Files {
+		path := cl.filePath(i)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if path == cl.outputPath {
+			continue
+		}
+		for dir := filepath.Dir(path); dir != cl.outputPath; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+		}
+		dirs[cl.outputPath] = true
+	}
+	ordered := []string{}
+	for dir := range dirs {
+		ordered = append(ordered, dir)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return len(ordered[i]) > len(ordered[j]) })
+	for _, dir := range ordered {
+		os.Remove(dir) // fails if something else is in it, which is fine
+	}
+	return nil
+}
+
+// writes out the file at index file from pieces
+func (cl *BTClient) writeFile(file int, pieces []fs.Piece) {
+	path := cl.filePath(file)
+	offset := cl.torrentMeta.FileOffsets()[file]
+	fs.WriteFileRange(path, pieces, int(cl.torrentMeta.PieceLen), offset, cl.torrentMeta.Files[file].Length)
+}
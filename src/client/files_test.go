@@ -0,0 +1,195 @@
+package btclient
+
+import (
+	"btnet"
+	"bytes"
+	"fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+
+// Makes a directory holding a.jpg, b.png and c.jpg and a torrent of it.
+// b is big enough that most of its pieces hold nothing of a or c.
+func makeFilesTorrent(trackerUrl string) (string, string) {
+	dir, _ := ioutil.TempDir("", "tfiles")
+	puppy, _ := ioutil.ReadFile(MalformedSeedFile)
+	pupper, _ := ioutil.ReadFile(SessionSeedFile)
+	ioutil.WriteFile(filepath.Join(dir, "a.jpg"), puppy, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.png"), pupper, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "c.jpg"), puppy, 0644)
+	torrent := filepath.Join(dir, "files.torrent")
+	metadata := fs.GetDirMetadata(dir, trackerUrl, "files")
+	fs.Write(torrent, metadata)
+	return dir, torrent
+}
+
+func startFilesClient(network *btnet.PipeNetwork, ip string, torrent string, seedPath string, outputPath string) *BTClient {
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	return StartBTClientWithConfig(ip, 6881, torrent, seedPath, outputPath,
+		MakePersister("/tmp/persister/tfiles.p"), config)
+}
+
+func awaitCompleted(t *testing.T, cl *BTClient) {
+	select {
+	case <-cl.Completed():
+	case <-time.After(10 * time.Second):
+		t.Fatalf("%s should have finished downloading", cl.Name())
+	}
+	util.Wait(200) // written out once complete
+}
+
+func expectSameFile(t *testing.T, got string, want string) {
+	gotData, err := ioutil.ReadFile(got)
+	if err != nil {
+		t.Fatalf("Expected %s to be written: %s", got, err)
+	}
+	wantData, _ := ioutil.ReadFile(want)
+	if !bytes.Equal(gotData, wantData) {
+		t.Fatalf("Expected %s to match %s", got, want)
+	}
+}
+
+// Tests
+func TestSkipFile(t *testing.T) {
+	util.StartTest("Testing downloading only some files of a torrent...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	dir, torrent := makeFilesTorrent(tracker.URL)
+	defer os.RemoveAll(dir)
+	out, _ := ioutil.TempDir("", "tfiles-out")
+	defer os.RemoveAll(out)
+	network := btnet.NewPipeNetwork()
+	seeder := startFilesClient(network, "10.0.0.1", torrent, dir, "")
+	defer seeder.Kill()
+	leecher := startFilesClient(network, "10.0.0.2", torrent, "", out)
+	defer leecher.Kill()
+
+	files := leecher.Files()
+	if len(files) != 3 || files[1].Path != "files/b.png" || files[1].Priority != PriorityNormal {
+		t.Fatalf("Expected files a.jpg, b.png and c.jpg at normal priority, have %+v", files)
+	}
+	if err := leecher.SetFilePriority(1, PrioritySkip); err != nil {
+		t.Fatalf("Couldn't skip b.png: %s", err)
+	}
+	if err := leecher.SetFilePriority(3, PriorityHigh); err != ErrFileIndex {
+		t.Fatalf("Expected setting the priority of a missing file to fail, got %v", err)
+	}
+	util.Wait(100)
+	seederAddr, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:6881")
+	leecher.SetupPeerConnections(seederAddr, nil)
+
+	awaitCompleted(t, leecher)
+	expectState(t, leecher, StateSeeding)
+	expectSameFile(t, filepath.Join(out, "a.jpg"), filepath.Join(dir, "a.jpg"))
+	expectSameFile(t, filepath.Join(out, "c.jpg"), filepath.Join(dir, "c.jpg"))
+	if fileExists(filepath.Join(out, "b.png")) {
+		t.Fatalf("Expected skipped b.png not to be written")
+	}
+	// only the pieces b shares with a and c are downloaded
+	files = leecher.Files()
+	pieceLen := leecher.torrentMeta.PieceLen
+	shared := 2*pieceLen - files[0].Length + (files[0].Length+files[1].Length)%pieceLen
+	if files[1].Done != shared || leecher.atomicGetBitmapElement(10) {
+		t.Fatalf("Expected %d bytes of b.png from shared pieces, have %d", shared, files[1].Done)
+	}
+	if files[0].Done != files[0].Length || files[2].Done != files[2].Length {
+		t.Fatalf("Expected all of a.jpg and c.jpg, have %+v", files)
+	}
+
+	// wanting b again picks up where we left off
+	leecher.SetFilePriority(1, PriorityLow)
+	expectState(t, leecher, StateDownloading)
+	awaitCompleted(t, leecher)
+	expectSameFile(t, filepath.Join(out, "b.png"), filepath.Join(dir, "b.png"))
+	util.EndTest()
+}
+
+func TestPickByPriority(t *testing.T) {
+	util.StartTest("Testing picking pieces of the most wanted files first...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	dir, torrent := makeFilesTorrent(tracker.URL)
+	defer os.RemoveAll(dir)
+	cl := startFilesClient(btnet.NewPipeNetwork(), "10.0.0.2", torrent, "", "")
+	defer cl.Kill()
+	cl.Pause() // so only we pick
+
+	last := cl.numPieces - 1
+	cl.SetFilePriority(0, PriorityLow)
+	cl.SetFilePriority(2, PriorityHigh)
+	picked := []int{}
+	for {
+		piece, ok := cl.atomicPickPiece(nil)
+		if !ok {
+			break
+		}
+		picked = append(picked, piece)
+	}
+	if len(picked) != cl.numPieces {
+		t.Fatalf("Expected every piece to be picked once, picked %v", picked)
+	}
+	for i := 0; i < 3; i++ {
+		if picked[i] < last-2 {
+			t.Fatalf("Expected the pieces of c.jpg first, picked %v", picked)
+		}
+	}
+	if picked[last] != 0 {
+		t.Fatalf("Expected the piece only a.jpg has last, picked %v", picked)
+	}
+
+	// pieces nobody finished are picked again, and skipped ones never are
+	cl.atomicDonePicking(5)
+	cl.atomicDonePicking(last)
+	cl.SetFilePriority(2, PrioritySkip)
+	if piece, ok := cl.atomicPickPiece(nil); !ok || piece != 5 {
+		t.Fatalf("Expected piece 5 to be picked again, got %d", piece)
+	}
+	if piece, ok := cl.atomicPickPiece(nil); ok {
+		t.Fatalf("Expected nothing left to pick, got %d", piece)
+	}
+	util.EndTest()
+}
+
+func TestPickAvailable(t *testing.T) {
+	util.StartTest("Testing downloaders only picking what peers have and stopping once done...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	dir, torrent := makeFilesTorrent(tracker.URL)
+	defer os.RemoveAll(dir)
+	network := btnet.NewPipeNetwork()
+	cl := startFilesClient(network, "10.0.0.2", torrent, "", "")
+	defer cl.Kill()
+	cl.Pause()
+
+	available := make([]bool, cl.numPieces)
+	if piece, ok := cl.atomicPickPiece(available); ok {
+		t.Fatalf("Expected nothing to be picked when nobody has anything, got %d", piece)
+	}
+	available[7] = true
+	if piece, ok := cl.atomicPickPiece(available); !ok || piece != 7 {
+		t.Fatalf("Expected the only available piece to be picked, got %d", piece)
+	}
+
+	// a seeder's downloaders have nothing to wait for
+	seeder := startFilesClient(network, "10.0.0.1", torrent, dir, "")
+	defer seeder.Kill()
+	returned := make(chan bool)
+	go func() {
+		seeder.downloadPieces()
+		returned <- true
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a seeder's downloader to return")
+	}
+	util.EndTest()
+}
@@ -0,0 +1,218 @@
+package btclient
+
+// Seeding goals
+// A torrent that has seeded up to its share ratio or for its seeding time
+// pauses or removes itself. Torrents in a session share the session's
+// goals unless given their own.
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"util"
+)
+
+// milliseconds between checks of the seeding goals
+const GoalInterval int = 1000
+
+// what a torrent does once it reaches a seeding goal
+type GoalAction int
+
+const (
+	GoalPause      GoalAction = iota // pause, keeping the data
+	GoalRemove                       // shut down and leave its session
+	GoalRemoveData                   // the same, deleting what it downloaded
+)
+
+func (a GoalAction) String() string {
+	switch a {
+	case GoalPause:
+		return "pause"
+	case GoalRemove:
+		return "remove"
+	case GoalRemoveData:
+		return "remove-data"
+	}
+	return "unknown"
+}
+
+func ParseGoalAction(str string) (GoalAction, error) {
+	switch strings.ToLower(str) {
+	case "pause":
+		return GoalPause, nil
+	case "remove":
+		return GoalRemove, nil
+	case "remove-data":
+		return GoalRemoveData, nil
+	}
+	return GoalPause, errors.New("invalid goal action " + str)
+}
+
+// When to stop seeding
+type SeedGoals struct {
+	Ratio    float64       // uploaded over the torrent's size, 0 for no limit
+	SeedTime time.Duration // spent seeding while running, 0 for no limit
+	Action   GoalAction
+}
+
+// Bytes transferred since the client started. Downloaded counts every
+// block received, including ones that failed the hash check.
+type Stats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64 // bytes of the wanted pieces we don't have yet
+	Ratio      float64
+	SeedTime   time.Duration
+
+	// bytes per second over the last RateInterval
+	UploadRate   float64
+	DownloadRate float64
+}
+
+func (cl *BTClient) Stats() Stats {
+	cl.lock("goals/Stats")
+	defer cl.unlock("goals/Stats")
+	return cl.stats()
+}
+
+// must hold lock
+func (cl *BTClient) stats() Stats {
+	left := int64(0)
+	for i, done := range cl.PieceBitmap {
+		if !done && cl.piecePriority[i] != PrioritySkip {
+			left += int64(cl.pieceLength(i))
+		}
+	}
+	return Stats{
+		Uploaded:     cl.uploaded,
+		Downloaded:   cl.downloaded,
+		Left:         left,
+		Ratio:        float64(cl.uploaded) / float64(cl.torrentMeta.GetLength()),
+		SeedTime:     cl.seedTime,
+		UploadRate:   cl.uploadRate,
+		DownloadRate: cl.downloadRate}
+}
+
+// gives this torrent its own goals, rather than its session's
+func (cl *BTClient) SetSeedGoals(goals SeedGoals) {
+	cl.setSeedGoals(goals, true)
+}
+
+// sets goals, unless they're a session's and the torrent has its own
+func (cl *BTClient) setSeedGoals(goals SeedGoals, own bool) {
+	cl.lock("goals/setSeedGoals")
+	defer cl.unlock("goals/setSeedGoals")
+	if !own && cl.ownGoals {
+		return
+	}
+	cl.ownGoals = cl.ownGoals || own
+	cl.config.SeedGoals = goals
+	cl.goalReached = false
+}
+
+func (cl *BTClient) SeedGoals() SeedGoals {
+	cl.lock("goals/SeedGoals")
+	defer cl.unlock("goals/SeedGoals")
+	return cl.config.SeedGoals
+}
+
+// returns true if the torrent has goals of its own, rather than its session's
+func (cl *BTClient) OwnSeedGoals() bool {
+	cl.lock("goals/OwnSeedGoals")
+	defer cl.unlock("goals/OwnSeedGoals")
+	return cl.ownGoals
+}
+
+// goes back to sharing its session's goals, or to having none if it
+// isn't in a session
+func (cl *BTClient) ClearSeedGoals() {
+	goals := SeedGoals{}
+	if cl.session != nil {
+		goals = cl.session.SeedGoals()
+	}
+	cl.lock("goals/ClearSeedGoals")
+	defer cl.unlock("goals/ClearSeedGoals")
+	cl.ownGoals = false
+	cl.config.SeedGoals = goals
+	cl.goalReached = false
+}
+
+func (s *Session) SeedGoals() SeedGoals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config.SeedGoals
+}
+
+// changes the goals of every torrent without goals of its own, and of
+// those added later
+func (s *Session) SetSeedGoals(goals SeedGoals) {
+	s.mu.Lock()
+	s.config.SeedGoals = goals
+	torrents := []*BTClient{}
+	for _, e := range s.torrents {
+		torrents = append(torrents, e.cl)
+	}
+	s.mu.Unlock()
+	for _, cl := range torrents {
+		cl.setSeedGoals(goals, false)
+	}
+}
+
+func (cl *BTClient) atomicAddUploaded(n int) {
+	cl.lock("goals/atomicAddUploaded")
+	defer cl.unlock("goals/atomicAddUploaded")
+	cl.uploaded += int64(n)
+}
+
+// returns true once a goal is reached, must hold lock
+func (cl *BTClient) goalsMet() bool {
+	goals := cl.config.SeedGoals
+	if cl.wantedLeft > 0 {
+		return false
+	}
+	stats := cl.stats()
+	return (goals.Ratio > 0 && stats.Ratio >= goals.Ratio) ||
+		(goals.SeedTime > 0 && stats.SeedTime >= goals.SeedTime)
+}
+
+// Counts the time since last as seeding if we're done, and acts on our
+// goals the first time one is met. Returns the time now.
+func (cl *BTClient) atomicCheckGoals(last time.Time) time.Time {
+	cl.lock("goals/atomicCheckGoals")
+	now := cl.config.Clock()
+	if cl.wantedLeft == 0 {
+		cl.seedTime += now.Sub(last)
+	}
+	reached := !cl.goalReached && cl.goalsMet()
+	if reached {
+		cl.goalReached = true
+	}
+	action := cl.config.SeedGoals.Action
+	cl.unlock("goals/atomicCheckGoals")
+	if reached {
+		util.IPrintf("%s: reached seeding goal, going to %s\n", cl.port, action)
+		go cl.reachGoal(action) // pausing waits for us to return
+	}
+	return now
+}
+
+func (cl *BTClient) reachGoal(action GoalAction) {
+	switch action {
+	case GoalPause:
+		cl.Pause()
+	case GoalRemove, GoalRemoveData:
+		deleteData := action == GoalRemoveData
+		if cl.session != nil {
+			cl.session.RemoveTorrent(cl.InfoHash(), deleteData)
+		} else {
+			cl.Remove(deleteData)
+		}
+	}
+}
+
+func (cl *BTClient) watchGoals() {
+	last := cl.config.Clock()
+	for cl.wait(GoalInterval) {
+		last = cl.atomicCheckGoals(last)
+	}
+}
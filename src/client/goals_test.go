@@ -0,0 +1,186 @@
+package btclient
+
+import (
+	"btnet"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !os.IsNotExist(err)
+}
+
+// requests each of blocks of piece 0 from cl and waits for them
+func requestBlocks(t *testing.T, cl *BTClient, network *btnet.PipeNetwork, peerId string, blocks int) {
+	conn := connectToClient(t, cl, network, peerId)
+	if conn == nil {
+		cl.Kill()
+		t.Fatalf("Client refused a well behaved peer")
+	}
+	defer conn.Close()
+	for i := 0; i < blocks; i++ {
+		conn.Write(btnet.EncodePeerMessage(btnet.PeerMessage{Type: btnet.Request, Index: 0,
+			Begin: i * 16384, Length: 16384}))
+		expectMessage(t, cl, conn, btnet.Piece)
+	}
+	util.Wait(50) // the count goes up once the write returns
+}
+
+// Tests
+func TestTransferStats(t *testing.T) {
+	util.StartTest("Testing counting bytes uploaded and downloaded...")
+	network := btnet.NewPipeNetwork()
+	seeder := makeSeederOnPipes(network)
+	util.Wait(100)
+	requestBlocks(t, seeder, network, makePeerId(1700), 2)
+	stats := seeder.Stats()
+	seeder.Kill()
+	if stats.Uploaded != 2*16384 || stats.Downloaded != 0 || stats.Left != 0 {
+		t.Fatalf("Expected 32768 bytes uploaded and nothing downloaded or left, have %+v", stats)
+	}
+	if ratio := float64(2*16384) / float64(seeder.torrentMeta.GetLength()); stats.Ratio != ratio {
+		t.Fatalf("Expected ratio %.2f, have %.2f", ratio, stats.Ratio)
+	}
+
+	network = btnet.NewPipeNetwork()
+	leecher := makeLeecherOnPipes(network, "/tmp/tstats.p")
+	defer leecher.Kill()
+	util.Wait(100)
+	sendPieces(t, leecher, network, makePeerId(1701), 0)
+	stats = leecher.Stats()
+	left := int64(leecher.torrentMeta.GetLength() - leecher.pieceLength(0))
+	if stats.Downloaded != int64(leecher.pieceLength(0)) || stats.Uploaded != 0 || stats.Left != left {
+		t.Fatalf("Expected piece 0 downloaded and %d bytes left, have %+v", left, stats)
+	}
+	util.EndTest()
+}
+
+func TestRatioGoal(t *testing.T) {
+	util.StartTest("Testing pausing once a share ratio is reached...")
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	config.SeedGoals = SeedGoals{Ratio: 0.5, Action: GoalPause}
+	cl := StartBTClientWithConfig("10.0.0.1", 6881, MalformedTorrentFile, MalformedSeedFile, "",
+		MakePersister("/tmp/persister/tgoal.p"), config)
+	defer cl.Kill()
+	util.Wait(100)
+
+	requestBlocks(t, cl, network, makePeerId(1710), 1)
+	util.Wait(1500)
+	expectState(t, cl, StateSeeding)
+	requestBlocks(t, cl, network, makePeerId(1711), 1)
+	awaitState(t, cl, StatePaused)
+
+	// resuming doesn't pause again until the goals change
+	cl.Resume()
+	util.Wait(1500)
+	expectState(t, cl, StateSeeding)
+	cl.SetSeedGoals(SeedGoals{Ratio: 0.5, Action: GoalPause})
+	awaitState(t, cl, StatePaused)
+	util.EndTest()
+}
+
+func TestSeedTimeGoal(t *testing.T) {
+	util.StartTest("Testing removing torrents once they've seeded long enough...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	clock := &fakeClock{now: at(1, 12, 0)}
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.Clock = clock.Now
+	config.SeedGoals = SeedGoals{SeedTime: time.Hour, Action: GoalRemoveData}
+	s := makeQueueSession(t, network, config)
+	defer s.Close(context.Background())
+
+	persister := MakePersister("/tmp/tgoal-a.p")
+	a, err := s.AddTorrent(makeQueueTorrent(tracker.URL, "a.jpg"), MalformedSeedFile, "", persister)
+	if err != nil {
+		t.Fatalf("Couldn't add a: %s", err)
+	}
+	b := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "b.jpg"), MalformedSeedFile)
+	b.SetSeedGoals(SeedGoals{}) // seeds forever
+	c := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "c.jpg"), MalformedSeedFile)
+	awaitState(t, a, StateSeeding)
+	awaitState(t, b, StateSeeding)
+	awaitState(t, c, StateSeeding)
+	s.SetSeedGoals(SeedGoals{SeedTime: 2 * time.Hour, Action: GoalPause})
+	a.SetSeedGoals(SeedGoals{SeedTime: time.Hour, Action: GoalRemoveData})
+	if !fileExists(persister.Path) {
+		t.Fatalf("Expected a's progress to be saved")
+	}
+
+	clock.Set(at(1, 13, 30))
+	awaitState(t, a, StateStopped)
+	if _, ok := s.Torrent(a.InfoHash()); ok {
+		t.Fatalf("Expected a to leave the session")
+	}
+	<-a.Stopped()
+	for i := 0; i < 10 && fileExists(persister.Path); i++ {
+		util.Wait(100) // deleted once it's shut down
+	}
+	if fileExists(persister.Path) {
+		t.Fatalf("Expected a's data to be deleted")
+	}
+	expectState(t, b, StateSeeding)
+	expectState(t, c, StateSeeding)
+
+	clock.Set(at(1, 14, 30))
+	awaitState(t, c, StatePaused)
+	expectState(t, b, StateSeeding)
+	if stats := b.Stats(); stats.SeedTime < 2*time.Hour {
+		t.Fatalf("Expected b to have seeded for 2 hours, has %s", stats.SeedTime)
+	}
+	util.EndTest()
+}
+
+func TestRemoveDataGoalMultiFile(t *testing.T) {
+	util.StartTest("Testing a goal removing a multi-file torrent's data and nothing else...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	dir, torrent := makeNestedTorrent(tracker.URL)
+	defer os.RemoveAll(dir)
+	defer os.Remove(torrent)
+	output, _ := ioutil.TempDir("", "tgoal-out")
+	defer os.RemoveAll(output)
+	keep := filepath.Join(output, "keep.txt")
+	ioutil.WriteFile(keep, []byte("not the torrent's"), 0644)
+
+	clock := &fakeClock{now: at(1, 12, 0)}
+	config := DefaultConfig()
+	config.Clock = clock.Now
+	config.SeedGoals = SeedGoals{SeedTime: time.Hour, Action: GoalRemoveData}
+	s := makeQueueSession(t, btnet.NewPipeNetwork(), config)
+	defer s.Close(context.Background())
+	cl, err := s.AddTorrent(torrent, dir, output, MakePersister("/tmp/tgoal-nested.p"))
+	if err != nil {
+		t.Fatalf("Couldn't add nested: %s", err)
+	}
+	awaitState(t, cl, StateSeeding)
+	for i := 0; i < 10 && !fileExists(filepath.Join(output, "sub", "b.png")); i++ {
+		util.Wait(100)
+	}
+
+	clock.Set(at(1, 13, 30))
+	<-cl.Stopped()
+	for i := 0; i < 10 && fileExists(filepath.Join(output, "a.jpg")); i++ {
+		util.Wait(100) // deleted once it's shut down
+	}
+	for _, path := range []string{filepath.Join(output, "a.jpg"), filepath.Join(output, "sub")} {
+		if fileExists(path) {
+			t.Fatalf("Expected %s to be deleted", path)
+		}
+	}
+	if !fileExists(keep) {
+		t.Fatalf("Expected a file that isn't the torrent's to be left alone")
+	}
+	util.EndTest()
+}
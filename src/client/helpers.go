@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"fs"
 	"math/rand"
+	"net"
 	"util"
 )
 
@@ -22,13 +23,53 @@ func (cl *BTClient) numBlocks(piece int) int {
 	return fs.NumBlocksInPiece(piece, int(cl.torrentMeta.PieceLen), cl.torrentMeta.GetLength())
 }
 
+func (cl *BTClient) pieceLength(piece int) int {
+	return fs.PieceLength(piece, int(cl.torrentMeta.PieceLen), cl.torrentMeta.GetLength())
+}
+
+func (cl *BTClient) blockLength(piece int, block int) int {
+	return fs.BlockLength(piece, block, int(cl.torrentMeta.PieceLen), cl.torrentMeta.GetLength())
+}
+
+// returns an error unless [begin, begin+length) lies within piece index
+// and isn't longer than a block may be
+func (cl *BTClient) checkBlock(index int, begin int, length int) error {
+	if index < 0 || index >= cl.numPieces {
+		return btnet.ErrMessageIndex
+	}
+	if length > btnet.MaxBlockLength {
+		return btnet.ErrMessageBlock
+	}
+	if begin < 0 || length <= 0 || begin+length > cl.pieceLength(index) {
+		return btnet.ErrMessageBlock
+	}
+	return nil
+}
+
+// count a protocol violation against peer and disconnect it
+func (cl *BTClient) penalize(peer *btnet.Peer, err error) {
+	cl.lock("client/penalize")
+	cl.strikes[peer.PeerId]++
+	strikes := cl.strikes[peer.PeerId]
+	cl.unlock("client/penalize")
+	util.WPrintf("%s: disconnecting %s (strike %d): %s\n", cl.port, peer.Conn.RemoteAddr(), strikes, err)
+	peer.Conn.Close()
+}
+
+// returns true if we've had enough of peerId's protocol violations
+func (cl *BTClient) atomicIsMisbehaving(peerId string) bool {
+	cl.lock("client/atomicIsMisbehaving")
+	defer cl.unlock("client/atomicIsMisbehaving")
+	return cl.strikes[peerId] >= MaxPeerStrikes
+}
+
 func (cl *BTClient) getRandomPeerOrder() []*btnet.Peer {
 	peerList := make([]*btnet.Peer, len(cl.peers))
 	order := rand.Perm(len(peerList))
 	i := 0
 	// create a list of peers in random order
-	for addr := range cl.peers {
-		peerList[order[i]] = cl.peers[addr]
+	for peerId := range cl.peers {
+		peerList[order[i]] = cl.peers[peerId]
 		i += 1
 	}
 	return peerList
@@ -48,40 +89,124 @@ func (cl *BTClient) AtomicGetBitmap() []bool {
 	return result
 }
 
+// marks piece verified, waking anything waiting for it, must hold lock
+func (cl *BTClient) setPieceDone(piece int) {
+	if cl.PieceBitmap[piece] {
+		return
+	}
+	cl.PieceBitmap[piece] = true
+	close(cl.pieceDone[piece])
+	delete(cl.deadlines, piece)
+	cl.numDone++
+	if cl.piecePriority[piece] != PrioritySkip {
+		cl.wantedLeft--
+		if cl.wantedLeft == 0 {
+			close(cl.complete)
+			cl.publish("state")
+		}
+	}
+}
+
 func (cl *BTClient) atomicGetBitmapElement(index int) bool {
 	cl.lock("getting bitmap element")
 	defer cl.unlock("getting bitmap element")
 	return cl.PieceBitmap[index]
 }
 
-func (cl *BTClient) atomicGetPeer(addr string) (*btnet.Peer, bool) {
+func (cl *BTClient) atomicGetPeer(peerId string) (*btnet.Peer, bool) {
 	cl.lock("client/atomicGetPeer")
-	p, ok := cl.peers[addr]
+	p, ok := cl.peers[peerId]
 	cl.unlock("client/atomicGetPeer")
 	return p, ok
 }
 
-func (cl *BTClient) atomicSetPeer(addr string, peer *btnet.Peer) {
-	cl.lock("client/atomicSetPeer")
-	cl.peers[addr] = peer
-	cl.unlock("client/atomicSetPeer")
-	return
+// find the peer listening on addr
+func (cl *BTClient) atomicGetPeerByAddr(addr *net.TCPAddr) (*btnet.Peer, bool) {
+	cl.lock("client/atomicGetPeerByAddr")
+	defer cl.unlock("client/atomicGetPeerByAddr")
+	for _, p := range cl.peers {
+		if p.GetAddr().String() == addr.String() {
+			return p, true
+		}
+	}
+	return nil, false
 }
 
-func (cl *BTClient) atomicDeletePeer(addr string) {
+// Adds peer, keeping a single connection per peer id. Returns the peer
+// whose connection should be closed, either peer itself or the one it
+// replaced, or nil if there wasn't one.
+func (cl *BTClient) atomicAddPeer(peer *btnet.Peer) *btnet.Peer {
+	cl.lock("client/atomicAddPeer")
+	defer cl.unlock("client/atomicAddPeer")
+	if cl.run.Err() != nil {
+		return peer // paused or shutting down
+	}
+	if peer.Outgoing {
+		cl.listenAddrs[peer.PeerId] = peer.GetAddr()
+	} else if addr, ok := cl.listenAddrs[peer.PeerId]; ok {
+		peer.SetAddr(*addr)
+	}
+	old, ok := cl.peers[peer.PeerId]
+	if !ok {
+		if !cl.makeRoom() {
+			util.TPrintf("%s: no room for peer %s\n", cl.port, peer.Conn.RemoteAddr())
+			return peer
+		}
+		cl.peers[peer.PeerId] = peer
+		return nil
+	}
+	if cl.preferConnection(peer, old) {
+		cl.peers[peer.PeerId] = peer
+		return old
+	}
+	if addr, ok := cl.listenAddrs[peer.PeerId]; ok {
+		old.SetAddr(*addr) // we may have only just learned it dialing peer
+	}
+	return peer
+}
+
+// remember where peerId listens, e.g. from the tracker
+func (cl *BTClient) atomicSetListenAddr(peerId string, addr *net.TCPAddr) {
+	cl.lock("client/atomicSetListenAddr")
+	defer cl.unlock("client/atomicSetListenAddr")
+	cl.listenAddrs[peerId] = addr
+	if peer, ok := cl.peers[peerId]; ok {
+		peer.SetAddr(*addr)
+	}
+}
+
+// Returns true if we should keep connection a over b to the same peer.
+// When both sides dial at once each ends up with two connections, so both
+// keep the one dialed by the smaller peer id.
+func (cl *BTClient) preferConnection(a *btnet.Peer, b *btnet.Peer) bool {
+	if a.Outgoing == b.Outgoing {
+		return false // a real duplicate, keep the established one
+	}
+	weDialed := a.Outgoing
+	return weDialed == (cl.peerId < a.PeerId)
+}
+
+// removes peer unless it has already been replaced
+func (cl *BTClient) atomicDeletePeer(peer *btnet.Peer) {
 	cl.lock("client/atomicDeletePeer")
-	util.WPrintf("%s: keepalive timeout exceeded for %s\n", cl.port, addr)
-	delete(cl.peers, addr)
+	if cl.peers[peer.PeerId] == peer {
+		util.TPrintf("%s: removing peer %s\n", cl.port, peer.Conn.RemoteAddr())
+		delete(cl.peers, peer.PeerId)
+		delete(cl.peerRates, peer.PeerId)
+		cl.config.Connections.closed()
+		cl.wakeDialer()
+		cl.loseRequests()
+	}
 	cl.unlock("client/atomicDeletePeer")
 }
 
-func (cl *BTClient) atomicGetPeerAddrs() []string {
-	cl.lock("client/atomicGetPeerAddrs")
+func (cl *BTClient) atomicGetPeerIds() []string {
+	cl.lock("client/atomicGetPeerIds")
 	result := []string{}
-	for addr := range cl.peers {
-		result = append(result, addr)
+	for peerId := range cl.peers {
+		result = append(result, peerId)
 	}
-	cl.unlock("client/atomicGetPeerAddrs")
+	cl.unlock("client/atomicGetPeerIds")
 	return result
 }
 
@@ -91,3 +216,14 @@ func (cl *BTClient) atomicGetNumPeers() int {
 	cl.unlock("client/atomicGetNumPeers")
 	return num
 }
+
+// peers are identified by TCP address, even when connected over uTP
+func tcpAddrOf(addr net.Addr) (*net.TCPAddr, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a, nil
+	case *net.UDPAddr:
+		return &net.TCPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}, nil
+	}
+	return net.ResolveTCPAddr("tcp", addr.String())
+}
@@ -0,0 +1,304 @@
+package btclient
+
+import (
+	"btnet"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+	"util"
+)
+
+const MalformedSeedFile = "../test/seed/puppy.jpg"
+const MalformedTorrentFile = "../test/torrent/puppy.torrent"
+
+// Helpers
+func makeSeederOnPipes(network *btnet.PipeNetwork) *BTClient {
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	persister := MakePersister("/tmp/persister/tmalformed.p")
+	return StartBTClientWithConfig("10.0.0.1", 6881, MalformedTorrentFile, MalformedSeedFile, "", persister, config)
+}
+
+// starts a client with nothing downloaded yet
+func makeLeecherOnPipes(network *btnet.PipeNetwork, persisterPath string) *BTClient {
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	return makeLeecherWithConfig(persisterPath, config)
+}
+
+func makeLeecherWithConfig(persisterPath string, config Config) *BTClient {
+	os.Remove(persisterPath)
+	persister := MakePersister(persisterPath)
+	return StartBTClientWithConfig("10.0.0.1", 6881, MalformedTorrentFile, "", "", persister, config)
+}
+
+func makePeerId(n int) string {
+	return fmt.Sprintf("-TT0000-%012d", n)
+}
+
+// handshakes with cl as peerId, returning nil if the client hangs up
+func connectToClient(t *testing.T, cl *BTClient, network *btnet.PipeNetwork, peerId string) net.Conn {
+	return connectFrom(t, cl, network, "127.0.0.1", peerId)
+}
+
+func connectFrom(t *testing.T, cl *BTClient, network *btnet.PipeNetwork, ip string, peerId string) net.Conn {
+	conn, err := network.DialFrom(ip, cl.ip+":"+cl.port)
+	if err != nil {
+		cl.Kill()
+		t.Fatalf("Dial error: %s", err)
+	}
+	handshake := makeTestHandshake(cl)
+	handshake.PeerId = []byte(peerId)
+	conn.Write(btnet.EncodeHandshake(handshake))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := btnet.ReadHandshake(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil
+	}
+	if reply := btnet.DecodeHandshake(data); string(reply.PeerId) != cl.peerId {
+		cl.Kill()
+		t.Fatalf("Expected handshake reply, got %v", reply)
+	}
+	return conn
+}
+
+// returns the next message of type msgType, skipping anything else
+func expectMessage(t *testing.T, cl *BTClient, conn net.Conn, msgType btnet.MessageType) btnet.PeerMessage {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		data, err := btnet.ReadMessage(conn)
+		if err != nil {
+			cl.Kill()
+			t.Fatalf("Expected message of type %d, got %s", msgType, err)
+		}
+		msg, err := btnet.DecodePeerMessage(data, cl.numPieces)
+		if err == nil && !msg.KeepAlive && msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// the client should hang up on us without a reply
+func expectDisconnect(t *testing.T, cl *BTClient, conn net.Conn, name string) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, err := btnet.ReadMessage(conn); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				cl.Kill()
+				t.Fatalf("%s: client didn't disconnect", name)
+			}
+			return
+		}
+	}
+}
+
+func (cl *BTClient) atomicGetStrikes(peerId string) int {
+	cl.lock("client/atomicGetStrikes")
+	defer cl.unlock("client/atomicGetStrikes")
+	return cl.strikes[peerId]
+}
+
+func makeRawMessage(msgType btnet.MessageType, fields ...uint32) []byte {
+	data := make([]byte, 5+4*len(fields))
+	binary.BigEndian.PutUint32(data, uint32(1+4*len(fields)))
+	data[4] = byte(msgType)
+	for i, field := range fields {
+		binary.BigEndian.PutUint32(data[5+4*i:], field)
+	}
+	return data
+}
+
+// Tests
+func TestClientRejectsMalformedMessages(t *testing.T) {
+	util.StartTest("Testing client with malformed peer messages...")
+	network := btnet.NewPipeNetwork()
+	cl := makeSeederOnPipes(network)
+	util.Wait(100)
+
+	pieceLen := uint32(cl.pieceLength(0))
+	lastLen := uint32(cl.pieceLength(cl.numPieces - 1))
+	numPieces := uint32(cl.numPieces)
+	badPiece := makeRawMessage(btnet.Piece, 0, pieceLen-1)
+	badPiece = append(badPiece, 0xaa, 0xbb)
+	binary.BigEndian.PutUint32(badPiece, uint32(len(badPiece)-4))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"have past last piece", makeRawMessage(btnet.Have, numPieces)},
+		{"have with negative index", makeRawMessage(btnet.Have, 0xffffffff)},
+		{"bitfield too long", append(makeRawMessage(btnet.Bitfield), 0xff, 0xff, 0xff)},
+		{"bitfield too short", makeRawMessage(btnet.Bitfield)},
+		{"bitfield with spare bits", append(makeRawMessage(btnet.Bitfield), 0xff)},
+		{"request past last piece", makeRawMessage(btnet.Request, numPieces, 0, 16384)},
+		{"request past piece end", makeRawMessage(btnet.Request, 0, pieceLen, 16384)},
+		{"request past short last piece", makeRawMessage(btnet.Request, numPieces-1, lastLen-1, 2)},
+		{"request with negative begin", makeRawMessage(btnet.Request, 0, 0xffffffff, 16384)},
+		{"request with negative length", makeRawMessage(btnet.Request, 0, 0, 0xffffffff)},
+		{"request with zero length", makeRawMessage(btnet.Request, 0, 0, 0)},
+		{"request for a huge block", makeRawMessage(btnet.Request, 0, 0, 1<<20)},
+		{"truncated request", makeRawMessage(btnet.Request, 0)},
+		{"piece past piece end", badPiece},
+		{"unknown message type", makeRawMessage(20, 0)},
+		{"oversized frame", []byte{0xff, 0xff, 0xff, 0xff, byte(btnet.Piece)}},
+	}
+
+	for i, test := range tests {
+		peerId := makePeerId(i)
+		conn := connectToClient(t, cl, network, peerId)
+		if conn == nil {
+			cl.Kill()
+			t.Fatalf("%s: client refused a well behaved peer", test.name)
+		}
+		expectMessage(t, cl, conn, btnet.Bitfield)
+		conn.Write(test.data)
+		expectDisconnect(t, cl, conn, test.name)
+		conn.Close()
+		if strikes := cl.atomicGetStrikes(peerId); strikes != 1 {
+			cl.Kill()
+			t.Fatalf("%s: expected 1 strike, got %d", test.name, strikes)
+		}
+	}
+
+	if cl.CheckShutdown() || !util.AllTrue(cl.AtomicGetBitmap()) {
+		t.Fatalf("Client should keep seeding after malformed messages")
+	}
+	cl.Kill()
+	util.EndTest()
+}
+
+func TestClientRefusesMisbehavingPeer(t *testing.T) {
+	util.StartTest("Testing client refusing a peer with too many strikes...")
+	network := btnet.NewPipeNetwork()
+	cl := makeSeederOnPipes(network)
+	util.Wait(100)
+
+	peerId := makePeerId(100)
+	for i := 0; i < MaxPeerStrikes; i++ {
+		conn := connectToClient(t, cl, network, peerId)
+		if conn == nil {
+			cl.Kill()
+			t.Fatalf("Client refused peer after %d strikes", i)
+		}
+		conn.Write(makeRawMessage(btnet.Have, uint32(cl.numPieces)))
+		expectDisconnect(t, cl, conn, fmt.Sprintf("strike %d", i+1))
+		conn.Close()
+	}
+	// the handshake is answered before the client knows who we are,
+	// but it should hang up before sending anything else
+	if conn := connectToClient(t, cl, network, peerId); conn != nil {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		data, err := btnet.ReadMessage(conn)
+		conn.Close()
+		if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+			cl.Kill()
+			t.Fatalf("Client accepted peer with %d strikes, sent %v", MaxPeerStrikes, data)
+		}
+	}
+	if conn := connectToClient(t, cl, network, makePeerId(101)); conn == nil {
+		cl.Kill()
+		t.Fatalf("Client refused a well behaved peer")
+	} else {
+		conn.Close()
+	}
+	cl.Kill()
+	util.EndTest()
+}
+
+func TestClientServesValidRequests(t *testing.T) {
+	util.StartTest("Testing client serving requests of any size and offset...")
+	network := btnet.NewPipeNetwork()
+	cl := makeSeederOnPipes(network)
+	util.Wait(100)
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+
+	conn := connectToClient(t, cl, network, makePeerId(200))
+	if conn == nil {
+		cl.Kill()
+		t.Fatalf("Client refused a well behaved peer")
+	}
+	defer conn.Close()
+	expectMessage(t, cl, conn, btnet.Bitfield)
+
+	last := cl.numPieces - 1
+	lastBlock := cl.numBlocks(last) - 1
+	requests := []btnet.PeerMessage{
+		{Type: btnet.Request, Index: 0, Begin: 0, Length: cl.blockLength(0, 0)},
+		{Type: btnet.Request, Index: int32(last), Begin: lastBlock * 16384, Length: cl.blockLength(last, lastBlock)},
+		{Type: btnet.Request, Index: 0, Begin: 1, Length: 100},
+		{Type: btnet.Request, Index: 0, Begin: 1000, Length: 20000},
+		{Type: btnet.Request, Index: 0, Begin: 0, Length: cl.pieceLength(0)},
+		{Type: btnet.Request, Index: int32(last), Begin: 5, Length: cl.pieceLength(last) - 5},
+	}
+	for _, request := range requests {
+		conn.Write(btnet.EncodePeerMessage(request))
+		msg := expectMessage(t, cl, conn, btnet.Piece)
+		start := int(request.Index)*cl.pieceLength(0) + request.Begin
+		if msg.Index != request.Index || msg.Begin != request.Begin ||
+			!util.ByteArrayEquals(msg.Block, seed[start:start+request.Length]) {
+			cl.Kill()
+			t.Fatalf("Bad reply to request %v", request)
+		}
+	}
+	if strikes := cl.atomicGetStrikes(makePeerId(200)); strikes != 0 {
+		cl.Kill()
+		t.Fatalf("Well behaved peer has %d strikes", strikes)
+	}
+	cl.Kill()
+	util.EndTest()
+}
+
+func TestClientStoresUnalignedBlocks(t *testing.T) {
+	util.StartTest("Testing client storing blocks by byte offset...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLeecherOnPipes(network, "/tmp/persister/tunaligned.p")
+	util.Wait(100)
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+
+	conn := connectToClient(t, cl, network, makePeerId(300))
+	if conn == nil {
+		cl.Kill()
+		t.Fatalf("Client refused a well behaved peer")
+	}
+	defer conn.Close()
+
+	// overlapping chunks that don't line up with blocks
+	pieceLen := cl.pieceLength(0)
+	chunks := []struct{ index, begin, end int }{
+		{0, 20000, pieceLen},
+		{0, 0, 1000},
+		{0, 900, 20001},
+		{1, 0, cl.pieceLength(1)},
+	}
+	for _, chunk := range chunks {
+		start := chunk.index * pieceLen
+		msg := btnet.PeerMessage{Type: btnet.Piece, Index: int32(chunk.index), Begin: chunk.begin,
+			Block: seed[start+chunk.begin : start+chunk.end]}
+		conn.Write(btnet.EncodePeerMessage(msg))
+	}
+	util.Wait(200)
+
+	if !util.AllTrue(cl.AtomicGetBitmap()) {
+		cl.Kill()
+		t.Fatalf("Expected all pieces, have %v", cl.AtomicGetBitmap())
+	}
+	cl.lock("test")
+	for i, piece := range cl.Pieces {
+		if !util.ByteArrayEquals(piece.Data, seed[i*pieceLen:i*pieceLen+cl.pieceLength(i)]) {
+			cl.unlock("test")
+			cl.Kill()
+			t.Fatalf("Piece %d doesn't match the seed", i)
+		}
+	}
+	cl.unlock("test")
+	cl.Kill()
+	util.EndTest()
+}
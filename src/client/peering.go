@@ -11,84 +11,139 @@ import (
 )
 
 const peerTimeout = time.Millisecond * 3000
-const DialTimeout = time.Millisecond * 100
+const DialTimeout = time.Second * 5
 
-func (cl *BTClient) startTCPServer() {
-	if !btnet.StartTCPServer(cl.ip+":"+cl.port, cl.messageHandler) {
+// listen on every configured network, giving up if none of them work
+func (cl *BTClient) startServers() {
+	listening := false
+	for _, network := range cl.config.Networks {
+		ln, err := network.Listen(cl.ip + ":" + cl.port)
+		if err != nil {
+			util.WPrintf("%s: could not listen on %T: %s\n", cl.port, network, err)
+			continue
+		}
+		listening = true
+		cl.lock("peering/startServers")
+		if cl.run.Err() != nil { // paused or shut down while we were starting
+			cl.unlock("peering/startServers")
+			ln.Close()
+			return
+		}
+		cl.listeners = append(cl.listeners, ln)
+		cl.unlock("peering/startServers")
+		cl.spawn(func() {
+			btnet.Serve(btnet.FilterListener(ln, cl.allowedAddr), cl.messageHandler, cl.encryptionConfig())
+		})
+	}
+	if !listening {
 		util.EPrintf("Error: port %s already in use\n", cl.port)
-		cl.Kill()
+		cl.stop()
 	}
 }
 
-func (cl *BTClient) requestBlock(piece int, block int) {
+func (cl *BTClient) encryptionConfig() *btnet.EncryptionConfig {
+	return &btnet.EncryptionConfig{
+		Policy:     cl.config.Encryption,
+		InfoHashes: func() [][]byte { return [][]byte{[]byte(cl.infoHash)} }}
+}
+
+// asks peers that have piece for block, returns false if none could be asked
+func (cl *BTClient) requestBlock(piece int, block int) bool {
 	cl.lock("peering/requestBlock")
-	util.TPrintf("%s: want to request piece %d block %d, current peers %v\n", cl.port, piece, block, cl.peers)
+	util.TPrintf("%s: want to request piece %d block %d, current peers %d\n", cl.port, piece, block, len(cl.peers))
 	peerList := cl.getRandomPeerOrder()
 	port := cl.port
 	cl.unlock("peering/requestBlock")
 
+	pinned := cl.atomicGetPinned(piece)
+	if pinned != "" {
+		// only ask the peer we're checking, unless it's gone
+		pinnedList := []*btnet.Peer{}
+		for _, peer := range peerList {
+			if ipOf(peer) == pinned {
+				pinnedList = append(pinnedList, peer)
+			}
+		}
+		if len(pinnedList) == 0 {
+			cl.atomicUnpin(piece)
+		} else {
+			peerList = pinnedList
+		}
+	}
+	if cl.atomicHasDeadline(piece) {
+		// it's in a hurry, so ask the fastest peers first
+		cl.atomicSortByRate(peerList)
+	}
+
+	requested := false
 	for _, peer := range peerList {
 		if peer.GetBitfield()[piece] && !peer.GetStatus().PeerChoking {
-			util.TPrintf("%s: requesting piece %d block %d from peer %s\n", port, piece, block, peer.Addr)
+			util.TPrintf("%s: requesting piece %d block %d from peer %s\n", port, piece, block, peer.Conn.RemoteAddr())
 			begin := block * fs.BlockSize
-			cl.sendRequestMessage(peer, piece, begin, fs.BlockSize)
+			cl.sendRequestMessage(peer, piece, begin, cl.blockLength(piece, block))
+			requested = true
 		}
 	}
-
+	return requested
 }
 
-func (cl *BTClient) sendBlock(index int, begin int, length int, peer *btnet.Peer) {
+// send a block we have, returns an error if the request is out of bounds
+func (cl *BTClient) sendBlock(index int, begin int, length int, peer *btnet.Peer) error {
+	if err := cl.checkBlock(index, begin, length); err != nil {
+		return err
+	}
+	cl.lock("peering/sendBlock")
 	if !cl.PieceBitmap[index] {
+		cl.unlock("peering/sendBlock")
 		util.TPrintf("%s: we don't have this piece\n", cl.port)
-		return
-	}
-	if length != fs.BlockSize {
-		util.TPrintf("%s: different block size\n", cl.port)
-		// the requester is using a different block size
-		// deny the request for simplicity
-		return
+		return nil
 	}
-	if begin%fs.BlockSize != 0 {
-		util.TPrintf("%s: not aligned with a block\n", cl.port)
-		return
-	}
-	blockIndex := begin / fs.BlockSize
-	util.TPrintf("%s: sending piece %d, block %d\n", cl.port, index, blockIndex)
-	data := cl.Pieces[index].Blocks[blockIndex]
-	go cl.sendPieceMessage(peer, index, begin, length, data)
+	// verified pieces are never written again, so the slice is safe to share
+	data := cl.Pieces[index].Data[begin : begin+length]
+	cl.unlock("peering/sendBlock")
+	util.TPrintf("%s: sending piece %d, bytes %d-%d\n", cl.port, index, begin, begin+length)
+	cl.spawn(func() { cl.sendPieceMessage(peer, index, begin, length, data) })
+	return nil
 }
 
-func (cl *BTClient) saveBlock(index int, begin int, length int, block []byte) {
-	if begin%fs.BlockSize != 0 {
-		util.TPrintf("%s: not aligned with a block\n", cl.port)
-		return
+// store data peer sent at its offset in the piece, returns an error
+// if it's out of bounds
+func (cl *BTClient) saveBlock(index int, begin int, block []byte, peer *btnet.Peer) error {
+	if err := cl.checkBlock(index, begin, len(block)); err != nil {
+		return err
 	}
-	blockIndex := begin / fs.BlockSize
 
-	util.TPrintf("%s: saving piece %d, block %d\n", cl.port, index, blockIndex)
+	util.TPrintf("%s: saving piece %d, bytes %d-%d\n", cl.port, index, begin, begin+len(block))
 	cl.lock("peering/saveBlock")
-	if length < fs.BlockSize {
-		util.TPrintf("%s: len less than BlockSize\n", cl.port)
-		cl.Pieces[index].Blocks[blockIndex] = block
-	} else {
-		cl.Pieces[index].Blocks[blockIndex] = block[:fs.BlockSize]
+	if cl.PieceBitmap[index] {
+		// already verified, don't let a late duplicate overwrite it
+		cl.unlock("peering/saveBlock")
+		return nil
 	}
-
-	if _, ok := cl.blockBitmap[index]; !ok {
-		cl.blockBitmap[index] = make([]bool, cl.numBlocks(index), cl.numBlocks(index))
+	ip := ipOf(peer)
+	if pinned, ok := cl.pinned[index]; ok && pinned != ip {
+		// we're finding out who sent bad data, late blocks would muddle it
+		cl.unlock("peering/saveBlock")
+		return nil
 	}
-	cl.blockBitmap[index][blockIndex] = true
+	cl.downloaded += int64(len(block))
+	cl.addReceived(peer, len(block))
+	copy(cl.Pieces[index].Data[begin:], block)
+	cl.attribute(index, begin, begin+len(block), ip)
+
+	cl.received[index] = cl.received[index].Add(begin, begin+len(block))
 
-	if util.AllTrue(cl.blockBitmap[index]) {
+	if cl.received[index].Covers(0, cl.pieceLength(index)) {
 		// hash and save piece
 		if cl.Pieces[index].Hash() != cl.torrentMeta.PieceHashes[index] {
 			util.WPrintf("%s: hashes didn't match - lengths: %d, %d", cl.port, len(cl.Pieces[index].Hash()), len(cl.torrentMeta.PieceHashes[index]))
-			delete(cl.blockBitmap, index)
+			cl.pieceFailed(index)
 			cl.unlock("peering/saveBlock")
-			return
+			return nil
 		}
 		util.TPrintf("%s: saving piece %d\n", cl.port, index)
-		cl.PieceBitmap[index] = true
+		cl.piecePassed(index)
+		cl.setPieceDone(index)
 		pieceBitmap := make([]bool, len(cl.PieceBitmap))
 		copy(pieceBitmap, cl.PieceBitmap)
 		pieces := make([]fs.Piece, len(cl.Pieces))
@@ -97,13 +152,14 @@ func (cl *BTClient) saveBlock(index int, begin int, length int, block []byte) {
 	}
 	cl.unlock("peering/saveBlock")
 
-	for _, addr := range cl.atomicGetPeerAddrs() {
+	for _, peerId := range cl.atomicGetPeerIds() {
 		// send have message
-		p, ok := cl.atomicGetPeer(addr)
+		p, ok := cl.atomicGetPeer(peerId)
 		if ok {
-			cl.sendHaveMessage(p, index, begin, length)
+			cl.sendHaveMessage(p, index, begin, len(block))
 		}
 	}
+	return nil
 }
 
 func (cl *BTClient) loadPieces(data []byte) {
@@ -112,8 +168,28 @@ func (cl *BTClient) loadPieces(data []byte) {
 	}
 	r := bytes.NewBuffer(data)
 	d := gob.NewDecoder(r)
-	d.Decode(&cl.Pieces)
-	d.Decode(&cl.PieceBitmap)
+	pieces := []fs.Piece{}
+	pieceBitmap := []bool{}
+	if d.Decode(&pieces) != nil || d.Decode(&pieceBitmap) != nil {
+		util.WPrintf("%s: ignoring unreadable saved state\n", cl.port)
+		return
+	}
+	if len(pieces) != cl.numPieces || len(pieceBitmap) != cl.numPieces {
+		util.WPrintf("%s: ignoring saved state for a different torrent\n", cl.port)
+		return
+	}
+	for i := range pieces {
+		if len(pieces[i].Data) != cl.pieceLength(i) {
+			util.WPrintf("%s: ignoring saved state with a bad piece %d\n", cl.port, i)
+			return
+		}
+	}
+	cl.Pieces = pieces
+	for i, done := range pieceBitmap {
+		if done {
+			cl.setPieceDone(i)
+		}
+	}
 }
 
 func (cl *BTClient) sendRequestMessage(peer *btnet.Peer, index int, begin int, length int) {
@@ -122,7 +198,7 @@ func (cl *BTClient) sendRequestMessage(peer *btnet.Peer, index int, begin int, l
 		Index:  int32(index),
 		Begin:  begin,
 		Length: length}
-	cl.SendPeerMessage(&peer.Addr, message)
+	peer.AddToMessageQueue(message)
 }
 
 func (cl *BTClient) sendPieceMessage(peer *btnet.Peer, index int, begin int, length int, data []byte) {
@@ -132,7 +208,7 @@ func (cl *BTClient) sendPieceMessage(peer *btnet.Peer, index int, begin int, len
 		Begin:  begin,
 		Length: length,
 		Block:  data}
-	cl.SendPeerMessage(&peer.Addr, message)
+	peer.AddToMessageQueue(message)
 }
 
 func (cl *BTClient) sendHaveMessage(peer *btnet.Peer, index int, begin int, length int) {
@@ -141,27 +217,59 @@ func (cl *BTClient) sendHaveMessage(peer *btnet.Peer, index int, begin int, leng
 		Index:  int32(index),
 		Begin:  begin,
 		Length: length}
-	cl.SendPeerMessage(&peer.Addr, message)
+	peer.AddToMessageQueue(message)
 }
 
-func (cl *BTClient) SetupPeerConnections(addr *net.TCPAddr, conn *net.TCPConn) {
+func (cl *BTClient) SetupPeerConnections(addr *net.TCPAddr, conn net.Conn) {
 	// Try dialing
 	// connection := DoDial(addr, data)
 
+	if addr == nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	if !cl.allowedIP(addr.IP) {
+		util.TPrintf("%s: refusing blocked peer %s\n", cl.port, addr)
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
 	infoHash := fs.GetInfoHash(fs.ReadTorrent(cl.torrentPath))
 	peerId := cl.peerId
 	bitfieldLength := cl.numPieces
-	peer := btnet.InitializePeer(addr, infoHash, peerId, bitfieldLength, conn, cl.PieceBitmap)
-	if peer == nil {
+	if conn == nil {
+		cl.config.Connections.startDial()
+	}
+	peer, err := btnet.InitializePeer(addr, infoHash, peerId, bitfieldLength, conn, cl.PieceBitmap, cl.dialer)
+	if conn == nil {
+		cl.config.Connections.endDial()
+	}
+	if err != nil {
 		// We got a bad handshake so drop the connection
+		util.TPrintf("%s: dropping connection to %s: %s\n", cl.port, addr, err)
+		return
+	}
+	cl.limitPeer(peer)
+	if cl.atomicIsMisbehaving(peer.PeerId) {
+		util.TPrintf("%s: refusing misbehaving peer %s\n", cl.port, addr)
+		peer.Conn.Close()
 		return
 	}
-	cl.atomicSetPeer(addr.String(), peer)
+	if drop := cl.atomicAddPeer(peer); drop != nil {
+		util.TPrintf("%s: dropping connection to %s: %s\n", cl.port, drop.Conn.RemoteAddr(), btnet.ErrHandshakeDuplicate)
+		drop.Conn.Close()
+		if drop == peer {
+			return
+		}
+	}
 
 	// Start go routine that handles the closing of the tcp connection if we dont
 	// get a keepAlive signal
 	// Separate go routine for sending keepalive signals
-	go func() {
+	cl.spawn(func() {
 		for {
 			if peer == nil || peer.Conn.RemoteAddr() == nil {
 				return
@@ -173,6 +281,8 @@ func (cl *BTClient) SetupPeerConnections(addr *net.TCPAddr, conn *net.TCPConn) {
 				util.TPrintf("Received message from msgqueue - Type: %v\n", msg.Type)
 			case <-time.After(peerTimeout / 3):
 				msg = btnet.PeerMessage{KeepAlive: true}
+			case <-peer.Done:
+				return
 			}
 
 			data := btnet.EncodePeerMessage(msg)
@@ -181,6 +291,9 @@ func (cl *BTClient) SetupPeerConnections(addr *net.TCPAddr, conn *net.TCPConn) {
 
 			_, err := peer.Conn.Write(data)
 			peer.MarkMessageSent(msg)
+			if err == nil && !msg.KeepAlive && msg.Type == btnet.Piece {
+				cl.atomicAddUploaded(len(msg.Block))
+			}
 			if err != nil {
 				// Connection is probably closed
 				// TODO: Not sure if this is the right way of checking this
@@ -192,10 +305,10 @@ func (cl *BTClient) SetupPeerConnections(addr *net.TCPAddr, conn *net.TCPConn) {
 			}
 			util.TPrintf("Sent message type: %v, to: %s\n", msg.Type, peer.Conn.RemoteAddr().String())
 		}
-	}()
+	})
 
 	// KeepAlive loop
-	go func() {
+	cl.spawn(func() {
 		for {
 			select {
 			case <-peer.KeepAlive:
@@ -204,28 +317,24 @@ func (cl *BTClient) SetupPeerConnections(addr *net.TCPAddr, conn *net.TCPConn) {
 				if peer.Conn.RemoteAddr() != nil {
 					peer.Conn.Close()
 				}
-				cl.atomicDeletePeer(peer.Addr.String())
+				cl.atomicDeletePeer(peer)
+				return
+			case <-peer.Done:
 				return
 			}
 		}
-	}()
+	})
 
 	// Start another go routine to read stuff from that channel
-	go func() {
-		if peer.Conn.RemoteAddr() == nil {
-			util.TPrintf("Connection closed!\n")
-		} else {
-			util.TPrintf("Connection alive!\n")
-		}
-		cl.messageHandler(&peer.Conn)
-	}()
+	cl.spawn(func() { cl.handlePeerMessages(peer) })
 }
 
+// send message to the peer listening on addr, connecting if needed
 func (cl *BTClient) SendPeerMessage(addr *net.TCPAddr, message btnet.PeerMessage) {
-	peer, ok := cl.atomicGetPeer(addr.String())
+	peer, ok := cl.atomicGetPeerByAddr(addr)
 	if !ok {
 		cl.SetupPeerConnections(addr, nil)
-		peer, ok = cl.atomicGetPeer(addr.String())
+		peer, ok = cl.atomicGetPeerByAddr(addr)
 		if !ok {
 			util.WPrintf("%d: failed to establish a connection with %s\n", cl.port, addr)
 			return
@@ -237,34 +346,58 @@ func (cl *BTClient) SendPeerMessage(addr *net.TCPAddr, message btnet.PeerMessage
 	return
 }
 
-func (cl *BTClient) messageHandler(conn *net.TCPConn) {
-	// Check if this is a new connection
-	// If so we need to initialize the Peer
+// handles incoming connections
+func (cl *BTClient) messageHandler(conn net.Conn) {
 	if conn == nil || conn.RemoteAddr() == nil {
 		return
 	}
-	peer, ok := cl.atomicGetPeer(conn.RemoteAddr().String())
-	if !ok {
-		// This internally calls messageHandler in a separate goRoutine
-		cl.SetupPeerConnections(conn.RemoteAddr().(*net.TCPAddr), conn)
+	if cl.CheckShutdown() { // a paused torrent in a session
+		conn.Close()
+		return
+	}
+	addr, err := tcpAddrOf(conn.RemoteAddr())
+	if err != nil {
+		util.TPrintf("%s: dropping connection from %s: %s\n", cl.port, conn.RemoteAddr(), err)
+		conn.Close()
 		return
 	}
+	// The listen address isn't known until the tracker tells us
+	cl.SetupPeerConnections(addr, conn)
+}
 
+// reads and handles messages from peer until the connection closes
+func (cl *BTClient) handlePeerMessages(peer *btnet.Peer) {
+	conn := peer.Conn
+	defer cl.atomicDeletePeer(peer)
+	defer peer.Close()
 	util.TPrintf("~~~ Got a connection! ~~~\n")
 	for {
 		// Process the message
 		buf, err := btnet.ReadMessage(conn)
-		if err != nil {
+		if err == btnet.ErrMessageTooLarge {
+			cl.penalize(peer, err)
+			return
+		} else if err != nil {
 			util.WPrintf("%s\n", err)
 			conn.Close()
 			return
 		}
-		peerMessage := btnet.DecodePeerMessage(buf, len(cl.torrentMeta.PieceHashes))
+		peerMessage, err := btnet.DecodePeerMessage(buf, len(cl.torrentMeta.PieceHashes))
+		if err != nil {
+			cl.penalize(peer, err)
+			return
+		}
 		util.TPrintf("Received PeerMessage, type: %v, from: %s\n", peerMessage.Type, conn.RemoteAddr().String())
 
 		// Really anytime we receive a message we should treat this as
 		// a KeepAlive message
-		peer.KeepAlive <- true
+		select {
+		case peer.KeepAlive <- true:
+		default: // there's one waiting already
+		}
+		if !peerMessage.KeepAlive {
+			peer.MarkActive()
+		}
 
 		// Massive switch case that would handle incoming messages depending on message type
 		if !peerMessage.KeepAlive {
@@ -273,40 +406,41 @@ func (cl *BTClient) messageHandler(conn *net.TCPConn) {
 				peer.SetChoking(true)
 			case btnet.Unchoke:
 				peer.SetChoking(false)
+				cl.atomicWakePickers()
 			case btnet.Interested:
 				peer.SetInterested(true)
 			case btnet.NotInterested:
 				peer.SetInterested(false)
 			case btnet.Have:
-				peer.SetBitfieldElement(peerMessage.Index, true)
+				err = peer.SetBitfieldElement(peerMessage.Index, true)
+				cl.atomicWakePickers()
 			case btnet.Bitfield:
-				peer.SetBitfield(peerMessage.Bitfield)
+				err = peer.SetBitfield(peerMessage.Bitfield)
+				cl.atomicWakePickers()
 			case btnet.Request:
 				index := int(peerMessage.Index)
 				util.TPrintf("%s: received request msg\n", cl.port)
 				cl.atomicAddUpdate(conn.RemoteAddr().String(), index, "Sending")
-				cl.sendBlock(index, peerMessage.Begin, peerMessage.Length, peer)
+				err = cl.sendBlock(index, peerMessage.Begin, peerMessage.Length, peer)
 			case btnet.Piece:
 				index := int(peerMessage.Index)
 				util.TPrintf("%s: received piece %d msg\n", cl.port, index)
 				cl.atomicAddUpdate(conn.RemoteAddr().String(), index, "Received")
-				cl.saveBlock(index, peerMessage.Begin, peerMessage.Length, peerMessage.Block)
+				err = cl.saveBlock(index, peerMessage.Begin, peerMessage.Block, peer)
 			case btnet.Cancel:
 				// TODO make a cancel queue and dont send out pieces if you recieve one of these
-				fallthrough
 			default:
-				// Unsupported message
-				util.WPrintf("%s: unsupported message\n", cl.port)
-				// Drop the connection
-				conn.Close()
+				err = btnet.ErrMessageType
 			}
 		}
+		if err != nil {
+			cl.penalize(peer, err)
+			return
+		}
 
-		// Update okay to make sure that we still have a connection
-		ok = conn.RemoteAddr() != nil
-		if !ok {
+		// Make sure that we still have a connection
+		if conn.RemoteAddr() == nil {
 			return
 		}
 	}
-	util.TPrintf("%s: exiting messageHandler\n", cl.port)
 }
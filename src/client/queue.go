@@ -0,0 +1,200 @@
+package btclient
+
+// Queueing
+// A session downloads at most MaxActiveDownloads torrents and seeds at
+// most MaxActiveSeeds at once, lowest queue position first. The rest are
+// paused until there's room, e.g. when a download finishes. Downloads
+// that stall stop counting towards the limit so the next one can start,
+// and force started torrents run whatever the queue says.
+
+import (
+	"sort"
+	"time"
+)
+
+// milliseconds between looks at the queue
+const QueueInterval int = 1000
+
+// a torrent and its place in a session's queue
+type queueEntry struct {
+	cl           *BTClient
+	position     int       // lowest runs first
+	forced       bool      // runs whatever the queue says
+	done         int       // pieces verified when we last looked
+	lastProgress time.Time // when done last went up, or the torrent last started
+}
+
+// returns every torrent in queue order
+func (s *Session) Queue() []*BTClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	torrents := []*BTClient{}
+	for _, e := range s.ordered() {
+		torrents = append(torrents, e.cl)
+	}
+	return torrents
+}
+
+// Moves the torrent with the given hex info hash to position in the
+// queue, 0 being the front, shifting the others along
+func (s *Session) SetQueuePosition(infoHash string, position int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entry(infoHash)
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	entries := s.ordered()
+	if position < 0 {
+		position = 0
+	}
+	if position >= len(entries) {
+		position = len(entries) - 1
+	}
+	entries = append(entries[:e.position], entries[e.position+1:]...)
+	entries = append(entries[:position], append([]*queueEntry{e}, entries[position:]...)...)
+	for i, entry := range entries {
+		entry.position = i
+	}
+	s.wakeQueue()
+	return nil
+}
+
+// returns the queue position of the torrent with the given hex info hash
+func (s *Session) QueuePosition(infoHash string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entry(infoHash); ok {
+		return e.position, true
+	}
+	return 0, false
+}
+
+// Runs the torrent with the given hex info hash whatever the queue says,
+// or puts it back in the queue
+func (s *Session) ForceStart(infoHash string, force bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entry(infoHash)
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	e.forced = force
+	s.wakeQueue()
+	return nil
+}
+
+// returns true if the torrent with the given hex info hash was force started
+func (s *Session) Forced(infoHash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entry(infoHash)
+	return ok && e.forced
+}
+
+// Changes how many torrents download and seed at once, 0 for no limit,
+// starting or queueing torrents to suit
+func (s *Session) SetQueueLimits(downloads int, seeds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.MaxActiveDownloads = downloads
+	s.config.MaxActiveSeeds = seeds
+	s.wakeQueue()
+}
+
+// returns how many torrents download and seed at once, 0 for no limit
+func (s *Session) QueueLimits() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config.MaxActiveDownloads, s.config.MaxActiveSeeds
+}
+
+// entries in queue order, must hold lock
+func (s *Session) ordered() []*queueEntry {
+	entries := []*queueEntry{}
+	for _, e := range s.torrents {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].position < entries[j].position })
+	return entries
+}
+
+// tell manageQueue to take another look
+func (s *Session) wakeQueue() {
+	select {
+	case s.wake <- true:
+	default: // it's been told already
+	}
+}
+
+func (s *Session) manageQueue() {
+	for {
+		s.updateQueue()
+		select {
+		case <-s.wake:
+		case <-time.After(time.Duration(QueueInterval) * time.Millisecond):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// works out which torrents should be running, then starts and queues them
+func (s *Session) updateQueue() {
+	now := s.config.Clock()
+	s.mu.Lock()
+	downloads, seeds := 0, 0
+	start, queue := []*BTClient{}, []*BTClient{}
+	for _, e := range s.ordered() {
+		state, done, complete := e.cl.atomicQueueInfo()
+		if state == StatePaused || state == StateStopped {
+			continue // paused by hand, so not ours to start
+		}
+		running := state != StateQueued
+		if !running || done != e.done {
+			e.done = done
+			e.lastProgress = now
+		}
+		seeding := complete
+		stalled := running && !seeding && s.config.StallTimeout > 0 &&
+			now.Sub(e.lastProgress) >= s.config.StallTimeout
+
+		run := true
+		switch {
+		case e.forced || stalled:
+			// doesn't take up a place
+		case seeding:
+			run = s.config.MaxActiveSeeds == 0 || seeds < s.config.MaxActiveSeeds
+			if run {
+				seeds++
+			}
+		default:
+			run = s.config.MaxActiveDownloads == 0 || downloads < s.config.MaxActiveDownloads
+			if run {
+				downloads++
+			}
+		}
+		if run && !running {
+			start = append(start, e.cl)
+		} else if !run && running {
+			queue = append(queue, e.cl)
+		}
+	}
+	s.mu.Unlock()
+
+	// make room before filling it
+	for _, cl := range queue {
+		cl.pause(true)
+	}
+	for _, cl := range start {
+		cl.resume(true)
+	}
+}
+
+// returns the torrent's state, how many pieces it has and whether it has
+// every wanted piece
+func (cl *BTClient) atomicQueueInfo() (State, int, bool) {
+	cl.lock("queue/atomicQueueInfo")
+	defer cl.unlock("queue/atomicQueueInfo")
+	return cl.state(), cl.numDone, cl.wantedLeft == 0
+}
@@ -0,0 +1,176 @@
+package btclient
+
+import (
+	"btnet"
+	"context"
+	"fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+
+// writes a copy of the puppy torrent under another name, so it has its
+// own info hash
+func makeQueueTorrent(trackerUrl string, name string) string {
+	path := "/tmp/tqueue-" + name + ".torrent"
+	fs.Write(path, fs.GetMetadata(MalformedSeedFile, trackerUrl, name))
+	return path
+}
+
+func makeQueueSession(t *testing.T, network *btnet.PipeNetwork, config Config) *Session {
+	config.Networks = []btnet.Network{network}
+	s, err := NewSession("10.0.0.1", 6881, config)
+	if err != nil {
+		t.Fatalf("Couldn't start session: %s", err)
+	}
+	return s
+}
+
+func addQueueTorrent(t *testing.T, s *Session, torrent string, seedPath string) *BTClient {
+	cl, err := s.AddTorrent(torrent, seedPath, "", MakePersister("/tmp/persister/tqueue.p"))
+	if err != nil {
+		s.Close(context.Background())
+		t.Fatalf("Couldn't add %s: %s", torrent, err)
+	}
+	return cl
+}
+
+// waits up to two seconds for cl to be in state
+func awaitState(t *testing.T, cl *BTClient, state State) {
+	for i := 0; i < 20 && cl.State() != state; i++ {
+		util.Wait(100)
+	}
+	if got := cl.State(); got != state {
+		t.Fatalf("Expected %s to be %s, is %s", cl.Name(), state, got)
+	}
+}
+
+// connects to cl and sends it every piece in pieces
+func sendPieces(t *testing.T, cl *BTClient, network *btnet.PipeNetwork, peerId string, pieces ...int) {
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+	conn := connectFrom(t, cl, network, "10.0.0.2", peerId)
+	if conn == nil {
+		t.Fatalf("%s refused a well behaved peer", cl.Name())
+	}
+	defer conn.Close()
+	for _, i := range pieces {
+		begin := i * int(cl.torrentMeta.PieceLen)
+		conn.Write(btnet.EncodePeerMessage(btnet.PeerMessage{Type: btnet.Piece, Index: int32(i), Begin: 0,
+			Block: seed[begin : begin+cl.pieceLength(i)]}))
+	}
+	for _, i := range pieces {
+		select {
+		case <-cl.pieceDone[i]:
+		case <-time.After(time.Second):
+			t.Fatalf("Piece %d of %s should be done", i, cl.Name())
+		}
+	}
+}
+
+func quietTracker() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+}
+
+// Tests
+func TestQueueLimits(t *testing.T) {
+	util.StartTest("Testing a session's active download and seed limits...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.MaxActiveDownloads = 1
+	config.MaxActiveSeeds = 1
+	s := makeQueueSession(t, network, config)
+	defer s.Close(context.Background())
+
+	a := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "a.jpg"), "")
+	b := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "b.jpg"), "")
+	c := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "c.jpg"), "")
+	awaitState(t, a, StateDownloading)
+	awaitState(t, b, StateQueued)
+	awaitState(t, c, StateQueued)
+	if queue := s.Queue(); len(queue) != 3 || queue[0] != a || queue[1] != b || queue[2] != c {
+		t.Fatalf("Expected a, b and c to be queued in the order added")
+	}
+
+	// a finishing lets b start
+	sendPieces(t, a, network, makePeerId(1600), 0, 1)
+	awaitState(t, a, StateSeeding)
+	awaitState(t, b, StateDownloading)
+	awaitState(t, c, StateQueued)
+
+	// force started torrents don't wait their turn
+	if err := s.ForceStart(c.InfoHash(), true); err != nil {
+		t.Fatalf("Couldn't force start c: %s", err)
+	}
+	awaitState(t, c, StateDownloading)
+	awaitState(t, b, StateDownloading)
+
+	// moving c ahead of b takes b's place once c is back in the queue
+	if err := s.SetQueuePosition(c.InfoHash(), 0); err != nil {
+		t.Fatalf("Couldn't move c: %s", err)
+	}
+	if position, _ := s.QueuePosition(c.InfoHash()); position != 0 {
+		t.Fatalf("Expected c at the front of the queue, at %d", position)
+	}
+	if position, _ := s.QueuePosition(a.InfoHash()); position != 1 {
+		t.Fatalf("Expected a to move back to 1, at %d", position)
+	}
+	s.ForceStart(c.InfoHash(), false)
+	awaitState(t, b, StateQueued)
+	awaitState(t, c, StateDownloading)
+
+	// there's only room for one seed
+	d := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "d.jpg"), MalformedSeedFile)
+	util.Wait(200)
+	awaitState(t, d, StateQueued)
+	awaitState(t, a, StateSeeding)
+
+	// pausing a queued torrent by hand takes it out of the queue
+	s.RemoveTorrent(a.InfoHash(), false)
+	d.Pause()
+	util.Wait(200)
+	awaitState(t, d, StatePaused)
+	d.Resume()
+	awaitState(t, d, StateSeeding)
+
+	if err := s.ForceStart("00", true); err != ErrUnknownTorrent {
+		t.Fatalf("Expected forcing an unknown torrent to fail, got %v", err)
+	}
+	util.EndTest()
+}
+
+func TestQueueStalledDownload(t *testing.T) {
+	util.StartTest("Testing a stalled download making room in the queue...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	clock := &fakeClock{now: at(1, 12, 0)}
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.MaxActiveDownloads = 1
+	config.StallTimeout = time.Minute
+	config.Clock = clock.Now
+	s := makeQueueSession(t, network, config)
+	defer s.Close(context.Background())
+
+	a := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "a.jpg"), "")
+	b := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "b.jpg"), "")
+	awaitState(t, a, StateDownloading)
+	awaitState(t, b, StateQueued)
+
+	// a gets nowhere, so b gets a go while a keeps trying
+	clock.Set(at(1, 12, 2))
+	awaitState(t, b, StateDownloading)
+	awaitState(t, a, StateDownloading)
+
+	// and once a gets going again b has to wait
+	sendPieces(t, a, network, makePeerId(1610), 0)
+	awaitState(t, b, StateQueued)
+	awaitState(t, a, StateDownloading)
+	util.EndTest()
+}
@@ -0,0 +1,77 @@
+package btclient
+
+import (
+	"btnet"
+	"time"
+)
+
+// milliseconds between measurements of the transfer rates
+const RateInterval int = 1000
+
+// Rate limiting
+// Every peer connection waits on its own limiter, its torrent's and the
+// global one from the ConnManager, for both reads and writes.
+
+// wrap peer's connection in its rate limits, before anything reads or writes it
+func (cl *BTClient) limitPeer(peer *btnet.Peer) {
+	cl.lock("ratelimiting/limitPeer")
+	peer.Upload = btnet.NewRateLimiter(cl.config.PeerUploadRate)
+	peer.Download = btnet.NewRateLimiter(cl.config.PeerDownloadRate)
+	cl.unlock("ratelimiting/limitPeer")
+	peer.Conn = btnet.LimitConn(peer.Conn,
+		[]*btnet.RateLimiter{peer.Upload, cl.upload, cl.config.Connections.Upload},
+		[]*btnet.RateLimiter{peer.Download, cl.download, cl.config.Connections.Download})
+}
+
+// change this torrent's normal limits in bytes per second, 0 for unlimited
+func (cl *BTClient) SetRateLimits(upload int, download int) {
+	cl.lock("ratelimiting/SetRateLimits")
+	defer cl.unlock("ratelimiting/SetRateLimits")
+	cl.config.UploadRate = upload
+	cl.config.DownloadRate = download
+	cl.applyRateLimits()
+}
+
+// returns this torrent's normal limits in bytes per second
+func (cl *BTClient) RateLimits() (int, int) {
+	cl.lock("ratelimiting/RateLimits")
+	defer cl.unlock("ratelimiting/RateLimits")
+	return cl.config.UploadRate, cl.config.DownloadRate
+}
+
+// change the limits for each of this torrent's peers, now and to come
+func (cl *BTClient) SetPeerRateLimits(upload int, download int) {
+	cl.lock("ratelimiting/SetPeerRateLimits")
+	defer cl.unlock("ratelimiting/SetPeerRateLimits")
+	cl.config.PeerUploadRate = upload
+	cl.config.PeerDownloadRate = download
+	for _, peer := range cl.peers {
+		peer.Upload.SetRate(upload)
+		peer.Download.SetRate(download)
+	}
+}
+
+// works out the transfer rates over each RateInterval while we're running
+func (cl *BTClient) measureRates() {
+	last := time.Now()
+	cl.atomicMeasureRates(last, last)
+	for cl.wait(RateInterval) {
+		now := time.Now()
+		cl.atomicMeasureRates(last, now)
+		last = now
+	}
+	cl.lock("ratelimiting/measureRates")
+	cl.uploadRate, cl.downloadRate = 0, 0
+	cl.unlock("ratelimiting/measureRates")
+}
+
+// sets the rates from the bytes transferred since last
+func (cl *BTClient) atomicMeasureRates(last time.Time, now time.Time) {
+	cl.lock("ratelimiting/atomicMeasureRates")
+	defer cl.unlock("ratelimiting/atomicMeasureRates")
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		cl.uploadRate = float64(cl.uploaded-cl.lastUploaded) / elapsed
+		cl.downloadRate = float64(cl.downloaded-cl.lastDownloaded) / elapsed
+	}
+	cl.lastUploaded, cl.lastDownloaded = cl.uploaded, cl.downloaded
+}
@@ -0,0 +1,96 @@
+package btclient
+
+import (
+	"btnet"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+func makeLimitedSeeder(network *btnet.PipeNetwork, config Config) *BTClient {
+	config.Networks = []btnet.Network{network}
+	persister := MakePersister("/tmp/persister/tratelimit.p")
+	return StartBTClientWithConfig("10.0.0.1", 6881, MalformedTorrentFile, MalformedSeedFile, "", persister, config)
+}
+
+// requests every block of the torrent from cl, returning the rate they
+// arrived at in bytes per second
+func downloadRate(t *testing.T, cl *BTClient, network *btnet.PipeNetwork, peerId string) float64 {
+	conn := connectToClient(t, cl, network, peerId)
+	if conn == nil {
+		cl.Kill()
+		t.Fatalf("Client refused a well behaved peer")
+	}
+	defer conn.Close()
+	expectMessage(t, cl, conn, btnet.Bitfield)
+
+	start := time.Now()
+	total := 0
+	for piece := 0; piece < cl.numPieces; piece++ {
+		for block := 0; block < cl.numBlocks(piece); block++ {
+			length := cl.blockLength(piece, block)
+			conn.Write(btnet.EncodePeerMessage(btnet.PeerMessage{Type: btnet.Request,
+				Index: int32(piece), Begin: block * 16384, Length: length}))
+			expectMessage(t, cl, conn, btnet.Piece)
+			total += length
+		}
+	}
+	return float64(total) / time.Since(start).Seconds()
+}
+
+// Tests
+func TestTorrentUploadLimit(t *testing.T) {
+	util.StartTest("Testing a torrent's upload limit...")
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.UploadRate = 32768
+	cl := makeLimitedSeeder(network, config)
+	defer cl.Kill()
+	util.Wait(100)
+
+	rate := downloadRate(t, cl, network, makePeerId(1000))
+	if rate > 1.25*32768 || rate < 0.5*32768 {
+		t.Fatalf("Expected about 32768 bytes/s, got %.0f", rate)
+	}
+
+	// lifting the limit takes effect straight away
+	cl.SetRateLimits(0, 0)
+	if rate := downloadRate(t, cl, network, makePeerId(1001)); rate < 4*32768 {
+		t.Fatalf("Expected an unlimited rate, got %.0f", rate)
+	}
+	util.EndTest()
+}
+
+func TestPeerRateLimits(t *testing.T) {
+	util.StartTest("Testing per peer and global rate limits...")
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.PeerUploadRate = 32768
+	config.Connections = NewConnManager(DefaultMaxConns, DefaultMaxHalfOpen)
+	cl := makeLimitedSeeder(network, config)
+	defer cl.Kill()
+	util.Wait(100)
+
+	rate := downloadRate(t, cl, network, makePeerId(1100))
+	if rate > 1.25*32768 || rate < 0.5*32768 {
+		t.Fatalf("Expected about 32768 bytes/s per peer, got %.0f", rate)
+	}
+
+	// existing peers pick up new per peer limits
+	conn := expectKept(t, cl, network, "10.0.0.2", makePeerId(1101))
+	defer conn.Close()
+	cl.SetPeerRateLimits(0, 1000)
+	peer, _ := cl.atomicGetPeer(makePeerId(1101))
+	if peer.Upload.Rate() != 0 || peer.Download.Rate() != 1000 {
+		t.Fatalf("Expected peer limits 0 and 1000, have %d and %d", peer.Upload.Rate(), peer.Download.Rate())
+	}
+
+	// and the shared limit applies on top
+	config.Connections.SetRateLimits(32768, 0)
+	rate = downloadRate(t, cl, network, makePeerId(1102))
+	if rate > 1.25*32768 || rate < 0.5*32768 {
+		t.Fatalf("Expected about 32768 bytes/s globally, got %.0f", rate)
+	}
+	util.EndTest()
+}
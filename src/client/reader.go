@@ -0,0 +1,204 @@
+package btclient
+
+// Readers
+// A Reader reads a torrent's data, or one of its files, while it
+// downloads. Reads block until the pieces they cover are verified, and
+// give those pieces and the ones up to Readahead bytes past them a
+// deadline so the picker goes for them first. Reading a skipped file
+// blocks until the file is wanted again, and reading pieces we don't have
+// fails once the torrent is paused or stopped.
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// bytes past each read that a Reader asks for early
+const DefaultReadahead int64 = 1 << 20
+
+var ErrReaderClosed = errors.New("reader: closed")
+var ErrTorrentStopped = errors.New("reader: torrent stopped before the data arrived")
+var ErrPaused = errors.New("reader: torrent paused before the data arrived")
+var ErrSeek = errors.New("reader: seek to a negative position")
+
+type Reader struct {
+	cl     *BTClient
+	offset int64 // where our data starts in the torrent's
+	length int64
+	pos    int64 // where Read reads next
+
+	mu        sync.Mutex
+	readahead int64
+	deadlines map[int]bool // pieces whose deadlines we hold
+	closed    chan struct{}
+}
+
+// returns a Reader over all of the torrent's data
+func (cl *BTClient) NewReader() *Reader {
+	return cl.newReader(0, int64(cl.torrentMeta.GetLength()))
+}
+
+// returns a Reader over the file at index file in Files
+func (cl *BTClient) NewFileReader(file int) (*Reader, error) {
+	if file < 0 || file >= len(cl.torrentMeta.Files) {
+		return nil, ErrFileIndex
+	}
+	offset := cl.torrentMeta.FileOffsets()[file]
+	return cl.newReader(offset, cl.torrentMeta.Files[file].Length), nil
+}
+
+func (cl *BTClient) newReader(offset int64, length int64) *Reader {
+	return &Reader{
+		cl:        cl,
+		offset:    offset,
+		length:    length,
+		readahead: DefaultReadahead,
+		deadlines: make(map[int]bool),
+		closed:    make(chan struct{})}
+}
+
+// sets how many bytes past each read to ask for early
+func (r *Reader) SetReadahead(bytes int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if bytes < 0 {
+		bytes = 0
+	}
+	r.readahead = bytes
+}
+
+func (r *Reader) Length() int64 {
+	return r.length
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil // the next read says so
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += r.pos
+	case io.SeekEnd:
+		pos += r.length
+	}
+	if pos < 0 {
+		return r.pos, ErrSeek
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+// Reads len(p) bytes from off, blocking until the pieces they're in are
+// verified. Returns io.EOF if there aren't that many bytes left, and
+// ErrPaused if the torrent is paused while we still need some.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	select {
+	case <-r.closed:
+		return 0, ErrReaderClosed
+	default:
+	}
+	if off >= r.length {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if off+want > r.length {
+		want = r.length - off
+	}
+	if want == 0 {
+		return 0, nil
+	}
+	pieceLen := r.cl.torrentMeta.PieceLen
+	start, end := r.offset+off, r.offset+off+want
+	first, last := int(start/pieceLen), int((end-1)/pieceLen)
+	r.hurry(first, last)
+	r.cl.lock("reader/ReadAt")
+	run := r.cl.run
+	r.cl.unlock("reader/ReadAt")
+
+	n := 0
+	for piece := first; piece <= last; piece++ {
+		select {
+		case <-r.cl.pieceDone[piece]:
+		case <-r.closed:
+			return n, ErrReaderClosed
+		case <-run.Done():
+			if r.cl.atomicGetBitmapElement(piece) {
+				break
+			}
+			if r.cl.ctx.Err() != nil {
+				return n, ErrTorrentStopped
+			}
+			return n, ErrPaused
+		}
+		begin, finish := int64(piece)*pieceLen, int64(piece+1)*pieceLen
+		if begin < start {
+			begin = start
+		}
+		if finish > end {
+			finish = end
+		}
+		r.cl.lock("reader/ReadAt")
+		data := r.cl.Pieces[piece].Data
+		n += copy(p[n:], data[begin-int64(piece)*pieceLen:finish-int64(piece)*pieceLen])
+		r.cl.unlock("reader/ReadAt")
+	}
+	if int64(n) < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Gives pieces first to last and the readahead after them a deadline of
+// now, so they're picked in order before anything else, and lets go of
+// the deadlines we held on pieces outside them, which other readers may
+// still be holding
+func (r *Reader) hurry(first int, last int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pieceLen := r.cl.torrentMeta.PieceLen
+	end := int64(last+1)*pieceLen + r.readahead
+	if end > r.offset+r.length {
+		end = r.offset + r.length
+	}
+	last = int((end - 1) / pieceLen)
+
+	now := time.Now()
+	for piece := range r.deadlines {
+		if piece < first || piece > last {
+			r.cl.releasePieceDeadline(piece)
+			delete(r.deadlines, piece)
+		}
+	}
+	for piece := first; piece <= last; piece++ {
+		if !r.deadlines[piece] {
+			r.cl.holdPieceDeadline(piece, now)
+			r.deadlines[piece] = true
+		}
+	}
+}
+
+// stops any reads in progress and lets go of our deadlines
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.closed:
+		return nil
+	default:
+	}
+	close(r.closed)
+	for piece := range r.deadlines {
+		r.cl.releasePieceDeadline(piece)
+	}
+	r.deadlines = make(map[int]bool)
+	return nil
+}
@@ -0,0 +1,232 @@
+package btclient
+
+import (
+	"btnet"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+
+type readResult struct {
+	n   int
+	err error
+}
+
+// reads len(p) bytes at off from r in the background
+func readInBackground(r *Reader, p []byte, off int64) chan readResult {
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := r.ReadAt(p, off)
+		done <- readResult{n, err}
+	}()
+	return done
+}
+
+// Tests
+func TestReaderSeeding(t *testing.T) {
+	util.StartTest("Testing reading a torrent's data...")
+	network := btnet.NewPipeNetwork()
+	cl := makeSeederOnPipes(network)
+	defer cl.Kill()
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+
+	r := cl.NewReader()
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(data, seed) {
+		t.Fatalf("Expected to read the whole seed file, read %d bytes, error %v", len(data), err)
+	}
+
+	// straddling the two pieces
+	if pos, err := r.Seek(32000, io.SeekStart); pos != 32000 || err != nil {
+		t.Fatalf("Couldn't seek to 32000: %v", err)
+	}
+	p := make([]byte, 1000)
+	if n, err := io.ReadFull(r, p); n != 1000 || err != nil || !bytes.Equal(p, seed[32000:33000]) {
+		t.Fatalf("Expected bytes 32000-33000 of the seed file, error %v", err)
+	}
+	if pos, _ := r.Seek(-10, io.SeekCurrent); pos != 32990 {
+		t.Fatalf("Expected to seek back to 32990, at %d", pos)
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err != ErrSeek {
+		t.Fatalf("Expected seeking before the start to fail, got %v", err)
+	}
+
+	// there's only so much to read
+	if n, err := r.ReadAt(p, r.Length()-10); n != 10 || err != io.EOF {
+		t.Fatalf("Expected the last 10 bytes then EOF, have %d bytes, error %v", n, err)
+	}
+	if n, err := r.ReadAt(p, r.Length()); n != 0 || err != io.EOF {
+		t.Fatalf("Expected EOF reading past the end, have %d bytes, error %v", n, err)
+	}
+	util.EndTest()
+}
+
+func TestReaderWhileDownloading(t *testing.T) {
+	util.StartTest("Testing reading a file while it downloads...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	dir, torrent := makeFilesTorrent(tracker.URL)
+	defer os.RemoveAll(dir)
+	network := btnet.NewPipeNetwork()
+	seeder := startFilesClient(network, "10.0.0.1", torrent, dir, "")
+	defer seeder.Kill()
+	leecher := startFilesClient(network, "10.0.0.2", torrent, "", "")
+	defer leecher.Kill()
+
+	if _, err := leecher.NewFileReader(3); err != ErrFileIndex {
+		t.Fatalf("Expected a reader of a missing file to fail, got %v", err)
+	}
+	r, _ := leecher.NewFileReader(2)
+	defer r.Close()
+	r.SetReadahead(0)
+	want, _ := ioutil.ReadFile(filepath.Join(dir, "c.jpg"))
+	p := make([]byte, 100)
+	done := readInBackground(r, p, 20000)
+	select {
+	case <-done:
+		t.Fatalf("Expected the read to wait for its piece")
+	case <-time.After(200 * time.Millisecond):
+	}
+	piece := int((leecher.torrentMeta.FileOffsets()[2] + 20000) / leecher.torrentMeta.PieceLen)
+	if _, ok := leecher.PieceDeadline(piece); !ok {
+		t.Fatalf("Expected piece %d to be hurried", piece)
+	}
+
+	util.Wait(100)
+	seederAddr, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:6881")
+	leecher.SetupPeerConnections(seederAddr, nil)
+	select {
+	case result := <-done:
+		if result.n != 100 || result.err != nil || !bytes.Equal(p, want[20000:20100]) {
+			t.Fatalf("Expected bytes 20000-20100 of c.jpg, error %v", result.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the read to finish once the piece arrived")
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(data, want) {
+		t.Fatalf("Expected to read all of c.jpg, read %d bytes, error %v", len(data), err)
+	}
+	util.EndTest()
+}
+
+func TestReaderClose(t *testing.T) {
+	util.StartTest("Testing closing a reader that's waiting...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLeecherOnPipes(network, "/tmp/persister/treader.p")
+	defer cl.Kill()
+	r := cl.NewReader()
+	done := readInBackground(r, make([]byte, 100), 0)
+	util.Wait(100)
+	if _, ok := cl.PieceDeadline(1); !ok {
+		t.Fatalf("Expected the readahead to be hurried too")
+	}
+
+	r.Close()
+	select {
+	case result := <-done:
+		if result.err != ErrReaderClosed {
+			t.Fatalf("Expected the read to fail once closed, got %v", result.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected closing to stop the read")
+	}
+	if _, ok := cl.PieceDeadline(0); ok {
+		t.Fatalf("Expected closing to take away the reader's deadlines")
+	}
+	if _, err := r.Read(make([]byte, 1)); err != ErrReaderClosed {
+		t.Fatalf("Expected reading a closed reader to fail, got %v", err)
+	}
+
+	// as does the torrent stopping
+	r = cl.NewReader()
+	done = readInBackground(r, make([]byte, 100), 0)
+	util.Wait(100)
+	cl.Kill()
+	if result := <-done; result.err != ErrTorrentStopped {
+		t.Fatalf("Expected the read to fail once the torrent stopped, got %v", result.err)
+	}
+	util.EndTest()
+}
+
+func TestReadersShareDeadlines(t *testing.T) {
+	util.StartTest("Testing readers keeping the deadlines other readers rely on...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLeecherOnPipes(network, "/tmp/persister/treadershare.p")
+	defer cl.Kill()
+	first, second := cl.NewReader(), cl.NewReader()
+	first.SetReadahead(0)
+	firstDone := readInBackground(first, make([]byte, 100), 0)
+	secondDone := readInBackground(second, make([]byte, 100), 0)
+	util.Wait(100)
+
+	// the first moves on to piece 1, but the second still wants piece 0
+	readInBackground(first, make([]byte, 100), 40000)
+	util.Wait(100)
+	if _, ok := cl.PieceDeadline(0); !ok {
+		t.Fatalf("Expected piece 0 to keep the deadline the second reader relies on")
+	}
+	first.Close()
+	if _, ok := cl.PieceDeadline(1); !ok {
+		t.Fatalf("Expected piece 1 to keep the deadline the second reader relies on")
+	}
+	second.Close()
+	if _, ok := cl.PieceDeadline(0); ok {
+		t.Fatalf("Expected the deadlines to go once no reader holds them")
+	}
+	<-firstDone
+	<-secondDone
+
+	// deadlines set by hand outlive the readers
+	cl.SetPieceDeadline(1, time.Now())
+	r := cl.NewReader()
+	readInBackground(r, make([]byte, 100), 40000)
+	util.Wait(100)
+	r.Close()
+	if _, ok := cl.PieceDeadline(1); !ok {
+		t.Fatalf("Expected a deadline set by hand to stay once the reader closed")
+	}
+	util.EndTest()
+}
+
+func TestReaderPaused(t *testing.T) {
+	util.StartTest("Testing reading from a paused torrent...")
+	network := btnet.NewPipeNetwork()
+	cl := makeLeecherOnPipes(network, "/tmp/persister/treaderpaused.p")
+	defer cl.Kill()
+
+	// a read that's waiting gives up once we pause
+	r := cl.NewReader()
+	defer r.Close()
+	done := readInBackground(r, make([]byte, 100), 0)
+	util.Wait(100)
+	cl.Pause()
+	select {
+	case result := <-done:
+		if result.err != ErrPaused {
+			t.Fatalf("Expected the read to fail once paused, got %v", result.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected pausing to stop the read")
+	}
+
+	// as does one that starts while we're paused
+	select {
+	case result := <-readInBackground(r, make([]byte, 100), 0):
+		if result.err != ErrPaused {
+			t.Fatalf("Expected reading a paused torrent to fail, got %v", result.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected reading a paused torrent not to wait")
+	}
+	util.EndTest()
+}
@@ -0,0 +1,185 @@
+package btclient
+
+// Alternate speed limits
+// A schedule switches a torrent between its normal and alternate rate
+// limits at set times of the week, e.g. to throttle during office hours.
+// Switching by hand with SetAltSpeed holds until the schedule next
+// switches.
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"util"
+)
+
+var ErrSchedule = errors.New("schedule should look like \"mon-fri 09:00-17:00\"")
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// When alternate limits apply. A period starts on each of Days at Start
+// and lasts until End, running past midnight if End is before Start, or
+// all day if they're equal.
+type SpeedSchedule struct {
+	Days  [7]bool       // indexed by time.Weekday
+	Start time.Duration // since midnight
+	End   time.Duration // since midnight
+}
+
+// Parses a schedule like "mon-fri 09:00-17:00", "sat,sun 22:00-06:00" or
+// just "01:00-07:00" for every day. Day ranges may wrap, e.g. "fri-mon".
+func ParseSchedule(s string) (*SpeedSchedule, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	schedule := &SpeedSchedule{}
+	var times string
+	switch len(fields) {
+	case 1:
+		for day := range schedule.Days {
+			schedule.Days[day] = true
+		}
+		times = fields[0]
+	case 2:
+		for _, part := range strings.Split(fields[0], ",") {
+			first, last, err := parseDayRange(part)
+			if err != nil {
+				return nil, err
+			}
+			for day := first; ; day = (day + 1) % 7 {
+				schedule.Days[day] = true
+				if day == last {
+					break
+				}
+			}
+		}
+		times = fields[1]
+	default:
+		return nil, ErrSchedule
+	}
+
+	bounds := strings.Split(times, "-")
+	if len(bounds) != 2 {
+		return nil, ErrSchedule
+	}
+	var err error
+	if schedule.Start, err = parseTimeOfDay(bounds[0]); err != nil {
+		return nil, err
+	}
+	if schedule.End, err = parseTimeOfDay(bounds[1]); err != nil {
+		return nil, err
+	}
+	return schedule, nil
+}
+
+// parses "mon" or "mon-fri" into the first and last day
+func parseDayRange(s string) (int, int, error) {
+	names := strings.Split(s, "-")
+	if len(names) > 2 {
+		return 0, 0, ErrSchedule
+	}
+	days := []int{}
+	for _, name := range names {
+		day := -1
+		for i, dayName := range dayNames {
+			if name == dayName {
+				day = i
+			}
+		}
+		if day < 0 {
+			return 0, 0, ErrSchedule
+		}
+		days = append(days, day)
+	}
+	return days[0], days[len(days)-1], nil
+}
+
+// parses "HH:MM" into the time since midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, ErrSchedule
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// returns true if alternate limits apply at now, in now's time zone
+func (s *SpeedSchedule) Active(now time.Time) bool {
+	since := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	switch {
+	case s.Start == s.End:
+		return s.Days[today]
+	case s.Start < s.End:
+		return s.Days[today] && since >= s.Start && since < s.End
+	default:
+		return (s.Days[today] && since >= s.Start) || (s.Days[yesterday] && since < s.End)
+	}
+}
+
+// sets the torrent's limiters to its normal or alternate limits, must hold lock
+func (cl *BTClient) applyRateLimits() {
+	if cl.altSpeed {
+		cl.upload.SetRate(cl.config.AltUploadRate)
+		cl.download.SetRate(cl.config.AltDownloadRate)
+	} else {
+		cl.upload.SetRate(cl.config.UploadRate)
+		cl.download.SetRate(cl.config.DownloadRate)
+	}
+}
+
+// change this torrent's alternate limits in bytes per second, 0 for unlimited
+func (cl *BTClient) SetAltRateLimits(upload int, download int) {
+	cl.lock("schedule/SetAltRateLimits")
+	defer cl.unlock("schedule/SetAltRateLimits")
+	cl.config.AltUploadRate = upload
+	cl.config.AltDownloadRate = download
+	cl.applyRateLimits()
+}
+
+// switch to the alternate limits, or back, until the schedule next switches
+func (cl *BTClient) SetAltSpeed(enabled bool) {
+	cl.lock("schedule/SetAltSpeed")
+	defer cl.unlock("schedule/SetAltSpeed")
+	cl.altSpeed = enabled
+	cl.applyRateLimits()
+}
+
+// returns true if the alternate limits are in use
+func (cl *BTClient) AltSpeed() bool {
+	cl.lock("schedule/AltSpeed")
+	defer cl.unlock("schedule/AltSpeed")
+	return cl.altSpeed
+}
+
+// switches limits if the schedule has switched since we last looked
+func (cl *BTClient) atomicCheckSchedule() {
+	cl.lock("schedule/atomicCheckSchedule")
+	defer cl.unlock("schedule/atomicCheckSchedule")
+	if cl.config.AltSchedule == nil {
+		return
+	}
+	active := cl.config.AltSchedule.Active(cl.config.Clock())
+	if active == cl.scheduled {
+		return
+	}
+	cl.scheduled = active
+	if active != cl.altSpeed {
+		util.IPrintf("%s: schedule switching alternate speed limits %s\n", cl.port, onOff(active))
+		cl.altSpeed = active
+		cl.applyRateLimits()
+	}
+}
+
+func (cl *BTClient) watchSchedule() {
+	for cl.wait(ScheduleInterval) {
+		cl.atomicCheckSchedule()
+	}
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
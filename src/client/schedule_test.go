@@ -0,0 +1,143 @@
+package btclient
+
+import (
+	"btnet"
+	"sync"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+
+// a clock tests can move
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// 2017-05-01 was a Monday
+func at(day int, hour int, minute int) time.Time {
+	return time.Date(2017, 5, day, hour, minute, 0, 0, time.UTC)
+}
+
+func expectLimits(t *testing.T, cl *BTClient, upload int, download int) {
+	if cl.upload.Rate() != upload || cl.download.Rate() != download {
+		t.Fatalf("Expected limits %d and %d, have %d and %d", upload, download, cl.upload.Rate(), cl.download.Rate())
+	}
+}
+
+// Tests
+func TestParseSchedule(t *testing.T) {
+	util.StartTest("Testing parsing alternate speed schedules...")
+	tests := []struct {
+		schedule string
+		active   []time.Time
+		inactive []time.Time
+	}{
+		{"mon-fri 09:00-17:00",
+			[]time.Time{at(1, 9, 0), at(5, 16, 59)},
+			[]time.Time{at(1, 8, 59), at(1, 17, 0), at(6, 12, 0), at(7, 12, 0)}},
+		{"sat,sun 22:00-06:00",
+			[]time.Time{at(6, 23, 0), at(7, 5, 0), at(8, 5, 59)},
+			[]time.Time{at(5, 23, 0), at(6, 5, 0), at(8, 6, 0), at(8, 23, 0)}},
+		{"01:00-07:00",
+			[]time.Time{at(1, 1, 0), at(4, 6, 30)},
+			[]time.Time{at(1, 0, 59), at(4, 7, 0)}},
+		{"FRI-MON 00:00-00:00",
+			[]time.Time{at(5, 0, 0), at(7, 12, 0), at(8, 23, 59)},
+			[]time.Time{at(2, 12, 0), at(4, 23, 59)}},
+	}
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.schedule)
+		if err != nil {
+			t.Fatalf("%s: %s", test.schedule, err)
+		}
+		for _, now := range test.active {
+			if !schedule.Active(now) {
+				t.Fatalf("%s: should be active at %s", test.schedule, now)
+			}
+		}
+		for _, now := range test.inactive {
+			if schedule.Active(now) {
+				t.Fatalf("%s: shouldn't be active at %s", test.schedule, now)
+			}
+		}
+	}
+
+	for _, bad := range []string{"", "mon-fri", "mon-fri 9-17", "someday 09:00-17:00", "mon-wed-fri 09:00-17:00",
+		"mon 09:00-17:00 extra", "mon 25:00-26:00"} {
+		if _, err := ParseSchedule(bad); err != ErrSchedule {
+			t.Fatalf("Expected an error parsing %q, got %v", bad, err)
+		}
+	}
+	util.EndTest()
+}
+
+func TestAltSpeedSchedule(t *testing.T) {
+	util.StartTest("Testing switching to alternate limits on a schedule...")
+	clock := &fakeClock{now: at(1, 8, 0)}
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{btnet.NewPipeNetwork()}
+	config.UploadRate = 100000
+	config.DownloadRate = 200000
+	config.AltUploadRate = 1000
+	config.AltDownloadRate = 2000
+	config.AltSchedule, _ = ParseSchedule("mon-fri 09:00-17:00")
+	config.Clock = clock.Now
+	cl := StartBTClientWithConfig("10.0.0.1", 6881, MalformedTorrentFile, MalformedSeedFile, "",
+		MakePersister("/tmp/persister/tschedule.p"), config)
+	defer cl.Kill()
+	expectLimits(t, cl, 100000, 200000)
+
+	clock.Set(at(1, 9, 0))
+	cl.atomicCheckSchedule()
+	if !cl.AltSpeed() {
+		t.Fatalf("Alternate limits should start with the schedule")
+	}
+	expectLimits(t, cl, 1000, 2000)
+
+	// switching by hand holds until the schedule next switches
+	cl.SetAltSpeed(false)
+	clock.Set(at(1, 12, 0))
+	cl.atomicCheckSchedule()
+	expectLimits(t, cl, 100000, 200000)
+	clock.Set(at(1, 17, 0))
+	cl.atomicCheckSchedule()
+	expectLimits(t, cl, 100000, 200000)
+	cl.SetAltSpeed(true)
+	clock.Set(at(2, 8, 0))
+	cl.atomicCheckSchedule()
+	expectLimits(t, cl, 1000, 2000)
+	clock.Set(at(2, 9, 0))
+	cl.atomicCheckSchedule()
+	clock.Set(at(2, 17, 0))
+	cl.atomicCheckSchedule()
+	expectLimits(t, cl, 100000, 200000)
+
+	// changing limits changes whichever are in use
+	cl.SetRateLimits(50000, 60000)
+	cl.SetAltRateLimits(500, 600)
+	expectLimits(t, cl, 50000, 60000)
+	cl.SetAltSpeed(true)
+	expectLimits(t, cl, 500, 600)
+
+	// and the watcher picks up the clock by itself
+	cl.SetAltSpeed(false)
+	clock.Set(at(3, 10, 0))
+	util.Wait(2 * ScheduleInterval)
+	expectLimits(t, cl, 500, 600)
+	util.EndTest()
+}
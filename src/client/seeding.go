@@ -9,12 +9,17 @@ func (cl *BTClient) Seed(file string) {
 	pieceLen := int(cl.torrentMeta.PieceLen)
 	cl.unlock("seeding/seed 1")
 
-	pieces := fs.SplitIntoPieces(file, pieceLen)
+	var pieces []fs.Piece
+	if len(cl.torrentMeta.Files) > 1 {
+		pieces = fs.SplitFilesIntoPieces(file, cl.torrentMeta.Files, pieceLen)
+	} else {
+		pieces = fs.SplitIntoPieces(file, pieceLen)
+	}
 
 	cl.lock("seeding/seed 2")
 	copy(cl.Pieces, pieces)
 	for i := range cl.PieceBitmap {
-		cl.PieceBitmap[i] = true
+		cl.setPieceDone(i)
 	}
 	pieceBitmap := make([]bool, len(cl.PieceBitmap))
 	copy(pieceBitmap, cl.PieceBitmap)
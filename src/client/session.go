@@ -0,0 +1,405 @@
+package btclient
+
+// Sessions
+// A session runs many torrents behind one listener. Incoming connections
+// go to whichever torrent their handshake names, and every torrent shares
+// the session's connection and rate limits. Torrents wait in a queue for
+// their turn to download or seed. Subscribers hear as torrents are added,
+// removed and change state.
+
+import (
+	"btnet"
+	"context"
+	"errors"
+	"fmt"
+	"fs"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"util"
+)
+
+var ErrDuplicateTorrent = errors.New("session: torrent already added")
+var ErrUnknownTorrent = errors.New("session: no such torrent")
+var ErrSessionClosed = errors.New("session: closed")
+var ErrOutputInUse = errors.New("session: another torrent already writes there")
+
+// events a subscriber can fall behind by before it's dropped
+const EventBuffer int = 64
+
+// Something that happened to one of a session's torrents: it was "added",
+// "removed", or its State changed, a "state" event
+type SessionEvent struct {
+	Type     string
+	InfoHash string // hex
+	Name     string
+	State    State // as of the event, empty if it was removed
+}
+
+type Session struct {
+	mu       sync.Mutex
+	ip       string
+	port     int
+	config   Config                 // what each torrent is started with
+	torrents map[string]*queueEntry // by raw info hash
+	wake     chan bool              // holds a value when the queue needs another look
+
+	blocklist *btnet.Blocklist // shared by every torrent, nil if there isn't one
+
+	eventsMu    sync.Mutex              // taken last, after any torrent's lock
+	known       map[string]SessionEvent // latest event of each torrent, by hex info hash
+	subscribers map[chan SessionEvent]bool
+
+	ctx       context.Context // done once the session is told to shut down
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	listeners []net.Listener
+}
+
+// Listens on ip:port on each of config's networks for the torrents added
+// later, returning an error if none of them work. Torrents share
+// config.Connections, or a new ConnManager if it's nil.
+func NewSession(ip string, port int, config Config) (*Session, error) {
+	s := &Session{ip: ip, port: port, config: config}
+	if len(s.config.Networks) == 0 {
+		s.config.Networks = []btnet.Network{&btnet.TCPNetwork{}}
+	}
+	if s.config.Connections == nil {
+		s.config.Connections = NewConnManager(DefaultMaxConns, DefaultMaxHalfOpen)
+	}
+	if s.config.Clock == nil {
+		s.config.Clock = time.Now
+	}
+	parent := config.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	s.ctx, s.cancel = context.WithCancel(parent)
+	s.config.Context = s.ctx
+	s.torrents = make(map[string]*queueEntry)
+	s.wake = make(chan bool, 1)
+	s.known = make(map[string]SessionEvent)
+	s.subscribers = make(map[chan SessionEvent]bool)
+	if s.config.BlocklistPath != "" {
+		s.blocklist = btnet.NewBlocklist(s.config.BlocklistPath)
+		if _, err := s.blocklist.Reload(); err != nil {
+			util.WPrintf("session %d: could not read blocklist: %s\n", port, err)
+		}
+	}
+
+	addr := fmt.Sprintf("%s:%d", ip, port)
+	enc := &btnet.EncryptionConfig{Policy: s.config.Encryption, InfoHashes: s.infoHashes}
+	for _, network := range s.config.Networks {
+		ln, err := network.Listen(addr)
+		if err != nil {
+			util.WPrintf("session %d: could not listen on %T: %s\n", port, network, err)
+			continue
+		}
+		s.listeners = append(s.listeners, ln)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			// refuse blocked peers before going to the trouble of a handshake
+			btnet.Serve(btnet.FilterListener(ln, s.allowedAddr), s.route, enc)
+		}()
+	}
+	if len(s.listeners) == 0 {
+		s.cancel()
+		return nil, fmt.Errorf("session: could not listen on %s", addr)
+	}
+	go func() {
+		<-s.ctx.Done()
+		for _, ln := range s.listeners {
+			ln.Close()
+		}
+	}()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.manageQueue()
+	}()
+	if s.blocklist != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.watchBlocklist()
+		}()
+	}
+	return s, nil
+}
+
+// Adds the torrent at metadataPath to the end of the queue, to download
+// or seed the same way StartBTClient would once it's its turn
+func (s *Session) AddTorrent(metadataPath string, seedPath string, outputPath string, persister *Persister) (*BTClient, error) {
+	infoHash, err := readInfoHash(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return nil, ErrSessionClosed
+	}
+	if _, ok := s.torrents[infoHash]; ok {
+		return nil, ErrDuplicateTorrent
+	}
+	if s.outputInUse(outputPath) {
+		return nil, ErrOutputInUse
+	}
+	cl := startBTClient(s.ip, s.port, metadataPath, seedPath, outputPath, persister, s.config, s)
+	s.torrents[infoHash] = &queueEntry{cl: cl, position: len(s.torrents)}
+	cl.atomicPublish("added")
+	s.wakeQueue()
+	return cl, nil
+}
+
+// Stops the torrent with the given hex info hash and forgets it, waiting
+// until it has shut down, and deletes its data too if deleteData is set
+func (s *Session) RemoveTorrent(infoHash string, deleteData bool) error {
+	s.mu.Lock()
+	e, ok := s.entry(infoHash)
+	if !ok {
+		s.mu.Unlock()
+		return ErrUnknownTorrent
+	}
+	delete(s.torrents, e.cl.infoHash)
+	for _, other := range s.torrents {
+		if other.position > e.position {
+			other.position--
+		}
+	}
+	s.wakeQueue()
+	s.mu.Unlock()
+	err := e.cl.Remove(deleteData)
+	s.publish(SessionEvent{Type: "removed", InfoHash: e.cl.InfoHash()})
+	return err
+}
+
+// returns the torrent with the given hex info hash
+func (s *Session) Torrent(infoHash string) (*BTClient, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entry(infoHash); ok {
+		return e.cl, true
+	}
+	return nil, false
+}
+
+// the entry for the torrent with the given hex info hash, must hold lock
+func (s *Session) entry(infoHash string) (*queueEntry, bool) {
+	for _, e := range s.torrents {
+		if e.cl.InfoHash() == infoHash {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// Returns true if another torrent writes to outputPath, or inside it, or
+// outputPath is inside where one writes. Must hold lock.
+func (s *Session) outputInUse(outputPath string) bool {
+	if outputPath == "" {
+		return false
+	}
+	for _, e := range s.torrents {
+		if e.cl.outputPath != "" && (within(outputPath, e.cl.outputPath) || within(e.cl.outputPath, outputPath)) {
+			return true
+		}
+	}
+	return false
+}
+
+// returns true if path is dir or inside it
+func within(path string, dir string) bool {
+	path, _ = filepath.Abs(path)
+	dir, _ = filepath.Abs(dir)
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// returns every torrent, sorted by name
+func (s *Session) Torrents() []*BTClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	torrents := []*BTClient{}
+	for _, e := range s.torrents {
+		torrents = append(torrents, e.cl)
+	}
+	sort.Slice(torrents, func(i, j int) bool {
+		if torrents[i].Name() != torrents[j].Name() {
+			return torrents[i].Name() < torrents[j].Name()
+		}
+		return torrents[i].infoHash < torrents[j].infoHash
+	})
+	return torrents
+}
+
+// the limits shared by every torrent
+func (s *Session) Connections() *ConnManager {
+	return s.config.Connections
+}
+
+// Stops listening and shuts down every torrent. Returns once they're all
+// done, or with ctx's error if ctx is done first.
+func (s *Session) Close(ctx context.Context) error {
+	s.mu.Lock()
+	s.cancel()
+	torrents := []*BTClient{}
+	for _, e := range s.torrents {
+		torrents = append(torrents, e.cl)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, cl := range torrents {
+			cl.Kill()
+		}
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Returns a channel of events, starting with an added event for every
+// torrent there already is, and a func that unsubscribes. The channel is
+// closed once unsubscribed, or if it falls EventBuffer events behind.
+func (s *Session) Subscribe() (<-chan SessionEvent, func()) {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	events := make(chan SessionEvent, len(s.known)+EventBuffer)
+	infoHashes := []string{}
+	for infoHash := range s.known {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	sort.Strings(infoHashes)
+	for _, infoHash := range infoHashes {
+		event := s.known[infoHash]
+		event.Type = "added"
+		events <- event
+	}
+	s.subscribers[events] = true
+	return events, func() {
+		s.eventsMu.Lock()
+		defer s.eventsMu.Unlock()
+		if s.subscribers[events] {
+			delete(s.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// Sends event to every subscriber, unless it changes nothing: a torrent
+// is only added once, and only changes state while it's in the session.
+// May be called holding a torrent's lock.
+func (s *Session) publish(event SessionEvent) {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	latest, ok := s.known[event.InfoHash]
+	switch event.Type {
+	case "added":
+		if ok {
+			return
+		}
+		s.known[event.InfoHash] = event
+	case "state":
+		if !ok || latest.State == event.State {
+			return
+		}
+		s.known[event.InfoHash] = event
+	case "removed":
+		if !ok {
+			return
+		}
+		delete(s.known, event.InfoHash)
+		event.Name = latest.Name
+	}
+	for events := range s.subscribers {
+		select {
+		case events <- event:
+		default: // too far behind to catch up, it'll have to start again
+			delete(s.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// info hashes of every torrent, for recognising encrypted connections
+func (s *Session) infoHashes() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := [][]byte{}
+	for hash := range s.torrents {
+		hashes = append(hashes, []byte(hash))
+	}
+	return hashes
+}
+
+// returns false for blocklisted addresses and ones we can't make out
+func (s *Session) allowedAddr(addr net.Addr) bool {
+	tcpAddr, err := tcpAddrOf(addr)
+	return err == nil && !s.blocklist.Contains(tcpAddr.IP)
+}
+
+// rereads the blocklist whenever its file changes, dropping peers of
+// every torrent it now blocks
+func (s *Session) watchBlocklist() {
+	for {
+		select {
+		case <-time.After(time.Duration(BlocklistInterval) * time.Millisecond):
+		case <-s.ctx.Done():
+			return
+		}
+		changed, err := s.blocklist.Reload()
+		if err != nil {
+			util.WPrintf("session %d: could not reread blocklist: %s\n", s.port, err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		util.IPrintf("session %d: blocklist now has %d ranges\n", s.port, s.blocklist.Len())
+		for _, cl := range s.Torrents() {
+			cl.atomicDropBlocked()
+		}
+	}
+}
+
+// hands conn to the torrent its handshake is for
+func (s *Session) route(conn net.Conn) {
+	handshake, peeked, err := btnet.PeekHandshake(conn)
+	if err != nil {
+		util.TPrintf("session %d: no handshake: %s\n", s.port, err)
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	e, ok := s.torrents[string(handshake.InfoHash)]
+	s.mu.Unlock()
+	if !ok {
+		util.TPrintf("session %d: dropping connection for unknown torrent %x\n", s.port, handshake.InfoHash)
+		conn.Close()
+		return
+	}
+	e.cl.messageHandler(peeked)
+}
+
+// reads the info hash of the torrent at path, turning fs's panics over
+// bad files into an error
+func readInfoHash(path string) (infoHash string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("session: can't read torrent %s: %v", path, r)
+		}
+	}()
+	fs.Read(path) // so a torrent without its info doesn't start
+	return fs.GetInfoHash(fs.ReadTorrent(path)), nil
+}
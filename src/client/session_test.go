@@ -0,0 +1,283 @@
+package btclient
+
+import (
+	"btnet"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+	"util"
+)
+
+const SessionSeedFile = "../test/seed/pupper.png"
+const SessionTorrentFile = "../test/torrent/pupper.torrent"
+
+// Helpers
+func makeTestSession(t *testing.T, network *btnet.PipeNetwork) (*Session, *BTClient, *BTClient) {
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	s, err := NewSession("10.0.0.1", 6881, config)
+	if err != nil {
+		t.Fatalf("Couldn't start session: %s", err)
+	}
+	puppy, err := s.AddTorrent(MalformedTorrentFile, MalformedSeedFile, "", MakePersister("/tmp/persister/tsession1.p"))
+	if err != nil {
+		s.Close(context.Background())
+		t.Fatalf("Couldn't add puppy: %s", err)
+	}
+	pupper, err := s.AddTorrent(SessionTorrentFile, SessionSeedFile, "", MakePersister("/tmp/persister/tsession2.p"))
+	if err != nil {
+		s.Close(context.Background())
+		t.Fatalf("Couldn't add pupper: %s", err)
+	}
+	return s, puppy, pupper
+}
+
+// Tests
+func TestSessionRoutesByInfoHash(t *testing.T) {
+	util.StartTest("Testing a session routing connections to their torrent...")
+	before := runtime.NumGoroutine()
+	network := btnet.NewPipeNetwork()
+	s, puppy, pupper := makeTestSession(t, network)
+	util.Wait(100)
+
+	for i, cl := range []*BTClient{puppy, pupper} {
+		conn := expectKept(t, cl, network, "10.0.0.2", makePeerId(1400+i))
+		defer conn.Close()
+	}
+
+	// a torrent the session doesn't have
+	conn, err := network.DialFrom("10.0.0.3", "10.0.0.1:6881")
+	if err != nil {
+		s.Close(context.Background())
+		t.Fatalf("Dial error: %s", err)
+	}
+	handshake := makeTestHandshake(puppy)
+	handshake.InfoHash = []byte("01234567890123456789")
+	conn.Write(btnet.EncodeHandshake(handshake))
+	expectDisconnect(t, puppy, conn, "unknown torrent")
+	conn.Close()
+
+	// encrypted connections are routed too
+	conn, err = network.DialFrom("10.0.0.4", "10.0.0.1:6881")
+	if err != nil {
+		s.Close(context.Background())
+		t.Fatalf("Dial error: %s", err)
+	}
+	conn, err = btnet.EncryptOutgoing(conn, []byte(pupper.infoHash), nil, btnet.EncryptionRequire)
+	if err != nil {
+		s.Close(context.Background())
+		t.Fatalf("Encryption failed: %s", err)
+	}
+	defer conn.Close()
+	handshake = makeTestHandshake(pupper)
+	handshake.PeerId = []byte(makePeerId(1410))
+	conn.Write(btnet.EncodeHandshake(handshake))
+	expectHandshake(t, pupper, conn)
+	expectMessage(t, pupper, conn, btnet.Bitfield)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("Session didn't shut down: %s", err)
+	}
+	for _, cl := range []*BTClient{puppy, pupper} {
+		select {
+		case <-cl.Stopped():
+		default:
+			t.Fatalf("Expected %s to be stopped", cl.Name())
+		}
+	}
+	if _, err := s.AddTorrent(MalformedTorrentFile, MalformedSeedFile, "", nil); err != ErrSessionClosed {
+		t.Fatalf("Expected adding to a closed session to fail, got %v", err)
+	}
+	conn.Close()
+	if ok, stacks := util.WaitForGoroutines(before, 1000); !ok {
+		t.Fatalf("Expected at most %d goroutines, have:\n%s", before, stacks)
+	}
+	util.EndTest()
+}
+
+func TestSessionAddRemove(t *testing.T) {
+	util.StartTest("Testing adding and removing torrents from a session...")
+	network := btnet.NewPipeNetwork()
+	s, puppy, pupper := makeTestSession(t, network)
+	defer s.Close(context.Background())
+	util.Wait(100)
+
+	if _, err := s.AddTorrent(MalformedTorrentFile, MalformedSeedFile, "", nil); err != ErrDuplicateTorrent {
+		t.Fatalf("Expected adding puppy twice to fail, got %v", err)
+	}
+	if _, err := s.AddTorrent("../test/torrent/missing.torrent", "", "", nil); err == nil {
+		t.Fatalf("Expected adding a missing torrent to fail")
+	}
+	torrents := s.Torrents()
+	if len(torrents) != 2 || torrents[0] != puppy || torrents[1] != pupper {
+		t.Fatalf("Expected puppy and pupper, got %v", torrents)
+	}
+	for _, cl := range torrents {
+		if cl.config.Connections != s.Connections() {
+			t.Fatalf("Expected %s to share the session's connection limits", cl.Name())
+		}
+		if found, ok := s.Torrent(cl.InfoHash()); !ok || found != cl {
+			t.Fatalf("Couldn't look up %s by info hash", cl.Name())
+		}
+	}
+
+	if err := s.RemoveTorrent(puppy.InfoHash(), false); err != nil {
+		t.Fatalf("Couldn't remove puppy: %s", err)
+	}
+	if err := s.RemoveTorrent(puppy.InfoHash(), false); err != ErrUnknownTorrent {
+		t.Fatalf("Expected removing puppy twice to fail, got %v", err)
+	}
+	select {
+	case <-puppy.Stopped():
+	default:
+		t.Fatalf("Expected puppy to be stopped once removed")
+	}
+	if torrents := s.Torrents(); len(torrents) != 1 || torrents[0] != pupper {
+		t.Fatalf("Expected just pupper, got %v", torrents)
+	}
+
+	// puppy's connections are now turned away, pupper's still welcome
+	if conn := connectFrom(t, puppy, network, "10.0.0.2", makePeerId(1420)); conn != nil {
+		conn.Close()
+		t.Fatalf("Expected connections for a removed torrent to be refused")
+	}
+	conn := expectKept(t, pupper, network, "10.0.0.2", makePeerId(1421))
+	conn.Close()
+
+	// and puppy can come back
+	if _, err := s.AddTorrent(MalformedTorrentFile, MalformedSeedFile, "", MakePersister("/tmp/persister/tsession1.p")); err != nil {
+		t.Fatalf("Couldn't add puppy again: %s", err)
+	}
+	util.EndTest()
+}
+
+func TestSessionBlocklist(t *testing.T) {
+	util.StartTest("Testing a session sharing one blocklist between its torrents...")
+	file, _ := ioutil.TempFile("", "blocklist")
+	path := file.Name()
+	file.Close()
+	defer os.Remove(path)
+	ioutil.WriteFile(path, []byte("10.0.0.3\n"), 0644)
+
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.BlocklistPath = path
+	s := makeQueueSession(t, network, config)
+	defer s.Close(context.Background())
+	puppy, err := s.AddTorrent(MalformedTorrentFile, MalformedSeedFile, "", MakePersister("/tmp/persister/tsession1.p"))
+	if err != nil {
+		t.Fatalf("Couldn't add puppy: %s", err)
+	}
+	pupper, err := s.AddTorrent(SessionTorrentFile, SessionSeedFile, "", MakePersister("/tmp/persister/tsession2.p"))
+	if err != nil {
+		t.Fatalf("Couldn't add pupper: %s", err)
+	}
+	if s.blocklist == nil || puppy.blocklist != s.blocklist || pupper.blocklist != s.blocklist {
+		t.Fatalf("Expected the torrents to share the session's blocklist")
+	}
+	awaitState(t, puppy, StateSeeding)
+	awaitState(t, pupper, StateSeeding)
+
+	if conn := connectFrom(t, puppy, network, "10.0.0.3", makePeerId(1420)); conn != nil {
+		conn.Close()
+		t.Fatalf("Session accepted a blocklisted peer")
+	}
+	kept := []net.Conn{}
+	for i, cl := range []*BTClient{puppy, pupper} {
+		conn := expectKept(t, cl, network, "10.0.0.2", makePeerId(1421+i))
+		defer conn.Close()
+		kept = append(kept, conn)
+	}
+
+	// every torrent drops its peers once the list changes to block them
+	ioutil.WriteFile(path, []byte("10.0.0.0/24\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	for i, cl := range []*BTClient{puppy, pupper} {
+		kept[i].SetReadDeadline(time.Now().Add(time.Duration(3*BlocklistInterval) * time.Millisecond))
+		for {
+			if _, err := btnet.ReadMessage(kept[i]); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					t.Fatalf("%s kept a peer after blocklisting it", cl.Name())
+				}
+				break
+			}
+		}
+	}
+	util.EndTest()
+}
+
+// the next event, skipping any not of type eventType
+func nextEvent(t *testing.T, events <-chan SessionEvent, eventType string) SessionEvent {
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("Expected a %s event, the subscription ended", eventType)
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("Expected a %s event", eventType)
+		}
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	util.StartTest("Testing subscribing to a session's events...")
+	s := makeQueueSession(t, btnet.NewPipeNetwork(), DefaultConfig())
+	defer s.Close(context.Background())
+	puppy, err := s.AddTorrent(MalformedTorrentFile, MalformedSeedFile, "", MakePersister("/tmp/persister/tsession1.p"))
+	if err != nil {
+		t.Fatalf("Couldn't add puppy: %s", err)
+	}
+	awaitState(t, puppy, StateSeeding)
+
+	events, unsubscribe := s.Subscribe()
+	if event := nextEvent(t, events, "added"); event.InfoHash != puppy.InfoHash() || event.State != StateSeeding {
+		t.Fatalf("Expected puppy to be there already and seeding, got %+v", event)
+	}
+	puppy.Pause()
+	if event := <-events; event.Type != "state" || event.State != StatePaused {
+		t.Fatalf("Expected puppy to be paused, got %+v", event)
+	}
+	pupper, err := s.AddTorrent(SessionTorrentFile, SessionSeedFile, "", MakePersister("/tmp/persister/tsession2.p"))
+	if err != nil {
+		t.Fatalf("Couldn't add pupper: %s", err)
+	}
+	if event := nextEvent(t, events, "added"); event.InfoHash != pupper.InfoHash() || event.Name != pupper.Name() {
+		t.Fatalf("Expected pupper to be added, got %+v", event)
+	}
+	s.RemoveTorrent(puppy.InfoHash(), false)
+	if event := nextEvent(t, events, "removed"); event.InfoHash != puppy.InfoHash() || event.Name != puppy.Name() {
+		t.Fatalf("Expected puppy to be removed, got %+v", event)
+	}
+	unsubscribe()
+	for range events {
+	}
+
+	// subscribers that don't keep up are dropped rather than held up for
+	behind, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+	pupper.Pause()
+	for i := 0; i < EventBuffer; i++ {
+		pupper.Resume()
+		pupper.Pause()
+	}
+	received := 0
+	for range behind {
+		received++
+	}
+	if received > EventBuffer+1 {
+		t.Fatalf("Expected the subscriber to be dropped after %d events, got %d", EventBuffer, received)
+	}
+	util.EndTest()
+}
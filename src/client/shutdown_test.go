@@ -0,0 +1,125 @@
+package btclient
+
+import (
+	"btnet"
+	"context"
+	"fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+	"util"
+)
+
+// Tests
+func TestShutdown(t *testing.T) {
+	util.StartTest("Testing shutting down cleanly...")
+	events := make(chan string, 100)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		events <- r.URL.Query().Get("event")
+	}))
+	defer tracker.Close()
+	torrent := "/tmp/tshutdown.torrent"
+	fs.Write(torrent, fs.GetMetadata(MalformedSeedFile, tracker.URL, "puppy.jpg"))
+
+	before := runtime.NumGoroutine()
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	cl := StartBTClientWithConfig("10.0.0.1", 6881, torrent, MalformedSeedFile, "",
+		MakePersister("/tmp/persister/tshutdown.p"), config)
+	util.Wait(100)
+	conn := expectKept(t, cl, network, "10.0.0.2", makePeerId(1200))
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := cl.Close(ctx); err != nil {
+		t.Fatalf("Shutdown didn't finish: %s", err)
+	}
+	expectDisconnect(t, cl, conn, "peer at shutdown")
+	if conn, err := network.DialFrom("10.0.0.3", "10.0.0.1:6881"); err == nil {
+		conn.Close()
+		t.Fatalf("Client still accepting connections after shutdown")
+	}
+
+	last := ""
+	for len(events) > 0 {
+		last = <-events
+	}
+	if last != string(Stopped) {
+		t.Fatalf("Expected the tracker to hear we stopped, last heard %q", last)
+	}
+
+	// nothing of the client's should be left running
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	tracker.CloseClientConnections()
+	if ok, stacks := util.WaitForGoroutines(before, 1000); !ok {
+		t.Fatalf("Expected at most %d goroutines, have:\n%s", before, stacks)
+	}
+
+	cl.Kill() // again, which is fine
+	util.EndTest()
+}
+
+func TestContextShutdown(t *testing.T) {
+	util.StartTest("Testing shutting down when the context is cancelled...")
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	network := btnet.NewPipeNetwork()
+	config := DefaultConfig()
+	config.Networks = []btnet.Network{network}
+	config.Context = ctx
+	os.Remove("/tmp/tcontext.p")
+	cl := StartBTClientWithConfig("10.0.0.1", 6881, MalformedTorrentFile, "", "",
+		MakePersister("/tmp/tcontext.p"), config)
+	util.Wait(100)
+
+	// a peer with one piece to give
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+	conn := connectToClient(t, cl, network, makePeerId(1300))
+	if conn == nil {
+		cl.Kill()
+		t.Fatalf("Client refused a well behaved peer")
+	}
+	defer conn.Close()
+	conn.Write(btnet.EncodePeerMessage(btnet.PeerMessage{Type: btnet.Piece, Index: 0, Begin: 0,
+		Block: seed[:cl.pieceLength(0)]}))
+	select {
+	case <-cl.pieceDone[0]:
+	case <-time.After(time.Second):
+		cl.Kill()
+		t.Fatalf("Piece 0 should be done")
+	}
+	select {
+	case <-cl.Completed():
+		cl.Kill()
+		t.Fatalf("Client shouldn't be complete with one piece")
+	default:
+	}
+
+	cancel()
+	select {
+	case <-cl.Stopped():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Client didn't shut down when its context was cancelled")
+	}
+	expectDisconnect(t, cl, conn, "peer at shutdown")
+	conn.Close()
+	if ok, stacks := util.WaitForGoroutines(before, 1000); !ok {
+		t.Fatalf("Expected at most %d goroutines, have:\n%s", before, stacks)
+	}
+
+	// progress was saved
+	config.Context = nil
+	restarted := StartBTClientWithConfig("10.0.0.1", 6881, MalformedTorrentFile, "", "",
+		MakePersister("/tmp/tcontext.p"), config)
+	defer restarted.Kill()
+	if !restarted.AtomicGetBitmap()[0] {
+		t.Fatalf("Expected piece 0 to be saved")
+	}
+	util.EndTest()
+}
@@ -0,0 +1,104 @@
+package btclient
+
+// Streaming over HTTP
+// Serves each file of a torrent at its path in Files, e.g.
+// /name/dir/file.mp4, so a browser or video player can play it while it
+// downloads. Range requests read just the pieces they need, hurrying them
+// along with a Reader. The content type comes from the file's extension,
+// or failing that from its first bytes.
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// serves the torrent's files, and a list of them at /
+func (cl *BTClient) StreamHandler() http.Handler {
+	return http.HandlerFunc(cl.serveStream)
+}
+
+func (cl *BTClient) serveStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	files := cl.Files()
+	if name == "" {
+		serveFileList(w, files)
+		return
+	}
+	for i, file := range files {
+		if file.Path != name {
+			continue
+		}
+		if file.Priority == PrioritySkip {
+			// we'd wait for ever
+			http.Error(w, "file is skipped", http.StatusConflict)
+			return
+		}
+		reader, _ := cl.NewFileReader(i)
+		defer reader.Close()
+		// stop waiting for pieces once the player hangs up
+		served := make(chan struct{})
+		defer close(served)
+		go func() {
+			select {
+			case <-r.Context().Done():
+				reader.Close()
+			case <-served:
+			}
+		}()
+		http.ServeContent(w, r, path.Base(file.Path), time.Time{}, reader)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func serveFileList(w http.ResponseWriter, files []FileInfo) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, file := range files {
+		link := (&url.URL{Path: file.Path}).String()
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a> %d bytes, %d%% done\n", html.EscapeString(link),
+			html.EscapeString(file.Path), file.Length, percentDone(file))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+func percentDone(file FileInfo) int64 {
+	if file.Length == 0 {
+		return 100
+	}
+	return file.Done * 100 / file.Length
+}
+
+// Serves each torrent's files under its hex info hash, e.g.
+// /<info hash>/name/file.mp4, and a list of torrents at /
+func (s *Session) StreamHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if name == "" {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprintf(w, "<pre>\n")
+			for _, cl := range s.Torrents() {
+				fmt.Fprintf(w, "<a href=\"%s/\">%s</a>\n", cl.InfoHash(), html.EscapeString(cl.Name()))
+			}
+			fmt.Fprintf(w, "</pre>\n")
+			return
+		}
+		infoHash := strings.SplitN(name, "/", 2)[0]
+		cl, ok := s.Torrent(infoHash)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.StripPrefix("/"+infoHash, cl.StreamHandler()).ServeHTTP(w, r)
+	})
+}
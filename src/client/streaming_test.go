@@ -0,0 +1,171 @@
+package btclient
+
+import (
+	"btnet"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"util"
+)
+
+// Helpers
+
+// requests url with the given Range header, if any, and returns the
+// response with its body read
+func getRange(t *testing.T, url string, byteRange string) (*http.Response, []byte) {
+	req, _ := http.NewRequest("GET", url, nil)
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Couldn't get %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, body
+}
+
+// Tests
+func TestStreamFile(t *testing.T) {
+	util.StartTest("Testing streaming a torrent's file over HTTP...")
+	network := btnet.NewPipeNetwork()
+	cl := makeSeederOnPipes(network)
+	defer cl.Kill()
+	server := httptest.NewServer(cl.StreamHandler())
+	defer server.Close()
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+	file := server.URL + "/" + cl.Files()[0].Path
+
+	resp, body := getRange(t, server.URL+"/", "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), cl.Files()[0].Path) {
+		t.Fatalf("Expected a list of files, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = getRange(t, file, "")
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, seed) {
+		t.Fatalf("Expected the whole file, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if resp.Header.Get("Content-Type") != "image/jpeg" || resp.ContentLength != int64(len(seed)) {
+		t.Fatalf("Expected a %d byte image/jpeg, got a %d byte %s", len(seed), resp.ContentLength,
+			resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Expected byte ranges to be accepted")
+	}
+
+	resp, body = getRange(t, file, "bytes=32000-32999")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, seed[32000:33000]) {
+		t.Fatalf("Expected bytes 32000-32999, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 32000-32999/44411" {
+		t.Fatalf("Expected Content-Range bytes 32000-32999/44411, got %s", got)
+	}
+	resp, _ = getRange(t, file, "bytes=50000-")
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("Expected a range past the end to be refused, got %d", resp.StatusCode)
+	}
+
+	resp, _ = getRange(t, server.URL+"/nothing.mp4", "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected a missing file not to be found, got %d", resp.StatusCode)
+	}
+	resp, _ = http.Post(file, "text/plain", strings.NewReader("hi"))
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected POST not to be allowed, got %d", resp.StatusCode)
+	}
+	util.EndTest()
+}
+
+func TestStreamWhileDownloading(t *testing.T) {
+	util.StartTest("Testing streaming a file while it downloads...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	dir, torrent := makeFilesTorrent(tracker.URL)
+	defer os.RemoveAll(dir)
+	network := btnet.NewPipeNetwork()
+	seeder := startFilesClient(network, "10.0.0.1", torrent, dir, "")
+	defer seeder.Kill()
+	leecher := startFilesClient(network, "10.0.0.2", torrent, "", "")
+	defer leecher.Kill()
+	server := httptest.NewServer(leecher.StreamHandler())
+	defer server.Close()
+	want, _ := ioutil.ReadFile(filepath.Join(dir, "c.jpg"))
+
+	leecher.SetFilePriority(1, PrioritySkip)
+	if resp, _ := getRange(t, server.URL+"/files/b.png", ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected streaming a skipped file to be refused, got %d", resp.StatusCode)
+	}
+
+	type response struct {
+		resp *http.Response
+		body []byte
+	}
+	done := make(chan response, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", server.URL+"/files/c.jpg", nil)
+		req.Header.Set("Range", "bytes=20000-")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			close(done)
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		done <- response{resp, body}
+	}()
+	select {
+	case <-done:
+		t.Fatalf("Expected the response to wait for the data")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	seederAddr, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:6881")
+	leecher.SetupPeerConnections(seederAddr, nil)
+	select {
+	case r, ok := <-done:
+		if !ok {
+			t.Fatalf("Couldn't get c.jpg")
+		}
+		if r.resp.StatusCode != http.StatusPartialContent || !bytes.Equal(r.body, want[20000:]) {
+			t.Fatalf("Expected c.jpg from byte 20000, got %d with %d bytes", r.resp.StatusCode, len(r.body))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the response once the data arrived")
+	}
+	util.EndTest()
+}
+
+func TestSessionStream(t *testing.T) {
+	util.StartTest("Testing streaming a session's torrents over HTTP...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	network := btnet.NewPipeNetwork()
+	s := makeQueueSession(t, network, DefaultConfig())
+	defer s.Close(context.Background())
+	cl := addQueueTorrent(t, s, makeQueueTorrent(tracker.URL, "a.jpg"), MalformedSeedFile)
+	server := httptest.NewServer(s.StreamHandler())
+	defer server.Close()
+	seed, _ := ioutil.ReadFile(MalformedSeedFile)
+
+	resp, body := getRange(t, server.URL+"/", "")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), cl.InfoHash()) {
+		t.Fatalf("Expected a list of torrents, got %d: %s", resp.StatusCode, body)
+	}
+	resp, body = getRange(t, server.URL+"/"+cl.InfoHash()+"/a.jpg", "bytes=0-99")
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, seed[:100]) {
+		t.Fatalf("Expected the first 100 bytes of a.jpg, got %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if resp, _ = getRange(t, server.URL+"/00/a.jpg", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected an unknown torrent not to be found, got %d", resp.StatusCode)
+	}
+	util.EndTest()
+}
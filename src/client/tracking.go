@@ -1,7 +1,7 @@
 package btclient
 
 import (
-	"btnet"
+	"context"
 	"errors"
 	"fs"
 	"io/ioutil"
@@ -9,9 +9,13 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 	"util"
 )
 
+// how long shutdown waits to tell the tracker we've stopped
+const StoppedTimeout = time.Second * 2
+
 type trackerReq struct {
 	peerId     string
 	ip         string
@@ -31,11 +35,8 @@ type TrackerRes struct {
 
 func (cl *BTClient) trackerHeartbeat() {
 	for {
-		if cl.CheckShutdown() {
-			return
-		}
 		res := cl.contactTracker(cl.torrentMeta.TrackerUrl)
-		go func() {
+		cl.spawn(func() {
 			for _, p := range res.Peers {
 				if cl.CheckShutdown() {
 					return
@@ -46,26 +47,33 @@ func (cl *BTClient) trackerHeartbeat() {
 					// panic(err)
 					continue
 				}
+				if p["peer id"] == cl.peerId || !cl.allowedIP(addr.IP) {
+					continue
+				}
+				// we may only know the port it dialed us from
+				cl.atomicSetListenAddr(p["peer id"], addr)
 				myAddr, err := net.ResolveTCPAddr("tcp", cl.ip+":"+cl.port)
 				if addr.String() != myAddr.String() {
-					util.TPrintf("%s: sending initial message to %v\n", cl.port, addr)
-					cl.SendPeerMessage(addr, btnet.PeerMessage{KeepAlive: true})
+					cl.atomicQueueDial(p["peer id"], addr)
 				}
 			}
-		}()
+		})
 		cl.lock("tracking/trackerHeartbeat")
 		wait := cl.heartbeatInterval * 1000
 		cl.unlock("tracking/trackerHeartbeat")
-		util.Wait(wait)
+		if !cl.wait(wait) {
+			return
+		}
 	}
 }
 
 func (cl *BTClient) contactTracker(baseUrl string) TrackerRes {
-	// TODO: update uploaded, downloaded, and left
 	cl.lock("tracking/contactTracker 1")
-	request := trackerReq{cl.peerId, cl.ip, cl.port, 0, 0, 0, cl.infoHash, cl.status}
+	stats := cl.stats()
+	request := trackerReq{cl.peerId, cl.ip, cl.port, int(stats.Uploaded), int(stats.Downloaded),
+		int(stats.Left), cl.infoHash, cl.status}
 	cl.unlock("tracking/contactTracker 1")
-	byteRes, err := sendRequest(baseUrl, &request)
+	byteRes, err := sendRequest(cl.run, baseUrl, &request)
 	if err != nil {
 		util.WPrintf("Received error sending to tracker: %s\n", err)
 	}
@@ -82,21 +90,43 @@ func (cl *BTClient) contactTracker(baseUrl string) TrackerRes {
 	}
 	util.TPrintf("Contacting tracker at %s (%d peers)\n", baseUrl, len(res.Peers))
 	cl.lock("tracking/contactTracker 2")
-	cl.heartbeatInterval = res.Interval
+	if res.Interval > 0 { // keep the old interval if the tracker is unreachable
+		cl.heartbeatInterval = res.Interval
+	}
 	cl.unlock("tracking/contactTracker 2")
 	return res
 }
 
-func sendRequest(addr string, req *trackerReq) ([]byte, error) {
+// tell the tracker we've stopped so it stops handing out our address
+func (cl *BTClient) announceStopped() {
+	ctx, cancel := context.WithTimeout(context.Background(), StoppedTimeout)
+	defer cancel()
+	cl.lock("tracking/announceStopped")
+	stats := cl.stats()
+	request := trackerReq{cl.peerId, cl.ip, cl.port, int(stats.Uploaded), int(stats.Downloaded),
+		int(stats.Left), cl.infoHash, Stopped}
+	cl.unlock("tracking/announceStopped")
+	if _, err := sendRequest(ctx, cl.torrentMeta.TrackerUrl, &request); err != nil {
+		util.WPrintf("%s: could not tell tracker we stopped: %s\n", cl.port, err)
+	}
+}
+
+// sends req to the tracker at addr, giving up if ctx is done first
+func sendRequest(ctx context.Context, addr string, req *trackerReq) ([]byte, error) {
 	url := addr + "/?peer_id=" + url.QueryEscape(req.peerId) +
 		"&port=" + req.port + "&ip=" + req.ip + "&uploaded=" +
 		strconv.Itoa(req.uploaded) + "&downloaded=" + strconv.Itoa(req.downloaded) +
 		"&left=" + strconv.Itoa(req.left) + "&info_hash=" +
-		url.QueryEscape(req.infoHash) + "&status=" + string(req.status)
-	resp, err := http.Get(url)
+		url.QueryEscape(req.infoHash) + "&event=" + string(req.status)
+	httpReq, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errors.New("Error sending request")
+	}
+	resp, err := http.DefaultClient.Do(httpReq.WithContext(ctx))
 	if err != nil {
 		return nil, errors.New("Error sending request")
 	}
+	defer resp.Body.Close()
 	if resp.Status != "200 OK" {
 		return nil, errors.New("Wrong response status code")
 	}
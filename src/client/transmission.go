@@ -0,0 +1,810 @@
+package btclient
+
+// Transmission RPC
+// The core of Transmission's RPC protocol, so its remotes and scripts can
+// drive a session: session-get, session-set, torrent-add, torrent-get,
+// torrent-set, torrent-start, torrent-start-now, torrent-stop and
+// torrent-remove, POSTed to /transmission/rpc as
+//
+//   {"method": "torrent-get", "arguments": {...}, "tag": 1}
+//
+// and answered with {"result": "success", "arguments": {...}, "tag": 1},
+// or an error message in result. Requests carry the API's token, usually
+// as the basic auth password, and the session id from the
+// X-Transmission-Session-Id header of a 409 Conflict response, which
+// stops other web pages from making requests through a browser.
+//
+// Torrents get ids counting up from 1 as they're first seen. Speeds are
+// in kB/s of 1000 bytes. Skipped files are unwanted, and remember the
+// priority they're given for when they're wanted again. Every torrent
+// counts as recently active.
+//
+// As with the control API, torrent-add takes .torrent files, not magnet
+// links, reads them only from the API's directory and downloads only
+// into it, and session-set keeps the download directory inside it.
+
+import (
+	"btnet"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"util"
+)
+
+const SessionIdHeader = "X-Transmission-Session-Id"
+
+// the protocol version we speak, Transmission 2.94's
+const RPCVersion int = 15
+
+// bytes per second in a kB/s
+const RPCSpeedUnit int = 1000
+
+// ids of removed torrents kept for recently-active torrent-gets, oldest
+// forgotten first
+const MaxRemovedIds int = 1000
+
+var ErrRPCMethod = errors.New("method name not recognized")
+var ErrRPCTorrent = errors.New("invalid or corrupt torrent file")
+var ErrRPCFields = errors.New("no fields given")
+
+// Transmission's torrent statuses
+const (
+	rpcStopped      = 0
+	rpcDownloadWait = 3
+	rpcDownloading  = 4
+	rpcSeedWait     = 5
+	rpcSeeding      = 6
+)
+
+// Transmission's estimates of the time left, in place of seconds
+const (
+	rpcETANotAvailable = -1 // nothing left to download
+	rpcETAUnknown      = -2 // nothing coming in
+)
+
+type rpc struct {
+	api       *api
+	sessionId string
+
+	mu          sync.Mutex
+	downloadDir string         // where torrents download to unless told otherwise
+	ids         map[string]int // by hex info hash
+	nextId      int
+	removed     []int                       // ids of torrents gone since the last recently-active torrent-get
+	unwanted    map[string]map[int]Priority // priorities of skipped files, by hex info hash
+}
+
+type rpcRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+type rpcResponse struct {
+	Result    string          `json:"result"`
+	Arguments interface{}     `json:"arguments"`
+	Tag       json.RawMessage `json:"tag,omitempty"`
+}
+
+// the torrents a request is about: an id, a hex info hash, a list of
+// those, "recently-active" or nothing for every torrent
+type rpcIds struct {
+	Ids json.RawMessage `json:"ids"`
+}
+
+type rpcSessionGet struct {
+	Fields []string `json:"fields"` // every field if empty
+}
+
+type rpcSessionSet struct {
+	DownloadDir           *string  `json:"download-dir"`
+	SpeedLimitUp          *int     `json:"speed-limit-up"`
+	SpeedLimitUpEnabled   *bool    `json:"speed-limit-up-enabled"`
+	SpeedLimitDown        *int     `json:"speed-limit-down"`
+	SpeedLimitDownEnabled *bool    `json:"speed-limit-down-enabled"`
+	SeedRatioLimit        *float64 `json:"seedRatioLimit"`
+	SeedRatioLimited      *bool    `json:"seedRatioLimited"`
+	DownloadQueueSize     *int     `json:"download-queue-size"`
+	DownloadQueueEnabled  *bool    `json:"download-queue-enabled"`
+	SeedQueueSize         *int     `json:"seed-queue-size"`
+	SeedQueueEnabled      *bool    `json:"seed-queue-enabled"`
+}
+
+// a .torrent file's path or URL in Filename, or its contents base64
+// encoded in Metainfo
+type rpcTorrentAdd struct {
+	Filename    string `json:"filename"`
+	Metainfo    string `json:"metainfo"`
+	DownloadDir string `json:"download-dir"`
+	Paused      bool   `json:"paused"`
+}
+
+type rpcTorrentGet struct {
+	rpcIds
+	Fields []string `json:"fields"`
+}
+
+type rpcTorrentSet struct {
+	rpcIds
+	UploadLimit     *int     `json:"uploadLimit"`
+	UploadLimited   *bool    `json:"uploadLimited"`
+	DownloadLimit   *int     `json:"downloadLimit"`
+	DownloadLimited *bool    `json:"downloadLimited"`
+	FilesWanted     []int    `json:"files-wanted"`
+	FilesUnwanted   []int    `json:"files-unwanted"`
+	PriorityHigh    []int    `json:"priority-high"`
+	PriorityLow     []int    `json:"priority-low"`
+	PriorityNormal  []int    `json:"priority-normal"`
+	QueuePosition   *int     `json:"queuePosition"`
+	SeedRatioLimit  *float64 `json:"seedRatioLimit"`
+	SeedRatioMode   *int     `json:"seedRatioMode"` // 0 the session's, 1 the torrent's, 2 unlimited
+}
+
+type rpcTorrentRemove struct {
+	rpcIds
+	DeleteLocalData bool `json:"delete-local-data"`
+}
+
+type rpcFile struct {
+	Name           string `json:"name"`
+	Length         int64  `json:"length"`
+	BytesCompleted int64  `json:"bytesCompleted"`
+}
+
+type rpcFileStats struct {
+	BytesCompleted int64 `json:"bytesCompleted"`
+	Wanted         bool  `json:"wanted"`
+	Priority       int   `json:"priority"`
+}
+
+// what torrent-add says about the torrent it added, or found already there
+type rpcAdded struct {
+	Id         int    `json:"id"`
+	Name       string `json:"name"`
+	HashString string `json:"hashString"`
+}
+
+// returns a handler for Transmission's RPC protocol, see the top of
+// transmission.go, that keeps what's added where the API with config would
+func (s *Session) TransmissionHandler(config APIConfig) http.Handler {
+	return &rpc{
+		api:         &api{s: s, config: config},
+		sessionId:   util.GenerateRandStr(48),
+		downloadDir: config.Dir,
+		ids:         make(map[string]int),
+		nextId:      1,
+		unwanted:    make(map[string]map[int]Priority)}
+}
+
+func (t *rpc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !t.api.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"Transmission\"")
+		http.Error(w, "401: Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set(SessionIdHeader, t.sessionId)
+	w.Header().Set("Access-Control-Expose-Headers", SessionIdHeader)
+	if r.Header.Get(SessionIdHeader) != t.sessionId {
+		http.Error(w, "409: Conflict\nYour request had an invalid session-id header.\n"+
+			"Resend it with the "+SessionIdHeader+" header of this response.", http.StatusConflict)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "405: Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req rpcRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 2*MaxTorrentSize)).Decode(&req); err != nil {
+		http.Error(w, "400: Bad Request", http.StatusBadRequest)
+		return
+	}
+	if len(req.Arguments) == 0 {
+		req.Arguments = json.RawMessage("{}")
+	}
+	resp := rpcResponse{Result: "success", Tag: req.Tag}
+	arguments, err := t.call(req.Method, req.Arguments)
+	if err != nil {
+		resp.Result = err.Error()
+	}
+	resp.Arguments = arguments
+	if arguments == nil {
+		resp.Arguments = struct{}{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// runs method with the JSON arguments, returning the arguments to answer with
+func (t *rpc) call(method string, arguments json.RawMessage) (interface{}, error) {
+	var err error
+	switch method {
+	case "session-get":
+		var req rpcSessionGet
+		if err = json.Unmarshal(arguments, &req); err == nil {
+			return t.sessionGet(req), nil
+		}
+	case "session-set":
+		var req rpcSessionSet
+		if err = json.Unmarshal(arguments, &req); err == nil {
+			return nil, t.sessionSet(req)
+		}
+	case "torrent-add":
+		var req rpcTorrentAdd
+		if err = json.Unmarshal(arguments, &req); err == nil {
+			return t.torrentAdd(req)
+		}
+	case "torrent-get":
+		var req rpcTorrentGet
+		if err = json.Unmarshal(arguments, &req); err == nil {
+			return t.torrentGet(req)
+		}
+	case "torrent-set":
+		var req rpcTorrentSet
+		if err = json.Unmarshal(arguments, &req); err == nil {
+			return nil, t.torrentSet(req)
+		}
+	case "torrent-start", "torrent-start-now", "torrent-stop":
+		var req rpcIds
+		if err = json.Unmarshal(arguments, &req); err == nil {
+			return nil, t.torrentStart(req, method)
+		}
+	case "torrent-remove":
+		var req rpcTorrentRemove
+		if err = json.Unmarshal(arguments, &req); err == nil {
+			return nil, t.torrentRemove(req)
+		}
+	default:
+		return nil, ErrRPCMethod
+	}
+	return nil, err
+}
+
+// Returns the torrents ids names, in queue order, and whether they were
+// asked for as "recently-active". Unknown ids are left out.
+func (t *rpc) torrents(ids json.RawMessage) ([]*BTClient, bool, error) {
+	all := t.api.s.Queue()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.updateIds(all)
+
+	var recent string
+	if len(ids) == 0 || (json.Unmarshal(ids, &recent) == nil && recent == "recently-active") {
+		return all, len(ids) != 0, nil
+	}
+	var list []interface{}
+	if err := json.Unmarshal(ids, &list); err != nil {
+		var one interface{}
+		if err := json.Unmarshal(ids, &one); err != nil {
+			return nil, false, err
+		}
+		list = []interface{}{one}
+	}
+	wanted := make(map[string]bool)
+	byId := make(map[int]string)
+	for infoHash, id := range t.ids {
+		byId[id] = infoHash
+	}
+	for _, id := range list {
+		switch id := id.(type) {
+		case float64:
+			wanted[byId[int(id)]] = true
+		case string:
+			wanted[strings.ToLower(id)] = true
+		default:
+			return nil, false, fmt.Errorf("invalid id %v", id)
+		}
+	}
+	torrents := []*BTClient{}
+	for _, cl := range all {
+		if wanted[cl.InfoHash()] {
+			torrents = append(torrents, cl)
+		}
+	}
+	return torrents, false, nil
+}
+
+// gives new torrents in all ids, and forgets those of torrents that
+// aren't there any more, must hold lock
+func (t *rpc) updateIds(all []*BTClient) {
+	there := make(map[string]bool)
+	for _, cl := range all {
+		there[cl.InfoHash()] = true
+		t.id(cl)
+	}
+	for infoHash, id := range t.ids {
+		if !there[infoHash] {
+			delete(t.ids, infoHash)
+			delete(t.unwanted, infoHash)
+			t.removed = append(t.removed, id)
+			if len(t.removed) > MaxRemovedIds {
+				t.removed = t.removed[len(t.removed)-MaxRemovedIds:]
+			}
+		}
+	}
+}
+
+// returns cl's id, giving it the next one if it doesn't have one yet,
+// must hold lock
+func (t *rpc) id(cl *BTClient) int {
+	infoHash := cl.InfoHash()
+	if _, ok := t.ids[infoHash]; !ok {
+		t.ids[infoHash] = t.nextId
+		t.nextId++
+	}
+	return t.ids[infoHash]
+}
+
+func (t *rpc) sessionGet(req rpcSessionGet) map[string]interface{} {
+	s := t.api.s
+	upload, download := s.Connections().Upload.Rate(), s.Connections().Download.Rate()
+	downloads, seeds := s.QueueLimits()
+	goals := s.SeedGoals()
+	t.mu.Lock()
+	downloadDir := t.downloadDir
+	t.mu.Unlock()
+	return pickFields(map[string]interface{}{
+		"version":                  "2.94 (btclient)",
+		"rpc-version":              RPCVersion,
+		"rpc-version-minimum":      1,
+		"session-id":               t.sessionId,
+		"download-dir":             downloadDir,
+		"peer-port":                s.port,
+		"encryption":               rpcEncryption(s.config.Encryption),
+		"speed-limit-up":           upload / RPCSpeedUnit,
+		"speed-limit-up-enabled":   upload > 0,
+		"speed-limit-down":         download / RPCSpeedUnit,
+		"speed-limit-down-enabled": download > 0,
+		"seedRatioLimit":           goals.Ratio,
+		"seedRatioLimited":         goals.Ratio > 0,
+		"download-queue-size":      downloads,
+		"download-queue-enabled":   downloads > 0,
+		"seed-queue-size":          seeds,
+		"seed-queue-enabled":       seeds > 0,
+		"units": map[string]interface{}{
+			"speed-units":  []string{"kB/s", "MB/s", "GB/s", "TB/s"},
+			"speed-bytes":  RPCSpeedUnit,
+			"size-units":   []string{"kB", "MB", "GB", "TB"},
+			"size-bytes":   1000,
+			"memory-units": []string{"KiB", "MiB", "GiB", "TiB"},
+			"memory-bytes": 1024}}, req.Fields)
+}
+
+// what Transmission calls an encryption policy
+func rpcEncryption(policy btnet.EncryptionPolicy) string {
+	switch policy {
+	case btnet.EncryptionDisabled:
+		return "tolerated"
+	case btnet.EncryptionRequire:
+		return "required"
+	}
+	return "preferred"
+}
+
+func (t *rpc) sessionSet(req rpcSessionSet) error {
+	s := t.api.s
+	if req.DownloadDir != nil {
+		dir, err := t.downloadDirectory(*req.DownloadDir)
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.downloadDir = dir
+		t.mu.Unlock()
+	}
+	conns := s.Connections()
+	conns.SetRateLimits(
+		rpcLimit(conns.Upload.Rate(), req.SpeedLimitUp, req.SpeedLimitUpEnabled, RPCSpeedUnit),
+		rpcLimit(conns.Download.Rate(), req.SpeedLimitDown, req.SpeedLimitDownEnabled, RPCSpeedUnit))
+	downloads, seeds := s.QueueLimits()
+	s.SetQueueLimits(
+		rpcLimit(downloads, req.DownloadQueueSize, req.DownloadQueueEnabled, 1),
+		rpcLimit(seeds, req.SeedQueueSize, req.SeedQueueEnabled, 1))
+	if req.SeedRatioLimit != nil || req.SeedRatioLimited != nil {
+		goals := s.SeedGoals()
+		goals.Ratio = rpcRatio(goals.Ratio, req.SeedRatioLimit, req.SeedRatioLimited)
+		s.SetSeedGoals(goals)
+	}
+	return nil
+}
+
+// Returns what a limit of current becomes given a new limit in units and
+// whether to limit at all, leaving out either to keep it as it is. 0 means
+// no limit, so there's no limit to switch on unless one is given.
+func rpcLimit(current int, limit *int, limited *bool, unit int) int {
+	on := current > 0
+	if limited != nil {
+		on = *limited
+	}
+	if limit != nil {
+		current = *limit * unit
+	}
+	if !on || current < 0 {
+		return 0
+	}
+	return current
+}
+
+// rpcLimit for share ratios
+func rpcRatio(current float64, limit *float64, limited *bool) float64 {
+	on := current > 0
+	if limited != nil {
+		on = *limited
+	}
+	if limit != nil {
+		current = *limit
+	}
+	if !on || current < 0 {
+		return 0
+	}
+	return current
+}
+
+// Adds a torrent, answering with it as torrent-added, or as
+// torrent-duplicate if it was there already. Its data goes in a directory
+// named after it in the download directory, with its hash added if
+// another torrent has that name.
+func (t *rpc) torrentAdd(req rpcTorrentAdd) (interface{}, error) {
+	var data []byte
+	var err error
+	switch {
+	case req.Metainfo != "":
+		data, err = base64.StdEncoding.DecodeString(req.Metainfo)
+	case strings.HasPrefix(req.Filename, "magnet:"):
+		return nil, ErrMagnet
+	case strings.HasPrefix(req.Filename, "http://") || strings.HasPrefix(req.Filename, "https://"):
+		data, err = fetchTorrent(req.Filename)
+	case req.Filename != "":
+		var path string
+		if path, err = t.api.inDir(req.Filename); err == nil {
+			data, err = ioutil.ReadFile(path)
+		}
+	default:
+		return nil, errors.New("no filename or metainfo given")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dir := req.DownloadDir
+	if dir == "" {
+		t.mu.Lock()
+		dir = t.downloadDir
+		t.mu.Unlock()
+	} else if dir, err = t.downloadDirectory(dir); err != nil {
+		return nil, err
+	}
+	cl, err := t.api.add(data, dir, "", "", req.Paused)
+	key := "torrent-added"
+	switch {
+	case err == ErrDuplicateTorrent && cl != nil:
+		key = "torrent-duplicate"
+	case err == ErrDuplicateTorrent || err == ErrOutputInUse:
+		return nil, err
+	case err != nil:
+		return nil, ErrRPCTorrent
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	added := rpcAdded{Id: t.id(cl), Name: cl.Name(), HashString: cl.InfoHash()}
+	return map[string]interface{}{key: added}, nil
+}
+
+// dir as a download directory, which like Transmission's must be absolute,
+// and must be the API's directory or inside it
+func (t *rpc) downloadDirectory(dir string) (string, error) {
+	if !filepath.IsAbs(dir) {
+		return "", errors.New("download directory path is not absolute")
+	}
+	if root, err := filepath.Abs(t.api.config.Dir); err == nil && filepath.Clean(dir) == root {
+		return root, nil
+	}
+	return t.api.inDir(dir)
+}
+
+// Answers with the fields asked for of each torrent, along with the ids
+// of those removed since last time if asked for recently active ones
+func (t *rpc) torrentGet(req rpcTorrentGet) (interface{}, error) {
+	if len(req.Fields) == 0 {
+		return nil, ErrRPCFields
+	}
+	torrents, recent, err := t.torrents(req.Ids)
+	if err != nil {
+		return nil, err
+	}
+	got := []map[string]interface{}{}
+	for _, cl := range torrents {
+		got = append(got, pickFields(t.describe(cl), req.Fields))
+	}
+	arguments := map[string]interface{}{"torrents": got}
+	if recent {
+		t.mu.Lock()
+		arguments["removed"] = append([]int{}, t.removed...)
+		t.removed = nil
+		t.mu.Unlock()
+	}
+	return arguments, nil
+}
+
+// every torrent-get field of cl
+func (t *rpc) describe(cl *BTClient) map[string]interface{} {
+	s := t.api.s
+	stats := cl.Stats()
+	upload, download := cl.RateLimits()
+	position, _ := s.QueuePosition(cl.InfoHash())
+	t.mu.Lock()
+	id := t.id(cl)
+	unwanted := make(map[int]Priority)
+	for file, priority := range t.unwanted[cl.InfoHash()] {
+		unwanted[file] = priority
+	}
+	t.mu.Unlock()
+
+	files := []rpcFile{}
+	fileStats := []rpcFileStats{}
+	priorities := []int{}
+	wanted := []int{}
+	size, have, sizeWhenDone, left := int64(0), int64(0), int64(0), int64(0)
+	for i, file := range cl.Files() {
+		priority := file.Priority
+		if priority == PrioritySkip {
+			priority = remembered(unwanted, i)
+		}
+		files = append(files, rpcFile{Name: file.Path, Length: file.Length, BytesCompleted: file.Done})
+		fileStats = append(fileStats, rpcFileStats{BytesCompleted: file.Done,
+			Wanted: file.Priority != PrioritySkip, Priority: rpcPriority(priority)})
+		priorities = append(priorities, rpcPriority(priority))
+		size += file.Length
+		have += file.Done
+		if file.Priority != PrioritySkip {
+			wanted = append(wanted, 1)
+			sizeWhenDone += file.Length
+			left += file.Length - file.Done
+		} else {
+			wanted = append(wanted, 0)
+		}
+	}
+	percentDone := 1.0
+	if sizeWhenDone > 0 {
+		percentDone = float64(sizeWhenDone-left) / float64(sizeWhenDone)
+	}
+
+	status := rpcStopped
+	switch cl.State() {
+	case StateQueued:
+		status = rpcDownloadWait
+		if left == 0 {
+			status = rpcSeedWait
+		}
+	case StateDownloading:
+		status = rpcDownloading
+	case StateSeeding:
+		status = rpcSeeding
+	}
+	eta := int64(rpcETANotAvailable)
+	if left > 0 {
+		eta = rpcETAUnknown
+		if stats.DownloadRate > 0 {
+			eta = int64(float64(left) / stats.DownloadRate)
+		}
+	}
+	goals := cl.SeedGoals()
+	seedRatioMode := 0
+	if cl.OwnSeedGoals() {
+		seedRatioMode = 1
+		if goals.Ratio == 0 {
+			seedRatioMode = 2
+		}
+	}
+	downloadDir := ""
+	if cl.outputPath != "" {
+		downloadDir = filepath.Dir(cl.outputPath)
+	}
+
+	return map[string]interface{}{
+		"id":              id,
+		"hashString":      cl.InfoHash(),
+		"name":            cl.Name(),
+		"status":          status,
+		"error":           0,
+		"errorString":     "",
+		"totalSize":       size,
+		"sizeWhenDone":    sizeWhenDone,
+		"leftUntilDone":   left,
+		"haveValid":       have,
+		"percentDone":     percentDone,
+		"uploadedEver":    stats.Uploaded,
+		"downloadedEver":  stats.Downloaded,
+		"uploadRatio":     stats.Ratio,
+		"rateUpload":      int64(stats.UploadRate),
+		"rateDownload":    int64(stats.DownloadRate),
+		"uploadLimit":     upload / RPCSpeedUnit,
+		"uploadLimited":   upload > 0,
+		"downloadLimit":   download / RPCSpeedUnit,
+		"downloadLimited": download > 0,
+		"peersConnected":  len(cl.atomicGetPeerIds()),
+		"queuePosition":   position,
+		"downloadDir":     downloadDir,
+		"secondsSeeding":  int64(stats.SeedTime.Seconds()),
+		"seedRatioLimit":  goals.Ratio,
+		"seedRatioMode":   seedRatioMode,
+		"eta":             eta,
+		"pieceCount":      len(cl.torrentMeta.PieceHashes),
+		"pieceSize":       cl.torrentMeta.PieceLen,
+		"files":           files,
+		"fileStats":       fileStats,
+		"priorities":      priorities,
+		"wanted":          wanted}
+}
+
+// Transmission's file priorities, which don't have skipping
+func rpcPriority(priority Priority) int {
+	switch priority {
+	case PriorityLow:
+		return -1
+	case PriorityHigh:
+		return 1
+	}
+	return 0
+}
+
+// the fields of all that were asked for, or all of them if none were
+func pickFields(all map[string]interface{}, fields []string) map[string]interface{} {
+	if len(fields) == 0 {
+		return all
+	}
+	picked := make(map[string]interface{})
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			picked[field] = value
+		}
+	}
+	return picked
+}
+
+func (t *rpc) torrentSet(req rpcTorrentSet) error {
+	torrents, _, err := t.torrents(req.Ids)
+	if err != nil {
+		return err
+	}
+	for _, cl := range torrents {
+		upload, download := cl.RateLimits()
+		cl.SetRateLimits(rpcLimit(upload, req.UploadLimit, req.UploadLimited, RPCSpeedUnit),
+			rpcLimit(download, req.DownloadLimit, req.DownloadLimited, RPCSpeedUnit))
+
+		if err := t.setFiles(cl, req); err != nil {
+			return err
+		}
+
+		if req.QueuePosition != nil {
+			t.api.s.SetQueuePosition(cl.InfoHash(), *req.QueuePosition)
+		}
+		if req.SeedRatioMode != nil || req.SeedRatioLimit != nil {
+			t.setSeedRatio(cl, req.SeedRatioMode, req.SeedRatioLimit)
+		}
+	}
+	return nil
+}
+
+// Applies the request's wanted files and priorities to cl. Unwanted files
+// are skipped and keep the priority they'd have in t.unwanted, and
+// unwanting a file wins over wanting it.
+func (t *rpc) setFiles(cl *BTClient, req rpcTorrentSet) error {
+	files := cl.Files()
+	for _, list := range [][]int{req.FilesWanted, req.FilesUnwanted, req.PriorityLow, req.PriorityNormal, req.PriorityHigh} {
+		for _, file := range list {
+			if file < 0 || file >= len(files) {
+				return ErrFileIndex
+			}
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	unwanted := t.unwanted[cl.InfoHash()]
+	if unwanted == nil {
+		unwanted = make(map[int]Priority)
+		t.unwanted[cl.InfoHash()] = unwanted
+	}
+
+	wanted := make([]bool, len(files))
+	priorities := make([]Priority, len(files))
+	for i, file := range files {
+		wanted[i] = file.Priority != PrioritySkip
+		priorities[i] = file.Priority
+		if !wanted[i] {
+			priorities[i] = remembered(unwanted, i)
+		}
+	}
+	for _, p := range []struct {
+		files    []int
+		priority Priority
+	}{{req.PriorityLow, PriorityLow}, {req.PriorityNormal, PriorityNormal}, {req.PriorityHigh, PriorityHigh}} {
+		for _, file := range p.files {
+			priorities[file] = p.priority
+		}
+	}
+	for _, file := range req.FilesWanted {
+		wanted[file] = true
+	}
+	for _, file := range req.FilesUnwanted {
+		wanted[file] = false
+	}
+
+	for i, file := range files {
+		priority := priorities[i]
+		if wanted[i] {
+			delete(unwanted, i)
+		} else {
+			unwanted[i] = priority
+			priority = PrioritySkip
+		}
+		if priority != file.Priority {
+			cl.SetFilePriority(i, priority)
+		}
+	}
+	return nil
+}
+
+// the priority unwanted remembers for file, normal if it has none
+func remembered(unwanted map[int]Priority, file int) Priority {
+	if priority, ok := unwanted[file]; ok {
+		return priority
+	}
+	return PriorityNormal
+}
+
+// Gives cl a share ratio of its own, none at all, or its session's.
+// A limit without a mode becomes cl's own.
+func (t *rpc) setSeedRatio(cl *BTClient, mode *int, limit *float64) {
+	goals := cl.SeedGoals()
+	switch {
+	case mode != nil && *mode == 0:
+		cl.ClearSeedGoals()
+		return
+	case mode != nil && *mode == 2:
+		goals.Ratio = 0
+	case limit != nil && *limit > 0:
+		goals.Ratio = *limit
+	case limit != nil:
+		goals.Ratio = 0
+	}
+	cl.SetSeedGoals(goals)
+}
+
+func (t *rpc) torrentStart(req rpcIds, method string) error {
+	torrents, _, err := t.torrents(req.Ids)
+	if err != nil {
+		return err
+	}
+	for _, cl := range torrents {
+		if method == "torrent-stop" {
+			t.api.s.ForceStart(cl.InfoHash(), false)
+			cl.Pause()
+			continue
+		}
+		cl.Resume()
+		t.api.s.ForceStart(cl.InfoHash(), method == "torrent-start-now")
+	}
+	return nil
+}
+
+func (t *rpc) torrentRemove(req rpcTorrentRemove) error {
+	torrents, _, err := t.torrents(req.Ids)
+	if err != nil {
+		return err
+	}
+	for _, cl := range torrents {
+		if err := t.api.s.RemoveTorrent(cl.InfoHash(), req.DeleteLocalData); err != nil {
+			return err
+		}
+	}
+	return nil
+}
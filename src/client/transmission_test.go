@@ -0,0 +1,158 @@
+package btclient
+
+import (
+	"btnet"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"util"
+)
+
+// Transmission RPC requests and the responses to expect, with $DIR,
+// $TORRENT, $OUTSIDE and $METAINFO standing in for the download
+// directory, the path of a.jpg's torrent in it and outside it, and b.jpg's
+// base64 encoded
+const TransmissionFixtures = "../test/transmission/*.json"
+
+// Helpers
+
+type rpcFixture struct {
+	Exchanges []struct {
+		Request  json.RawMessage `json:"request"`
+		Response json.RawMessage `json:"response"`
+	} `json:"exchanges"`
+}
+
+func makeTransmission(t *testing.T) (*Session, *httptest.Server, string) {
+	s := makeQueueSession(t, btnet.NewPipeNetwork(), DefaultConfig())
+	dir, _ := ioutil.TempDir("", "trpc")
+	server := httptest.NewServer(s.TransmissionHandler(APIConfig{Token: APIToken, Dir: dir}))
+	return s, server, dir
+}
+
+// POSTs body with the API's token as the basic auth password and the
+// given session id, returning the response with its body read
+func rpcPost(t *testing.T, url string, sessionId string, body string) (*http.Response, []byte) {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+	req.SetBasicAuth("admin", APIToken)
+	if sessionId != "" {
+		req.Header.Set(SessionIdHeader, sessionId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Couldn't post to %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp, data
+}
+
+// sends each of the fixture's requests in turn, expecting the JSON of the
+// responses to match
+func replayFixture(t *testing.T, path string, url string, vars map[string]string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read %s: %s", path, err)
+	}
+	for name, value := range vars {
+		encoded, _ := json.Marshal(value)
+		data = bytes.Replace(data, []byte("$"+name), encoded[1:len(encoded)-1], -1)
+	}
+	var fixture rpcFixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		t.Fatalf("Couldn't parse %s: %s", path, err)
+	}
+
+	resp, _ := rpcPost(t, url, "", "")
+	sessionId := resp.Header.Get(SessionIdHeader)
+	for i, exchange := range fixture.Exchanges {
+		resp, body := rpcPost(t, url, sessionId, string(exchange.Request))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %d: expected 200, got %d: %s", filepath.Base(path), i, resp.StatusCode, body)
+		}
+		var got, want interface{}
+		json.Unmarshal(body, &got)
+		json.Unmarshal(exchange.Response, &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s %d: %s\nexpected %s\n     got %s", filepath.Base(path), i, exchange.Request,
+				exchange.Response, body)
+		}
+	}
+}
+
+// Tests
+func TestTransmissionSessionId(t *testing.T) {
+	util.StartTest("Testing Transmission RPC's authentication and session ids...")
+	s, server, dir := makeTransmission(t)
+	defer os.RemoveAll(dir)
+	defer s.Close(context.Background())
+	defer server.Close()
+	url := server.URL + "/transmission/rpc"
+	request := `{"method": "session-get", "arguments": {"fields": ["rpc-version"]}, "tag": 7}`
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(request))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("Expected a request without the token to be asked for it, got %v", resp.StatusCode)
+	}
+	resp, _ = rpcPost(t, url, "", request)
+	sessionId := resp.Header.Get(SessionIdHeader)
+	if resp.StatusCode != http.StatusConflict || sessionId == "" {
+		t.Fatalf("Expected a request without a session id to be given one, got %d", resp.StatusCode)
+	}
+	if resp, _ = rpcPost(t, url, "wrong", request); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected a request with the wrong session id to conflict, got %d", resp.StatusCode)
+	}
+
+	resp, body := rpcPost(t, url, sessionId, request)
+	var got rpcResponse
+	json.Unmarshal(body, &got)
+	if resp.StatusCode != http.StatusOK || got.Result != "success" || string(got.Tag) != "7" {
+		t.Fatalf("Expected the request to succeed with its tag, got %d: %s", resp.StatusCode, body)
+	}
+	if resp.Header.Get(SessionIdHeader) != sessionId {
+		t.Fatalf("Expected the session id to stay the same")
+	}
+	if resp, _ = rpcPost(t, url, sessionId, "{"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected a malformed request to be refused, got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", url, nil)
+	req.SetBasicAuth("admin", APIToken)
+	req.Header.Set(SessionIdHeader, sessionId)
+	if resp, _ = http.DefaultClient.Do(req); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected GET not to be allowed, got %d", resp.StatusCode)
+	}
+	util.EndTest()
+}
+
+func TestTransmissionFixtures(t *testing.T) {
+	util.StartTest("Testing Transmission RPC against recorded requests and responses...")
+	tracker := quietTracker()
+	defer tracker.Close()
+	fixtures, _ := filepath.Glob(TransmissionFixtures)
+	if len(fixtures) == 0 {
+		t.Fatalf("Expected fixtures in %s", TransmissionFixtures)
+	}
+	a := makeQueueTorrent(tracker.URL, "a.jpg")
+	b := makeQueueTorrent(tracker.URL, "b.jpg")
+
+	for _, fixture := range fixtures {
+		s, server, dir := makeTransmission(t)
+		torrent, _ := ioutil.ReadFile(a)
+		ioutil.WriteFile(filepath.Join(dir, "a.jpg.torrent"), torrent, 0644)
+		vars := map[string]string{"DIR": dir, "TORRENT": filepath.Join(dir, "a.jpg.torrent"), "OUTSIDE": a,
+			"METAINFO": torrentData(b)}
+		replayFixture(t, fixture, server.URL+"/transmission/rpc", vars)
+		server.Close()
+		s.Close(context.Background())
+		os.RemoveAll(dir)
+	}
+	util.EndTest()
+}
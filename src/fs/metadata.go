@@ -6,6 +6,7 @@ import (
 	"crypto/sha1"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"util"
 )
@@ -29,7 +30,7 @@ type Metadata struct {
 
 type FileData struct {
 	Length int64
-	Path   []string
+	Path   []string // within the torrent's directory, for multi-file torrents
 }
 
 func (md *Metadata) GetLength() int {
@@ -40,6 +41,17 @@ func (md *Metadata) GetLength() int {
 	return length
 }
 
+// returns where each file starts in the torrent's data
+func (md *Metadata) FileOffsets() []int64 {
+	offsets := make([]int64, len(md.Files))
+	offset := int64(0)
+	for i, file := range md.Files {
+		offsets[i] = offset
+		offset += file.Length
+	}
+	return offsets
+}
+
 // Open a .torrent file and decodne its contents
 func ReadTorrent(path string) Torrent {
 	fileBytes, err := ioutil.ReadFile(path)
@@ -83,22 +95,41 @@ func Read(path string) Metadata {
 				Length: torrent.Info["length"].(int64),
 				Path:   []string{}}}
 	} else {
-		panic("currently no support for multiple files in a torrent file")
-		// // multiple files
-		// metadata.Files = []FileData{}
-		// obj := []interface{}{}
-		// files := Decode(torrent.Info["files"], obj)
-		// fmt.Println("%v", files)
-		// // for _, file := range files {
-		// //     fmt.Println("%T", file)
-		// //     // metadata.Files = append(metadata.Files, FileData{
-		// //     //     Length: file["length"],
-		// //     //     Path: file["path"] })
-		// // }
+		// multiple files
+		files, ok := torrent.Info["files"].([]interface{})
+		if !ok || len(files) == 0 {
+			panic("Torrent " + path + " has no files")
+		}
+		metadata.Files = []FileData{}
+		for _, f := range files {
+			file := f.(map[string]interface{})
+			data := FileData{Length: file["length"].(int64), Path: []string{}}
+			for _, part := range file["path"].([]interface{}) {
+				data.Path = append(data.Path, part.(string))
+			}
+			if !safePath(data.Path) {
+				panic("Torrent " + path + " has a file outside its directory: " + strings.Join(data.Path, "/"))
+			}
+			metadata.Files = append(metadata.Files, data)
+		}
 	}
 	return metadata
 }
 
+// whether a multi-file torrent's file path stays inside the directory it's
+// written to, so a torrent can't overwrite whatever it likes
+func safePath(path []string) bool {
+	if len(path) == 0 || filepath.IsAbs(filepath.Join(path...)) {
+		return false
+	}
+	for _, part := range path {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\\x00") {
+			return false
+		}
+	}
+	return true
+}
+
 // Write torrent metadata into a .torrent file
 func Write(path string, data Metadata) {
 	torrent := Torrent{}
@@ -110,16 +141,14 @@ func Write(path string, data Metadata) {
 	if len(data.Files) == 1 {
 		torrent.Info["length"] = data.Files[0].Length
 	} else {
-		panic("currently no support for multiple files in a torrent file")
-		// // multiple files
-		// files := []map[string]string{}
-		// for _, file := range data.Files {
-		//     newFile := map[string]string{
-		//         "length": strconv.FormatUint(file.Length, 10),
-		//         "path": Encode(file.Path) }
-		//     files = append(files, newFile)
-		// }
-		// torrent.Info["files"] = Encode(files)
+		// multiple files
+		files := []map[string]interface{}{}
+		for _, file := range data.Files {
+			files = append(files, map[string]interface{}{
+				"length": file.Length,
+				"path":   file.Path})
+		}
+		torrent.Info["files"] = files
 	}
 	outBytes := []byte(Encode(torrent))
 	err := ioutil.WriteFile(path, outBytes, 0644)
@@ -156,3 +185,28 @@ func GetMetadata(path string, trackerUrl string, fileName string) Metadata {
 
 	return Metadata{trackerUrl, fileName, PieceSize, pieceHashes, []FileData{fileInfo}}
 }
+
+// read every file under dir, in lexical order, and create a Metadata
+// struct for a multi-file torrent of them. There should be at least two.
+func GetDirMetadata(dir string, trackerUrl string, name string) Metadata {
+	files := []FileData{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileData{info.Size(), strings.Split(filepath.ToSlash(rel), "/")})
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	pieceHashes := []string{}
+	for _, p := range SplitFilesIntoPieces(dir, files, PieceSize) {
+		pieceHashes = append(pieceHashes, p.Hash())
+	}
+	return Metadata{trackerUrl, name, PieceSize, pieceHashes, files}
+}
@@ -1,8 +1,11 @@
 package fs
 
 import (
+	"io/ioutil"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"util"
 )
@@ -14,6 +17,17 @@ func init() {
 	util.Debug = util.None
 }
 
+// copies the test seeds into a new directory, one in a subdirectory
+func makeTestDir() string {
+	dir, _ := ioutil.TempDir("", "tfs")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	puppy, _ := ioutil.ReadFile("../test/seed/puppy.jpg")
+	pupper, _ := ioutil.ReadFile("../test/seed/pupper.png")
+	ioutil.WriteFile(filepath.Join(dir, "puppy.jpg"), puppy, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "pupper.png"), pupper, 0644)
+	return dir
+}
+
 func TestReadIMGTorrent(t *testing.T) {
 	util.StartTest("Testing IMG torrent... ")
 	_ = Read("../test/torrent/IMG_4484.CR2.torrent")
@@ -61,3 +75,55 @@ func TestReadFakeTorrent(t *testing.T) {
 
 	util.EndTest()
 }
+
+func TestReadWriteMultiFileTorrent(t *testing.T) {
+	util.StartTest("Testing writing and reading a multi-file torrent...")
+	dir := makeTestDir()
+	defer os.RemoveAll(dir)
+	metadata := GetDirMetadata(dir, "blahUrl", "dogs")
+	Write(TempTorrent, metadata)
+	defer os.Remove(TempTorrent)
+
+	read := Read(TempTorrent)
+	if read.Name != "dogs" || len(read.Files) != 2 || len(read.PieceHashes) != NumPieces(PieceSize, read.GetLength()) {
+		t.Fatalf("Unexpected metadata %v", read)
+	}
+	expected := []FileData{{44411, []string{"puppy.jpg"}}, {1166819, []string{"sub", "pupper.png"}}}
+	for i, file := range read.Files {
+		if file.Length != expected[i].Length || strings.Join(file.Path, "/") != strings.Join(expected[i].Path, "/") {
+			t.Fatalf("Expected file %d to be %v, was %v", i, expected[i], file)
+		}
+	}
+	if offsets := read.FileOffsets(); offsets[0] != 0 || offsets[1] != 44411 {
+		t.Fatalf("Unexpected file offsets %v", offsets)
+	}
+	util.EndTest()
+}
+
+func TestReadMaliciousPaths(t *testing.T) {
+	util.StartTest("Testing refusing torrents with files outside their directory...")
+	defer os.Remove(TempTorrent)
+	paths := [][]string{
+		{"..", "..", "etc", "passwd"},
+		{"sub", "..", "..", "escaped"},
+		{"/etc/passwd"},
+		{"sub/../../escaped"},
+		{"sub\\..\\..\\escaped"},
+		{"."},
+		{""},
+		{},
+	}
+	for _, path := range paths {
+		files := []FileData{{10, []string{"fine.txt"}}, {10, path}}
+		Write(TempTorrent, Metadata{"blahUrl", "evil", 32, []string{"aaaaaaaaaaaaaaaaaaaa"}, files})
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("Expected a torrent with file %q to be refused", path)
+				}
+			}()
+			Read(TempTorrent)
+		}()
+	}
+	util.EndTest()
+}
@@ -4,23 +4,58 @@ import (
 	"crypto/sha1"
 	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
+	"sort"
 )
 
 const BlockSize int = 16384
 
-type Block []byte
-
+// a piece's data, addressed by byte offset
 type Piece struct {
-	Blocks []Block
+	Data []byte
+}
+
+// a byte range [Begin, End) within a piece
+type Extent struct {
+	Begin int
+	End   int
+}
+
+// sorted, disjoint byte ranges of a piece that have been filled in
+type Extents []Extent
+
+// returns the extents with [begin, end) added, merging any it touches
+func (extents Extents) Add(begin int, end int) Extents {
+	result := Extents{}
+	for _, e := range extents {
+		if e.End < begin || e.Begin > end {
+			result = append(result, e)
+			continue
+		}
+		begin = min(begin, e.Begin)
+		if e.End > end {
+			end = e.End
+		}
+	}
+	result = append(result, Extent{begin, end})
+	sort.Slice(result, func(i, j int) bool { return result[i].Begin < result[j].Begin })
+	return result
+}
+
+// returns true if every byte in [begin, end) has been filled in
+func (extents Extents) Covers(begin int, end int) bool {
+	for _, e := range extents {
+		if e.Begin <= begin && e.End >= end {
+			return true
+		}
+	}
+	return false
 }
 
 // get the SHA1 hash of a piece
 func (piece *Piece) Hash() string {
-	allBytes := []byte{}
-	for _, block := range piece.Blocks {
-		allBytes = append(allBytes, block...)
-	}
-	sha := sha1.Sum(allBytes)
+	sha := sha1.Sum(piece.Data)
 	n := len(sha)
 	if n != 20 {
 		panic("SHA hash generation failed")
@@ -43,13 +78,52 @@ func SplitIntoPieces(path string, pieceLen int) []Piece {
 	return pieces
 }
 
+// split the files of a multi-file torrent, found under dir, into pieces
+// of size pieceLen
+func SplitFilesIntoPieces(dir string, files []FileData, pieceLen int) []Piece {
+	data := []byte{}
+	for _, file := range files {
+		fileBytes, err := ioutil.ReadFile(filepath.Join(dir, filepath.Join(file.Path...)))
+		if err != nil {
+			panic(err)
+		}
+		data = append(data, fileBytes...)
+	}
+	numPieces := NumPieces(pieceLen, len(data))
+	pieces := []Piece{}
+	for i := 0; i < numPieces; i++ {
+		pieces = append(pieces, getPiece(i, pieceLen, data))
+	}
+	return pieces
+}
+
+// write length bytes of the pieces' data, starting at offset, out at
+// path, making any directories needed
+func WriteFileRange(path string, pieces []Piece, pieceLen int, offset int64, length int64) {
+	data := make([]byte, 0, length)
+	for i := int(offset / int64(pieceLen)); int64(len(data)) < length; i++ {
+		piece := pieces[i].Data
+		if begin := offset + int64(len(data)) - int64(i*pieceLen); begin > 0 {
+			piece = piece[begin:]
+		}
+		if left := length - int64(len(data)); int64(len(piece)) > left {
+			piece = piece[:left]
+		}
+		data = append(data, piece...)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		panic(err)
+	}
+}
+
 // combine a slice of pieces into one file, written out at path
 func CombinePieces(path string, pieces []Piece, totalLen int64) {
 	data := make([]byte, 0, totalLen)
 	for _, piece := range pieces {
-		for _, block := range piece.Blocks {
-			data = append(data, block...)
-		}
+		data = append(data, piece.Data...)
 	}
 	err := ioutil.WriteFile(path, data, 0644)
 	if err != nil {
@@ -59,15 +133,23 @@ func CombinePieces(path string, pieces []Piece, totalLen int64) {
 
 // returns the number of blocks for a given piece
 func NumBlocksInPiece(piece int, pieceLen int, totalLen int) int {
-	var actualLen int
+	actualLen := PieceLength(piece, pieceLen, totalLen)
+	return int(math.Ceil(float64(actualLen) / float64(BlockSize)))
+}
+
+// returns the length in bytes of a given piece
+func PieceLength(piece int, pieceLen int, totalLen int) int {
 	numPieces := NumPieces(pieceLen, totalLen)
 	if piece == numPieces-1 && totalLen%pieceLen != 0 {
 		// the last piece is irregular
-		actualLen = totalLen % pieceLen
-	} else {
-		actualLen = pieceLen
+		return totalLen % pieceLen
 	}
-	return int(math.Ceil(float64(actualLen) / float64(BlockSize)))
+	return pieceLen
+}
+
+// returns the length in bytes of a given block in a piece
+func BlockLength(piece int, block int, pieceLen int, totalLen int) int {
+	return min(BlockSize, PieceLength(piece, pieceLen, totalLen)-block*BlockSize)
 }
 
 // get the number of pieces given total file size and anticipated piece size
@@ -82,19 +164,7 @@ func getSubArray(start int, length int, arr []byte) []byte {
 
 // get a piece from arr with index num
 func getPiece(num int, pieceLen int, arr []byte) Piece {
-	pieceBytes := getSubArray(num*pieceLen, pieceLen, arr)
-	numBlocks := NumBlocksInPiece(num, pieceLen, len(arr))
-	blocks := []Block{}
-	for i := 0; i < numBlocks; i++ {
-		blocks = append(blocks, getBlock(i, pieceBytes))
-	}
-	return Piece{blocks}
-}
-
-// get one block
-func getBlock(block int, piece []byte) Block {
-	start := block * BlockSize
-	return Block(getSubArray(start, BlockSize, piece))
+	return Piece{getSubArray(num*pieceLen, pieceLen, arr)}
 }
 
 func min(a, b int) int {
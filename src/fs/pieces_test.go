@@ -1,7 +1,9 @@
 package fs
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"util"
 )
@@ -29,3 +31,46 @@ func TestSplitAndCombineFile(t *testing.T) {
 
 	util.EndTest()
 }
+
+func TestExtents(t *testing.T) {
+	util.StartTest("Testing tracking filled in byte ranges...")
+	extents := Extents{}
+	extents = extents.Add(1000, 2000)
+	extents = extents.Add(5000, 6000)
+	if extents.Covers(0, 2000) || extents.Covers(1000, 6000) || !extents.Covers(1200, 1800) {
+		t.Fatalf("Bad coverage of %v", extents)
+	}
+	extents = extents.Add(0, 1000) // touching ranges merge
+	extents = extents.Add(1500, 5500)
+	if len(extents) != 1 || extents[0] != (Extent{0, 6000}) {
+		t.Fatalf("Expected one extent [0, 6000), got %v", extents)
+	}
+	extents = extents.Add(7000, 8000).Add(6500, 6600)
+	if len(extents) != 3 || extents[1] != (Extent{6500, 6600}) || extents.Covers(0, 8000) {
+		t.Fatalf("Extents out of order: %v", extents)
+	}
+	util.EndTest()
+}
+
+func TestSplitAndWriteFiles(t *testing.T) {
+	util.StartTest("Testing splitting files and writing them back out...")
+	dir := makeTestDir()
+	defer os.RemoveAll(dir)
+	files := []FileData{{44411, []string{"puppy.jpg"}}, {1166819, []string{"sub", "pupper.png"}}}
+	pieces := SplitFilesIntoPieces(dir, files, PieceSize)
+	if len(pieces) != NumPieces(PieceSize, 44411+1166819) {
+		t.Fatalf("Expected %d pieces, got %d", NumPieces(PieceSize, 44411+1166819), len(pieces))
+	}
+
+	out, _ := ioutil.TempDir("", "tfs-out")
+	defer os.RemoveAll(out)
+	WriteFileRange(filepath.Join(out, "a", "puppy.jpg"), pieces, PieceSize, 0, 44411)
+	WriteFileRange(filepath.Join(out, "pupper.png"), pieces, PieceSize, 44411, 1166819)
+	if same, err := util.CompareFiles(filepath.Join(out, "a", "puppy.jpg"), "../test/seed/puppy.jpg"); err != nil || !same {
+		t.Fatalf("Written puppy doesn't match: %v", err)
+	}
+	if same, err := util.CompareFiles(filepath.Join(out, "pupper.png"), "../test/seed/pupper.png"); err != nil || !same {
+		t.Fatalf("Written pupper doesn't match: %v", err)
+	}
+	util.EndTest()
+}
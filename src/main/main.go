@@ -1,27 +1,67 @@
 package main
 
 import (
+	"btnet"
 	"client"
+	"context"
 	"flag"
 	"fs"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 	"tracker"
 	"util"
 )
 
-func cleanup(cl *btclient.BTClient) {
-	cl.Kill()
-	// fmt.Println("cleanup")
-}
-
 func generate(input string, output string, url string, name string) {
 	metadata := fs.GetMetadata(input, url, name)
 	fs.Write(output, metadata)
 }
 
+// runs a session driven by the control API and Transmission RPC until ctx
+// is done, starting with torrent if it isn't empty
+func runDaemon(ctx context.Context, ip string, port int, config btclient.Config, apiAddr string, token string,
+	dir string, torrent string, seed string, output string) {
+	s, err := btclient.NewSession(ip, port, config)
+	if err != nil {
+		util.EPrintf("Couldn't start: %s\n", err)
+		return
+	}
+	defer s.Close(context.Background())
+	if torrent != "" {
+		persister := btclient.MakePersister(filepath.Join(dir, filepath.Base(torrent)+".p"))
+		if _, err := s.AddTorrent(torrent, seed, output, persister); err != nil {
+			util.EPrintf("Couldn't add %s: %s\n", torrent, err)
+			return
+		}
+	}
+	if token == "" {
+		token = util.GenerateRandStr(32)
+		util.Printf("Control API token: %s\n", token)
+	}
+
+	ln, err := net.Listen("tcp", apiAddr)
+	if err != nil {
+		util.EPrintf("Couldn't serve the control API: %s\n", err)
+		return
+	}
+	apiConfig := btclient.APIConfig{Token: token, Dir: dir}
+	mux := http.NewServeMux()
+	mux.Handle("/api/", s.APIHandler(apiConfig))
+	mux.Handle("/transmission/rpc", s.TransmissionHandler(apiConfig))
+	server := &http.Server{Handler: mux}
+	go server.Serve(ln)
+	util.Printf("Serving the control API on http://%s/api/ and Transmission RPC on http://%s/transmission/rpc\n",
+		apiAddr, apiAddr)
+	<-ctx.Done()
+	server.Close()
+}
+
 func main() {
 	showStatus := false
 	// TODO: add persister flag so we can restart client with partial downloads
@@ -36,6 +76,23 @@ func main() {
 	urlFlag := flag.String("url", "", "URL of tracker (-generate only)")
 	portFlag := flag.Int("port", 8000, "Port (default 8000)")
 	persisterFlag := flag.String("persister", "", "file for loading and saving download progress")
+	utpFlag := flag.Bool("utp", false, "Accept uTP connections and prefer uTP when dialing peers (-client only)")
+	blocklistFlag := flag.String("blocklist", "", "P2P, DAT or CIDR list of peer addresses to refuse (-client only)")
+	encryptionFlag := flag.String("encryption", "prefer", "Peer connection encryption [disabled|prefer|require] (-client only)")
+	uploadFlag := flag.Int("upload", 0, "Upload limit in KiB/s, 0 for unlimited (-client only)")
+	downloadFlag := flag.Int("download", 0, "Download limit in KiB/s, 0 for unlimited (-client only)")
+	altUploadFlag := flag.Int("alt-upload", 0, "Alternate upload limit in KiB/s, 0 for unlimited (-client only)")
+	altDownloadFlag := flag.Int("alt-download", 0, "Alternate download limit in KiB/s, 0 for unlimited (-client only)")
+	altScheduleFlag := flag.String("alt-schedule", "", "When to use the alternate limits, e.g. 'mon-fri 09:00-17:00' (-client only)")
+	ratioFlag := flag.Float64("ratio", 0, "Stop seeding at this share ratio, 0 for no limit (-client only)")
+	seedTimeFlag := flag.Duration("seed-time", 0, "Stop seeding after this long, e.g. '2h', 0 for no limit (-client only)")
+	goalActionFlag := flag.String("goal-action", "pause", "What to do on reaching -ratio or -seed-time [pause|remove|remove-data] (-client only)")
+	sequentialFlag := flag.Bool("sequential", false, "Download pieces in order, so media can play while downloading (-client only)")
+	streamFlag := flag.String("stream", "", "Address to stream the torrent's files over HTTP on, e.g. 'localhost:8080' (-client only)")
+	daemonFlag := flag.Bool("daemon", false, "Run torrents added over the control API, and -torrent if given")
+	apiFlag := flag.String("api", "localhost:9091", "Address to serve the control API on (-daemon only)")
+	apiTokenFlag := flag.String("api-token", "", "Token the control API requires, made up and printed if empty (-daemon only)")
+	dirFlag := flag.String("dir", ".", "Where torrents added over the control API and their data go (-daemon only)")
 	flag.Parse()
 
 	// set debug level
@@ -56,17 +113,65 @@ func main() {
 	}
 
 	// check for file flag, since it's required
-	if *torrentFlag == "" {
+	if *torrentFlag == "" && !*daemonFlag {
 		util.EPrintf("Missing torrent file flag (-torrent)\n")
 		return
 	}
 
+	// check for valid encryption policy
+	encryption, err := btnet.ParseEncryptionPolicy(*encryptionFlag)
+	if err != nil {
+		util.EPrintf("Invalid encryption policy.\n")
+		return
+	}
+
+	// check for valid alternate speed schedule
+	var altSchedule *btclient.SpeedSchedule
+	if *altScheduleFlag != "" {
+		if altSchedule, err = btclient.ParseSchedule(*altScheduleFlag); err != nil {
+			util.EPrintf("Invalid alternate speed schedule: %s\n", err)
+			return
+		}
+	}
+
+	// check for valid seeding goal action
+	goalAction, err := btclient.ParseGoalAction(*goalActionFlag)
+	if err != nil {
+		util.EPrintf("Invalid goal action.\n")
+		return
+	}
+
 	// check for valid port
 	if *portFlag < 1 || *portFlag > 65535 {
 		util.EPrintf("Invalid port number\n")
 		return
 	}
 
+	// shut down cleanly on ^C
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	config := btclient.DefaultConfig()
+	config.Context = ctx
+	config.Encryption = encryption
+	config.BlocklistPath = *blocklistFlag
+	config.UploadRate = *uploadFlag * 1024
+	config.DownloadRate = *downloadFlag * 1024
+	config.AltUploadRate = *altUploadFlag * 1024
+	config.AltDownloadRate = *altDownloadFlag * 1024
+	config.AltSchedule = altSchedule
+	config.SeedGoals = btclient.SeedGoals{Ratio: *ratioFlag, SeedTime: *seedTimeFlag, Action: goalAction}
+	config.Sequential = *sequentialFlag
+	if *utpFlag {
+		config.Networks = []btnet.Network{&btnet.UTPNetwork{}, &btnet.TCPNetwork{}}
+	}
+
 	// start client or tracker
 	if *generateFlag {
 		if *fileFlag == "" {
@@ -79,6 +184,13 @@ func main() {
 		}
 		util.Printf("Generating torrent for file %s and tracker url %s...\nSaving to %s\n", *fileFlag, *urlFlag, *torrentFlag)
 		generate(*fileFlag, *torrentFlag, *urlFlag, *fileFlag)
+	} else if *daemonFlag {
+		if *clientFlag || *trackerFlag {
+			util.EPrintf("Daemons can't be clients or trackers too.\n")
+			return
+		}
+		runDaemon(ctx, *ipFlag, *portFlag, config, *apiFlag, *apiTokenFlag, *dirFlag, *torrentFlag, *seedFlag, *fileFlag)
+		return
 	} else if *clientFlag == *trackerFlag {
 		util.EPrintf("Select either client or tracker.\n")
 		return
@@ -87,15 +199,14 @@ func main() {
 			util.EPrintf("Trackers cannot seed files.\n")
 			return
 		}
-		tr := bttracker.StartBTTracker(*torrentFlag, *portFlag)
-		for !tr.CheckShutdown() {
-		}
+		tr := bttracker.StartBTTrackerWithContext(ctx, *torrentFlag, *portFlag)
+		<-tr.Stopped()
 		return
 	} else if *clientFlag {
 		var persister *btclient.Persister
 		var tmpFile *os.File
 		if *persisterFlag == "" {
-			tmpFile, err := ioutil.TempFile(".", *fileFlag+"_download")
+			tmpFile, err = ioutil.TempFile(".", *fileFlag+"_download")
 			if err != nil {
 				panic(err)
 			}
@@ -104,36 +215,38 @@ func main() {
 			persister = btclient.MakePersister(*persisterFlag)
 		}
 
-		c := make(chan os.Signal, 2)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-
-		cl := btclient.StartBTClient(*ipFlag, *portFlag, *torrentFlag, *seedFlag, *fileFlag, persister)
-
-		go func() {
-			<-c
-			cleanup(cl)
-			if *persisterFlag == "" {
-				os.Remove(tmpFile.Name())
-			}
-			os.Exit(1)
-		}()
+		cl := btclient.StartBTClientWithConfig(*ipFlag, *portFlag, *torrentFlag, *seedFlag, *fileFlag, persister, config)
+		if *streamFlag != "" {
+			go func() {
+				err := http.ListenAndServe(*streamFlag, cl.StreamHandler())
+				util.EPrintf("Couldn't stream on %s: %s\n", *streamFlag, err)
+			}()
+		}
 
 		if showStatus {
 			status, _ := cl.GetStatusString()
 			util.ZeroCursor()
 			util.ClearScreen()
 			util.Printf(status)
-			for !cl.CheckShutdown() {
-				util.ZeroCursor()
-				status, _ = cl.GetStatusString()
-				util.Printf(status)
-				util.Wait(100)
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			for running := true; running; {
+				select {
+				case <-ticker.C:
+					util.ZeroCursor()
+					status, _ = cl.GetStatusString()
+					util.Printf(status)
+				case <-cl.Stopped():
+					running = false
+				}
 			}
 		} else {
-			for !cl.CheckShutdown() {
-			}
+			<-cl.Stopped()
 		}
-		return
+		if *persisterFlag == "" {
+			os.Remove(tmpFile.Name())
+		}
+		os.Exit(1)
 	}
 
 }
@@ -1,7 +1,9 @@
 package test
 
 import (
+	"btnet"
 	"client"
+	"net"
 	"os"
 	"testing"
 	"tracker"
@@ -41,6 +43,75 @@ func TestOneDownloaderBasic(t *testing.T) {
 	util.EndTest()
 }
 
+func TestOneDownloaderUTP(t *testing.T) {
+	util.StartTest("Testing small file with one seeder and one downloader over uTP...")
+	output := generateOutFile()
+	seederPersister := makePersister()
+	downloaderPersister := makePersister()
+
+	tr := bttracker.StartBTTracker(TorrentS, PortS)
+	seeder := btclient.StartBTClientWithConfig("localhost", nextPort(), TorrentS, SeedS, "", seederPersister, makeUTPConfig())
+	downloader := btclient.StartBTClientWithConfig("localhost", nextPort(), TorrentS, "", output, downloaderPersister, makeUTPConfig())
+
+	waitUntilDone(t, true, downloader)
+
+	tr.Kill()
+	seeder.Kill()
+	downloader.Kill()
+
+	util.Wait(WaitForDeath)
+
+	res := loadDataFromPersister(downloaderPersister)
+
+	os.Remove(seederPersister.Path)
+	os.Remove(downloaderPersister.Path)
+
+	checkDownloadResult(t, res, TorrentS, SeedS, output)
+	util.EndTest()
+}
+
+func TestPipeSwarm(t *testing.T) {
+	util.StartTest("Testing swarm over in-memory pipes without a tracker...")
+	output := generateOutFile()
+	output2 := generateOutFile()
+	seederPersister := makePersister()
+	downloaderPersister := makePersister()
+	downloaderPersister2 := makePersister()
+	network := btnet.NewPipeNetwork()
+	config := btclient.DefaultConfig()
+	config.Networks = []btnet.Network{network}
+
+	seeder := btclient.StartBTClientWithConfig("10.0.0.1", 6881, TorrentM, SeedM, "", seederPersister, config)
+	downloader := btclient.StartBTClientWithConfig("10.0.0.2", 6881, TorrentM, "", output, downloaderPersister, config)
+	downloader2 := btclient.StartBTClientWithConfig("10.0.0.3", 6881, TorrentM, "", output2, downloaderPersister2, config)
+
+	util.Wait(100)
+	seederAddr, _ := net.ResolveTCPAddr("tcp", "10.0.0.1:6881")
+	downloaderAddr, _ := net.ResolveTCPAddr("tcp", "10.0.0.2:6881")
+	downloader.SetupPeerConnections(seederAddr, nil)
+	downloader2.SetupPeerConnections(downloaderAddr, nil)
+
+	util.TPrintf("  Waiting for download to finish...\n")
+	waitUntilDone(t, true, downloader, downloader2)
+
+	seeder.Kill()
+	downloader.Kill()
+	downloader2.Kill()
+
+	util.Wait(WaitForDeath)
+
+	res := loadDataFromPersister(downloaderPersister)
+	res2 := loadDataFromPersister(downloaderPersister2)
+
+	os.Remove(seederPersister.Path)
+	os.Remove(downloaderPersister.Path)
+	os.Remove(downloaderPersister2.Path)
+
+	checkDownloadResult(t, res, TorrentM, SeedM, output)
+	checkDownloadResult(t, res2, TorrentM, SeedM, output2)
+	util.EndTest()
+}
+
 func TestTwoDownloaders(t *testing.T) {
 	util.StartTest("Testing small file with one seeder and two downloaders...")
 	output := generateOutFile()
@@ -219,6 +290,54 @@ func TestRestartedDownloader(t *testing.T) {
 	util.EndTest()
 }
 
+func TestPausedDownloader(t *testing.T) {
+	util.StartTest("Testing 36-piece file with paused and resumed downloader...")
+	output := generateOutFile()
+	seederPersister := makePersister()
+	downloaderPersister := makePersister()
+	config := btclient.DefaultConfig()
+	config.DownloadRate = 256 * 1024 // so there's time to pause halfway
+
+	tr := bttracker.StartBTTracker(TorrentM, PortM)
+	seeder := btclient.StartBTClient("localhost", nextPort(), TorrentM, SeedM, "", seederPersister)
+	downloader := btclient.StartBTClientWithConfig("localhost", nextPort(), TorrentM, "", output, downloaderPersister, config)
+
+	waitUntilStarted(t, downloader)
+	downloader.Pause()
+	if downloader.State() != btclient.StatePaused {
+		t.Fatalf("Expected downloader to be paused, is %s", downloader.State())
+	}
+	oldBitmap := downloader.AtomicGetBitmap()
+	if util.AllTrue(oldBitmap) {
+		t.Fatalf("Downloader finished before it could be paused")
+	}
+	util.Wait(1000)
+	if !util.BoolArrayEquals(oldBitmap, downloader.AtomicGetBitmap()) {
+		t.Fatalf("Downloader kept downloading while paused")
+	}
+
+	downloader.Resume()
+	waitUntilDone(t, true, downloader)
+	if downloader.State() != btclient.StateSeeding {
+		t.Fatalf("Expected downloader to be seeding, is %s", downloader.State())
+	}
+
+	tr.Kill()
+	seeder.Kill()
+	downloader.Kill()
+
+	util.Wait(WaitForDeath)
+
+	res := loadDataFromPersister(downloaderPersister)
+
+	os.Remove(seederPersister.Path)
+	os.Remove(downloaderPersister.Path)
+
+	checkDownloadResult(t, res, TorrentM, SeedM, output)
+
+	util.EndTest()
+}
+
 func TestStoppedSeeder(t *testing.T) {
 	util.StartTest("Testing 36-piece file with one good seeder, one stopped seeder...")
 	output := generateOutFile()
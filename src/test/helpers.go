@@ -1,6 +1,7 @@
 package test
 
 import (
+	"btnet"
 	"bytes"
 	"client"
 	"encoding/gob"
@@ -41,6 +42,13 @@ func makePersister() *btclient.Persister {
 	return btclient.MakePersister("out/persist_" + util.GenerateRandStr(5))
 }
 
+// uTP networks hold the client's socket, so every client needs its own
+func makeUTPConfig() btclient.Config {
+	config := btclient.DefaultConfig()
+	config.Networks = []btnet.Network{&btnet.UTPNetwork{}, &btnet.TCPNetwork{}}
+	return config
+}
+
 func loadDataFromPersister(ps *btclient.Persister) btclient.BTClient {
 	data := ps.ReadState()
 	cl := btclient.BTClient{}
@@ -33,13 +33,13 @@ type FailureResponse struct {
 func writeSuccess(w http.ResponseWriter, interval int, peers []map[string]string) (int, error) {
 	resp := fs.Encode(SuccessResponse{interval, peers})
 	util.TPrintf("[resp] %v\n", resp)
-	fmt.Fprintf(w, resp)
+	fmt.Fprint(w, resp)
 	return 200, nil
 }
 
 func writeFailure(w http.ResponseWriter, format string, a ...interface{}) (int, error) {
 	resp := fs.Encode(FailureResponse{fmt.Sprintf(format, a...)})
-	fmt.Fprintf(w, resp)
+	fmt.Fprint(w, resp)
 	return 200, nil
 }
 
@@ -77,7 +77,7 @@ func IndexHandler(tr *BTTracker, w http.ResponseWriter, r *http.Request) (int, e
 	} else if infoHash != tr.infoHash {
 		return writeFailure(w, "invalid infohash %s", infoHash)
 	} else if port < 1 || port > 65535 {
-		return writeFailure(w, "invalid port %s", port)
+		return writeFailure(w, "invalid port %d", port)
 	} else if len(peerIdStr) != PeerIdLength {
 		return writeFailure(w, "invalid peerId %s", peerIdStr)
 	} else if event != Started && event != Completed && event != Stopped && event != Empty {
@@ -91,7 +91,11 @@ func IndexHandler(tr *BTTracker, w http.ResponseWriter, r *http.Request) (int, e
 	peer := peer{peerIdStr, ip, port, uploaded, downloaded, left, event, reqTime}
 
 	tr.mu.Lock()
-	tr.peers[peerIdStr] = peer
+	if event == Stopped {
+		delete(tr.peers, peerIdStr) // it's not there to hand out any more
+	} else {
+		tr.peers[peerIdStr] = peer
+	}
 	numPeers := len(tr.peers)
 	peers := tr.getPeerList()
 	tr.mu.Unlock()
@@ -101,23 +105,11 @@ func IndexHandler(tr *BTTracker, w http.ResponseWriter, r *http.Request) (int, e
 }
 
 // TODO: Create a debug=Status for the tracker
-func (tr *BTTracker) main(port int) {
-	portStr := ":" + strconv.Itoa(port)
-
-	tr.mu.Lock()
-	tr.srv = &http.Server{Addr: portStr}
-	tr.mu.Unlock()
-
-	http.Get("/")
-	go func() {
-		for {
-			if tr.CheckShutdown() {
-				tr.srv.Close()
-				util.IPrintf("Shutting down tracker on port %d...\n", tr.port)
-				return
-			}
-			util.Wait(10)
-		}
-	}()
-	http.ListenAndServe(portStr, appHandler{tr, IndexHandler})
+// serves requests on ln until the server is closed
+func (tr *BTTracker) main(ln net.Listener) {
+	defer tr.wg.Done()
+	if err := tr.srv.Serve(ln); err != http.ErrServerClosed {
+		util.EPrintf("Tracker on port %d stopped serving: %s\n", tr.port, err)
+		tr.cancel()
+	}
 }
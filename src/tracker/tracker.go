@@ -1,7 +1,9 @@
 package bttracker
 
 import (
+	"context"
 	"fs"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -42,40 +44,70 @@ type BTTracker struct {
 	mu       sync.Mutex
 	peers    map[peerId]peer
 	port     int
-	shutdown chan bool
 	srv      *http.Server
+
+	ctx     context.Context // done once the tracker is told to shut down
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup // every goroutine but finish
+	stopped chan struct{}  // closed once shutdown is complete
 }
 
 // Instantiate a new BTTracker
 func StartBTTracker(path string, port int) *BTTracker {
+	return StartBTTrackerWithContext(context.Background(), path, port)
+}
+
+// starts a tracker that shuts down once ctx is done, listening before it
+// returns so it's ready for requests straight away
+func StartBTTrackerWithContext(ctx context.Context, path string, port int) *BTTracker {
 	tr := &BTTracker{}
 	tr.file = path
 	tr.port = port
 	tr.peers = make(map[peerId]peer)
-	tr.shutdown = make(chan bool)
+	tr.ctx, tr.cancel = context.WithCancel(ctx)
+	tr.stopped = make(chan struct{})
 	torrent := fs.ReadTorrent(path)
 	tr.infoHash = fs.GetInfoHash(torrent)
+	tr.srv = &http.Server{Addr: ":" + strconv.Itoa(port), Handler: appHandler{tr, IndexHandler}}
 
-	util.IPrintf("Tracker for %s listening on port %d - escaped infohash %s\n", tr.file, port, url.QueryEscape(tr.infoHash))
-	go tr.main(port)
+	ln, err := net.Listen("tcp", tr.srv.Addr)
+	if err != nil {
+		util.EPrintf("Error: could not listen on port %d: %s\n", port, err)
+		tr.cancel()
+	} else {
+		util.IPrintf("Tracker for %s listening on port %d - escaped infohash %s\n", tr.file, port, url.QueryEscape(tr.infoHash))
+		tr.wg.Add(1)
+		go tr.main(ln)
+	}
+	tr.wg.Add(1)
 	go tr.watchPeers()
+	go tr.finish()
 	return tr
 }
 
+// shuts down and waits until it's done
 func (tr *BTTracker) Kill() {
-	close(tr.shutdown)
+	tr.cancel()
+	<-tr.stopped
 }
 
 // returns true if the tracker has been ordered to shut down
 func (tr *BTTracker) CheckShutdown() bool {
-	select {
-	case _, ok := <-tr.shutdown:
-		if !ok {
-			return true
-		}
-	default:
-	}
-	return false
+	return tr.ctx.Err() != nil
+}
+
+// closed once the tracker has shut down, however it was told to
+func (tr *BTTracker) Stopped() <-chan struct{} {
+	return tr.stopped
+}
+
+// stops the server once we're told to shut down, then waits for the rest
+func (tr *BTTracker) finish() {
+	<-tr.ctx.Done()
+	util.IPrintf("Shutting down tracker on port %d...\n", tr.port)
+	tr.srv.Close()
+	tr.wg.Wait()
+	close(tr.stopped)
 }
 
 // get peer list to use in tracker response
@@ -95,7 +127,13 @@ func (tr *BTTracker) getPeerList() []map[string]string {
 }
 
 func (tr *BTTracker) watchPeers() {
+	defer tr.wg.Done()
 	for {
+		select {
+		case <-time.After(time.Second):
+		case <-tr.ctx.Done():
+			return
+		}
 		timeNow := time.Now()
 		tr.mu.Lock()
 		for k, v := range tr.peers {
@@ -104,6 +142,5 @@ func (tr *BTTracker) watchPeers() {
 			}
 		}
 		tr.mu.Unlock()
-		util.Wait(1000)
 	}
 }
@@ -1,14 +1,18 @@
 package bttracker
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"fs"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 	"util"
 )
 
@@ -60,14 +64,22 @@ func findPeer(peerIdStr string, peers []map[string]string) (map[string]string, e
 }
 
 func sendRequest(port int, req *requestParams) ([]byte, error) {
+	return sendEvent(port, req, "")
+}
+
+func sendEvent(port int, req *requestParams, event string) ([]byte, error) {
 	url := BaseStr + strconv.Itoa(port) + "/?peer_id=" + req.peerIdStr +
 		"&port=" + req.port + "&ip=" + req.ip + "&uploaded=" +
 		strconv.Itoa(req.uploaded) + "&downloaded=" + strconv.Itoa(req.downloaded) +
 		"&left=" + strconv.Itoa(req.left) + "&info_hash=" + req.infoHash
+	if event != "" {
+		url += "&event=" + event
+	}
 	resp, err := http.Get(url)
 	if err != nil {
 		return nil, errors.New("Error sending request")
 	}
+	defer resp.Body.Close()
 	if resp.Status != "200 OK" {
 		return nil, errors.New("Wrong response status code")
 	}
@@ -392,3 +404,65 @@ func TestMultiplePeersTimeout(t *testing.T) {
 	util.Wait(BetweenTests)
 	util.EndTest()
 }
+
+func TestStoppedPeer(t *testing.T) {
+	util.StartTest("Testing peers that announce they've stopped...")
+	tr := makeTestTracker(8008)
+	util.Wait(100)
+	params := requestParams{Peer1, "", Port1, 0, 0, 300, InfoHash}
+	if _, err := sendEvent(8008, &params, "started"); err != nil {
+		tr.Kill()
+		t.Fatalf("%s\n", err.Error())
+	}
+	params = requestParams{Peer2, "", Port2, 0, 0, 300, InfoHash}
+	if _, err := sendEvent(8008, &params, "started"); err != nil {
+		tr.Kill()
+		t.Fatalf("%s\n", err.Error())
+	}
+	bodyBytes, err := sendEvent(8008, &params, "stopped")
+	if err != nil {
+		tr.Kill()
+		t.Fatalf("%s\n", err.Error())
+	}
+	respS := SuccessResponse{}
+	fs.Decode(bodyBytes, &respS)
+	_, err1 := findPeer(Peer1, respS.Peers)
+	_, err2 := findPeer(Peer2, respS.Peers)
+	if len(respS.Peers) != 1 || err1 != nil || err2 == nil {
+		tr.Kill()
+		t.Fatalf("Expected only the peer still running, got %v\n", respS.Peers)
+	}
+	tr.Kill()
+	util.Wait(BetweenTests)
+	util.EndTest()
+}
+
+func TestTrackerShutdown(t *testing.T) {
+	util.StartTest("Testing tracker shutting down when its context is cancelled...")
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithCancel(context.Background())
+	tr := StartBTTrackerWithContext(ctx, TestTorrent, 8009)
+	params := requestParams{Peer1, "", Port1, 0, 0, 300, InfoHash}
+	if _, err := sendRequest(8009, &params); err != nil {
+		tr.Kill()
+		t.Fatalf("%s\n", err.Error())
+	}
+
+	cancel()
+	select {
+	case <-tr.Stopped():
+	case <-time.After(time.Second):
+		t.Fatalf("Tracker didn't shut down")
+	}
+	ln, err := net.Listen("tcp", ":8009")
+	if err != nil {
+		t.Fatalf("Tracker's port should be free: %s", err)
+	}
+	ln.Close()
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+	if ok, stacks := util.WaitForGoroutines(before, 1000); !ok {
+		t.Fatalf("Expected at most %d goroutines, have:\n%s", before, stacks)
+	}
+	tr.Kill() // again, which is fine
+	util.EndTest()
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"math/rand"
 	"os"
+	"runtime"
 	"strings"
 	"time"
 )
@@ -117,6 +118,21 @@ func Wait(milliseconds int) {
 	<-time.After(time.Millisecond * time.Duration(milliseconds))
 }
 
+// Waits up to milliseconds for at most n goroutines to be running, for
+// tests checking that nothing was left behind. If there are still too
+// many, returns false and every goroutine's stack.
+func WaitForGoroutines(n int, milliseconds int) (bool, string) {
+	deadline := time.Now().Add(time.Millisecond * time.Duration(milliseconds))
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			return false, string(buf[:runtime.Stack(buf, true)])
+		}
+		Wait(10)
+	}
+	return true, ""
+}
+
 // check if bool array is all true
 func AllTrue(arr []bool) bool {
 	for _, entry := range arr {
@@ -2,6 +2,8 @@ package util
 
 import (
 	"crypto/sha1"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -123,3 +125,21 @@ func TestSplitAndCombineHashes(t *testing.T) {
 	}
 	EndTest()
 }
+
+func TestWaitForGoroutines(t *testing.T) {
+	StartTest("Testing waiting for goroutines to exit...")
+	before := runtime.NumGoroutine()
+	done := make(chan bool)
+	go func() {
+		<-done
+	}()
+	ok, stacks := WaitForGoroutines(before, 50)
+	if ok || !strings.Contains(stacks, "TestWaitForGoroutines") {
+		t.Fatalf("Expected a leftover goroutine and its stack")
+	}
+	close(done)
+	if ok, stacks := WaitForGoroutines(before, 1000); !ok {
+		t.Fatalf("Expected the goroutine to exit, have:\n%s", stacks)
+	}
+	EndTest()
+}